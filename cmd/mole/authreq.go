@@ -4,10 +4,17 @@ import (
 	"bufio"
 	"fmt"
 	"os"
+	"strconv"
 	"strings"
+	"time"
 )
 
-const retries = 3
+const (
+	retries = 3
+
+	// Tickets are renewed when they expire within this time
+	renewMargin = 24 * time.Hour
+)
 
 type authenticatedRequest func() (interface{}, error)
 
@@ -17,6 +24,10 @@ func authenticated(c *Client, r authenticatedRequest) (interface{}, error) {
 	c.Ticket = moleIni.Get("server", "ticket")
 	br := bufio.NewReader(os.Stdin)
 
+	if c.Ticket != "" {
+		renewTicket(c)
+	}
+
 	result, err := r()
 	if err == nil || !strings.HasPrefix(err.Error(), "401 Unauthorized") {
 		return result, err
@@ -34,11 +45,22 @@ func authenticated(c *Client, r authenticatedRequest) (interface{}, error) {
 		}
 		pass := readpass(fmt.Sprintf(msgPassword, user))
 
-		ticket, err := c.GetTicket(user, pass)
+		ticket, err := c.GetTicket(user, pass, "")
+		if err == errOTPRequired {
+			ticket, err = c.GetTicket(user, pass, readOTP(br))
+		}
+		if err == errOTPEnroll {
+			fatalln(msgErrOTPEnroll)
+		}
+		if err == errLockedOut {
+			fatalln(msgErrLockedOut)
+		}
 		if err == nil {
+			rekeyOfflineCache(c.Ticket, ticket)
 			c.Ticket = ticket
 			moleIni.Set("server", "ticket", ticket)
 			moleIni.Set("server", "user", user)
+			moleIni.Delete("server", "validity")
 			saveMoleIni()
 		} else {
 			warnln(err.Error())
@@ -52,3 +74,45 @@ func authenticated(c *Client, r authenticatedRequest) (interface{}, error) {
 
 	return nil, fmt.Errorf("Too many authentication failures")
 }
+
+// renewTicket renews the ticket of the client if it is about to expire.
+// The validity is remembered to avoid asking the server each time. Failure
+// is not an error; the ticket is used as it is until authentication is
+// required again.
+func renewTicket(c *Client) {
+	validity, _ := strconv.ParseInt(moleIni.Get("server", "validity"), 10, 64)
+	if validity == 0 {
+		tic, err := c.ParseTicket()
+		if err != nil {
+			debugln("parse ticket:", err)
+			return
+		}
+		validity = time.Time(tic.Validity).Unix()
+		moleIni.Set("server", "validity", strconv.FormatInt(validity, 10))
+		saveMoleIni()
+	}
+
+	left := time.Until(time.Unix(validity, 0))
+	if left < 0 || left > renewMargin {
+		return
+	}
+
+	ticket, err := c.RenewTicket()
+	if err != nil {
+		debugln("renew ticket:", err)
+		return
+	}
+	rekeyOfflineCache(c.Ticket, ticket)
+	c.Ticket = ticket
+	moleIni.Set("server", "ticket", ticket)
+	moleIni.Delete("server", "validity")
+	saveMoleIni()
+	debugln("renewed ticket")
+}
+
+func readOTP(br *bufio.Reader) string {
+	fmt.Printf(msgOTPCode)
+	bs, _, err := br.ReadLine()
+	fatalErr(err)
+	return strings.TrimSpace(string(bs))
+}
@@ -5,17 +5,21 @@ import (
 	"crypto/sha1"
 	"crypto/tls"
 	"encoding/json"
+	"errors"
 	"fmt"
 	"io"
 	"io/ioutil"
 	"net"
 	"net/http"
+	"net/url"
 	"regexp"
 	"sort"
 	"strconv"
 	"strings"
 	"sync"
 	"time"
+
+	"github.com/calmh/mole/conf"
 )
 
 var clientVersion string
@@ -25,6 +29,15 @@ type Client struct {
 	Ticket string
 	host   string
 	client *http.Client
+	otp    string
+
+	// Warnings from the server about the last request, such as for a pushed
+	// tunnel
+	Warnings []string
+
+	// Preconditions for the next request
+	ifMatch     string
+	ifNoneMatch string
 }
 
 type ListItem struct {
@@ -60,6 +73,32 @@ type ParsedTicket struct {
 	User     string
 	IPs      []string
 	Validity EpochTime
+	Groups   []string
+}
+
+var errAccessDenied = errors.New("403 Forbidden: access denied")
+
+var errLockedOut = errors.New("429 Too Many Requests: too many failed authentications")
+
+var errConflict = errors.New("412 Precondition Failed: the tunnel has been changed on the server")
+
+var (
+	errOTPRequired = errors.New("401 Unauthorized: one-time code required")
+	errOTPInvalid  = errors.New("401 Unauthorized: incorrect one-time code")
+	errOTPEnroll   = errors.New("403 Forbidden: TOTP enrollment required")
+)
+
+// A Revision is a change to a tunnel definition in the server's history.
+type Revision struct {
+	Rev     string
+	Author  string
+	Date    EpochTime
+	Comment string
+}
+
+type TOTPEnrollment struct {
+	Secret string
+	URI    string
 }
 
 var obfuscatedRe = regexp.MustCompile(`\$mole\$[0-9a-zA-Z+/-]+`)
@@ -120,28 +159,65 @@ func (c *Client) request(method, path string, content io.Reader) (*http.Response
 	req.Header.Set("User-Agent", "mole/"+clientVersion)
 	req.Header.Set("X-Mole-Version", clientVersion)
 	req.Header.Set("X-Mole-Ticket", c.Ticket)
+	if c.otp != "" {
+		req.Header.Set("X-Mole-OTP", c.otp)
+	}
+	if c.ifMatch != "" {
+		req.Header.Set("If-Match", c.ifMatch)
+	}
+	if c.ifNoneMatch != "" {
+		req.Header.Set("If-None-Match", c.ifNoneMatch)
+	}
 
 	resp, err := c.client.Do(req)
 	if err != nil {
 		return nil, err
 	}
 
+	if otp := resp.Header.Get("X-Mole-OTP"); otp != "" && resp.StatusCode != 200 {
+		resp.Body.Close()
+		switch otp {
+		case "required":
+			return nil, errOTPRequired
+		case "invalid":
+			return nil, errOTPInvalid
+		case "enroll":
+			return nil, errOTPEnroll
+		}
+	}
+
 	if resp.StatusCode == 530 {
 		defer resp.Body.Close()
 		return nil, fmt.Errorf(msg530)
 	}
 
+	if resp.StatusCode == 429 {
+		resp.Body.Close()
+		return nil, errLockedOut
+	}
+
+	if resp.StatusCode == 412 {
+		resp.Body.Close()
+		return nil, errConflict
+	}
+
+	if resp.StatusCode == 403 && resp.Header.Get("X-Mole-Access") == "denied" {
+		resp.Body.Close()
+		return nil, errAccessDenied
+	}
+
 	if resp.StatusCode != 200 {
 		defer resp.Body.Close()
 		data, _ := ioutil.ReadAll(resp.Body)
 		if len(data) > 0 {
 			return nil, fmt.Errorf("%s: %s", resp.Status, data)
 		} else {
-			return nil, fmt.Errorf(resp.Status)
+			return nil, errors.New(resp.Status)
 		}
 	}
 
 	debugln(resp.Status, resp.Header.Get("Content-type"), resp.ContentLength)
+	c.Warnings = resp.Header["X-Mole-Warning"]
 
 	if ch := resp.Header.Get("X-Mole-Canonical-Hostname"); ch != "" && ch != moleIni.Get("server", "host") {
 		moleIni.Set("server", "host", ch)
@@ -194,35 +270,55 @@ func (c *Client) List() ([]ListItem, error) {
 }
 
 func (c *Client) Get(tunnel string) (string, error) {
+	res, _, err := c.GetVersion(tunnel)
+	return res, err
+}
+
+// GetVersion returns the tunnel and the ETag of the version returned, for
+// pushing changes to it.
+func (c *Client) GetVersion(tunnel string) (string, string, error) {
 	t0 := time.Now()
 
 	resp, err := c.request("GET", "/store/"+tunnel+".ini", nil)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	defer resp.Body.Close()
 
 	data, err := ioutil.ReadAll(resp.Body)
 	if err != nil {
-		return "", err
+		return "", "", err
 	}
 	res := string(data)
 
 	debugf("get %.01f ms", time.Since(t0).Seconds()*1000)
-	return res, nil
+	return res, resp.Header.Get("ETag"), nil
 }
 
-func (c *Client) Put(tunnel string, data io.Reader) error {
+// Put stores the tunnel and returns the ETag of the stored version. With an
+// ETag, the tunnel is stored only if the server has that version; with "new"
+// only if the server has none, and with "" regardless. It fails with
+// errConflict otherwise.
+func (c *Client) Put(tunnel, etag string, data io.Reader) (string, error) {
 	t0 := time.Now()
 
+	switch etag {
+	case "":
+	case "new":
+		c.ifNoneMatch = "*"
+	default:
+		c.ifMatch = etag
+	}
+	defer func() { c.ifMatch, c.ifNoneMatch = "", "" }()
+
 	resp, err := c.request("PUT", "/store/"+tunnel+".ini", data)
 	if err != nil {
-		return err
+		return "", err
 	}
 	resp.Body.Close()
 
 	debugf("put %.01f ms", time.Since(t0).Seconds()*1000)
-	return nil
+	return resp.Header.Get("ETag"), nil
 }
 
 func (c *Client) Delete(tunnel string) error {
@@ -241,7 +337,26 @@ func (c *Client) Delete(tunnel string) error {
 func (c *Client) Deobfuscate(tunnel string) (string, error) {
 	t0 := time.Now()
 
-	var err error
+	keymap, err := c.Keys(tunnel)
+	if err != nil {
+		return "", err
+	}
+	tunnel = deobfuscateWith(tunnel, keymap)
+
+	debugf("deobfuscate %.01f ms", time.Since(t0).Seconds()*1000)
+	return tunnel, nil
+}
+
+// deobfuscateWith replaces the references in the tunnel with the secrets.
+func deobfuscateWith(tunnel string, keymap map[string]string) string {
+	for k, v := range keymap {
+		tunnel = strings.Replace(tunnel, "$mole$"+k, strconv.Quote(v), -1)
+	}
+	return tunnel
+}
+
+// Keys returns the secrets referenced by the tunnel.
+func (c *Client) Keys(tunnel string) (map[string]string, error) {
 	var keylist []string
 	var keymap map[string]string
 
@@ -250,30 +365,28 @@ func (c *Client) Deobfuscate(tunnel string) (string, error) {
 		keylist = append(keylist, o[6:])
 	}
 	if len(keylist) == 0 {
-		return tunnel, nil
+		return keymap, nil
 	}
 
 	var buf bytes.Buffer
 	json.NewEncoder(&buf).Encode(keylist)
 	resp, err := c.request("POST", "/keys", &buf)
 	if err != nil {
-		return "", err
+		return nil, err
 	}
 	defer resp.Body.Close()
 
 	err = json.NewDecoder(resp.Body).Decode(&keymap)
 	fatalErr(err)
-
-	for k, v := range keymap {
-		tunnel = strings.Replace(tunnel, "$mole$"+k, strconv.Quote(v), -1)
-	}
-
-	debugf("deobfuscate %.01f ms", time.Since(t0).Seconds()*1000)
-	return tunnel, nil
+	return keymap, nil
 }
 
-func (c *Client) GetTicket(username, password string) (string, error) {
+// GetTicket requests a new ticket. The one-time code may be empty when not
+// required.
+func (c *Client) GetTicket(username, password, otp string) (string, error) {
 	t0 := time.Now()
+	c.otp = otp
+	defer func() { c.otp = "" }()
 
 	resp, err := c.request("POST", "/ticket/"+username, bytes.NewBufferString(password))
 	if err != nil {
@@ -291,6 +404,148 @@ func (c *Client) GetTicket(username, password string) (string, error) {
 	return res, nil
 }
 
+// EnrollTOTP starts a TOTP enrollment, returning the new secret. The
+// one-time code is required when replacing an existing enrollment.
+func (c *Client) EnrollTOTP(username, password, otp string) (TOTPEnrollment, error) {
+	var res TOTPEnrollment
+	c.otp = otp
+	defer func() { c.otp = "" }()
+
+	resp, err := c.request("POST", "/totp/enroll/"+username, bytes.NewBufferString(password))
+	if err != nil {
+		return res, err
+	}
+	defer resp.Body.Close()
+
+	err = json.NewDecoder(resp.Body).Decode(&res)
+	return res, err
+}
+
+// ConfirmTOTP completes a TOTP enrollment with a code for the new secret.
+func (c *Client) ConfirmTOTP(username, password, otp string) error {
+	c.otp = otp
+	defer func() { c.otp = "" }()
+
+	resp, err := c.request("POST", "/totp/confirm/"+username, bytes.NewBufferString(password))
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	return nil
+}
+
+// RenewTicket returns the current ticket with its validity extended.
+func (c *Client) RenewTicket() (string, error) {
+	t0 := time.Now()
+
+	resp, err := c.request("POST", "/renew", nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	debugf("renewticket %.01f ms", time.Since(t0).Seconds()*1000)
+	return string(data), nil
+}
+
+// History returns the changes to the tunnel, latest first.
+func (c *Client) History(tunnel string) ([]Revision, error) {
+	t0 := time.Now()
+
+	resp, err := c.request("GET", "/history/"+tunnel, nil)
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var revs []Revision
+	err = json.NewDecoder(resp.Body).Decode(&revs)
+	if err != nil {
+		return nil, err
+	}
+
+	debugf("history %.01f ms", time.Since(t0).Seconds()*1000)
+	return revs, nil
+}
+
+// Diff returns the changes to the tunnel since the revision, or the latest
+// change when the revision is empty.
+func (c *Client) Diff(tunnel, rev string) (string, error) {
+	t0 := time.Now()
+
+	path := "/diff/" + tunnel
+	if rev != "" {
+		path += "?rev=" + url.QueryEscape(rev)
+	}
+	resp, err := c.request("GET", path, nil)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+
+	data, err := ioutil.ReadAll(resp.Body)
+	if err != nil {
+		return "", err
+	}
+
+	debugf("diff %.01f ms", time.Since(t0).Seconds()*1000)
+	return string(data), nil
+}
+
+// Revert restores the tunnel as it was in the revision.
+func (c *Client) Revert(tunnel, rev string) error {
+	t0 := time.Now()
+
+	resp, err := c.request("POST", "/revert/"+tunnel+"?rev="+url.QueryEscape(rev), nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	debugf("revert %.01f ms", time.Since(t0).Seconds()*1000)
+	return nil
+}
+
+// Lint returns the warnings for the tunnel definition, were it pushed as
+// the named tunnel.
+func (c *Client) Lint(tunnel string, data []byte) ([]conf.Warning, error) {
+	t0 := time.Now()
+
+	resp, err := c.request("POST", "/lint/"+tunnel, bytes.NewReader(data))
+	if err != nil {
+		return nil, err
+	}
+	defer resp.Body.Close()
+
+	var ws []conf.Warning
+	err = json.NewDecoder(resp.Body).Decode(&ws)
+	if err != nil {
+		return nil, err
+	}
+
+	debugf("lint %.01f ms", time.Since(t0).Seconds()*1000)
+	return ws, nil
+}
+
+// Logout revokes the current ticket.
+func (c *Client) Logout() error {
+	t0 := time.Now()
+
+	resp, err := c.request("POST", "/logout", nil)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+
+	debugf("logout %.01f ms", time.Since(t0).Seconds()*1000)
+	return nil
+}
+
 func (c *Client) ParseTicket() (ParsedTicket, error) {
 	t0 := time.Now()
 	var res ParsedTicket
@@ -53,8 +53,8 @@ func bashcompCommand(args []string) {
 		FileCommands   []string
 	}{
 		path.Join(homeDir, "tunnels.cache"),
-		[]string{"dig", "ls", "push", "register", "show", "test", "upgrade", "version", "rm"},
-		[]string{"dig", "show", "test", "rm"},
+		[]string{"cleanup", "diff", "dig", "edit", "lint", "log", "logout", "ls", "push", "register", "revert", "show", "test", "totp-enroll", "trace", "upgrade", "version", "rm"},
+		[]string{"diff", "dig", "edit", "lint", "log", "revert", "show", "test", "trace", "rm"},
 		[]string{"push"},
 	}
 
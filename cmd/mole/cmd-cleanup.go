@@ -0,0 +1,180 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"strings"
+	"time"
+
+	"github.com/calmh/mole/hosts"
+)
+
+func init() {
+	addCommand(command{name: "cleanup", fn: commandCleanup, descr: msgCleanupShort})
+}
+
+func commandCleanup(args []string) {
+	fs := flag.NewFlagSet("cleanup", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgCleanupUsage)
+	fs.Parse(args)
+
+	journals := staleJournals()
+	if len(journals) == 0 {
+		okln(msgCleanupNothing)
+		return
+	}
+
+	requireRoot("cleanup")
+	for _, j := range journals {
+		cleanupJournal(j)
+	}
+}
+
+// offerCleanup is called by dig to let the user clean up after previous
+// sessions before starting a new one.
+func offerCleanup() {
+	journals := staleJournals()
+	if len(journals) == 0 {
+		return
+	}
+
+	warnf(msgCleanupStale, len(journals))
+	if !hasRoot() || !isTerminal(os.Stdin.Fd()) {
+		infoln(msgCleanupRun)
+		return
+	}
+
+	fmt.Print(msgCleanupPrompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	if answer := strings.ToLower(strings.TrimSpace(line)); answer != "" && answer != "y" && answer != "yes" {
+		return
+	}
+	for _, j := range journals {
+		cleanupJournal(j)
+	}
+}
+
+// cleanupJournal undoes the changes recorded in the journal that are still
+// in effect, in the reverse order of their making, and removes the journal.
+func cleanupJournal(j *journal) {
+	if j.live() {
+		warnf(msgCleanupLive, j.PID)
+		return
+	}
+
+	infof(msgCleanupSession, j.Tunnel, j.PID, j.Started.Format(time.RFC1123))
+	fixed := 0
+
+	for _, p := range j.Processes {
+		if !p.running() {
+			continue
+		}
+		if err := stopProcess(p.PID); err != nil {
+			warnln(err)
+			continue
+		}
+		okf(msgCleanupStopped, p.Command, p.PID)
+		fixed++
+	}
+
+	for _, d := range j.SplitDNS {
+		if err := unregisterSplitDNS(d.Tag, d.Domains); err != nil {
+			warnln(err)
+			continue
+		}
+		okf(msgCleanupDNS, strings.Join(d.Domains, ", "))
+		fixed++
+	}
+
+	if len(j.HostsTags) > 0 {
+		n, err := hosts.RemoveStale(hosts.DefaultPath)
+		if err != nil {
+			warnln(err)
+		} else if n > 0 {
+			okf(msgCleanupHosts, n)
+			fixed++
+		}
+	}
+
+	if len(j.Addresses) > 0 {
+		for _, addr := range staleAddresses(j, currentAddresses()) {
+			removeAddresses([]string{addr})
+			okf(msgCleanupAddress, addr)
+			fixed++
+		}
+	}
+
+	for _, file := range j.Files {
+		if _, err := os.Stat(file); err != nil {
+			continue
+		}
+		if err := os.RemoveAll(file); err != nil {
+			warnln(err)
+			continue
+		}
+		okf(msgCleanupFile, file)
+		fixed++
+	}
+
+	if fixed == 0 {
+		okln(msgCleanupNothingLeft)
+	}
+
+	err := os.Remove(j.path())
+	if err != nil {
+		warnln(err)
+	}
+}
+
+// staleAddresses returns the addresses added by the session of the journal
+// that are still present, except those also added by a running session.
+func staleAddresses(j *journal, current []string) []string {
+	cur := make(map[string]bool)
+	for _, ip := range current {
+		cur[ip] = true
+	}
+	claimed := make(map[string]int)
+	for _, o := range readJournals() {
+		if o.PID == j.PID || !o.live() {
+			continue
+		}
+		for _, addr := range o.Addresses {
+			claimed[addr] = o.PID
+		}
+	}
+
+	var res []string
+	for _, addr := range j.Addresses {
+		if !cur[addr] {
+			continue
+		}
+		if pid, ok := claimed[addr]; ok {
+			infof(msgCleanupAddressUsed, addr, pid)
+			continue
+		}
+		res = append(res, addr)
+	}
+	return res
+}
+
+// stopProcess asks the process to exit, giving it time to clean up after
+// itself before resorting to killing it.
+func stopProcess(pid int) error {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return err
+	}
+	err = p.Signal(os.Interrupt)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < 100; i++ {
+		if !processExists(pid) {
+			return nil
+		}
+		time.Sleep(100 * time.Millisecond)
+	}
+	return p.Kill()
+}
@@ -0,0 +1,29 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+)
+
+func init() {
+	addCommand(command{name: "diff", fn: diffCommand, descr: msgDiffShort})
+}
+
+func diffCommand(args []string) {
+	fs := flag.NewFlagSet("diff", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgDiffUsage)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if l := len(args); l < 1 || l > 2 {
+		fs.Usage()
+		exit(3)
+	}
+
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	res, err := authenticated(cl, func() (interface{}, error) { return cl.Diff(args[0], fs.Arg(1)) })
+	fatalErr(err)
+
+	// No log function, since it must be possible to pipe to patch
+	fmt.Print(res.(string))
+}
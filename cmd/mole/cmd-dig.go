@@ -29,6 +29,8 @@ func commandDig(args []string) {
 	qualify := fs.Bool("q", false, "Use <host>.<tunnel> for host aliases instead of just <host>")
 	noVerify := fs.Bool("n", false, "Don't verify connectivity")
 	direct := fs.Bool("d", false, "Use direct connectivity, bypassing VPN/SSH")
+	userspace := fs.Bool("u", false, "Use a userspace network stack for the VPN, not requiring root")
+	offline := fs.Bool("offline", false, "Use the offline cache, not the server")
 	fs.DurationVar(&keepaliveInterval, "keepalive", keepaliveInterval, "SSH server alive timeout")
 	fs.Usage = usageFor(fs, msgDigUsage)
 	fs.Parse(args)
@@ -40,10 +42,16 @@ func commandDig(args []string) {
 	}
 
 	// Fail early in case we don't have root since it's always required on
-	// platforms where it matters
-	requireRoot("dig")
+	// platforms where it matters, unless the VPN runs in userspace.
+	if !*userspace {
+		requireRoot("dig")
+	}
+
+	offerCleanup()
+	openJournal(args[0])
+	atExit(closeJournal)
 
-	cfg := loadTunnel(args[0], *local)
+	cfg := loadTunnel(args[0], *local, *offline)
 
 	for _, cmt := range cfg.Comments {
 		infoln(ansi.Cyan("; " + cmt))
@@ -53,7 +61,10 @@ func commandDig(args []string) {
 	}
 
 	var addrs []string
-	if remapIntfs {
+	if remapIntfs || !hasRoot() {
+		if !hasRoot() && len(cfg.Forwards) > 0 {
+			warnln(msgNoRootRemap)
+		}
 		cfg.Remap()
 	} else {
 		addrs = missingAddresses(cfg)
@@ -81,14 +92,35 @@ func commandDig(args []string) {
 
 	var vpn VPN
 	var err error
+	var base Dialer = proxy.Direct
 
-	if !*direct {
+	if !*direct && *userspace {
+		if cfg.Vpnc != nil {
+			vpn, err = startUserspaceVpn("vpnc", cfg)
+		} else if cfg.OpenConnect != nil {
+			vpn, err = startUserspaceVpn("openconnect", cfg)
+		} else if cfg.OpenVPN != nil {
+			vpn, err = startUserspaceVpn("openvpn", cfg)
+		}
+		fatalErr(err)
+		if vpn != nil {
+			base = vpn.(UserspaceVPN)
+		}
+		atExit(func() {
+			if vpn != nil {
+				vpn.Stop()
+			}
+		})
+	} else if !*direct {
 		if cfg.Vpnc != nil {
 			vpn, err = startVpn("vpnc", cfg)
 			fatalErr(err)
 		} else if cfg.OpenConnect != nil {
 			vpn, err = startVpn("openconnect", cfg)
 			fatalErr(err)
+		} else if cfg.OpenVPN != nil {
+			vpn, err = startVpn("openvpn", cfg)
+			fatalErr(err)
 		}
 		atExit(func() {
 			if vpn != nil {
@@ -97,10 +129,10 @@ func commandDig(args []string) {
 		})
 	}
 
-	var dialer Dialer = proxy.Direct
+	var dialer Dialer = base
 	if !*direct {
 		if mh := cfg.General.Main; mh != "" {
-			sshConn, err := sshHost(mh, cfg)
+			sshConn, err := sshHost(mh, cfg, base)
 			fatalErr(err)
 			dialer = sshConn
 
@@ -116,10 +148,25 @@ func commandDig(args []string) {
 		domain = strings.TrimSuffix(domain, ".ini")
 	}
 
-	setupHostsFile(domain, cfg, *qualify)
-	atExit(func() {
-		restoreHostsFile(domain, *qualify)
-	})
+	if cfg.DNS != nil {
+		if hasRoot() {
+			stop, err := startSplitDNS(domain, cfg, dialer)
+			if err != nil {
+				warnf(msgErrSplitDNS, err)
+			} else {
+				atExit(stop)
+			}
+		} else {
+			warnf(msgDNSNoRoot, strings.Join(cfg.DNS.Domains, ", "))
+		}
+	}
+
+	if hasRoot() {
+		setupHostsFile(domain, cfg, *qualify)
+		atExit(func() {
+			restoreHostsFile(domain, *qualify)
+		})
+	}
 
 	if !*noVerify {
 		go verify(dialer, cfg)
@@ -164,13 +211,22 @@ func startKeepalive(dialer Dialer) {
 	}()
 }
 
-func loadTunnel(name string, local bool) *conf.Config {
+// loadTunnel returns the tunnel definition from the server, or from the
+// offline cache when offline or the server cannot be reached.
+func loadTunnel(name string, local, offline bool) *conf.Config {
 	var err error
 	var tun string
 
-	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
-
-	if local {
+	if offline {
+		var cached time.Time
+		tun, cached, err = cachedTunnel(name)
+		if err == errNotCached {
+			fatalf(msgErrNotCached, name)
+		}
+		fatalErr(err)
+		infof(msgOfflineUsing, name, fmtAge(cached))
+	} else if local {
+		cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
 		fd, err := os.Open(name)
 		fatalErr(err)
 		bs, err := ioutil.ReadAll(fd)
@@ -179,11 +235,26 @@ func loadTunnel(name string, local bool) *conf.Config {
 		fatalErr(err)
 		tun = tuni.(string)
 	} else {
-		tuni, err := authenticated(cl, func() (interface{}, error) { return cl.Get(name) })
+		cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+		tuni, err := authenticated(cl, func() (interface{}, error) {
+			tun, err := cl.Get(name)
+			if err != nil {
+				return nil, err
+			}
+			return cl.Deobfuscate(tun)
+		})
+		if err != nil && serverUnreachable(err) {
+			if ctun, cached, cerr := cachedTunnel(name); cerr == nil {
+				warnf(msgOfflineFallback, err, fmtAge(cached))
+				tuni, err = ctun, nil
+			} else if cerr != errNotCached {
+				debugln("offline cache:", cerr)
+			}
+		} else if err == nil {
+			cacheTunnel(name, tuni.(string))
+		}
 		fatalErr(err)
 		tun = tuni.(string)
-		tun, err = cl.Deobfuscate(tun)
-		fatalErr(err)
 	}
 
 	cfg, err := conf.Load(bytes.NewBufferString(tun))
@@ -234,6 +305,17 @@ func sshPathStr(hostname string, cfg *conf.Config) string {
 			} else {
 				this = opnc + " -> " + this
 			}
+		} else if cfg.OpenVPN != nil {
+			var remote string
+			if fields := strings.Fields(cfg.OpenVPN["remote"]); len(fields) > 0 {
+				remote = fields[0]
+			}
+			ovpn := fmt.Sprintf("openvpn://%s", remote)
+			if this == "" {
+				return ovpn
+			} else {
+				this = ovpn + " -> " + this
+			}
 		}
 	}
 
@@ -0,0 +1,249 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"runtime"
+	"strconv"
+	"strings"
+	"sync"
+
+	"github.com/calmh/mole/conf"
+)
+
+func init() {
+	addCommand(command{name: "edit", fn: editCommand, descr: msgEditShort})
+}
+
+// Lines starting with this are errors shown in the editor, removed again
+// when read back.
+const editErrorPrefix = "; mole edit: "
+
+func editCommand(args []string) {
+	fs := flag.NewFlagSet("edit", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgEditUsage)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 {
+		fs.Usage()
+		exit(3)
+	}
+
+	tunnelname := args[0]
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+
+	var etag string
+	var keymap map[string]string
+	res, err := authenticated(cl, func() (interface{}, error) {
+		tun, v, err := cl.GetVersion(tunnelname)
+		if err != nil {
+			return nil, err
+		}
+		etag = v
+		keymap, err = cl.Keys(tun)
+		return tun, err
+	})
+	fatalErr(err)
+	raw := res.(string)
+	refs := secretRefs(raw, keymap)
+	orig := deobfuscateWith(raw, keymap)
+
+	// Secrets are written in the clear; the file is only readable by us and
+	// overwritten when done
+	fd, err := ioutil.TempFile("", "mole-edit-")
+	fatalErr(err)
+	file := fd.Name()
+	var shredOnce sync.Once
+	shred := func() { shredOnce.Do(func() { shredFile(file) }) }
+	defer shred()
+	atExit(shred)
+	fatalErr(fd.Chmod(0600))
+	_, err = fd.WriteString(orig)
+	fatalErr(err)
+	fatalErr(fd.Close())
+
+	edited := orig
+	for {
+		edited, err = editUntilValid(file, edited)
+		fatalErr(err)
+		if edited == orig {
+			infoln(msgEditNoChanges)
+			return
+		}
+
+		bs := []byte(restoreRefs(edited, refs))
+		err = pushTunnel(cl, tunnelname, bs, etag)
+		if err == errAccessDenied {
+			fatalf(msgErrPushDenied, tunnelname)
+		}
+		if err != errConflict {
+			fatalErr(err)
+			okf(msgOkPushed, tunnelname)
+			return
+		}
+
+		showConflict(cl, tunnelname, bs)
+		switch editConflictChoice() {
+		case "o":
+			etag = ""
+			fatalErr(pushTunnel(cl, tunnelname, bs, etag))
+			okf(msgOkPushed, tunnelname)
+			return
+		case "e":
+			// Merge with the server copy shown, which is then the base
+			res, err := authenticated(cl, func() (interface{}, error) {
+				_, v, err := cl.GetVersion(tunnelname)
+				return v, err
+			})
+			fatalErr(err)
+			etag = res.(string)
+		default:
+			fatalf(msgErrEditAborted, tunnelname)
+		}
+	}
+}
+
+// editUntilValid opens the editor on the file with the text, until the
+// result is a valid tunnel definition, and returns it.
+func editUntilValid(file, text string) (string, error) {
+	for {
+		if err := ioutil.WriteFile(file, []byte(text), 0600); err != nil {
+			return "", err
+		}
+		if err := runEditor(file); err != nil {
+			return "", err
+		}
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return "", err
+		}
+		text = stripEditErrors(string(bs))
+		if strings.TrimSpace(text) == "" {
+			fatalln(msgErrEditEmpty)
+		}
+
+		_, err = conf.Load(bytes.NewBufferString(text))
+		if err == nil {
+			return text, nil
+		}
+		warnln(err)
+		text = editErrorPrefix + strings.Replace(err.Error(), "\n", "\n"+editErrorPrefix, -1) + "\n" + text
+	}
+}
+
+func runEditor(file string) error {
+	editor := []string{"vi"}
+	if runtime.GOOS == "windows" {
+		editor = []string{"notepad"}
+	}
+	for _, v := range []string{"VISUAL", "EDITOR"} {
+		if e := strings.Fields(os.Getenv(v)); len(e) > 0 {
+			editor = e
+			break
+		}
+	}
+
+	cmd := exec.Command(editor[0], append(editor[1:], file)...)
+	cmd.Stdin = os.Stdin
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	return cmd.Run()
+}
+
+func stripEditErrors(text string) string {
+	var buf bytes.Buffer
+	for _, line := range strings.SplitAfter(text, "\n") {
+		if !strings.HasPrefix(line, editErrorPrefix) {
+			buf.WriteString(line)
+		}
+	}
+	return buf.String()
+}
+
+func editConflictChoice() string {
+	if !isTerminal(os.Stdin.Fd()) {
+		return "a"
+	}
+	fmt.Print(msgEditConflictPrompt)
+	line, _ := bufio.NewReader(os.Stdin).ReadString('\n')
+	return strings.ToLower(strings.TrimSpace(line))
+}
+
+// A secretRef is a secret option of a tunnel definition as fetched.
+type secretRef struct {
+	ref   string
+	value string
+}
+
+// secretRefs returns the secret references in the tunnel by section and
+// option, with their values as deobfuscated.
+func secretRefs(tun string, keymap map[string]string) map[string]secretRef {
+	refs := make(map[string]secretRef)
+	mapOptions(tun, func(section, option, value string) (string, bool) {
+		if strings.HasPrefix(value, "$mole$") {
+			if v, ok := keymap[value[6:]]; ok {
+				refs[section+"\x00"+option] = secretRef{value[6:], strconv.Quote(v)}
+			}
+		}
+		return "", false
+	})
+	return refs
+}
+
+// restoreRefs puts back the references of the secrets that are unchanged,
+// so that they are not stored again as new secrets.
+func restoreRefs(tun string, refs map[string]secretRef) string {
+	return mapOptions(tun, func(section, option, value string) (string, bool) {
+		if r, ok := refs[section+"\x00"+option]; ok && value == r.value {
+			return "$mole$" + r.ref, true
+		}
+		return "", false
+	})
+}
+
+// mapOptions calls fn for each option of the INI text, replacing the value
+// when fn returns true. Other lines are left as they are.
+func mapOptions(text string, fn func(section, option, value string) (string, bool)) string {
+	var buf bytes.Buffer
+	var section string
+	for _, line := range strings.SplitAfter(text, "\n") {
+		trimmed := strings.TrimSpace(line)
+		switch {
+		case strings.HasPrefix(trimmed, "[") && strings.HasSuffix(trimmed, "]"):
+			section = strings.TrimSpace(trimmed[1 : len(trimmed)-1])
+		case strings.HasPrefix(trimmed, ";") || strings.HasPrefix(trimmed, "#"):
+		default:
+			if eq := strings.IndexByte(line, '='); eq > 0 {
+				option := strings.TrimSpace(line[:eq])
+				value := strings.TrimSpace(line[eq+1:])
+				if nv, ok := fn(section, option, value); ok {
+					nl := ""
+					if strings.HasSuffix(line, "\n") {
+						nl = "\n"
+					}
+					line = line[:eq+1] + " " + nv + nl
+				}
+			}
+		}
+		buf.WriteString(line)
+	}
+	return buf.String()
+}
+
+// shredFile overwrites the file before removing it.
+func shredFile(name string) {
+	if fi, err := os.Stat(name); err == nil {
+		if fd, err := os.OpenFile(name, os.O_WRONLY, 0); err == nil {
+			fd.Write(make([]byte, fi.Size()))
+			fd.Sync()
+			fd.Close()
+		}
+	}
+	os.Remove(name)
+}
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"bytes"
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"github.com/calmh/mole/conf"
+)
+
+func init() {
+	addCommand(command{name: "lint", fn: lintCommand, descr: msgLintShort})
+}
+
+func lintCommand(args []string) {
+	fs := flag.NewFlagSet("lint", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgLintUsage)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 {
+		fs.Usage()
+		exit(3)
+	}
+
+	var ws []conf.Warning
+	if _, err := os.Stat(args[0]); err == nil && filepath.Ext(args[0]) == ".ini" {
+		ws = lintFile(args[0])
+	} else {
+		ws = lintTunnel(args[0])
+	}
+
+	if len(ws) == 0 {
+		okln(msgLintOK)
+		return
+	}
+	for _, w := range ws {
+		// No log function, so that the output can be used by scripts
+		fmt.Println(w)
+	}
+	exit(1)
+}
+
+// lintFile checks a tunnel file before it is pushed, against the other
+// tunnels on the server when it is reachable.
+func lintFile(file string) []conf.Warning {
+	bs, err := ioutil.ReadFile(file)
+	fatalErr(err)
+	cfg, err := conf.Load(bytes.NewReader(bs))
+	fatalErr(err)
+
+	ws := cfg.ClearSecrets()
+	if moleIni.Get("server", "host") == "" {
+		warnln(msgLintLocalOnly)
+		return append(ws, cfg.Lint(nil)...)
+	}
+
+	tunnelname := strings.TrimSuffix(filepath.Base(file), ".ini")
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	res, err := authenticated(cl, func() (interface{}, error) { return cl.Lint(tunnelname, bs) })
+	if serverUnreachable(err) {
+		warnln(msgLintLocalOnly)
+		return append(ws, cfg.Lint(nil)...)
+	}
+	fatalErr(err)
+	return append(ws, res.([]conf.Warning)...)
+}
+
+// lintTunnel checks a tunnel as stored on the server.
+func lintTunnel(tunnelname string) []conf.Warning {
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	res, err := authenticated(cl, func() (interface{}, error) {
+		tun, err := cl.Get(tunnelname)
+		if err != nil {
+			return nil, err
+		}
+		return cl.Lint(tunnelname, []byte(tun))
+	})
+	fatalErr(err)
+	return res.([]conf.Warning)
+}
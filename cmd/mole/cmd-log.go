@@ -0,0 +1,53 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"time"
+
+	"github.com/calmh/mole/ansi"
+	"github.com/calmh/mole/table"
+)
+
+func init() {
+	addCommand(command{name: "log", fn: logCommand, descr: msgLogShort, aliases: []string{"history"}})
+}
+
+func logCommand(args []string) {
+	fs := flag.NewFlagSet("log", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgLogUsage)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 {
+		fs.Usage()
+		exit(3)
+	}
+
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	res, err := authenticated(cl, func() (interface{}, error) { return cl.History(args[0]) })
+	fatalErr(err)
+	revs := res.([]Revision)
+
+	rows := [][]string{{"REV", "DATE", "AUTHOR", "CHANGE"}}
+	for _, r := range revs {
+		rev := r.Rev
+		if len(rev) > 8 {
+			rev = rev[:8]
+		}
+		rows = append(rows, []string{rev, time.Time(r.Date).Format("2006-01-02 15:04"), r.Author, r.Comment})
+	}
+	// Never prefix table with log stuff
+	fmt.Print(table.FmtFunc("llll", rows, logFormatter))
+}
+
+func logFormatter(cell string, row, col, flags int) string {
+	if row == 0 {
+		return ansi.Underline(cell)
+	} else if col == 0 {
+		return ansi.Yellow(cell)
+	} else if flags&table.Truncated != 0 {
+		return cell[:len(cell)-1] + ansi.Red(">")
+	}
+	return cell
+}
@@ -0,0 +1,36 @@
+package main
+
+import (
+	"flag"
+	"strings"
+)
+
+func init() {
+	addCommand(command{name: "logout", fn: logoutCommand, descr: msgLogoutShort})
+}
+
+func logoutCommand(args []string) {
+	fs := flag.NewFlagSet("logout", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgLogoutUsage)
+	fs.Parse(args)
+
+	tic := moleIni.Get("server", "ticket")
+	if tic == "" {
+		infoln(msgNotLoggedIn)
+		return
+	}
+
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	cl.Ticket = tic
+	err := cl.Logout()
+	if err != nil && !strings.HasPrefix(err.Error(), "401 Unauthorized") {
+		// The ticket is forgotten regardless; it expires in due time
+		warnf(msgErrLogout, err)
+	}
+
+	moleIni.Delete("server", "ticket")
+	moleIni.Delete("server", "validity")
+	saveMoleIni()
+	clearOfflineCache()
+	okln(msgLoggedOut)
+}
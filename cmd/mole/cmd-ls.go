@@ -6,7 +6,9 @@ import (
 	"os"
 	"path"
 	"regexp"
+	"sort"
 	"strings"
+	"time"
 
 	"github.com/calmh/mole/ansi"
 	"github.com/calmh/mole/conf"
@@ -25,7 +27,7 @@ func commandLs(args []string) {
 	err := fs.Parse(args)
 	if err != nil {
 		fmt.Println(ansi.Bold("Feature Flags:"))
-		fmt.Println(msgLsFlags)
+		fmt.Print(msgLsFlags)
 		exit(3)
 	}
 	args = fs.Args()
@@ -36,8 +38,15 @@ func commandLs(args []string) {
 		fatalErr(err)
 	}
 
+	offline := offlineTunnels()
+
 	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
 	res, err := authenticated(cl, func() (interface{}, error) { return cl.List() })
+	if err != nil && serverUnreachable(err) && len(offline) > 0 {
+		warnf(msgOfflineList, err)
+		listOffline(offline, re, *short)
+		return
+	}
 	fatalErr(err)
 	l := res.([]ListItem)
 
@@ -64,6 +73,11 @@ func commandLs(args []string) {
 		header = append(header, "HOSTS", "VER")
 		format += "lr"
 	}
+	showOffline := offlineMode() != ""
+	if showOffline {
+		header = append(header, "OFFLINE")
+		format += "r"
+	}
 
 	rows = [][]string{header}
 
@@ -87,7 +101,7 @@ func commandLs(args []string) {
 				if hasFeatureFlags {
 					flags := ""
 					spacer := "·"
-					unsupported := i.Features & ^(conf.FeatureError|conf.FeatureSshKey|conf.FeatureSshPassword|conf.FeatureLocalOnly|conf.FeatureVpnc|conf.FeatureOpenConnect|conf.FeatureSocks) != 0
+					unsupported := i.Features & ^(conf.FeatureError|conf.FeatureSshKey|conf.FeatureSshPassword|conf.FeatureLocalOnly|conf.FeatureVpnc|conf.FeatureOpenConnect|conf.FeatureOpenVPN|conf.FeatureSocks) != 0
 
 					if i.Features&conf.FeatureError != 0 {
 						flags = strings.Repeat(spacer, 4) + "E"
@@ -98,6 +112,9 @@ func commandLs(args []string) {
 						} else if i.Features&conf.FeatureOpenConnect != 0 {
 							flags += "o"
 							unsupported = unsupported || !supportsVpn("openconnect")
+						} else if i.Features&conf.FeatureOpenVPN != 0 {
+							flags += "n"
+							unsupported = unsupported || !supportsVpn("openvpn")
 						} else {
 							flags += spacer
 						}
@@ -141,6 +158,14 @@ func commandLs(args []string) {
 					row = append(row, hosts, ver)
 				}
 
+				if showOffline {
+					if cached, ok := offline[i.Name]; ok {
+						row = append(row, fmtAge(cached))
+					} else {
+						row = append(row, "-")
+					}
+				}
+
 				rows = append(rows, row)
 			}
 		}
@@ -152,13 +177,37 @@ func commandLs(args []string) {
 
 	if !*short {
 		// Never prefix table with log stuff
-		fmt.Printf(table.FmtFunc(format, rows, tableFormatter))
+		fmt.Print(table.FmtFunc(format, rows, tableFormatter))
 		if matched != len(l) {
 			fmt.Printf(ansi.Faint(" - Matched %d out of %d records\n"), matched, len(l))
 		}
 	}
 }
 
+// listOffline lists the tunnels in the offline cache, when the server
+// cannot be reached.
+func listOffline(offline map[string]time.Time, re *regexp.Regexp, short bool) {
+	var names []string
+	for name := range offline {
+		if re == nil || re.MatchString(name) {
+			names = append(names, name)
+		}
+	}
+	sort.Strings(names)
+
+	if short {
+		for _, name := range names {
+			fmt.Println(name)
+		}
+		return
+	}
+	rows := [][]string{{"TUNNEL", "OFFLINE"}}
+	for _, name := range names {
+		rows = append(rows, []string{name, fmtAge(offline[name])})
+	}
+	fmt.Print(table.FmtFunc("lr", rows, tableFormatter))
+}
+
 func tableFormatter(cell string, row, col, flags int) string {
 	if row == 0 {
 		return ansi.Underline(cell)
@@ -3,6 +3,7 @@ package main
 import (
 	"bytes"
 	"flag"
+	"fmt"
 	"io/ioutil"
 	"os"
 	"path/filepath"
@@ -16,6 +17,7 @@ func init() {
 
 func pushCommand(args []string) {
 	fs := flag.NewFlagSet("push", flag.ExitOnError)
+	force := fs.Bool("force", false, "Overwrite the server copy even if it has changed")
 	fs.Usage = usageFor(fs, msgPushUsage)
 	fs.Parse(args)
 	args = fs.Args()
@@ -44,10 +46,60 @@ func pushCommand(args []string) {
 	// Push
 	tunnelname := filename[:len(filename)-4]
 	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
-	_, err = authenticated(cl, func() (interface{}, error) {
-		return nil, cl.Put(tunnelname, bytes.NewBuffer(bs))
-	})
+	base := "new"
+	if *force {
+		base = ""
+	} else if etag := moleIni.Get("etags", tunnelname); etag != "" {
+		base = etag
+	}
+	err = pushTunnel(cl, tunnelname, bs, base)
+	if err == errConflict {
+		showConflict(cl, tunnelname, bs)
+		fatalf(msgErrPushConflict, tunnelname)
+	}
+	if err == errAccessDenied {
+		fatalf(msgErrPushDenied, tunnelname)
+	}
 	fatalErr(err)
 
 	okf(msgOkPushed, tunnelname)
 }
+
+// pushTunnel stores the tunnel, unless the server copy is not the base
+// version (see Client.Put).
+func pushTunnel(cl *Client, tunnelname string, bs []byte, base string) error {
+	res, err := authenticated(cl, func() (interface{}, error) {
+		return cl.Put(tunnelname, base, bytes.NewBuffer(bs))
+	})
+	if err != nil {
+		return err
+	}
+	rememberVersion(tunnelname, res.(string))
+	for _, w := range cl.Warnings {
+		warnln(w)
+	}
+	return nil
+}
+
+// rememberVersion records the version of the tunnel that local changes are
+// based on.
+func rememberVersion(tunnelname, etag string) {
+	if etag == "" {
+		moleIni.Delete("etags", tunnelname)
+	} else {
+		moleIni.Set("etags", tunnelname, etag)
+	}
+	saveMoleIni()
+}
+
+// showConflict shows how the server copy differs from what is pushed.
+func showConflict(cl *Client, tunnelname string, bs []byte) {
+	res, err := authenticated(cl, func() (interface{}, error) { return cl.Get(tunnelname) })
+	if err != nil {
+		warnln(err)
+		return
+	}
+	warnf(msgPushConflict, tunnelname)
+	// Never prefix diff with log stuff
+	fmt.Print(fmtDiff(res.(string), string(bs), 3))
+}
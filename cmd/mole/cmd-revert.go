@@ -0,0 +1,34 @@
+package main
+
+import (
+	"flag"
+)
+
+func init() {
+	addCommand(command{name: "revert", fn: revertCommand, descr: msgRevertShort})
+}
+
+func revertCommand(args []string) {
+	fs := flag.NewFlagSet("revert", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgRevertUsage)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 2 {
+		fs.Usage()
+		exit(3)
+	}
+
+	tunnelname, rev := args[0], args[1]
+
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	_, err := authenticated(cl, func() (interface{}, error) {
+		return nil, cl.Revert(tunnelname, rev)
+	})
+	if err == errAccessDenied {
+		fatalf(msgErrRevertDenied, tunnelname)
+	}
+	fatalErr(err)
+
+	okf(msgOkReverted, tunnelname, rev)
+}
@@ -25,6 +25,9 @@ func rmCommand(args []string) {
 	_, err := authenticated(cl, func() (interface{}, error) {
 		return nil, cl.Delete(tunnelname)
 	})
+	if err == errAccessDenied {
+		fatalf(msgErrRmDenied, tunnelname)
+	}
 	fatalErr(err)
 
 	okf(msgOkDeleted, tunnelname)
@@ -25,13 +25,20 @@ func showCommand(args []string) {
 	}
 
 	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
-	res, err := authenticated(cl, func() (interface{}, error) { return cl.Get(args[0]) })
+	var etag string
+	res, err := authenticated(cl, func() (interface{}, error) {
+		tun, v, err := cl.GetVersion(args[0])
+		etag = v
+		return tun, err
+	})
 	fatalErr(err)
 	tun := res.(string)
 
 	if *raw {
+		// Exported for editing; changes are pushed to this version
+		rememberVersion(args[0], etag)
 		// No log function, since it must be possible to pipe to a valid file
-		fmt.Printf(tun)
+		fmt.Print(tun)
 	} else {
 		cfg, err := conf.Load(bytes.NewBufferString(tun))
 		fatalErr(err)
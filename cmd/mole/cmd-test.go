@@ -26,7 +26,7 @@ func testCommand(args []string) {
 	// platforms where it matters
 	requireRoot("test")
 
-	cfg := loadTunnel(args[0], *local)
+	cfg := loadTunnel(args[0], *local, false)
 
 	var vpn VPN
 	var err error
@@ -37,11 +37,14 @@ func testCommand(args []string) {
 	} else if cfg.OpenConnect != nil {
 		vpn, err = startVpn("openconnect", cfg)
 		fatalErr(err)
+	} else if cfg.OpenVPN != nil {
+		vpn, err = startVpn("openvpn", cfg)
+		fatalErr(err)
 	}
 
 	var dialer Dialer = proxy.Direct
 	if mh := cfg.General.Main; mh != "" {
-		dialer, err = sshHost(mh, cfg)
+		dialer, err = sshHost(mh, cfg, proxy.Direct)
 		fatalErr(err)
 	}
 
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"strings"
 	"time"
 
 	"github.com/calmh/mole/ansi"
@@ -20,4 +21,7 @@ func ticketCommand(args []string) {
 	for _, ip := range tic.IPs {
 		infoln("  * ", ansi.Cyan(ip))
 	}
+	if len(tic.Groups) > 0 {
+		infof(msgTicketGroups, ansi.Cyan(strings.Join(tic.Groups, ", ")))
+	}
 }
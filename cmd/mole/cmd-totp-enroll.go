@@ -0,0 +1,70 @@
+package main
+
+import (
+	"bufio"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+)
+
+func init() {
+	addCommand(command{name: "totp-enroll", fn: totpEnrollCommand, descr: msgTOTPEnrollShort})
+}
+
+func totpEnrollCommand(args []string) {
+	fs := flag.NewFlagSet("totp-enroll", flag.ExitOnError)
+	fs.Usage = usageFor(fs, msgTOTPEnrollUsage)
+	fs.Parse(args)
+
+	cl := NewClient(serverAddress(), moleIni.Get("server", "fingerprint"))
+	br := bufio.NewReader(os.Stdin)
+
+	user := moleIni.Get("server", "user")
+	if user == "" {
+		fmt.Printf(msgUsername)
+		bs, _, err := br.ReadLine()
+		fatalErr(err)
+		user = string(bs)
+	}
+	pass := readpass(fmt.Sprintf(msgPassword, user))
+
+	enr, err := cl.EnrollTOTP(user, pass, "")
+	if err == errOTPRequired {
+		// Replacing an existing enrollment
+		infoln(msgTOTPReplace)
+		enr, err = cl.EnrollTOTP(user, pass, readOTP(br))
+	}
+	fatalErr(err)
+
+	infoln(msgTOTPScan)
+	showQR(enr.URI)
+	infof(msgTOTPSecret, enr.URI, enr.Secret)
+
+	for i := 0; i < retries; i++ {
+		err = cl.ConfirmTOTP(user, pass, readOTP(br))
+		if err != errOTPInvalid {
+			break
+		}
+		warnln(msgTOTPIncorrect)
+	}
+	fatalErr(err)
+
+	okln(msgTOTPEnrolled)
+}
+
+// showQR displays the URI as a QR code in the terminal, when qrencode is
+// available to draw it.
+func showQR(uri string) {
+	qrencode, err := exec.LookPath("qrencode")
+	if err != nil {
+		debugln(err)
+		return
+	}
+	cmd := exec.Command(qrencode, "-t", "ANSIUTF8", uri)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	if err := cmd.Run(); err != nil {
+		debugln(err)
+	}
+}
@@ -0,0 +1,232 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+
+	"github.com/calmh/mole/ansi"
+	"github.com/calmh/mole/conf"
+	"github.com/calmh/mole/table"
+
+	"golang.org/x/crypto/ssh"
+	"golang.org/x/net/proxy"
+)
+
+func init() {
+	addCommand(command{name: "trace", fn: traceCommand, descr: msgTraceShort})
+}
+
+type hopTrace struct {
+	host      string
+	addr      string
+	connect   time.Duration
+	handshake time.Duration
+	auth      string // the method that succeeded
+	err       error
+}
+
+func (h hopTrace) row() []string {
+	auth := h.auth
+	if auth == "" {
+		auth = "-"
+	}
+	row := []string{h.host, h.addr, fmtMs(h.connect), fmtMs(h.handshake), auth}
+	if h.err != nil {
+		return append(row, h.err.Error())
+	}
+	return append(row, "ok")
+}
+
+func traceCommand(args []string) {
+	fs := flag.NewFlagSet("trace", flag.ExitOnError)
+	local := fs.Bool("l", false, "Local file, not remote tunnel definition")
+	fs.Usage = usageFor(fs, msgTraceUsage)
+	fs.Parse(args)
+	args = fs.Args()
+
+	if len(args) != 1 {
+		fs.Usage()
+		exit(3)
+	}
+
+	// Fail early in case we don't have root since it's always required on
+	// platforms where it matters
+	requireRoot("trace")
+
+	cfg := loadTunnel(args[0], *local, false)
+	infoln(sshPathStr(cfg.General.Main, cfg))
+
+	var vpn VPN
+	var err error
+
+	t0 := time.Now()
+	if cfg.Vpnc != nil {
+		vpn, err = startVpn("vpnc", cfg)
+		fatalErr(err)
+	} else if cfg.OpenConnect != nil {
+		vpn, err = startVpn("openconnect", cfg)
+		fatalErr(err)
+	} else if cfg.OpenVPN != nil {
+		vpn, err = startVpn("openvpn", cfg)
+		fatalErr(err)
+	}
+	if vpn != nil {
+		okf(msgTraceVpnUp, fmtMs(time.Since(t0)))
+		atExit(vpn.Stop)
+	}
+
+	var dialer Dialer = proxy.Direct
+	if mh := cfg.General.Main; mh != "" {
+		hops, client := traceHops(mh, cfg)
+
+		rows := [][]string{{"HOST", "ADDRESS", "CONNECT", "HANDSHAKE", "AUTH", "RESULT"}}
+		for _, hop := range hops {
+			rows = append(rows, hop.row())
+		}
+		fmt.Print(table.FmtFunc("llrrll", rows, traceFormatter(5)))
+
+		if client == nil {
+			fatalf(msgTraceHopFailed, hops[len(hops)-1].host)
+		}
+		dialer = client
+	}
+
+	rows := [][]string{{"FORWARD", "DESTINATION", "DIAL", "RESULT"}}
+	var failed int
+	for res := range testForwards(dialer, cfg) {
+		for _, line := range res.results {
+			result := "ok"
+			if line.err != nil {
+				result = line.err.Error()
+				failed++
+			}
+			rows = append(rows, []string{res.name, line.dst, fmt.Sprintf("%.01f ms", line.ms), result})
+		}
+	}
+	if len(rows) > 1 {
+		fmt.Print(table.FmtFunc("llrl", rows, traceFormatter(3)))
+	}
+
+	if failed > 0 {
+		exit(1)
+	}
+}
+
+// traceHops connects to each host on the way to the given host, starting
+// from the one that is dialed directly. It returns the trace of each hop
+// attempted and, if all of them succeeded, the client for the last one.
+func traceHops(host string, cfg *conf.Config) ([]hopTrace, *ssh.Client) {
+	var chain []string
+	for h := host; h != ""; h = cfg.Hosts[cfg.HostsMap[h]].Via {
+		chain = append([]string{h}, chain...)
+	}
+
+	var hops []hopTrace
+	var clients []*ssh.Client
+	var client *ssh.Client
+	for _, name := range chain {
+		hop, next := traceHop(cfg.Hosts[cfg.HostsMap[name]], client)
+		hops = append(hops, hop)
+		if hop.err != nil {
+			// Each client runs over a connection through the previous one,
+			// so close them from the last hop back
+			for i := len(clients) - 1; i >= 0; i-- {
+				clients[i].Close()
+			}
+			return hops, nil
+		}
+		clients = append(clients, next)
+		client = next
+	}
+
+	return hops, client
+}
+
+// traceHop dials and authenticates to the host, via the previous hop if
+// there is one.
+func traceHop(h conf.Host, prev *ssh.Client) (hopTrace, *ssh.Client) {
+	hop := hopTrace{host: h.Name, addr: fmt.Sprintf("%s:%d", h.Addr, h.Port)}
+
+	var dialer Dialer = proxy.Direct
+	if prev != nil {
+		dialer = prev
+	} else if h.SOCKS != "" {
+		hop.addr = h.SOCKS + " -> " + hop.addr
+		var err error
+		dialer, err = proxy.SOCKS5("tcp", h.SOCKS, nil, proxy.Direct)
+		if err != nil {
+			hop.err = err
+			return hop, nil
+		}
+	}
+
+	t0 := time.Now()
+	debugln("dial", h.Addr, h.Port)
+	conn, err := dialer.Dial("tcp", fmt.Sprintf("%s:%d", h.Addr, h.Port))
+	hop.connect = time.Since(t0)
+	if err != nil {
+		hop.err = err
+		return hop, nil
+	}
+
+	var tried string
+	auths, err := sshAuthMethods(h, func(method string) {
+		tried = method
+	})
+	if err != nil {
+		conn.Close()
+		hop.err = err
+		return hop, nil
+	}
+
+	t0 = time.Now()
+	config := &ssh.ClientConfig{
+		User: h.User,
+		Auth: auths,
+		HostKeyCallback: func(string, net.Addr, ssh.PublicKey) error {
+			// The key exchange is complete once we're asked to verify the
+			// host key; the rest is authentication.
+			hop.handshake = time.Since(t0)
+			return nil
+		},
+	}
+
+	debugln("handshake & authenticate")
+	cc, nc, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
+	if err != nil {
+		conn.Close()
+		hop.err = err
+		return hop, nil
+	}
+	// Authentication stops at the first method the server accepts
+	hop.auth = tried
+	return hop, ssh.NewClient(cc, nc, reqs)
+}
+
+func fmtMs(d time.Duration) string {
+	if d == 0 {
+		return "-"
+	}
+	return fmt.Sprintf("%.01f ms", d.Seconds()*1000)
+}
+
+// traceFormatter returns a table formatter that colors the result column
+// according to success or failure.
+func traceFormatter(resultCol int) table.Formatter {
+	return func(cell string, row, col, flags int) string {
+		if row == 0 {
+			return ansi.Underline(cell)
+		} else if col == 0 {
+			return ansi.Bold(ansi.Cyan(cell))
+		} else if col == resultCol {
+			if strings.TrimSpace(cell) == "ok" {
+				return ansi.Green(cell)
+			}
+			return ansi.Red(cell)
+		}
+		return cell
+	}
+}
@@ -0,0 +1,424 @@
+package main
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"runtime"
+	"strings"
+	"time"
+
+	"github.com/calmh/mole/conf"
+)
+
+// The split DNS stub listens on a loopback alias in this range, taking the
+// first address not already in use by another mole.
+const dnsStubNet = "127.0.53."
+
+const (
+	dnsTimeout    = 5 * time.Second
+	dnsMaxUDPSize = 512
+	dnsHeaderLen  = 12
+
+	dnsTypeA    = 1
+	dnsTypeAAAA = 28
+
+	dnsRcodeServFail = 2
+	dnsRcodeRefused  = 5
+)
+
+var errDNSMalformed = errors.New("malformed DNS message")
+
+// A dnsStub answers queries for names within its domains by forwarding them
+// over TCP to the upstream servers, reached through the dialer. Addresses in
+// the answers that are the destination of a forward are replaced by the
+// source of that forward.
+type dnsStub struct {
+	dialer  Dialer
+	servers []string
+	domains []string
+	mapped  map[string]net.IP
+
+	udp net.PacketConn
+	tcp net.Listener
+}
+
+func newDNSStub(dialer Dialer, cfg *conf.Config) *dnsStub {
+	return &dnsStub{
+		dialer:  dialer,
+		servers: cfg.DNS.Servers,
+		domains: cfg.DNS.Domains,
+		mapped:  forwardedAddresses(cfg),
+	}
+}
+
+// startSplitDNS starts a DNS stub for the tunnel and registers it with the
+// system resolver. The returned function reverses the process.
+func startSplitDNS(tag string, cfg *conf.Config, dialer Dialer) (func(), error) {
+	if runtime.GOOS == "windows" {
+		return nil, errors.New(msgErrNoSplitDNS)
+	}
+
+	addr := dnsStubAddress()
+	if addr == "" {
+		return nil, errors.New("no free loopback address for DNS")
+	}
+	addAddresses([]string{addr})
+
+	stub := newDNSStub(dialer, cfg)
+	if err := stub.listen(net.JoinHostPort(addr, "53")); err != nil {
+		removeAddresses([]string{addr})
+		return nil, err
+	}
+
+	journalDNSRegistered(tag, stub.domains)
+	if err := registerSplitDNS(tag, net.ParseIP(addr), stub.domains); err != nil {
+		unregisterSplitDNS(tag, stub.domains)
+		journalDNSUnregistered(tag)
+		stub.close()
+		removeAddresses([]string{addr})
+		return nil, err
+	}
+	okf(msgDNSStarted, strings.Join(stub.domains, ", "), addr)
+
+	return func() {
+		if err := unregisterSplitDNS(tag, stub.domains); err != nil {
+			warnln(err)
+		} else {
+			journalDNSUnregistered(tag)
+		}
+		stub.close()
+		removeAddresses([]string{addr})
+	}, nil
+}
+
+func dnsStubAddress() string {
+	cur := make(map[string]bool)
+	for _, ip := range currentAddresses() {
+		cur[ip] = true
+	}
+	for i := 1; i < 255; i++ {
+		addr := fmt.Sprintf("%s%d", dnsStubNet, i)
+		if !cur[addr] {
+			return addr
+		}
+	}
+	return ""
+}
+
+// forwardedAddresses maps forward destination addresses to the local source
+// address, for destinations that are reachable on the same ports through a
+// single source address.
+func forwardedAddresses(cfg *conf.Config) map[string]net.IP {
+	srcs := make(map[string]net.IP)
+	usable := make(map[string]bool)
+	for _, fwd := range cfg.Forwards {
+		for _, line := range fwd.Lines {
+			dst := line.Dst.Addr.String()
+			samePorts := fmt.Sprint(line.Src.Ports) == fmt.Sprint(line.Dst.Ports)
+			if src, ok := srcs[dst]; ok {
+				usable[dst] = usable[dst] && samePorts && src.Equal(line.Src.Addr)
+				continue
+			}
+			srcs[dst] = line.Src.Addr
+			usable[dst] = samePorts
+		}
+	}
+
+	for dst := range srcs {
+		if !usable[dst] {
+			delete(srcs, dst)
+		}
+	}
+	return srcs
+}
+
+func (s *dnsStub) listen(addr string) error {
+	var err error
+	s.udp, err = net.ListenPacket("udp", addr)
+	if err != nil {
+		return err
+	}
+	// The same port for TCP, in case addr was given as port zero
+	s.tcp, err = net.Listen("tcp", s.udp.LocalAddr().String())
+	if err != nil {
+		s.udp.Close()
+		return err
+	}
+	debugln("dns stub listening on", s.udp.LocalAddr())
+
+	go s.serveUDP()
+	go s.serveTCP()
+	return nil
+}
+
+func (s *dnsStub) close() {
+	s.udp.Close()
+	s.tcp.Close()
+}
+
+func (s *dnsStub) serveUDP() {
+	buf := make([]byte, 65536)
+	for {
+		n, addr, err := s.udp.ReadFrom(buf)
+		if err != nil {
+			return
+		}
+		query := append([]byte(nil), buf[:n]...)
+		go func() {
+			resp := s.handle(query)
+			if resp == nil {
+				return
+			}
+			if len(resp) > dnsMaxUDPSize && binary.BigEndian.Uint16(query[10:]) == 0 {
+				// The client doesn't do EDNS and needs to retry over TCP
+				resp = dnsTruncate(resp)
+			}
+			s.udp.WriteTo(resp, addr)
+		}()
+	}
+}
+
+func (s *dnsStub) serveTCP() {
+	for {
+		conn, err := s.tcp.Accept()
+		if err != nil {
+			return
+		}
+		go func() {
+			defer conn.Close()
+			for {
+				conn.SetDeadline(time.Now().Add(dnsTimeout))
+				query, err := dnsReadTCP(conn)
+				if err != nil {
+					return
+				}
+				resp := s.handle(query)
+				if resp == nil {
+					return
+				}
+				if err := dnsWriteTCP(conn, resp); err != nil {
+					return
+				}
+			}
+		}()
+	}
+}
+
+// handle returns the response to the query, or nil if the query is too
+// malformed to respond to.
+func (s *dnsStub) handle(query []byte) []byte {
+	name, _, err := dnsQuestion(query)
+	if err != nil {
+		debugln("dns:", err)
+		return nil
+	}
+	if !dnsInDomains(name, s.domains) {
+		debugln("dns: refusing", name)
+		return dnsError(query, dnsRcodeRefused)
+	}
+
+	resp, err := s.exchange(query)
+	if err != nil {
+		warnf(msgDNSFailed, name, err)
+		return dnsError(query, dnsRcodeServFail)
+	}
+	if err := dnsMapAnswers(resp, s.mapped); err != nil {
+		debugln("dns:", err)
+	}
+	return resp
+}
+
+func (s *dnsStub) exchange(query []byte) ([]byte, error) {
+	var err error
+	for _, server := range s.servers {
+		var resp []byte
+		resp, err = dnsExchangeTCP(s.dialer, server, query)
+		if err == nil {
+			return resp, nil
+		}
+		debugf("dns: %s: %v", server, err)
+	}
+	return nil, err
+}
+
+func dnsExchangeTCP(dialer Dialer, server string, query []byte) ([]byte, error) {
+	conn, err := dialer.Dial("tcp", server)
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	// Connections through SSH don't support deadlines
+	timer := time.AfterFunc(dnsTimeout, func() { conn.Close() })
+	defer timer.Stop()
+
+	if err := dnsWriteTCP(conn, query); err != nil {
+		return nil, err
+	}
+	resp, err := dnsReadTCP(conn)
+	if err != nil {
+		return nil, err
+	}
+	if len(resp) < dnsHeaderLen || resp[0] != query[0] || resp[1] != query[1] {
+		return nil, errors.New("DNS response ID mismatch")
+	}
+	return resp, nil
+}
+
+func dnsReadTCP(r io.Reader) ([]byte, error) {
+	var l uint16
+	if err := binary.Read(r, binary.BigEndian, &l); err != nil {
+		return nil, err
+	}
+	msg := make([]byte, l)
+	_, err := io.ReadFull(r, msg)
+	return msg, err
+}
+
+func dnsWriteTCP(w io.Writer, msg []byte) error {
+	buf := make([]byte, 2+len(msg))
+	binary.BigEndian.PutUint16(buf, uint16(len(msg)))
+	copy(buf[2:], msg)
+	_, err := w.Write(buf)
+	return err
+}
+
+func dnsInDomains(name string, domains []string) bool {
+	name = strings.ToLower(strings.TrimSuffix(name, "."))
+	for _, d := range domains {
+		d = strings.ToLower(strings.TrimSuffix(d, "."))
+		if name == d || strings.HasSuffix(name, "."+d) {
+			return true
+		}
+	}
+	return false
+}
+
+// dnsQuestion returns the name in the first question of the message and the
+// offset of the end of the question section.
+func dnsQuestion(msg []byte) (string, int, error) {
+	if len(msg) < dnsHeaderLen || binary.BigEndian.Uint16(msg[4:]) == 0 {
+		return "", 0, errDNSMalformed
+	}
+	name, off, err := dnsName(msg, dnsHeaderLen)
+	if err != nil {
+		return "", 0, err
+	}
+	off += 4 // type and class
+	for i := 1; i < int(binary.BigEndian.Uint16(msg[4:])); i++ {
+		_, off, err = dnsName(msg, off)
+		if err != nil {
+			return "", 0, err
+		}
+		off += 4
+	}
+	if off > len(msg) {
+		return "", 0, errDNSMalformed
+	}
+	return name, off, nil
+}
+
+// dnsName reads the possibly compressed name at off, returning it and the
+// offset following it.
+func dnsName(msg []byte, off int) (string, int, error) {
+	var labels []string
+	end := -1
+	for jumps := 0; ; {
+		if off >= len(msg) {
+			return "", 0, errDNSMalformed
+		}
+		l := int(msg[off])
+		switch {
+		case l == 0:
+			if end < 0 {
+				end = off + 1
+			}
+			return strings.Join(labels, ".") + ".", end, nil
+		case l&0xc0 == 0xc0:
+			if off+1 >= len(msg) || jumps > 16 {
+				return "", 0, errDNSMalformed
+			}
+			if end < 0 {
+				end = off + 2
+			}
+			off = int(binary.BigEndian.Uint16(msg[off:]) & 0x3fff)
+			jumps++
+		default:
+			if off+1+l > len(msg) {
+				return "", 0, errDNSMalformed
+			}
+			labels = append(labels, string(msg[off+1:off+1+l]))
+			off += 1 + l
+		}
+	}
+}
+
+// dnsMapAnswers replaces, in place, A and AAAA records in the answer section
+// that are present in the map.
+func dnsMapAnswers(msg []byte, mapped map[string]net.IP) error {
+	_, off, err := dnsQuestion(msg)
+	if err != nil {
+		return err
+	}
+	for i := 0; i < int(binary.BigEndian.Uint16(msg[6:])); i++ {
+		_, off, err = dnsName(msg, off)
+		if err != nil {
+			return err
+		}
+		if off+10 > len(msg) {
+			return errDNSMalformed
+		}
+		typ := binary.BigEndian.Uint16(msg[off:])
+		rdlen := int(binary.BigEndian.Uint16(msg[off+8:]))
+		off += 10
+		if off+rdlen > len(msg) {
+			return errDNSMalformed
+		}
+
+		rdata := msg[off : off+rdlen]
+		if (typ == dnsTypeA && rdlen == net.IPv4len) || (typ == dnsTypeAAAA && rdlen == net.IPv6len) {
+			if src, ok := mapped[net.IP(rdata).String()]; ok {
+				if src4 := src.To4(); typ == dnsTypeA && src4 != nil {
+					debugf("dns: mapping %v to %v", net.IP(rdata), src4)
+					copy(rdata, src4)
+				} else if typ == dnsTypeAAAA && src4 == nil {
+					debugf("dns: mapping %v to %v", net.IP(rdata), src)
+					copy(rdata, src.To16())
+				}
+			}
+		}
+		off += rdlen
+	}
+	return nil
+}
+
+// dnsError returns a response to the query with the given response code and
+// no records.
+func dnsError(query []byte, rcode byte) []byte {
+	_, off, _ := dnsQuestion(query)
+	resp := append([]byte(nil), query[:off]...)
+	resp[2] = 0x80 | resp[2]&0x79 // response; keep opcode and RD
+	resp[3] = 0x80 | rcode        // recursion available
+	for i := 6; i < dnsHeaderLen; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
+
+// dnsTruncate returns the header and question of the response, with the
+// truncated flag set.
+func dnsTruncate(resp []byte) []byte {
+	_, off, err := dnsQuestion(resp)
+	if err != nil {
+		return resp[:dnsHeaderLen]
+	}
+	resp = append([]byte(nil), resp[:off]...)
+	resp[2] |= 0x02
+	for i := 6; i < dnsHeaderLen; i++ {
+		resp[i] = 0
+	}
+	return resp
+}
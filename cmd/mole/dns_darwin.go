@@ -0,0 +1,80 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+var resolverDir = "/etc/resolver"
+
+const resolverFileHeader = "# Added by mole for "
+
+func registerSplitDNS(tag string, server net.IP, domains []string) error {
+	return writeResolverFiles("tunnel "+tag, []net.IP{server}, domains)
+}
+
+func unregisterSplitDNS(tag string, domains []string) error {
+	return removeResolverFiles("tunnel "+tag, domains)
+}
+
+// writeResolverFiles directs queries for the domains to the servers, using
+// one resolver file per domain. The split DNS stub and the VPN can both ask
+// for a domain; the first one to do so owns the file until it removes it.
+func writeResolverFiles(owner string, servers []net.IP, domains []string) error {
+	err := os.MkdirAll(resolverDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "%s%s\n", resolverFileHeader, owner)
+	for _, ip := range servers {
+		fmt.Fprintf(&buf, "nameserver %s\n", ip)
+	}
+	for _, d := range domains {
+		file := filepath.Join(resolverDir, d)
+		if cur := resolverFileOwner(file); cur != "" && cur != owner {
+			warnf(msgDNSResolverInUse, d, owner, file, cur)
+			continue
+		}
+		err := ioutil.WriteFile(file, buf.Bytes(), 0644)
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// removeResolverFiles removes the resolver files for the domains that were
+// written by owner.
+func removeResolverFiles(owner string, domains []string) error {
+	for _, d := range domains {
+		file := filepath.Join(resolverDir, d)
+		if resolverFileOwner(file) != owner {
+			continue
+		}
+		if err := os.Remove(file); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// resolverFileOwner returns who wrote the resolver file, "" if it doesn't
+// exist, or "someone else" if it wasn't written by mole.
+func resolverFileOwner(file string) string {
+	bs, err := ioutil.ReadFile(file)
+	if os.IsNotExist(err) {
+		return ""
+	}
+	line := strings.SplitN(string(bs), "\n", 2)[0]
+	if err != nil || !strings.HasPrefix(line, resolverFileHeader) {
+		return "someone else"
+	}
+	return strings.TrimPrefix(line, resolverFileHeader)
+}
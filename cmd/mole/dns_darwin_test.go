@@ -0,0 +1,58 @@
+package main
+
+import (
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+func TestResolverFileOwnership(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-resolver.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	defer func(old string) { resolverDir = old }(resolverDir)
+	resolverDir = dir
+
+	if err := ioutil.WriteFile(filepath.Join(dir, "local.example"), []byte("nameserver 10.0.0.53\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	vpn := commandSystem{}
+	servers := []net.IP{net.ParseIP("10.1.0.53")}
+	if err := vpn.SetDNS("utun3", servers, []string{"corp.example", "local.example"}); err != nil {
+		t.Fatal(err)
+	}
+	if err := registerSplitDNS("test", net.ParseIP("127.0.0.53"), []string{"corp.example", "db.example"}); err != nil {
+		t.Fatal(err)
+	}
+
+	expected := map[string]string{
+		"corp.example":  "interface utun3",
+		"db.example":    "tunnel test",
+		"local.example": "someone else",
+	}
+	for d, owner := range expected {
+		if cur := resolverFileOwner(filepath.Join(dir, d)); cur != owner {
+			t.Errorf("%s owned by %q, not %q", d, cur, owner)
+		}
+	}
+
+	// Each removes only its own files
+	if err := unregisterSplitDNS("test", []string{"corp.example", "db.example"}); err != nil {
+		t.Fatal(err)
+	}
+	expected["db.example"] = ""
+	if err := vpn.RevertDNS("utun3", []string{"corp.example", "local.example"}); err != nil {
+		t.Fatal(err)
+	}
+	expected["corp.example"] = ""
+	for d, owner := range expected {
+		if cur := resolverFileOwner(filepath.Join(dir, d)); cur != owner {
+			t.Errorf("%s owned by %q after removal, not %q", d, cur, owner)
+		}
+	}
+}
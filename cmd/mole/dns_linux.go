@@ -0,0 +1,75 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+)
+
+// Runtime configuration drop-ins for systemd-resolved; these don't survive a
+// reboot, which is what we want should we fail to clean up.
+const resolvedConfDir = "/run/systemd/resolved.conf.d"
+
+func registerSplitDNS(tag string, server net.IP, domains []string) error {
+	if _, err := exec.LookPath("resolvectl"); err != nil {
+		return fmt.Errorf(msgErrNoResolvedStub)
+	}
+
+	err := os.MkdirAll(resolvedConfDir, 0755)
+	if err != nil {
+		return err
+	}
+
+	var buf bytes.Buffer
+	fmt.Fprintf(&buf, "# Added by mole for %s\n[Resolve]\nDNS=%s\nDomains=", tag, server)
+	for i, d := range domains {
+		if i > 0 {
+			buf.WriteString(" ")
+		}
+		// Routing-only domains; only names under them go to the stub
+		buf.WriteString("~" + d)
+	}
+	buf.WriteString("\n")
+
+	err = ioutil.WriteFile(resolvedConfFile(tag), buf.Bytes(), 0644)
+	if err != nil {
+		return err
+	}
+	return reloadResolved()
+}
+
+func unregisterSplitDNS(tag string, domains []string) error {
+	err := os.Remove(resolvedConfFile(tag))
+	if os.IsNotExist(err) {
+		return nil
+	} else if err != nil {
+		return err
+	}
+	return reloadResolved()
+}
+
+func resolvedConfFile(tag string) string {
+	name := strings.Replace(filepath.Base(tag), " ", "_", -1)
+	return filepath.Join(resolvedConfDir, "mole-"+name+".conf")
+}
+
+// reloadResolved makes systemd-resolved read the drop-ins again. Reloading
+// requires systemd 251 or later; older versions are restarted instead, which
+// also flushes the cache and may drop the DNS settings of links.
+func reloadResolved() error {
+	err := runLogged("systemctl", "reload", "systemd-resolved")
+	if err == nil {
+		return nil
+	}
+	debugln(err)
+	if rerr := runLogged("systemctl", "try-restart", "systemd-resolved"); rerr != nil {
+		return fmt.Errorf("%v; %v", err, rerr)
+	}
+	warnln(msgResolvedRestarted)
+	return nil
+}
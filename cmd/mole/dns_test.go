@@ -0,0 +1,154 @@
+package main
+
+import (
+	"encoding/binary"
+	"net"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/conf"
+
+	"golang.org/x/net/proxy"
+)
+
+func dnsTestQuery(id uint16, name string) []byte {
+	msg := make([]byte, dnsHeaderLen)
+	binary.BigEndian.PutUint16(msg, id)
+	msg[2] = 0x01 // RD
+	binary.BigEndian.PutUint16(msg[4:], 1)
+	for _, label := range strings.Split(strings.TrimSuffix(name, "."), ".") {
+		msg = append(msg, byte(len(label)))
+		msg = append(msg, label...)
+	}
+	return append(msg, 0, 0, dnsTypeA, 0, 1)
+}
+
+// dnsTestServer answers every query over TCP with the given A records.
+func dnsTestServer(t *testing.T, answers ...string) string {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return
+			}
+			query, err := dnsReadTCP(conn)
+			if err != nil {
+				t.Error(err)
+				return
+			}
+			resp := append([]byte(nil), query...)
+			resp[2] |= 0x80
+			binary.BigEndian.PutUint16(resp[6:], uint16(len(answers)))
+			for _, a := range answers {
+				// Compressed name pointing at the question
+				resp = append(resp, 0xc0, dnsHeaderLen, 0, dnsTypeA, 0, 1, 0, 0, 0, 60, 0, 4)
+				resp = append(resp, net.ParseIP(a).To4()...)
+			}
+			dnsWriteTCP(conn, resp)
+			conn.Close()
+		}
+	}()
+	return l.Addr().String()
+}
+
+func dnsTestAnswers(t *testing.T, resp []byte) []string {
+	_, off, err := dnsQuestion(resp)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var res []string
+	for i := 0; i < int(binary.BigEndian.Uint16(resp[6:])); i++ {
+		off += 2 + 10
+		res = append(res, net.IP(resp[off:off+4]).String())
+		off += 4
+	}
+	return res
+}
+
+func TestDNSInDomains(t *testing.T) {
+	domains := []string{"corp.example.com", "Lab."}
+	cases := map[string]bool{
+		"corp.example.com.":      true,
+		"HOST.Corp.Example.com.": true,
+		"host.lab.":              true,
+		"LAB.":                   true,
+		"example.com.":           false,
+		"notcorp.example.com.":   false,
+		"lab.example.com.":       false,
+	}
+	for name, in := range cases {
+		if dnsInDomains(name, domains) != in {
+			t.Errorf("dnsInDomains(%q) != %v", name, in)
+		}
+	}
+}
+
+func TestDNSStub(t *testing.T) {
+	cfg, err := conf.Load(strings.NewReader(`
+[general]
+description = test
+author = test
+version = 4.0
+
+[forwards.web]
+127.0.0.12:8443 = 10.22.0.6:8443
+
+[forwards.db]
+127.0.0.13:5433 = 10.22.0.7:5432
+
+[dns]
+domains = corp.example.com
+servers = ` + dnsTestServer(t, "10.22.0.6", "10.22.0.7", "10.22.0.8")))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	stub := newDNSStub(proxy.Direct, cfg)
+	if err := stub.listen("127.0.0.1:0"); err != nil {
+		t.Fatal(err)
+	}
+	defer stub.close()
+
+	conn, err := net.Dial("udp", stub.udp.LocalAddr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+
+	exchange := func(query []byte) []byte {
+		if _, err := conn.Write(query); err != nil {
+			t.Fatal(err)
+		}
+		buf := make([]byte, 65536)
+		n, err := conn.Read(buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf[:n]
+	}
+
+	resp := exchange(dnsTestQuery(42, "web.corp.example.com"))
+	if id := binary.BigEndian.Uint16(resp); id != 42 {
+		t.Errorf("incorrect response id %d", id)
+	}
+	// Only the forward on the same port is mapped
+	answers := dnsTestAnswers(t, resp)
+	expected := "[127.0.0.12 10.22.0.7 10.22.0.8]"
+	if s := "[" + strings.Join(answers, " ") + "]"; s != expected {
+		t.Errorf("incorrect answers %s != %s", s, expected)
+	}
+
+	resp = exchange(dnsTestQuery(43, "www.example.com"))
+	if rcode := resp[3] & 0x0f; rcode != dnsRcodeRefused {
+		t.Errorf("query outside domains not refused; rcode %d", rcode)
+	}
+	if len(dnsTestAnswers(t, resp)) != 0 {
+		t.Error("unexpected answers to refused query")
+	}
+}
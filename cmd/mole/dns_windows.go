@@ -0,0 +1,14 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+func registerSplitDNS(tag string, server net.IP, domains []string) error {
+	return errors.New(msgErrNoSplitDNS)
+}
+
+func unregisterSplitDNS(tag string, domains []string) error {
+	return nil
+}
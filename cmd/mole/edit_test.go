@@ -0,0 +1,71 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"strings"
+	"testing"
+)
+
+const editTunnel = `[general]
+description = Test
+author = Test
+version = 4.0
+main = test
+
+[hosts.test]
+addr = 192.0.2.1
+user = test
+password = $mole$a1b2
+
+[hosts.other]
+addr = 192.0.2.2
+user = test
+password = $mole$c3d4
+`
+
+func TestRestoreRefs(t *testing.T) {
+	keymap := map[string]string{"a1b2": "hunter2", "c3d4": "s3cr3t"}
+	refs := secretRefs(editTunnel, keymap)
+	plain := deobfuscateWith(editTunnel, keymap)
+	if strings.Contains(plain, "$mole$") {
+		t.Fatalf("not deobfuscated:\n%s", plain)
+	}
+
+	// Unchanged secrets get their references back, changed ones are sent
+	// in the clear to be stored again
+	edited := strings.Replace(plain, `password = "s3cr3t"`, `password = "changed"`, 1)
+	edited = strings.Replace(edited, "description = Test", "description = Edited", 1)
+	expected := strings.Replace(editTunnel, "password = $mole$c3d4", `password = "changed"`, 1)
+	expected = strings.Replace(expected, "description = Test", "description = Edited", 1)
+	if res := restoreRefs(edited, refs); res != expected {
+		t.Errorf("unexpected result:\n%s", res)
+	}
+
+	// A secret moved to another host is not the same reference
+	moved := strings.Replace(plain, "[hosts.other]", "[hosts.moved]", 1)
+	if res := restoreRefs(moved, refs); !strings.Contains(res, `password = "s3cr3t"`) {
+		t.Errorf("moved secret restored:\n%s", res)
+	}
+}
+
+func TestStripEditErrors(t *testing.T) {
+	text := editErrorPrefix + "line 3: bad\n" + editErrorPrefix + "more\n; own comment\n[general]\n"
+	if res := stripEditErrors(text); res != "; own comment\n[general]\n" {
+		t.Errorf("unexpected result %q", res)
+	}
+}
+
+func TestShredFile(t *testing.T) {
+	fd, err := ioutil.TempFile("", "mole-edit-")
+	if err != nil {
+		t.Fatal(err)
+	}
+	fd.WriteString("hunter2")
+	fd.Close()
+
+	shredFile(fd.Name())
+	if _, err := os.Stat(fd.Name()); !os.IsNotExist(err) {
+		t.Error("file not removed")
+	}
+}
@@ -3,10 +3,7 @@ package main
 import (
 	"errors"
 	"net"
-	"os"
-	"os/exec"
 	"regexp"
-	"runtime"
 	"strings"
 
 	"github.com/calmh/mole/conf"
@@ -15,30 +12,31 @@ import (
 var errNoLoopbackFound = errors.New("no loopback interface found")
 var keepAddressRe = regexp.MustCompile(`^(127\.0\.0\.([0-9]|[0-2][0-9]|3[0-1])|::1)$`)
 
-func loInterface() string {
+func loInterface() (net.Interface, error) {
 	intfs, err := net.Interfaces()
-	fatalErr(err)
+	if err != nil {
+		return net.Interface{}, err
+	}
 
 	for _, intf := range intfs {
 		if intf.Flags&net.FlagLoopback == net.FlagLoopback {
 			debugf("loopback interface on %q", intf.Name)
-			return intf.Name
+			return intf, nil
 		}
 	}
 
-	fatalln(errNoLoopbackFound)
-	return "" // Unreachable
+	return net.Interface{}, errNoLoopbackFound
 }
 
 func currentAddresses() []string {
 	addrs, err := net.InterfaceAddrs()
 	fatalErr(err)
 
-	cur := make([]string, len(addrs))
-	for i := range addrs {
-		s := addrs[i].String()
-		ps := strings.SplitN(s, "/", 2)
-		cur[i] = ps[0]
+	var cur []string
+	for _, addr := range addrs {
+		if ipnet, ok := addr.(*net.IPNet); ok {
+			cur = append(cur, ipnet.IP.String())
+		}
 	}
 
 	debugf("current interface addresses: %v", cur)
@@ -90,28 +88,65 @@ func extraneousAddresses(cfg *conf.Config) []string {
 	return extra
 }
 
+// An addressManager adds and removes addresses on the loopback interface.
+// Failures are reported per address, as addressErrors.
+type addressManager interface {
+	AddAddresses(addrs []string) error
+	RemoveAddresses(addrs []string) error
+}
+
+type addressError struct {
+	addr string
+	err  error
+}
+
+// addressErrors lists the addresses an operation failed for, and why.
+type addressErrors []addressError
+
+func (e addressErrors) Error() string {
+	msgs := make([]string, len(e))
+	for i, ae := range e {
+		msgs[i] = ae.addr + ": " + ae.err.Error()
+	}
+	return strings.Join(msgs, "; ")
+}
+
+var addrManager = newAddressManager()
+
 func addAddresses(addrs []string) {
-	ifconfigAddresses("add", addrs)
+	requireRoot("add interface addresses")
+
+	journalAddressesAdded(addrs)
+	err := addrManager.AddAddresses(addrs)
+	if err != nil {
+		failed := reportAddressErrors(err)
+		// The failed ones were not added and need no cleaning up
+		journalAddressesRemoved(failed)
+		fatalln(msgErrAddAddresses)
+	}
 }
 
 func removeAddresses(addrs []string) {
-	if runtime.GOOS == "darwin" {
-		ifconfigAddresses("remove", addrs)
-	} else {
-		ifconfigAddresses("del", addrs)
+	requireRoot("remove interface addresses")
+
+	err := addrManager.RemoveAddresses(addrs)
+	var failed []string
+	if err != nil {
+		failed = reportAddressErrors(err)
 	}
+	journalAddressesRemoved(removeStrings(addrs, failed...))
 }
 
-func ifconfigAddresses(command string, addrs []string) {
-	requireRoot("ifconfig")
-
-	lo := loInterface()
-	for _, addr := range addrs {
-		debugln("ifconfig", lo, command, addr)
-		out, err := exec.Command("ifconfig", lo, command, addr).CombinedOutput()
-		if err != nil {
-			os.Stdout.Write(out)
-			fatalErr(err)
-		}
+// reportAddressErrors warns about each failed address and returns them.
+func reportAddressErrors(err error) []string {
+	aerrs, ok := err.(addressErrors)
+	if !ok {
+		fatalErr(err)
+	}
+	var failed []string
+	for _, ae := range aerrs {
+		warnf(msgErrAddress, ae.addr, ae.err)
+		failed = append(failed, ae.addr)
 	}
+	return failed
 }
@@ -0,0 +1,68 @@
+// +build !linux
+
+package main
+
+import (
+	"errors"
+	"net"
+	"os/exec"
+	"runtime"
+	"strings"
+)
+
+// execAddressManager manages addresses using ifconfig.
+type execAddressManager struct{}
+
+func newAddressManager() addressManager {
+	return execAddressManager{}
+}
+
+func (execAddressManager) AddAddresses(addrs []string) error {
+	return ifconfigAddresses(true, addrs)
+}
+
+func (execAddressManager) RemoveAddresses(addrs []string) error {
+	return ifconfigAddresses(false, addrs)
+}
+
+func ifconfigAddresses(add bool, addrs []string) error {
+	lo, err := loInterface()
+	if err != nil {
+		return err
+	}
+
+	var errs addressErrors
+	for _, addr := range addrs {
+		args := []string{lo.Name}
+		ip := net.ParseIP(addr)
+		switch {
+		case ip == nil:
+			errs = append(errs, addressError{addr, errors.New("not an IP address")})
+			continue
+		case ip.To4() == nil && add:
+			args = append(args, "inet6", addr, "alias")
+		case ip.To4() == nil:
+			args = append(args, "inet6", addr, "-alias")
+		case add:
+			args = append(args, "add", addr)
+		case runtime.GOOS == "darwin":
+			args = append(args, "remove", addr)
+		default:
+			args = append(args, "del", addr)
+		}
+
+		debugln("ifconfig", strings.Join(args, " "))
+		out, err := exec.Command("ifconfig", args...).CombinedOutput()
+		if err != nil {
+			if msg := strings.TrimSpace(string(out)); msg != "" {
+				err = errors.New(msg)
+			}
+			errs = append(errs, addressError{addr, err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
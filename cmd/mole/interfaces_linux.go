@@ -0,0 +1,47 @@
+package main
+
+import (
+	"errors"
+	"net"
+)
+
+// netlinkAddressManager manages addresses through netlink, requiring no
+// external tools.
+type netlinkAddressManager struct{}
+
+func newAddressManager() addressManager {
+	return netlinkAddressManager{}
+}
+
+func (netlinkAddressManager) AddAddresses(addrs []string) error {
+	return netlinkAddresses(netlinkAddrAdd, addrs)
+}
+
+func (netlinkAddressManager) RemoveAddresses(addrs []string) error {
+	return netlinkAddresses(netlinkAddrDel, addrs)
+}
+
+func netlinkAddresses(fn func(int, *net.IPNet) error, addrs []string) error {
+	lo, err := loInterface()
+	if err != nil {
+		return err
+	}
+
+	var errs addressErrors
+	for _, addr := range addrs {
+		ip := net.ParseIP(addr)
+		if ip == nil {
+			errs = append(errs, addressError{addr, errors.New("not an IP address")})
+			continue
+		}
+		debugln("netlink", lo.Name, addr)
+		if err := fn(lo.Index, hostNet(ip)); err != nil {
+			errs = append(errs, addressError{addr, err})
+		}
+	}
+
+	if len(errs) > 0 {
+		return errs
+	}
+	return nil
+}
@@ -0,0 +1,41 @@
+package main
+
+import (
+	"os"
+	"testing"
+)
+
+func TestNetlinkAddressManager(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	addrs := []string{"127.0.0.201", "fd00:6d6f:6c65::201"}
+	m := netlinkAddressManager{}
+	if err := m.AddAddresses(addrs); err != nil {
+		t.Fatal(err)
+	}
+	defer m.RemoveAddresses(addrs)
+
+	cur := make(map[string]bool)
+	for _, ip := range currentAddresses() {
+		cur[ip] = true
+	}
+	for _, addr := range addrs {
+		if !cur[addr] {
+			t.Errorf("address %s not added", addr)
+		}
+	}
+
+	// Failures are reported for each address, without affecting the others
+	err := m.RemoveAddresses([]string{"127.0.0.201", "bogus", "127.0.0.202"})
+	aerrs, ok := err.(addressErrors)
+	if !ok || len(aerrs) != 2 || aerrs[0].addr != "bogus" || aerrs[1].addr != "127.0.0.202" {
+		t.Errorf("incorrect errors %v", err)
+	}
+	for _, ip := range currentAddresses() {
+		if ip == "127.0.0.201" {
+			t.Error("address 127.0.0.201 not removed")
+		}
+	}
+}
@@ -0,0 +1,255 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"time"
+)
+
+// A journal records the changes made to the system by a dig session, so that
+// they can be undone by 'mole cleanup' should the session not get to do so
+// itself.
+type journal struct {
+	PID       int
+	Tunnel    string
+	Started   time.Time
+	HostsTags []string         `json:",omitempty"`
+	Addresses []string         `json:",omitempty"`
+	Files     []string         `json:",omitempty"`
+	Processes []journalProcess `json:",omitempty"`
+	SplitDNS  []journalDNS     `json:",omitempty"`
+}
+
+type journalProcess struct {
+	PID     int
+	Command string
+}
+
+type journalDNS struct {
+	Tag     string
+	Domains []string
+}
+
+var (
+	activeJournal     *journal
+	activeJournalLock sync.Mutex
+)
+
+func journalDir() string {
+	return filepath.Join(homeDir, "journal")
+}
+
+func (j *journal) path() string {
+	return filepath.Join(journalDir(), fmt.Sprintf("dig-%d.json", j.PID))
+}
+
+func (j *journal) save() error {
+	err := os.MkdirAll(journalDir(), 0700)
+	if err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(j, "", "  ")
+	if err != nil {
+		return err
+	}
+	tmp := j.path() + ".tmp"
+	err = ioutil.WriteFile(tmp, bs, 0600)
+	if err != nil {
+		return err
+	}
+	return os.Rename(tmp, j.path())
+}
+
+// openJournal starts journaling changes for the current session.
+func openJournal(tunnel string) {
+	activeJournalLock.Lock()
+	defer activeJournalLock.Unlock()
+
+	activeJournal = &journal{PID: os.Getpid(), Tunnel: tunnel, Started: time.Now()}
+	err := activeJournal.save()
+	fatalErr(err)
+}
+
+// closeJournal ends journaling for the current session. The journal is
+// removed, unless some changes could not be undone and are left for 'mole
+// cleanup'.
+func closeJournal() {
+	activeJournalLock.Lock()
+	defer activeJournalLock.Unlock()
+
+	if activeJournal == nil {
+		return
+	}
+	if activeJournal.empty() {
+		err := os.Remove(activeJournal.path())
+		if err != nil {
+			warnln(err)
+		}
+	} else {
+		debugf("leaving journal %s", activeJournal.path())
+	}
+	activeJournal = nil
+}
+
+func (j *journal) empty() bool {
+	return len(j.HostsTags) == 0 && len(j.Addresses) == 0 && len(j.Files) == 0 &&
+		len(j.Processes) == 0 && len(j.SplitDNS) == 0
+}
+
+// updateJournal applies the change to the journal of the current session and
+// saves it. It does nothing outside of a journaled session.
+func updateJournal(fn func(j *journal)) {
+	activeJournalLock.Lock()
+	defer activeJournalLock.Unlock()
+
+	if activeJournal == nil {
+		return
+	}
+	fn(activeJournal)
+	err := activeJournal.save()
+	if err != nil {
+		warnln(err)
+	}
+}
+
+func journalAddressesAdded(addrs []string) {
+	var removable []string
+	for _, addr := range addrs {
+		// Addresses matching keepAddressRe are left in place by design
+		if !keepAddressRe.MatchString(addr) {
+			removable = append(removable, addr)
+		}
+	}
+	updateJournal(func(j *journal) { j.Addresses = addStrings(j.Addresses, removable...) })
+}
+
+func journalAddressesRemoved(addrs []string) {
+	updateJournal(func(j *journal) { j.Addresses = removeStrings(j.Addresses, addrs...) })
+}
+
+func journalHostsTagged(tag string) {
+	updateJournal(func(j *journal) { j.HostsTags = addStrings(j.HostsTags, tag) })
+}
+
+func journalHostsUntagged(tag string) {
+	updateJournal(func(j *journal) { j.HostsTags = removeStrings(j.HostsTags, tag) })
+}
+
+func journalFileCreated(file string) {
+	updateJournal(func(j *journal) { j.Files = addStrings(j.Files, file) })
+}
+
+func journalFileRemoved(file string) {
+	updateJournal(func(j *journal) { j.Files = removeStrings(j.Files, file) })
+}
+
+func journalProcessStarted(cmd *exec.Cmd) {
+	updateJournal(func(j *journal) {
+		j.Processes = append(j.Processes, journalProcess{cmd.Process.Pid, cmd.Path})
+	})
+}
+
+func journalProcessStopped(cmd *exec.Cmd) {
+	updateJournal(func(j *journal) {
+		for i, p := range j.Processes {
+			if p.PID == cmd.Process.Pid {
+				j.Processes = append(j.Processes[:i], j.Processes[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func journalDNSRegistered(tag string, domains []string) {
+	updateJournal(func(j *journal) { j.SplitDNS = append(j.SplitDNS, journalDNS{tag, domains}) })
+}
+
+func journalDNSUnregistered(tag string) {
+	updateJournal(func(j *journal) {
+		for i, d := range j.SplitDNS {
+			if d.Tag == tag {
+				j.SplitDNS = append(j.SplitDNS[:i], j.SplitDNS[i+1:]...)
+				return
+			}
+		}
+	})
+}
+
+func addStrings(l []string, ss ...string) []string {
+	l = removeStrings(l, ss...)
+	return append(l, ss...)
+}
+
+func removeStrings(l []string, ss ...string) []string {
+	var res []string
+next:
+	for _, s := range l {
+		for _, r := range ss {
+			if s == r {
+				continue next
+			}
+		}
+		res = append(res, s)
+	}
+	return res
+}
+
+// staleJournals returns the journals left behind by sessions that are no
+// longer running.
+func staleJournals() []*journal {
+	var res []*journal
+	for _, j := range readJournals() {
+		if !j.live() {
+			res = append(res, j)
+		}
+	}
+	return res
+}
+
+// readJournals returns the journals of all sessions, running or not.
+func readJournals() []*journal {
+	files, _ := filepath.Glob(filepath.Join(journalDir(), "dig-*.json"))
+
+	var res []*journal
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			warnln(err)
+			continue
+		}
+		var j journal
+		err = json.Unmarshal(bs, &j)
+		if err != nil {
+			warnf(msgErrJournalCorrupt, file, err)
+			continue
+		}
+		res = append(res, &j)
+	}
+	return res
+}
+
+// live returns true if the session that wrote the journal is still running.
+func (j *journal) live() bool {
+	return j.PID == os.Getpid() || processExists(j.PID)
+}
+
+// running returns true if the process is still running the recorded
+// command, as opposed to the PID having been reused by something else.
+func (p journalProcess) running() bool {
+	if !processExists(p.PID) {
+		return false
+	}
+	out, err := exec.Command("ps", "-p", fmt.Sprint(p.PID), "-o", "comm=").Output()
+	if err != nil {
+		return false
+	}
+	// Some systems truncate the command name
+	comm := filepath.Base(strings.TrimSpace(string(out)))
+	return comm != "" && strings.HasPrefix(filepath.Base(p.Command), comm)
+}
@@ -0,0 +1,137 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+func withTestHomeDir(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "molehome")
+	if err != nil {
+		t.Fatal(err)
+	}
+	oldHome := homeDir
+	homeDir = dir
+	return func() {
+		homeDir = oldHome
+		os.RemoveAll(dir)
+	}
+}
+
+func TestJournal(t *testing.T) {
+	defer withTestHomeDir(t)()
+
+	openJournal("test")
+	journalFileCreated("/tmp/foo")
+	journalAddressesAdded([]string{"127.0.0.1", "127.0.0.200"})
+	journalHostsTagged("mole")
+
+	if _, err := os.Stat(activeJournal.path()); err != nil {
+		t.Fatal(err)
+	}
+
+	j := activeJournal
+	if len(j.Files) != 1 || len(j.HostsTags) != 1 {
+		t.Errorf("changes not recorded: %+v", j)
+	}
+	// Addresses that are kept by design are not journaled
+	if len(j.Addresses) != 1 || j.Addresses[0] != "127.0.0.200" {
+		t.Errorf("incorrect addresses recorded: %v", j.Addresses)
+	}
+
+	// Our own journal is never stale
+	if js := staleJournals(); len(js) != 0 {
+		t.Errorf("unexpected stale journals %v", js)
+	}
+
+	journalFileRemoved("/tmp/foo")
+	journalAddressesRemoved([]string{"127.0.0.200"})
+	journalHostsUntagged("mole")
+	path := j.path()
+	closeJournal()
+	if _, err := os.Stat(path); !os.IsNotExist(err) {
+		t.Error("empty journal not removed on close")
+	}
+}
+
+func TestCleanupJournal(t *testing.T) {
+	defer withTestHomeDir(t)()
+
+	// A process that has exited, to get the PID of a nonexistent process
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	dead := cmd.ProcessState.Pid()
+
+	leftover := filepath.Join(homeDir, "vpnc-script.123")
+	if err := ioutil.WriteFile(leftover, nil, 0644); err != nil {
+		t.Fatal(err)
+	}
+	j := &journal{
+		PID:       dead,
+		Tunnel:    "test",
+		Started:   time.Now(),
+		Files:     []string{leftover, filepath.Join(homeDir, "already-gone")},
+		Processes: []journalProcess{{dead, "/usr/sbin/vpnc"}},
+	}
+	if err := j.save(); err != nil {
+		t.Fatal(err)
+	}
+
+	js := staleJournals()
+	if len(js) != 1 || js[0].PID != dead {
+		t.Fatalf("stale journal not found: %v", js)
+	}
+
+	cleanupJournal(js[0])
+
+	if _, err := os.Stat(leftover); !os.IsNotExist(err) {
+		t.Error("leftover file not removed")
+	}
+	if _, err := os.Stat(j.path()); !os.IsNotExist(err) {
+		t.Error("journal not removed after cleanup")
+	}
+}
+
+func TestCleanupAddresses(t *testing.T) {
+	defer withTestHomeDir(t)()
+
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	dead := cmd.ProcessState.Pid()
+
+	stale := &journal{
+		PID:       dead,
+		Tunnel:    "old",
+		Addresses: []string{"127.0.0.201", "127.0.0.202", "127.0.0.203"},
+	}
+	live := &journal{
+		PID:       os.Getpid(),
+		Tunnel:    "new",
+		Addresses: []string{"127.0.0.202"},
+	}
+	for _, j := range []*journal{stale, live} {
+		if err := j.save(); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// 127.0.0.202 belongs to the running session and 127.0.0.203 is gone
+	addrs := staleAddresses(stale, []string{"127.0.0.1", "127.0.0.201", "127.0.0.202"})
+	if len(addrs) != 1 || addrs[0] != "127.0.0.201" {
+		t.Errorf("unexpected stale addresses %v", addrs)
+	}
+
+	// Nothing is done for a session that is still running
+	cleanupJournal(live)
+	if _, err := os.Stat(live.path()); err != nil {
+		t.Error("journal of running session removed")
+	}
+}
@@ -1,28 +1,46 @@
 package main
 
 const (
-	msgMainUsage     = "mole [options] <command> [command-options]"
-	msgDigUsage      = "mole [global-options] dig [options] <tunnel> [host]"
-	msgInstallUsage  = "mole [global-options] install [package]"
-	msgLsUsage       = "mole [global-options] ls [options] [regexp]"
-	msgPushUsage     = "mole [global-options] push <tunnelfile>"
-	msgRegisterUsage = "mole [global-options] register [options] <server>"
-	msgShowUsage     = "mole [global-options] show [options] <tunnel>"
-	msgTestUsage     = "mole [global-options] test [options] <tunnel>"
-	msgUpgradeUsage  = "mole [global-options] upgrade [options]"
-	msgVersionUsage  = "mole [global-options] version [options]"
-
-	msgDigShort      = "Dig tunnel"
-	msgInstallShort  = "Install package"
-	msgLsShort       = "List tunnels"
-	msgPushShort     = "Push tunnel"
-	msgRegisterShort = "Register with server"
-	msgRmShort       = "Delete tunnel"
-	msgShowShort     = "Show tunnel"
-	msgTestShort     = "Test tunnel"
-	msgTicketShort   = "Explain current ticket"
-	msgUpgradeShort  = "Upgrade mole"
-	msgVersionShort  = "Show version"
+	msgMainUsage       = "mole [options] <command> [command-options]"
+	msgDiffUsage       = "mole [global-options] diff <tunnel> [revision]"
+	msgDigUsage        = "mole [global-options] dig [options] <tunnel> [host]"
+	msgEditUsage       = "mole [global-options] edit <tunnel>"
+	msgInstallUsage    = "mole [global-options] install [package]"
+	msgLintUsage       = "mole [global-options] lint <tunnel|tunnelfile>"
+	msgLogUsage        = "mole [global-options] log <tunnel>"
+	msgLogoutUsage     = "mole [global-options] logout"
+	msgLsUsage         = "mole [global-options] ls [options] [regexp]"
+	msgPushUsage       = "mole [global-options] push <tunnelfile>"
+	msgRegisterUsage   = "mole [global-options] register [options] <server>"
+	msgRevertUsage     = "mole [global-options] revert <tunnel> <revision>"
+	msgShowUsage       = "mole [global-options] show [options] <tunnel>"
+	msgTestUsage       = "mole [global-options] test [options] <tunnel>"
+	msgTraceUsage      = "mole [global-options] trace [options] <tunnel>"
+	msgTOTPEnrollUsage = "mole [global-options] totp-enroll"
+	msgCleanupUsage    = "mole [global-options] cleanup"
+	msgUpgradeUsage    = "mole [global-options] upgrade [options]"
+	msgVersionUsage    = "mole [global-options] version [options]"
+
+	msgCleanupShort    = "Undo changes left behind by interrupted sessions"
+	msgDiffShort       = "Show changes to tunnel"
+	msgDigShort        = "Dig tunnel"
+	msgEditShort       = "Edit tunnel on the server"
+	msgInstallShort    = "Install package"
+	msgLintShort       = "Check tunnel for questionable configuration"
+	msgLogShort        = "Show tunnel history"
+	msgLogoutShort     = "Revoke current ticket"
+	msgLsShort         = "List tunnels"
+	msgPushShort       = "Push tunnel"
+	msgRegisterShort   = "Register with server"
+	msgRevertShort     = "Restore earlier version of tunnel"
+	msgRmShort         = "Delete tunnel"
+	msgShowShort       = "Show tunnel"
+	msgTestShort       = "Test tunnel"
+	msgTicketShort     = "Explain current ticket"
+	msgTOTPEnrollShort = "Enroll an authenticator app for two-factor authentication"
+	msgTraceShort      = "Trace tunnel hop by hop"
+	msgUpgradeShort    = "Upgrade mole"
+	msgVersionShort    = "Show version"
 
 	msgDebugEnabled = "Debug output enabled."
 
@@ -32,7 +50,7 @@ const (
 	msgErrIncorrectFwdSrc  = "Badly formatted fwd source %q."
 	msgErrIncorrectFwdDst  = "Badly formatted fwd destination %q."
 	msgErrIncorrectFwdIP   = "Cannot forward from non-existent local IP %q."
-	msgErrIncorrectFwdPriv = "Cannot forward from privileged port %q (<1024)."
+	msgErrIncorrectFwdPriv = "Cannot forward from privileged port %d (<1024)."
 	msgErrNoSuchCommand    = `No such command %q. Try "help".`
 	msgErrNoHome           = "No home directory that I could find; cannot proceed."
 	msgErrPEMNoKey         = "No ssh key found after PEM decode."
@@ -49,6 +67,12 @@ const (
 	msgOpncConnected = "openconnect: Connected."
 	msgOpncStopped   = "openconnect: Stopped."
 
+	msgOvpnStart     = "openvpn: Started (pid %d)."
+	msgOvpnStopping  = "openvpn: Stopping (pid %d)."
+	msgOvpnWait      = "openvpn: Waiting for connect..."
+	msgOvpnConnected = "openvpn: Connected."
+	msgOvpnStopped   = "openvpn: Stopped."
+
 	msgDownloadingUpgrade = "Downloading upgrade..."
 	msgUpgraded           = "Upgraded your mole to %s."
 
@@ -56,10 +80,56 @@ const (
 	msgOkPushed       = "Pushed %q"
 	msgErrNoTunModule = "Required tunnel module (kernel extension) not available and not loadable."
 
+	msgErrPushDenied      = "You do not have write access to tunnel %q on the server."
+	msgErrRmDenied        = "You do not have write access to tunnel %q on the server; it was not deleted."
+	msgErrRevertDenied    = "You do not have write access to tunnel %q on the server; it was not reverted."
+	msgPushConflict       = "Tunnel %q has been changed on the server since you fetched it. Changes from the server copy to yours:"
+	msgEditNoChanges      = "No changes; nothing pushed."
+	msgEditConflictPrompt = "[o]verwrite the server copy, [e]dit again to merge, or [a]bort? "
+	msgErrEditAborted     = "Not pushed; your changes to %q have been discarded."
+	msgErrEditEmpty       = "The tunnel definition is empty; nothing pushed."
+	msgErrPushConflict    = "Not pushed. Merge the server copy of %q ('mole show -r') with your changes, or use 'mole push -force' to overwrite it."
+
+	msgLintOK        = "No warnings."
+	msgLintLocalOnly = "The server is not available; forwards are not checked against other tunnels."
+
+	msgErrAddress      = "Interface address %s: %v"
+	msgErrAddAddresses = "Could not add the interface addresses needed for forwarding."
+
+	msgErrNoResolved   = "systemd-resolved is not available; DNS settings from the VPN are ignored."
+	msgErrNoDNSDomains = "The VPN provides no DNS domains; DNS settings from the VPN are ignored."
+
+	msgErrNoResolvedStub = "systemd-resolved is not available to direct queries to the split DNS stub."
+	msgResolvedRestarted = "systemd-resolved could not be reloaded and was restarted instead."
+	msgErrNoSplitDNS     = "Split DNS is not supported on this platform."
+
+	msgDNSStarted  = "Resolving %s through the tunnel via %s."
+	msgDNSFailed   = "DNS query for %s failed: %v"
+	msgDNSNoRoot   = "Split DNS requires root privileges; names in %s are not resolved through the tunnel."
+	msgErrSplitDNS = "Split DNS not available: %v"
+
+	msgDNSResolverInUse = "Not resolving %s via %s; %s is in use by %s."
+
+	msgErrNoUserspaceVPN = "VPN provider %q requires a tun device and cannot run without root privileges. Only openconnect can."
+	msgNoRootRemap       = "Without root privileges, forwards are remapped to ports on 127.0.0.1 and the hosts file is not updated."
+
 	msgNeedsAuth       = "Authentication required. Enter your LDAP credentials."
 	msgUsername        = "Username: "
 	msgPassword        = "Password for %q: "
 	msgPasswordVisible = "Password will be visible when typed."
+	msgOTPCode         = "One-time code: "
+	msgErrOTPEnroll    = "Two-factor authentication is required for your account. Enroll an authenticator app using 'mole totp-enroll'."
+	msgErrLockedOut    = "Too many failed authentications for your account or address. Try again later, or ask the server administrator to clear the lockout."
+
+	msgTOTPReplace   = "You are already enrolled. Enter a code from your current authenticator app to replace it."
+	msgTOTPScan      = "Add the following to your authenticator app, then enter the code it shows to complete enrollment."
+	msgTOTPSecret    = "URI: %s\nSecret: %s"
+	msgTOTPIncorrect = "Incorrect code; try again."
+	msgTOTPEnrolled  = "Enrolled. A one-time code will be asked for when you next authenticate."
+
+	msgNotLoggedIn = "You have no ticket; nothing to do."
+	msgLoggedOut   = "Logged out. Your ticket has been revoked and removed."
+	msgErrLogout   = "The ticket could not be revoked on the server (%v); it has been removed locally."
 
 	msgNoHost = "No server hostname is configured. Have you run 'mole register'?"
 
@@ -67,7 +137,8 @@ const (
 
 	msgRegistered = "Registered with %q. Consider running 'mole install' to see what extra packages, such as VPN providers, are available."
 
-	msgOkDeleted = "Deleted %q."
+	msgOkDeleted  = "Deleted %q."
+	msgOkReverted = "Reverted %q to revision %s."
 
 	msg530 = "530 Version Unacceptable\nYour client is either too new or too old to talk to this server. Make sure you are in fact registered with the correct server and try 'mole upgrade' to get the newest client."
 
@@ -76,6 +147,7 @@ const (
 	msgUpdatedHost  = "Updated configured server name to %q."
 
 	msgLsFlags = `  o····  Requires OpenConnect
+  n····  Requires OpenVPN
   v····  Requires vpnc
   ·k···  Uses SSH with key authentication
   ··p··  Uses SSH with password authentication
@@ -90,6 +162,35 @@ const (
 	msgTunnelVerifyFailed = "No forwards (out of %d) could connect. Aborting."
 
 	msgTicketExplanation = "Ticket valid for %s\nUntil %s\nFor the following IPs:"
+	msgTicketGroups      = "Member of groups: %s"
+
+	msgTraceVpnUp     = "VPN connected in %s"
+	msgTraceHopFailed = "Could not connect to host %q; not testing forwards."
+
+	msgCleanupNothing     = "Nothing to clean up."
+	msgCleanupNothingLeft = "Nothing left to undo."
+	msgCleanupStale       = "%d previous mole dig session(s) did not exit cleanly and may have left changes behind."
+	msgCleanupRun         = "Run 'mole cleanup' as root to undo them."
+	msgCleanupPrompt      = "Clean up now? [Y/n] "
+	msgCleanupSession     = "Cleaning up after tunnel %q (pid %d, started %s):"
+	msgCleanupStopped     = "Stopped %s (pid %d)"
+	msgCleanupDNS         = "Removed split DNS for %s"
+	msgCleanupHosts       = "Removed %d stale hosts file entries"
+	msgCleanupAddress     = "Removed interface address %s"
+	msgCleanupAddressUsed = "Kept interface address %s, in use by the session with pid %d"
+	msgCleanupLive        = "Session with pid %d is still running; not cleaning up after it."
+	msgCleanupFile        = "Removed %s"
+	msgErrJournalCorrupt  = "Ignoring unreadable journal %s: %v"
+
+	msgOfflinePassphrase = "Offline cache passphrase: "
+	msgOfflineUsing      = "Using %q from the offline cache, cached %s ago."
+	msgOfflineFallback   = "The server cannot be reached (%v); using the offline cache from %s ago."
+	msgOfflineList       = "The server cannot be reached (%v); listing tunnels available offline."
+	msgErrNotCached      = "Tunnel %q is not available offline."
+	msgErrOfflineCache   = "Could not cache %q for offline use: %v"
+	msgOfflineNotCached  = "Not caching %q for offline use: %v"
+	msgErrOfflineMode    = "Unknown offline cache mode %q in mole.ini; the offline cache is disabled."
+	msgErrOfflineMaxAge  = "Bad offline cache maxage %q in mole.ini (%v); using the default."
 
 	msgDigWarnMainHost = "Using non-default main host; some or all tunnels may be nonfunctional."
 	msgDigNoHost       = "Host %q does not exist in tunnel configuration."
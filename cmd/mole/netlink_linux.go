@@ -0,0 +1,261 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"sync/atomic"
+	"syscall"
+	"unsafe"
+)
+
+// Minimal rtnetlink client for managing addresses, links and routes without
+// depending on the ip or ifconfig tools.
+
+var netlinkSeq uint32
+
+type netlinkAttr struct {
+	typ  uint16
+	data []byte
+}
+
+func netlinkU32Attr(typ uint16, v uint32) netlinkAttr {
+	bs := make([]byte, 4)
+	*(*uint32)(unsafe.Pointer(&bs[0])) = v
+	return netlinkAttr{typ, bs}
+}
+
+func netlinkIPAttr(typ uint16, ip net.IP) netlinkAttr {
+	if ip4 := ip.To4(); ip4 != nil {
+		return netlinkAttr{typ, []byte(ip4)}
+	}
+	return netlinkAttr{typ, []byte(ip.To16())}
+}
+
+func netlinkFamily(ip net.IP) uint8 {
+	if ip.To4() != nil {
+		return syscall.AF_INET
+	}
+	return syscall.AF_INET6
+}
+
+func netlinkAlign(l int) int {
+	return (l + syscall.NLMSG_ALIGNTO - 1) & ^(syscall.NLMSG_ALIGNTO - 1)
+}
+
+// netlinkExchange sends a request and returns the messages received in
+// response, up to and including the acknowledgement. A negative
+// acknowledgement is returned as a syscall.Errno.
+func netlinkExchange(typ uint16, flags uint16, hdr []byte, attrs ...netlinkAttr) ([]syscall.NetlinkMessage, error) {
+	fd, err := syscall.Socket(syscall.AF_NETLINK, syscall.SOCK_RAW|syscall.SOCK_CLOEXEC, syscall.NETLINK_ROUTE)
+	if err != nil {
+		return nil, err
+	}
+	defer syscall.Close(fd)
+
+	err = syscall.Bind(fd, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	body := append([]byte(nil), hdr...)
+	for len(body)%syscall.NLMSG_ALIGNTO != 0 {
+		body = append(body, 0)
+	}
+	for _, attr := range attrs {
+		a := make([]byte, netlinkAlign(syscall.SizeofRtAttr+len(attr.data)))
+		rta := (*syscall.RtAttr)(unsafe.Pointer(&a[0]))
+		rta.Len = uint16(syscall.SizeofRtAttr + len(attr.data))
+		rta.Type = attr.typ
+		copy(a[syscall.SizeofRtAttr:], attr.data)
+		body = append(body, a...)
+	}
+
+	seq := atomic.AddUint32(&netlinkSeq, 1)
+	msg := make([]byte, syscall.NLMSG_HDRLEN+len(body))
+	nlh := (*syscall.NlMsghdr)(unsafe.Pointer(&msg[0]))
+	nlh.Len = uint32(len(msg))
+	nlh.Type = typ
+	nlh.Flags = flags | syscall.NLM_F_REQUEST | syscall.NLM_F_ACK
+	nlh.Seq = seq
+	copy(msg[syscall.NLMSG_HDRLEN:], body)
+
+	err = syscall.Sendto(fd, msg, 0, &syscall.SockaddrNetlink{Family: syscall.AF_NETLINK})
+	if err != nil {
+		return nil, err
+	}
+
+	var res []syscall.NetlinkMessage
+	for {
+		// The parsed messages refer into the buffer, so it can't be reused
+		buf := make([]byte, 65536)
+		n, _, err := syscall.Recvfrom(fd, buf, 0)
+		if err != nil {
+			return nil, err
+		}
+		msgs, err := syscall.ParseNetlinkMessage(buf[:n])
+		if err != nil {
+			return nil, err
+		}
+		for _, m := range msgs {
+			if m.Header.Seq != seq {
+				continue
+			}
+			switch m.Header.Type {
+			case syscall.NLMSG_ERROR:
+				if len(m.Data) < 4 {
+					return nil, errors.New("netlink: short error message")
+				}
+				if errno := *(*int32)(unsafe.Pointer(&m.Data[0])); errno != 0 {
+					return nil, syscall.Errno(-errno)
+				}
+				return res, nil
+			case syscall.NLMSG_DONE:
+				return res, nil
+			default:
+				res = append(res, m)
+			}
+		}
+	}
+}
+
+func netlinkAddr(typ uint16, flags uint16, ifindex int, addr *net.IPNet) error {
+	ones, _ := addr.Mask.Size()
+	msg := syscall.IfAddrmsg{
+		Family:    netlinkFamily(addr.IP),
+		Prefixlen: uint8(ones),
+		Index:     uint32(ifindex),
+	}
+	if addr.IP.IsLoopback() {
+		msg.Scope = syscall.RT_SCOPE_HOST
+	}
+	hdr := (*[syscall.SizeofIfAddrmsg]byte)(unsafe.Pointer(&msg))[:]
+	_, err := netlinkExchange(typ, flags, hdr,
+		netlinkIPAttr(syscall.IFA_LOCAL, addr.IP),
+		netlinkIPAttr(syscall.IFA_ADDRESS, addr.IP))
+	return err
+}
+
+// netlinkAddrAdd adds the address to the interface. Adding an address that
+// already exists is not an error.
+func netlinkAddrAdd(ifindex int, addr *net.IPNet) error {
+	err := netlinkAddr(syscall.RTM_NEWADDR, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, ifindex, addr)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+// netlinkAddrDel removes the address from the interface.
+func netlinkAddrDel(ifindex int, addr *net.IPNet) error {
+	return netlinkAddr(syscall.RTM_DELADDR, 0, ifindex, addr)
+}
+
+// netlinkLinkUp sets the interface up and, if mtu is nonzero, its MTU.
+func netlinkLinkUp(ifindex int, mtu int) error {
+	msg := syscall.IfInfomsg{
+		Family: syscall.AF_UNSPEC,
+		Index:  int32(ifindex),
+		Flags:  syscall.IFF_UP,
+		Change: syscall.IFF_UP,
+	}
+	hdr := (*[syscall.SizeofIfInfomsg]byte)(unsafe.Pointer(&msg))[:]
+	var attrs []netlinkAttr
+	if mtu > 0 {
+		attrs = append(attrs, netlinkU32Attr(syscall.IFLA_MTU, uint32(mtu)))
+	}
+	_, err := netlinkExchange(syscall.RTM_NEWLINK, 0, hdr, attrs...)
+	return err
+}
+
+func netlinkRoute(typ uint16, flags uint16, dst *net.IPNet, gw net.IP, ifindex int) error {
+	msg, attrs := netlinkRouteMsg(typ, dst, gw, ifindex)
+	hdr := (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]
+	_, err := netlinkExchange(typ, flags, hdr, attrs...)
+	return err
+}
+
+// netlinkRouteMsg builds a route request. As with "ip route del", deletes
+// leave the scope, protocol and type open so that they match any route to
+// dst; a link scope route added without a gateway would otherwise not be
+// found when deleted with one, and vice versa.
+func netlinkRouteMsg(typ uint16, dst *net.IPNet, gw net.IP, ifindex int) (syscall.RtMsg, []netlinkAttr) {
+	ones, _ := dst.Mask.Size()
+	msg := syscall.RtMsg{
+		Family:  netlinkFamily(dst.IP),
+		Dst_len: uint8(ones),
+		Table:   syscall.RT_TABLE_MAIN,
+	}
+	if typ == syscall.RTM_DELROUTE {
+		msg.Scope = syscall.RT_SCOPE_NOWHERE
+	} else {
+		msg.Protocol = syscall.RTPROT_BOOT
+		msg.Type = syscall.RTN_UNICAST
+		msg.Scope = syscall.RT_SCOPE_UNIVERSE
+		if gw == nil {
+			msg.Scope = syscall.RT_SCOPE_LINK
+		}
+	}
+	attrs := []netlinkAttr{netlinkIPAttr(syscall.RTA_DST, dst.IP)}
+	if gw != nil {
+		attrs = append(attrs, netlinkIPAttr(syscall.RTA_GATEWAY, gw))
+	}
+	if ifindex > 0 {
+		attrs = append(attrs, netlinkU32Attr(syscall.RTA_OIF, uint32(ifindex)))
+	}
+	return msg, attrs
+}
+
+// netlinkRouteAdd adds a route to dst via the gateway and/or interface.
+// Adding a route that already exists is not an error.
+func netlinkRouteAdd(dst *net.IPNet, gw net.IP, ifindex int) error {
+	err := netlinkRoute(syscall.RTM_NEWROUTE, syscall.NLM_F_CREATE|syscall.NLM_F_EXCL, dst, gw, ifindex)
+	if err == syscall.EEXIST {
+		return nil
+	}
+	return err
+}
+
+// netlinkRouteDel removes the route to dst.
+func netlinkRouteDel(dst *net.IPNet, gw net.IP, ifindex int) error {
+	return netlinkRoute(syscall.RTM_DELROUTE, 0, dst, gw, ifindex)
+}
+
+// netlinkRouteGet returns the gateway (possibly nil) and interface index
+// that traffic to the given address would currently use.
+func netlinkRouteGet(ip net.IP) (net.IP, int, error) {
+	bits := 128
+	if ip.To4() != nil {
+		bits = 32
+	}
+	msg := syscall.RtMsg{
+		Family:  netlinkFamily(ip),
+		Dst_len: uint8(bits),
+	}
+	hdr := (*[syscall.SizeofRtMsg]byte)(unsafe.Pointer(&msg))[:]
+	msgs, err := netlinkExchange(syscall.RTM_GETROUTE, 0, hdr, netlinkIPAttr(syscall.RTA_DST, ip))
+	if err != nil {
+		return nil, 0, err
+	}
+
+	for _, m := range msgs {
+		if m.Header.Type != syscall.RTM_NEWROUTE {
+			continue
+		}
+		attrs, err := syscall.ParseNetlinkRouteAttr(&m)
+		if err != nil {
+			return nil, 0, err
+		}
+		var gw net.IP
+		var ifindex int
+		for _, a := range attrs {
+			switch a.Attr.Type {
+			case syscall.RTA_GATEWAY:
+				gw = net.IP(a.Value)
+			case syscall.RTA_OIF:
+				ifindex = int(*(*uint32)(unsafe.Pointer(&a.Value[0])))
+			}
+		}
+		return gw, ifindex, nil
+	}
+	return nil, 0, errors.New("netlink: no route to " + ip.String())
+}
@@ -0,0 +1,58 @@
+package main
+
+import (
+	"net"
+	"os"
+	"syscall"
+	"testing"
+)
+
+func TestNetlinkRouteMsg(t *testing.T) {
+	_, dst, _ := net.ParseCIDR("10.254.0.0/16")
+	gw := net.ParseIP("192.168.1.1")
+
+	cases := []struct {
+		typ   uint16
+		gw    net.IP
+		scope uint8
+	}{
+		{syscall.RTM_NEWROUTE, gw, syscall.RT_SCOPE_UNIVERSE},
+		{syscall.RTM_NEWROUTE, nil, syscall.RT_SCOPE_LINK},
+		{syscall.RTM_DELROUTE, gw, syscall.RT_SCOPE_NOWHERE},
+		{syscall.RTM_DELROUTE, nil, syscall.RT_SCOPE_NOWHERE},
+	}
+	for _, tc := range cases {
+		msg, _ := netlinkRouteMsg(tc.typ, dst, tc.gw, 0)
+		if msg.Scope != tc.scope {
+			t.Errorf("type %d gw %v: scope %d != %d", tc.typ, tc.gw, msg.Scope, tc.scope)
+		}
+		if msg.Dst_len != 16 || msg.Family != syscall.AF_INET {
+			t.Errorf("type %d gw %v: incorrect destination %+v", tc.typ, tc.gw, msg)
+		}
+	}
+}
+
+func TestNetlinkRouteDel(t *testing.T) {
+	if os.Geteuid() != 0 {
+		t.Skip("requires root")
+	}
+
+	lo, err := net.InterfaceByName("lo")
+	if err != nil {
+		t.Skip(err)
+	}
+	ip := net.ParseIP("10.254.1.1")
+	dst := &net.IPNet{IP: ip, Mask: net.CIDRMask(32, 32)}
+
+	// A route via a gateway is removed by a delete without one, as done
+	// for the host route to the VPN gateway on disconnect.
+	if err := netlinkRouteAdd(dst, net.ParseIP("127.0.0.1"), lo.Index); err != nil {
+		t.Fatal(err)
+	}
+	if err := netlinkRouteDel(dst, nil, 0); err != nil {
+		t.Fatal(err)
+	}
+	if _, idx, err := netlinkRouteGet(ip); err == nil && idx == lo.Index {
+		t.Error("route not removed")
+	}
+}
@@ -0,0 +1,212 @@
+package main
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"sync"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/buffer"
+	"gvisor.dev/gvisor/pkg/tcpip"
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/link/channel"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+	"gvisor.dev/gvisor/pkg/tcpip/stack"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/tcp"
+	"gvisor.dev/gvisor/pkg/tcpip/transport/udp"
+)
+
+// A netstack is a userspace TCP/IP stack, gVisor's, making outgoing
+// connections over a link carrying IPv4 packets, such as the socket
+// openconnect hands its --script-tun script, so that a VPN can be used
+// without a tun device.
+type netstack struct {
+	link   io.ReadWriteCloser // each Read and Write is one packet
+	ep     *channel.Endpoint
+	stack  *stack.Stack
+	mtu    int
+	dns    []net.IP
+	ctx    context.Context // done when the stack is closed
+	cancel context.CancelFunc
+	once   sync.Once
+}
+
+const (
+	netstackNIC           = 1
+	netstackQueue         = 512
+	netstackDefaultMTU    = 1280
+	netstackDialTimeout   = 30 * time.Second
+	netstackLookupTimeout = 10 * time.Second
+)
+
+// newNetstack starts a stack with the given address on the link. The MTU is
+// that of the link, or zero if unknown. DNS servers, if any, are used to
+// resolve names when dialing.
+func newNetstack(link io.ReadWriteCloser, addr net.IP, mtu int, dns []net.IP) (*netstack, error) {
+	if mtu <= 0 {
+		mtu = netstackDefaultMTU
+	}
+
+	s := stack.New(stack.Options{
+		NetworkProtocols:   []stack.NetworkProtocolFactory{ipv4.NewProtocol},
+		TransportProtocols: []stack.TransportProtocolFactory{tcp.NewProtocol, udp.NewProtocol},
+	})
+	sack := tcpip.TCPSACKEnabled(true)
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &sack)
+	cc := tcpip.CongestionControlOption("cubic")
+	s.SetTransportProtocolOption(tcp.ProtocolNumber, &cc)
+
+	ep := channel.New(netstackQueue, uint32(mtu), "")
+	if err := s.CreateNIC(netstackNIC, ep); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("create NIC: %v", err)
+	}
+	paddr := tcpip.ProtocolAddress{
+		Protocol:          ipv4.ProtocolNumber,
+		AddressWithPrefix: tcpip.AddrFrom4Slice(addr.To4()).WithPrefix(),
+	}
+	if err := s.AddProtocolAddress(netstackNIC, paddr, stack.AddressProperties{}); err != nil {
+		s.Close()
+		return nil, fmt.Errorf("add address %s: %v", addr, err)
+	}
+	s.SetRouteTable([]tcpip.Route{{Destination: header.IPv4EmptySubnet, NIC: netstackNIC}})
+
+	ctx, cancel := context.WithCancel(context.Background())
+	ns := &netstack{
+		link:   link,
+		ep:     ep,
+		stack:  s,
+		mtu:    mtu,
+		dns:    dns,
+		ctx:    ctx,
+		cancel: cancel,
+	}
+	go ns.reader()
+	go ns.writer()
+	return ns, nil
+}
+
+// Dial connects to the address, resolving host names using the DNS servers
+// of the stack.
+func (ns *netstack) Dial(network, addr string) (net.Conn, error) {
+	switch network {
+	case "tcp", "tcp4":
+	default:
+		return nil, fmt.Errorf("dial %s %s: unsupported network", network, addr)
+	}
+	host, sport, err := net.SplitHostPort(addr)
+	if err != nil {
+		return nil, err
+	}
+	port, err := net.LookupPort("tcp", sport)
+	if err != nil {
+		return nil, err
+	}
+	ip := net.ParseIP(host).To4()
+	if ip == nil {
+		if ip, err = ns.lookup(host); err != nil {
+			return nil, err
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ns.ctx, netstackDialTimeout)
+	defer cancel()
+	return gonet.DialContextTCP(ctx, ns.stack, ns.fullAddr(ip, port), ipv4.ProtocolNumber)
+}
+
+// lookup resolves the host name using the DNS servers of the stack, through
+// it, or the system resolver if there are none.
+func (ns *netstack) lookup(host string) (net.IP, error) {
+	r := net.DefaultResolver
+	if len(ns.dns) > 0 {
+		r = &net.Resolver{
+			PreferGo: true,
+			Dial: func(ctx context.Context, network, address string) (net.Conn, error) {
+				raddr := ns.fullAddr(ns.dns[0], 53)
+				if network == "udp" || network == "udp4" {
+					return gonet.DialUDP(ns.stack, nil, &raddr, ipv4.ProtocolNumber)
+				}
+				return gonet.DialContextTCP(ctx, ns.stack, raddr, ipv4.ProtocolNumber)
+			},
+		}
+	}
+
+	ctx, cancel := context.WithTimeout(ns.ctx, netstackLookupTimeout)
+	defer cancel()
+	addrs, err := r.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	for _, a := range addrs {
+		if ip := a.IP.To4(); ip != nil {
+			return ip, nil
+		}
+	}
+	return nil, fmt.Errorf("lookup %s: no IPv4 address", host)
+}
+
+func (ns *netstack) fullAddr(ip net.IP, port int) tcpip.FullAddress {
+	return tcpip.FullAddress{
+		NIC:  netstackNIC,
+		Addr: tcpip.AddrFrom4Slice(ip.To4()),
+		Port: uint16(port),
+	}
+}
+
+// Close aborts all connections and closes the link.
+func (ns *netstack) Close() error {
+	ns.once.Do(func() {
+		ns.cancel()
+		ns.stack.Close()
+		ns.ep.Close()
+		ns.link.Close()
+	})
+	return nil
+}
+
+// reader passes packets from the link to the stack.
+func (ns *netstack) reader() {
+	buf := make([]byte, ns.mtu+64)
+	for {
+		n, err := ns.link.Read(buf)
+		if err != nil {
+			ns.Close()
+			return
+		}
+		if n == 0 || buf[0]>>4 != header.IPv4Version {
+			// Only IPv4 is routed to us
+			continue
+		}
+		pkt := stack.NewPacketBuffer(stack.PacketBufferOptions{
+			Payload: buffer.MakeWithData(append([]byte(nil), buf[:n]...)),
+		})
+		ns.ep.InjectInbound(ipv4.ProtocolNumber, pkt)
+		pkt.DecRef()
+	}
+}
+
+// writer passes packets from the stack to the link.
+func (ns *netstack) writer() {
+	for {
+		pkt := ns.ep.ReadContext(ns.ctx)
+		if pkt == nil {
+			return
+		}
+		view := pkt.ToView()
+		_, err := ns.link.Write(view.AsSlice())
+		view.Release()
+		pkt.DecRef()
+		if err != nil {
+			select {
+			case <-ns.ctx.Done():
+			default:
+				debugln("netstack:", err)
+			}
+			ns.Close()
+			return
+		}
+	}
+}
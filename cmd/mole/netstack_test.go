@@ -0,0 +1,352 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"io"
+	"io/ioutil"
+	"net"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"gvisor.dev/gvisor/pkg/tcpip/adapters/gonet"
+	"gvisor.dev/gvisor/pkg/tcpip/header"
+	"gvisor.dev/gvisor/pkg/tcpip/network/ipv4"
+)
+
+var (
+	testStackAddr = net.IP{10, 0, 0, 2}
+	testPeerAddr  = net.IP{10, 0, 0, 1}
+)
+
+// A packetPipe is one end of an in-memory link carrying packets.
+type packetPipe struct {
+	in     <-chan []byte
+	out    chan<- []byte
+	closed chan struct{}
+	once   *sync.Once
+}
+
+func newPacketPipe() (*packetPipe, *packetPipe) {
+	ab, ba := make(chan []byte, 1024), make(chan []byte, 1024)
+	closed := make(chan struct{})
+	once := new(sync.Once)
+	return &packetPipe{ba, ab, closed, once}, &packetPipe{ab, ba, closed, once}
+}
+
+func (p *packetPipe) Read(b []byte) (int, error) {
+	select {
+	case pkt := <-p.in:
+		return copy(b, pkt), nil
+	case <-p.closed:
+		return 0, io.EOF
+	}
+}
+
+func (p *packetPipe) Write(b []byte) (int, error) {
+	pkt := append([]byte(nil), b...)
+	select {
+	case p.out <- pkt:
+		return len(b), nil
+	case <-p.closed:
+		return 0, io.ErrClosedPipe
+	}
+}
+
+func (p *packetPipe) Close() error {
+	p.once.Do(func() { close(p.closed) })
+	return nil
+}
+
+// A lossyLink drops the packets written to it that drop returns true for.
+type lossyLink struct {
+	io.ReadWriteCloser
+	drop func(pkt []byte) bool
+}
+
+func (l lossyLink) Write(b []byte) (int, error) {
+	if l.drop(b) {
+		return len(b), nil
+	}
+	return l.ReadWriteCloser.Write(b)
+}
+
+// A testPeer is the host at the far end of the link, a stack of its own
+// with an echo service on port 7, discard on 9, chargen on 19 and a DNS
+// server on 53. The data received by discard is sent on finished.
+type testPeer struct {
+	ns       *netstack
+	finished chan []byte
+}
+
+const testChargenSize = 300000
+
+func newTestNetstack(t *testing.T, drop func(pkt []byte) bool) (*netstack, *testPeer) {
+	a, b := newPacketPipe()
+	p := startTestPeer(t, b)
+	var link io.ReadWriteCloser = a
+	if drop != nil {
+		link = lossyLink{a, drop}
+	}
+	ns, err := newNetstack(link, testStackAddr, 1500, []net.IP{testPeerAddr})
+	if err != nil {
+		t.Fatal(err)
+	}
+	return ns, p
+}
+
+func startTestPeer(t *testing.T, link io.ReadWriteCloser) *testPeer {
+	ns, err := newNetstack(link, testPeerAddr, 1500, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	p := &testPeer{ns: ns, finished: make(chan []byte, 16)}
+
+	p.serve(t, 7, func(c net.Conn) { io.Copy(c, c) })
+	p.serve(t, 9, func(c net.Conn) {
+		bs, _ := ioutil.ReadAll(c)
+		p.finished <- bs
+	})
+	p.serve(t, 19, func(c net.Conn) {
+		c.Write(bytes.Repeat([]byte("0123456789"), testChargenSize/10))
+	})
+	p.serve(t, 53, func(c net.Conn) {
+		for {
+			var l uint16
+			if err := binary.Read(c, binary.BigEndian, &l); err != nil {
+				return
+			}
+			msg := make([]byte, l)
+			if _, err := io.ReadFull(c, msg); err != nil {
+				return
+			}
+			resp := testDNSAnswer(msg)
+			binary.Write(c, binary.BigEndian, uint16(len(resp)))
+			c.Write(resp)
+		}
+	})
+
+	laddr := ns.fullAddr(testPeerAddr, 53)
+	uc, err := gonet.DialUDP(ns.stack, &laddr, nil, ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		buf := make([]byte, 512)
+		for {
+			n, addr, err := uc.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			uc.WriteTo(testDNSAnswer(buf[:n]), addr)
+		}
+	}()
+	return p
+}
+
+func (p *testPeer) serve(t *testing.T, port int, fn func(c net.Conn)) {
+	l, err := gonet.ListenTCP(p.ns.stack, p.ns.fullAddr(testPeerAddr, port), ipv4.ProtocolNumber)
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				fn(c)
+				c.Close()
+			}()
+		}
+	}()
+}
+
+// testDNSAnswer answers the query, knowing only vpnhost.example, at the
+// peer address.
+func testDNSAnswer(msg []byte) []byte {
+	// Name, type and class of the question
+	i := 12
+	var labels []string
+	for i < len(msg) && msg[i] != 0 {
+		labels = append(labels, string(msg[i+1:i+1+int(msg[i])]))
+		i += 1 + int(msg[i])
+	}
+	question := msg[12 : i+5]
+	qtype := binary.BigEndian.Uint16(msg[i+1:])
+	name := strings.ToLower(strings.Join(labels, "."))
+
+	resp := []byte{msg[0], msg[1], 0x81, 0x80, 0, 1, 0, 0, 0, 0, 0, 0}
+	if name != "vpnhost.example" {
+		resp[3] |= 3 // NXDOMAIN
+	}
+	resp = append(resp, question...)
+	if name == "vpnhost.example" && qtype == 1 {
+		resp[7] = 1
+		resp = append(resp, 0xc0, 12, 0, 1, 0, 1, 0, 0, 0, 60, 0, 4)
+		resp = append(resp, testPeerAddr...)
+	}
+	return resp
+}
+
+func TestNetstackEcho(t *testing.T) {
+	ns, p := newTestNetstack(t, nil)
+	defer ns.Close()
+	defer p.ns.Close()
+
+	conn, err := ns.Dial("tcp", "10.0.0.1:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := conn.Write([]byte("hello, world")); err != nil {
+		t.Fatal(err)
+	}
+	buf := make([]byte, 12)
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	if string(buf) != "hello, world" {
+		t.Errorf("unexpected echo %q", buf)
+	}
+
+	// Nothing more to read
+	conn.SetReadDeadline(time.Now().Add(50 * time.Millisecond))
+	if _, err := conn.Read(buf); err == nil || !err.(net.Error).Timeout() {
+		t.Errorf("unexpected error %v after deadline", err)
+	}
+	conn.Close()
+}
+
+func TestNetstackTransfer(t *testing.T) {
+	ns, p := newTestNetstack(t, nil)
+	defer ns.Close()
+	defer p.ns.Close()
+
+	// Sending more than fits in the windows and buffers
+	conn, err := ns.Dial("tcp", "10.0.0.1:discard")
+	if err != nil {
+		t.Fatal(err)
+	}
+	data := bytes.Repeat([]byte("abcdefghijklmnopqrstuvwxyz"), 20000)
+	if n, err := conn.Write(data); err != nil || n != len(data) {
+		t.Fatalf("write %d, %v", n, err)
+	}
+	conn.Close()
+	select {
+	case received := <-p.finished:
+		if !bytes.Equal(received, data) {
+			t.Errorf("sent %d bytes, %d received", len(data), len(received))
+		}
+	case <-time.After(10 * time.Second):
+		t.Fatal("connection not closed")
+	}
+
+	// ... and receiving
+	conn, err = ns.Dial("tcp", "10.0.0.1:19")
+	if err != nil {
+		t.Fatal(err)
+	}
+	bs, err := ioutil.ReadAll(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(bs, bytes.Repeat([]byte("0123456789"), testChargenSize/10)) {
+		t.Errorf("received %d bytes, not the %d sent", len(bs), testChargenSize)
+	}
+	conn.Close()
+}
+
+func TestNetstackRetransmit(t *testing.T) {
+	// The SYN and the first data segment are lost once
+	var mut sync.Mutex
+	dropped := 0
+	ns, p := newTestNetstack(t, func(pkt []byte) bool {
+		ip := header.IPv4(pkt)
+		if ip.Protocol() != uint8(header.TCPProtocolNumber) {
+			return false
+		}
+		seg := header.TCP(ip.Payload())
+		mut.Lock()
+		defer mut.Unlock()
+		if (seg.Flags().Contains(header.TCPFlagSyn) || len(seg.Payload()) > 0) && dropped < 2 {
+			dropped++
+			return true
+		}
+		return false
+	})
+	defer ns.Close()
+	defer p.ns.Close()
+
+	conn, err := ns.Dial("tcp", "10.0.0.1:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("again"))
+	buf := make([]byte, 5)
+	conn.SetReadDeadline(time.Now().Add(10 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil {
+		t.Fatal(err)
+	}
+	mut.Lock()
+	defer mut.Unlock()
+	if string(buf) != "again" || dropped != 2 {
+		t.Errorf("unexpected echo %q after %d drops", buf, dropped)
+	}
+	conn.Close()
+}
+
+func TestNetstackRefused(t *testing.T) {
+	ns, p := newTestNetstack(t, nil)
+	defer ns.Close()
+	defer p.ns.Close()
+
+	_, err := ns.Dial("tcp", "10.0.0.1:1")
+	if err == nil || !strings.Contains(err.Error(), "refused") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestNetstackResolve(t *testing.T) {
+	ns, p := newTestNetstack(t, nil)
+	defer ns.Close()
+	defer p.ns.Close()
+
+	conn, err := ns.Dial("tcp", "vpnhost.example.:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if ra := conn.RemoteAddr().String(); ra != "10.0.0.1:7" {
+		t.Errorf("connected to %s", ra)
+	}
+	conn.Close()
+
+	if _, err := ns.Dial("tcp", "unknown.example.:7"); err == nil {
+		t.Error("unexpected success resolving unknown name")
+	}
+}
+
+func TestNetstackClose(t *testing.T) {
+	ns, p := newTestNetstack(t, nil)
+	defer p.ns.Close()
+
+	conn, err := ns.Dial("tcp", "10.0.0.1:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go func() {
+		time.Sleep(50 * time.Millisecond)
+		ns.Close()
+	}()
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err == nil {
+		t.Error("unexpected success reading on closed stack")
+	} else if ne, ok := err.(net.Error); ok && ne.Timeout() {
+		t.Error("connection not aborted on close")
+	}
+	if _, err := ns.Dial("tcp", "10.0.0.1:7"); err == nil {
+		t.Error("unexpected success dialing on closed stack")
+	}
+}
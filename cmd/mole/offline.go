@@ -0,0 +1,318 @@
+package main
+
+import (
+	"crypto/aes"
+	"crypto/cipher"
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net"
+	"net/url"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/scrypt"
+)
+
+// The offline cache keeps deobfuscated tunnel definitions, encrypted, for
+// use when the server cannot be reached. It is enabled in mole.ini:
+//
+//     [offline]
+//     cache = passphrase   ; or "ticket"
+//     maxage = 168h
+//
+// With "passphrase" the key is derived from $MOLE_OFFLINE_PASSPHRASE, or a
+// passphrase asked for when using the cache. Tunnels are only cached when
+// the passphrase is already known, so that online digs don't ask for it.
+//
+// With "ticket" the key is derived from the current ticket, and the cache is
+// encrypted again when the ticket is replaced. The ticket is stored in
+// mole.ini next to the cache, so this is obfuscation rather than encryption:
+// it protects a copy of the cache alone, not against anyone who can also
+// read mole.ini.
+
+const (
+	offlineVersion  = 1
+	offlineSaltSize = 16
+
+	defaultOfflineMaxAge = 7 * 24 * time.Hour
+)
+
+var errNotCached = errors.New("not available offline")
+
+// An offlineEntry is a cached tunnel definition, encrypted with AES-GCM
+// authenticating the tunnel name.
+type offlineEntry struct {
+	Version int    `json:"version"`
+	Cached  int64  `json:"cached"`
+	Salt    []byte `json:"salt"`
+	Data    []byte `json:"data"`
+}
+
+// The passphrase, once asked for
+var offlinePassphrase string
+
+func offlineDir() string {
+	return path.Join(homeDir, "offline")
+}
+
+func offlinePath(name string) string {
+	return path.Join(offlineDir(), name+".cache")
+}
+
+// offlineMode returns how the cache is keyed, or "" when it is disabled.
+func offlineMode() string {
+	switch mode := moleIni.Get("offline", "cache"); mode {
+	case "passphrase", "ticket":
+		return mode
+	case "", "no":
+		return ""
+	default:
+		warnf(msgErrOfflineMode, mode)
+		return ""
+	}
+}
+
+func offlineMaxAge() time.Duration {
+	s := moleIni.Get("offline", "maxage")
+	if s == "" {
+		return defaultOfflineMaxAge
+	}
+	d, err := time.ParseDuration(s)
+	if err != nil {
+		warnf(msgErrOfflineMaxAge, s, err)
+		return defaultOfflineMaxAge
+	}
+	return d
+}
+
+// offlineSecret returns the secret the cache key is derived from. The
+// passphrase is only asked for if prompt is set.
+func offlineSecret(prompt bool) (string, error) {
+	if offlineMode() == "ticket" {
+		tic := moleIni.Get("server", "ticket")
+		if tic == "" {
+			return "", errors.New("no ticket")
+		}
+		return tic, nil
+	}
+
+	if offlinePassphrase == "" {
+		offlinePassphrase = os.Getenv("MOLE_OFFLINE_PASSPHRASE")
+	}
+	if offlinePassphrase == "" && prompt {
+		offlinePassphrase = readpass(msgOfflinePassphrase)
+	}
+	if offlinePassphrase == "" {
+		return "", errors.New("no passphrase; set MOLE_OFFLINE_PASSPHRASE")
+	}
+	return offlinePassphrase, nil
+}
+
+func offlineAEAD(secret string, salt []byte) (cipher.AEAD, error) {
+	key, err := scrypt.Key([]byte(secret), salt, 1<<15, 8, 1, 32)
+	if err != nil {
+		return nil, err
+	}
+	c, err := aes.NewCipher(key)
+	if err != nil {
+		return nil, err
+	}
+	return cipher.NewGCM(c)
+}
+
+func sealOffline(secret, name, tun string, cached time.Time) (offlineEntry, error) {
+	e := offlineEntry{Version: offlineVersion, Cached: cached.Unix(), Salt: make([]byte, offlineSaltSize)}
+	if _, err := io.ReadFull(rand.Reader, e.Salt); err != nil {
+		return e, err
+	}
+	aead, err := offlineAEAD(secret, e.Salt)
+	if err != nil {
+		return e, err
+	}
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		return e, err
+	}
+	e.Data = aead.Seal(nonce, nonce, []byte(tun), []byte(name))
+	return e, nil
+}
+
+func openOffline(secret, name string, e offlineEntry) (string, error) {
+	if e.Version != offlineVersion {
+		return "", fmt.Errorf("unsupported version %d", e.Version)
+	}
+	aead, err := offlineAEAD(secret, e.Salt)
+	if err != nil {
+		return "", err
+	}
+	if len(e.Data) < aead.NonceSize() {
+		return "", errors.New("entry too short")
+	}
+	bs, err := aead.Open(nil, e.Data[:aead.NonceSize()], e.Data[aead.NonceSize():], []byte(name))
+	if err != nil {
+		return "", errors.New("incorrect passphrase or corrupt entry")
+	}
+	return string(bs), nil
+}
+
+func readOfflineEntry(name string) (offlineEntry, error) {
+	var e offlineEntry
+	bs, err := ioutil.ReadFile(offlinePath(name))
+	if err != nil {
+		return e, err
+	}
+	err = json.Unmarshal(bs, &e)
+	return e, err
+}
+
+func writeOfflineEntry(name string, e offlineEntry) error {
+	if err := os.MkdirAll(offlineDir(), 0700); err != nil {
+		return err
+	}
+	bs, err := json.Marshal(e)
+	if err != nil {
+		return err
+	}
+	tmp := offlinePath(name) + ".tmp"
+	if err := ioutil.WriteFile(tmp, bs, 0600); err != nil {
+		return err
+	}
+	return os.Rename(tmp, offlinePath(name))
+}
+
+// cacheTunnel saves the deobfuscated tunnel definition in the offline
+// cache, if enabled and the passphrase is known without asking. Failure,
+// including an unknown passphrase, only warns; the tunnel can be used
+// regardless.
+func cacheTunnel(name, tun string) {
+	if offlineMode() == "" || offlineMaxAge() <= 0 {
+		return
+	}
+	secret, err := offlineSecret(false)
+	if err != nil {
+		warnf(msgOfflineNotCached, name, err)
+		return
+	}
+	e, err := sealOffline(secret, name, tun, time.Now())
+	if err == nil {
+		err = writeOfflineEntry(name, e)
+	}
+	if err != nil {
+		warnf(msgErrOfflineCache, name, err)
+		return
+	}
+	debugln("cached", name, "for offline use")
+}
+
+// cachedTunnel returns the tunnel definition from the offline cache and
+// when it was cached. Expired entries are removed.
+func cachedTunnel(name string) (string, time.Time, error) {
+	if offlineMode() == "" {
+		return "", time.Time{}, errNotCached
+	}
+	e, err := readOfflineEntry(name)
+	if os.IsNotExist(err) {
+		return "", time.Time{}, errNotCached
+	} else if err != nil {
+		return "", time.Time{}, err
+	}
+	cached := time.Unix(e.Cached, 0)
+	if time.Since(cached) > offlineMaxAge() {
+		os.Remove(offlinePath(name))
+		return "", time.Time{}, errNotCached
+	}
+
+	secret, err := offlineSecret(true)
+	if err != nil {
+		return "", time.Time{}, err
+	}
+	tun, err := openOffline(secret, name, e)
+	return tun, cached, err
+}
+
+// offlineTunnels returns the tunnels available offline and when they were
+// cached.
+func offlineTunnels() map[string]time.Time {
+	res := make(map[string]time.Time)
+	if offlineMode() == "" {
+		return res
+	}
+	files, _ := filepath.Glob(path.Join(offlineDir(), "*.cache"))
+	maxAge := offlineMaxAge()
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".cache")
+		e, err := readOfflineEntry(name)
+		if err != nil {
+			continue
+		}
+		if cached := time.Unix(e.Cached, 0); time.Since(cached) <= maxAge {
+			res[name] = cached
+		}
+	}
+	return res
+}
+
+// rekeyOfflineCache encrypts the cache again when the ticket it is keyed by
+// is replaced. Entries that cannot be read are removed.
+func rekeyOfflineCache(oldTicket, newTicket string) {
+	if offlineMode() != "ticket" || oldTicket == newTicket {
+		return
+	}
+	files, _ := filepath.Glob(path.Join(offlineDir(), "*.cache"))
+	for _, file := range files {
+		name := strings.TrimSuffix(path.Base(file), ".cache")
+		e, err := readOfflineEntry(name)
+		if err == nil {
+			var tun string
+			tun, err = openOffline(oldTicket, name, e)
+			if err == nil {
+				e, err = sealOffline(newTicket, name, tun, time.Unix(e.Cached, 0))
+			}
+			if err == nil {
+				err = writeOfflineEntry(name, e)
+			}
+		}
+		if err != nil {
+			debugln("offline cache:", name, err)
+			os.Remove(file)
+		}
+	}
+}
+
+// clearOfflineCache removes all cached tunnel definitions.
+func clearOfflineCache() {
+	files, _ := filepath.Glob(path.Join(offlineDir(), "*.cache"))
+	for _, file := range files {
+		os.Remove(file)
+	}
+}
+
+// serverUnreachable returns true if the error is from failing to reach the
+// server, as opposed to the server refusing the request.
+func serverUnreachable(err error) bool {
+	if ue, ok := err.(*url.Error); ok {
+		err = ue.Err
+	}
+	_, ok := err.(net.Error)
+	return ok
+}
+
+// fmtAge formats the time since t coarsely, for display.
+func fmtAge(t time.Time) string {
+	d := time.Since(t)
+	switch {
+	case d < time.Hour:
+		return fmt.Sprintf("%dm", int(d.Minutes()))
+	case d < 48*time.Hour:
+		return fmt.Sprintf("%dh", int(d.Hours()))
+	default:
+		return fmt.Sprintf("%dd", int(d.Hours()/24))
+	}
+}
@@ -0,0 +1,112 @@
+package main
+
+import (
+	"errors"
+	"net"
+	"net/url"
+	"os"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/ini"
+)
+
+func TestOfflineCache(t *testing.T) {
+	defer withTestHomeDir(t)()
+	oldIni, oldPass := moleIni, offlinePassphrase
+	defer func() { moleIni, offlinePassphrase = oldIni, oldPass }()
+	moleIni = ini.Config{}
+
+	// Nothing is cached unless enabled
+	cacheTunnel("test", "secret tunnel")
+	if _, err := os.Stat(offlinePath("test")); !os.IsNotExist(err) {
+		t.Fatal("cached while disabled")
+	}
+
+	// ... nor without a passphrase, which isn't asked for
+	moleIni.Set("offline", "cache", "passphrase")
+	os.Unsetenv("MOLE_OFFLINE_PASSPHRASE")
+	offlinePassphrase = ""
+	cacheTunnel("test", "secret tunnel")
+	if _, err := os.Stat(offlinePath("test")); !os.IsNotExist(err) {
+		t.Fatal("cached without passphrase")
+	}
+
+	offlinePassphrase = "correct horse"
+	cacheTunnel("test", "secret tunnel")
+	tun, _, err := cachedTunnel("test")
+	if err != nil || tun != "secret tunnel" {
+		t.Fatalf("unexpected cached tunnel %q, %v", tun, err)
+	}
+	if _, ok := offlineTunnels()["test"]; !ok {
+		t.Error("test not listed as available offline")
+	}
+
+	// An entry is bound to its name
+	if err := os.Rename(offlinePath("test"), offlinePath("other")); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cachedTunnel("other"); err == nil {
+		t.Error("renamed entry accepted")
+	}
+
+	offlinePassphrase = "battery staple"
+	cacheTunnel("test", "secret tunnel")
+	offlinePassphrase = "correct horse"
+	if _, _, err := cachedTunnel("test"); err == nil {
+		t.Error("incorrect passphrase accepted")
+	}
+
+	// Expired entries are removed
+	moleIni.Set("offline", "maxage", "1h")
+	e, err := sealOffline("correct horse", "test", "secret tunnel", time.Now().Add(-2*time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := writeOfflineEntry("test", e); err != nil {
+		t.Fatal(err)
+	}
+	if _, _, err := cachedTunnel("test"); err != errNotCached {
+		t.Errorf("expired entry not refused; %v", err)
+	}
+	if _, err := os.Stat(offlinePath("test")); !os.IsNotExist(err) {
+		t.Error("expired entry not removed")
+	}
+}
+
+func TestOfflineCacheTicket(t *testing.T) {
+	defer withTestHomeDir(t)()
+	oldIni := moleIni
+	defer func() { moleIni = oldIni }()
+	moleIni = ini.Config{}
+	moleIni.Set("offline", "cache", "ticket")
+	moleIni.Set("server", "ticket", "first")
+
+	cacheTunnel("test", "secret tunnel")
+
+	// A new ticket keeps the cache readable
+	rekeyOfflineCache("first", "second")
+	moleIni.Set("server", "ticket", "second")
+	if tun, _, err := cachedTunnel("test"); err != nil || tun != "secret tunnel" {
+		t.Fatalf("unexpected cached tunnel %q, %v", tun, err)
+	}
+
+	// Unreadable entries are dropped
+	rekeyOfflineCache("wrong", "third")
+	if len(offlineTunnels()) != 0 {
+		t.Error("unreadable entry kept")
+	}
+}
+
+func TestServerUnreachable(t *testing.T) {
+	dial := &url.Error{Op: "Get", URL: "http://mole", Err: &net.OpError{Op: "dial", Err: errors.New("connection refused")}}
+	if !serverUnreachable(dial) {
+		t.Error("dial error not unreachable")
+	}
+	if serverUnreachable(errAccessDenied) {
+		t.Error("access denied is unreachable")
+	}
+	if serverUnreachable(&url.Error{Op: "Get", URL: "http://mole", Err: errors.New("server fingerprint mismatch")}) {
+		t.Error("fingerprint mismatch is unreachable")
+	}
+}
@@ -0,0 +1,269 @@
+// +build darwin linux
+
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+
+	"github.com/calmh/mole/conf"
+	"github.com/kardianos/osext"
+)
+
+// With --script-tun, openconnect passes the VPN traffic to its script on a
+// socket instead of a tun device. mole is the script: it hands the socket
+// back to the dig process, which runs a netstack on it.
+
+const userspaceConnectTimeout = 60 * time.Second
+
+func init() {
+	// Undocumented; run by openconnect as its --script-tun script.
+	addCommand(command{name: "userspace-tun-helper", fn: userspaceTunHelperCommand})
+}
+
+// tunInfo is the VPN configuration given by openconnect to its script,
+// handed to the dig process with the socket.
+type tunInfo struct {
+	Address string
+	MTU     int
+	DNS     []string
+}
+
+type OpenConnectUserspace struct {
+	cmd    *exec.Cmd
+	done   chan struct{}
+	helper *net.UnixConn
+	stack  *netstack
+}
+
+func (p OpenConnectProvider) StartUserspace(cfg *conf.Config) (UserspaceVPN, error) {
+	self, err := osext.Executable()
+	if err != nil {
+		return nil, err
+	}
+
+	// The script connects back to hand over the socket. Only we can enter
+	// the directory, so no one else can connect first.
+	dir, err := ioutil.TempDir("", "mole-tun.")
+	if err != nil {
+		return nil, err
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "tun.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		return nil, err
+	}
+	defer l.Close()
+
+	script := []string{shellQuote(self)}
+	if debugEnabled {
+		script = append(script, "-d")
+	}
+	script = append(script, "userspace-tun-helper", shellQuote(sock))
+
+	args := append([]string{"--script-tun", "--script", strings.Join(script, " ")}, openconnectArgs(cfg)...)
+	cmd := exec.Command(p.openconnectBinary, args...)
+	cmd.Stdin = strings.NewReader(cfg.OpenConnect["password"] + "\n")
+	var outbuf bytes.Buffer
+	cmd.Stdout = &outbuf
+	cmd.Stderr = &outbuf
+	if debugEnabled {
+		cmd.Stdout = os.Stdout
+		cmd.Stderr = os.Stderr
+	}
+
+	err = cmd.Start()
+	if err != nil {
+		return nil, err
+	}
+	debugf(msgOpncStart, cmd.Process.Pid)
+	journalProcessStarted(cmd)
+	debugln(msgOpncWait)
+
+	v := &OpenConnectUserspace{cmd: cmd, done: make(chan struct{})}
+	go func() {
+		cmd.Wait()
+		journalProcessStopped(cmd)
+		close(v.done)
+	}()
+
+	// The script is run once the VPN is up
+	info, link, helper, err := acceptTun(l, v.done, userspaceConnectTimeout)
+	if err == errTunExited {
+		msg := strings.Replace(strings.TrimSpace(outbuf.String()), "\n", "; ", -1)
+		return nil, fmt.Errorf("openconnect: %s", msg)
+	} else if err != nil {
+		v.Stop()
+		return nil, fmt.Errorf("openconnect: %v", err)
+	}
+	v.helper = helper
+
+	addr := net.ParseIP(info.Address).To4()
+	if addr == nil {
+		v.Stop()
+		link.Close()
+		return nil, fmt.Errorf("openconnect: no IPv4 address for the VPN")
+	}
+	var dns []net.IP
+	for _, s := range info.DNS {
+		if ip := net.ParseIP(s).To4(); ip != nil {
+			dns = append(dns, ip)
+		}
+	}
+	v.stack, err = newNetstack(link, addr, info.MTU, dns)
+	if err != nil {
+		v.Stop()
+		link.Close()
+		return nil, fmt.Errorf("openconnect: %v", err)
+	}
+
+	debugln(msgOpncConnected)
+	return v, nil
+}
+
+func (v *OpenConnectUserspace) Dial(network, addr string) (net.Conn, error) {
+	return v.stack.Dial(network, addr)
+}
+
+func (v *OpenConnectUserspace) Stop() {
+	if v.stack != nil {
+		v.stack.Close()
+	}
+	if v.helper != nil {
+		v.helper.Close()
+	}
+
+	debugf(msgOpncStopping, v.cmd.Process.Pid)
+	err := v.cmd.Process.Signal(os.Interrupt)
+	if err != nil {
+		warnln(err)
+	}
+	<-v.done
+	debugln(msgOpncStopped)
+}
+
+var errTunExited = errors.New("exited before connecting")
+
+// acceptTun waits for the script to connect and hand over the socket, as
+// long as done isn't closed. It returns the connection to the script, which
+// exits once it is closed.
+func acceptTun(l *net.UnixListener, done <-chan struct{}, timeout time.Duration) (tunInfo, net.Conn, *net.UnixConn, error) {
+	deadline := time.Now().Add(timeout)
+	l.SetDeadline(deadline)
+
+	type result struct {
+		conn *net.UnixConn
+		err  error
+	}
+	accepted := make(chan result, 1)
+	go func() {
+		conn, err := l.AcceptUnix()
+		accepted <- result{conn, err}
+	}()
+
+	var res result
+	select {
+	case res = <-accepted:
+	case <-done:
+		return tunInfo{}, nil, nil, errTunExited
+	}
+	if res.err != nil {
+		return tunInfo{}, nil, nil, res.err
+	}
+
+	res.conn.SetReadDeadline(deadline)
+	info, link, err := receiveTun(res.conn)
+	res.conn.SetReadDeadline(time.Time{})
+	if err != nil {
+		res.conn.Close()
+		return tunInfo{}, nil, nil, err
+	}
+	return info, link, res.conn, nil
+}
+
+// receiveTun reads the socket and VPN configuration sent by sendTun.
+func receiveTun(conn *net.UnixConn) (tunInfo, net.Conn, error) {
+	var info tunInfo
+	buf := make([]byte, 4096)
+	oob := make([]byte, syscall.CmsgSpace(4))
+	n, oobn, _, _, err := conn.ReadMsgUnix(buf, oob)
+	if err != nil {
+		return info, nil, err
+	}
+
+	msgs, err := syscall.ParseSocketControlMessage(oob[:oobn])
+	if err != nil {
+		return info, nil, err
+	}
+	var fds []int
+	for i := range msgs {
+		rights, err := syscall.ParseUnixRights(&msgs[i])
+		if err == nil {
+			fds = append(fds, rights...)
+		}
+	}
+	if len(fds) != 1 {
+		for _, fd := range fds {
+			syscall.Close(fd)
+		}
+		return info, nil, fmt.Errorf("expected one socket, got %d", len(fds))
+	}
+
+	f := os.NewFile(uintptr(fds[0]), "vpnfd")
+	link, err := net.FileConn(f)
+	f.Close()
+	if err != nil {
+		return info, nil, err
+	}
+	if err := json.Unmarshal(buf[:n], &info); err != nil {
+		link.Close()
+		return info, nil, err
+	}
+	return info, link, nil
+}
+
+// sendTun hands the socket and VPN configuration over conn.
+func sendTun(conn *net.UnixConn, fd int, info tunInfo) error {
+	bs, err := json.Marshal(info)
+	if err != nil {
+		return err
+	}
+	_, _, err = conn.WriteMsgUnix(bs, syscall.UnixRights(fd), nil)
+	return err
+}
+
+func userspaceTunHelperCommand(args []string) {
+	if len(args) != 1 {
+		fatalln("usage: userspace-tun-helper <socket>")
+	}
+
+	fd, err := strconv.Atoi(os.Getenv("VPNFD"))
+	fatalErr(err)
+	mtu, _ := strconv.Atoi(os.Getenv("INTERNAL_IP4_MTU"))
+	info := tunInfo{
+		Address: os.Getenv("INTERNAL_IP4_ADDRESS"),
+		MTU:     mtu,
+		DNS:     strings.Fields(os.Getenv("INTERNAL_IP4_DNS")),
+	}
+	debugf("userspace-tun-helper: %+v", info)
+
+	conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: args[0], Net: "unix"})
+	fatalErr(err)
+	fatalErr(sendTun(conn, fd, info))
+
+	// openconnect expects the script to keep running; it does so until the
+	// dig process is done with the VPN.
+	ioutil.ReadAll(conn)
+}
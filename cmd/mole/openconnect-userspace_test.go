@@ -0,0 +1,120 @@
+// +build darwin linux
+
+package main
+
+import (
+	"io"
+	"io/ioutil"
+	"net"
+	"os"
+	"path/filepath"
+	"reflect"
+	"syscall"
+	"testing"
+	"time"
+)
+
+func TestUserspaceTunHandover(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-tun-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	sock := filepath.Join(dir, "tun.sock")
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: sock, Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	// As openconnect does, with VPNFD for the script
+	fds, err := syscall.Socketpair(syscall.AF_UNIX, syscall.SOCK_DGRAM, 0)
+	if err != nil {
+		t.Fatal(err)
+	}
+	vpnFile := os.NewFile(uintptr(fds[0]), "vpn")
+	peerLink, err := net.FileConn(vpnFile)
+	vpnFile.Close()
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peerLink.Close()
+	p := startTestPeer(t, peerLink)
+	defer p.ns.Close()
+
+	sent := tunInfo{Address: testStackAddr.String(), MTU: 1400, DNS: []string{testPeerAddr.String()}}
+	helperDone := make(chan struct{})
+	go func() {
+		defer close(helperDone)
+		conn, err := net.DialUnix("unix", nil, &net.UnixAddr{Name: sock, Net: "unix"})
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		err = sendTun(conn, fds[1], sent)
+		syscall.Close(fds[1])
+		if err != nil {
+			t.Error(err)
+			return
+		}
+		io.Copy(ioutil.Discard, conn)
+	}()
+
+	info, link, helper, err := acceptTun(l, make(chan struct{}), 5*time.Second)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(info, sent) {
+		t.Errorf("received %+v, not %+v", info, sent)
+	}
+
+	// Connections through the stack on the socket reach the peer
+	ns, err := newNetstack(link, net.ParseIP(info.Address), info.MTU, []net.IP{net.ParseIP(info.DNS[0])})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer ns.Close()
+	conn, err := ns.Dial("tcp", "vpnhost.example.:7")
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Write([]byte("through the socket"))
+	buf := make([]byte, 18)
+	conn.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := io.ReadFull(conn, buf); err != nil || string(buf) != "through the socket" {
+		t.Errorf("unexpected echo %q, %v", buf, err)
+	}
+	conn.Close()
+
+	// The script keeps running until we're done
+	select {
+	case <-helperDone:
+		t.Fatal("helper exited early")
+	default:
+	}
+	helper.Close()
+	select {
+	case <-helperDone:
+	case <-time.After(5 * time.Second):
+		t.Error("helper not done")
+	}
+}
+
+func TestUserspaceTunExited(t *testing.T) {
+	dir, err := ioutil.TempDir("", "mole-tun-test.")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	l, err := net.ListenUnix("unix", &net.UnixAddr{Name: filepath.Join(dir, "tun.sock"), Net: "unix"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+
+	done := make(chan struct{})
+	close(done)
+	if _, _, _, err := acceptTun(l, done, 5*time.Second); err != errTunExited {
+		t.Errorf("unexpected error %v", err)
+	}
+}
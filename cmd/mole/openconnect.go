@@ -45,20 +45,7 @@ func (p OpenConnectProvider) Start(cfg *conf.Config) (VPN, error) {
 
 	script := writeVpncScript(cfg)
 
-	args := []string{"--non-inter", "--passwd-on-stdin", "--script", script}
-	for k, v := range cfg.OpenConnect {
-		if k == "password" {
-			continue
-		} else if k == "server" {
-			args = append(args, v)
-		} else if v == "yes" {
-			args = append(args, "--"+k)
-		} else {
-			args = append(args, "--"+k+"="+v)
-		}
-
-	}
-
+	args := append([]string{"--script", script}, openconnectArgs(cfg)...)
 	cmd := exec.Command(p.openconnectBinary, args...)
 
 	stdin, err := cmd.StdinPipe()
@@ -80,6 +67,7 @@ func (p OpenConnectProvider) Start(cfg *conf.Config) (VPN, error) {
 		return nil, err
 	}
 	debugf(msgOpncStart, cmd.Process.Pid)
+	journalProcessStarted(cmd)
 	debugln(msgOpncWait)
 
 	_, err = stdin.Write([]byte(cfg.OpenConnect["password"] + "\n"))
@@ -108,12 +96,32 @@ func (p OpenConnectProvider) Start(cfg *conf.Config) (VPN, error) {
 	}
 }
 
+// openconnectArgs returns the command line arguments corresponding to the
+// openconnect section. The password is given on stdin.
+func openconnectArgs(cfg *conf.Config) []string {
+	args := []string{"--non-inter", "--passwd-on-stdin"}
+	for k, v := range cfg.OpenConnect {
+		if k == "password" {
+			continue
+		} else if k == "server" {
+			args = append(args, v)
+		} else if v == "yes" {
+			args = append(args, "--"+k)
+		} else {
+			args = append(args, "--"+k+"="+v)
+		}
+	}
+	return args
+}
+
 func (v *OpenConnect) Stop() {
 	defer func() {
 		debugln("rm", v.script)
 		err := os.Remove(v.script)
 		if err != nil {
 			warnln(err)
+		} else {
+			journalFileRemoved(v.script)
 		}
 	}()
 
@@ -126,5 +134,6 @@ func (v *OpenConnect) Stop() {
 	if err != nil {
 		warnln(err)
 	}
+	journalProcessStopped(&v.cmd)
 	debugln(msgOpncStopped)
 }
@@ -0,0 +1,302 @@
+// +build darwin linux
+
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+
+	"github.com/calmh/mole/conf"
+)
+
+type OpenVPNProvider struct {
+	openvpnBinary string
+}
+
+func init() {
+	locations := []string{
+		"/usr/bin/openvpn",
+		"/usr/sbin/openvpn",
+		"/usr/local/bin/openvpn",
+		"/usr/local/sbin/openvpn",
+	}
+	for _, path := range locations {
+		if _, err := os.Stat(path); err == nil {
+			vpnProviders["openvpn"] = OpenVPNProvider{path}
+			return
+		}
+	}
+}
+
+// Directives in the openvpn section whose value is the contents of a file,
+// to be given inline in the profile.
+var openvpnInline = map[string]bool{
+	"ca":          true,
+	"cert":        true,
+	"extra-certs": true,
+	"key":         true,
+	"secret":      true,
+	"tls-auth":    true,
+	"tls-crypt":   true,
+}
+
+type OpenVPN struct {
+	cmd    *exec.Cmd
+	done   chan struct{} // closed when the process has exited
+	err    error         // exit status, valid once done is closed
+	mgmt   net.Conn
+	dir    string
+	script string
+}
+
+func (p OpenVPNProvider) Start(cfg *conf.Config) (VPN, error) {
+	requireRoot("openvpn")
+
+	if ok := ensureTunModule(); !ok {
+		return nil, fmt.Errorf(msgErrNoTunModule)
+	}
+
+	var script string
+	if len(cfg.VpnRoutes) > 0 {
+		script = writeVpncScript(cfg)
+	}
+
+	return p.start(cfg, script)
+}
+
+func (p OpenVPNProvider) start(cfg *conf.Config, script string) (VPN, error) {
+	dir, err := ioutil.TempDir("", "mole-openvpn.")
+	if err != nil {
+		return nil, err
+	}
+	journalFileCreated(dir)
+	v := &OpenVPN{dir: dir, script: script}
+
+	profile := filepath.Join(dir, "profile.ovpn")
+	err = ioutil.WriteFile(profile, []byte(openvpnProfile(cfg.OpenVPN)), 0600)
+	if err != nil {
+		v.cleanup()
+		return nil, err
+	}
+
+	sock := filepath.Join(dir, "management")
+	args := []string{"--config", profile, "--management", sock, "unix", "--management-hold"}
+	if _, ok := cfg.OpenVPN["username"]; ok {
+		args = append(args, "--management-query-passwords")
+	}
+	if script != "" {
+		// Routes are set up by the vpnc script according to the vpn routes
+		// section, instead of whatever the server pushes.
+		args = append(args, "--script-security", "2", "--route-noexec", "--up", script, "--down", script)
+	}
+
+	v.cmd = exec.Command(p.openvpnBinary, args...)
+	var outbuf bytes.Buffer
+	v.cmd.Stdout = &outbuf
+	if debugEnabled {
+		v.cmd.Stdout = os.Stdout
+	}
+
+	err = v.cmd.Start()
+	if err != nil {
+		v.cleanup()
+		return nil, err
+	}
+	debugf(msgOvpnStart, v.cmd.Process.Pid)
+	journalProcessStarted(v.cmd)
+
+	v.done = make(chan struct{})
+	go func() {
+		v.err = v.cmd.Wait()
+		journalProcessStopped(v.cmd)
+		close(v.done)
+	}()
+
+	v.mgmt, err = openvpnManagement(sock, v.done)
+	if err != nil {
+		_ = v.cmd.Process.Kill()
+		<-v.done
+		v.cleanup()
+		return nil, openvpnError(err, outbuf.String())
+	}
+
+	debugln(msgOvpnWait)
+	err = v.await(cfg.OpenVPN["username"], cfg.OpenVPN["password"])
+	if err != nil {
+		v.Stop()
+		return nil, openvpnError(err, outbuf.String())
+	}
+
+	debugln(msgOvpnConnected)
+	return v, nil
+}
+
+// openvpnProfile returns the contents of an openvpn configuration file
+// with the directives from the openvpn section.
+func openvpnProfile(options map[string]string) string {
+	var keys []string
+	for k := range options {
+		if k != "username" && k != "password" {
+			keys = append(keys, k)
+		}
+	}
+	sort.Strings(keys)
+
+	var b bytes.Buffer
+	for _, k := range keys {
+		v := options[k]
+		if openvpnInline[k] {
+			fmt.Fprintf(&b, "<%s>\n%s\n</%s>\n", k, strings.TrimSpace(v), k)
+		} else if v == "yes" {
+			fmt.Fprintln(&b, k)
+		} else {
+			fmt.Fprintln(&b, k, v)
+		}
+	}
+	if _, ok := options["username"]; ok {
+		// Credentials are given over the management interface
+		fmt.Fprintln(&b, "auth-user-pass")
+	}
+	return b.String()
+}
+
+// openvpnManagement connects to the management socket, once openvpn has
+// created it.
+func openvpnManagement(sock string, done <-chan struct{}) (net.Conn, error) {
+	timeout := time.After(10 * time.Second)
+	for {
+		conn, err := net.Dial("unix", sock)
+		if err == nil {
+			return conn, nil
+		}
+
+		select {
+		case <-done:
+			return nil, fmt.Errorf("exited before accepting management connections")
+		case <-timeout:
+			return nil, err
+		case <-time.After(100 * time.Millisecond):
+		}
+	}
+}
+
+// await releases the management hold and answers the management interface
+// until the connection is up or has failed.
+func (v *OpenVPN) await(user, pass string) error {
+	err := v.command("state on", "hold release")
+	if err != nil {
+		return err
+	}
+
+	br := bufio.NewReader(v.mgmt)
+	for {
+		bs, _, err := br.ReadLine()
+		if err != nil {
+			return err
+		}
+		line := strings.TrimSpace(string(bs))
+		debugln("ovpn:", line)
+
+		switch {
+		case strings.HasPrefix(line, ">STATE:"):
+			// >STATE:1472154474,CONNECTED,SUCCESS,10.8.0.6,192.0.2.1,...
+			fields := strings.Split(line[7:], ",")
+			if len(fields) > 1 && fields[1] == "CONNECTED" {
+				return nil
+			}
+		case strings.HasPrefix(line, ">PASSWORD:Need 'Auth'"):
+			err := v.command(`username "Auth" `+openvpnQuote(user), `password "Auth" `+openvpnQuote(pass))
+			if err != nil {
+				return err
+			}
+		case strings.HasPrefix(line, ">PASSWORD:Verification Failed"):
+			return fmt.Errorf("authentication failed")
+		case strings.HasPrefix(line, ">FATAL:"):
+			return fmt.Errorf("%s", line[7:])
+		}
+	}
+}
+
+func (v *OpenVPN) command(cmds ...string) error {
+	for _, cmd := range cmds {
+		_, err := v.mgmt.Write([]byte(cmd + "\n"))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func (v *OpenVPN) Stop() {
+	defer v.cleanup()
+
+	debugf(msgOvpnStopping, v.cmd.Process.Pid)
+	err := v.command("signal SIGTERM")
+	if err != nil {
+		warnln(err)
+		err = v.cmd.Process.Signal(os.Interrupt)
+		if err != nil {
+			warnln(err)
+		}
+	}
+
+	select {
+	case <-v.done:
+		if v.err != nil {
+			warnln(v.err)
+		}
+	case <-time.After(10 * time.Second):
+		warnln("openvpn: not stopping; killing")
+		_ = v.cmd.Process.Kill()
+		<-v.done
+	}
+	debugln(msgOvpnStopped)
+}
+
+func (v *OpenVPN) cleanup() {
+	if v.mgmt != nil {
+		_ = v.mgmt.Close()
+	}
+	if v.script != "" {
+		debugln("rm", v.script)
+		err := os.Remove(v.script)
+		if err != nil {
+			warnln(err)
+		} else {
+			journalFileRemoved(v.script)
+		}
+	}
+	debugln("rm", v.dir)
+	err := os.RemoveAll(v.dir)
+	if err != nil {
+		warnln(err)
+	} else {
+		journalFileRemoved(v.dir)
+	}
+}
+
+func openvpnQuote(s string) string {
+	s = strings.Replace(s, `\`, `\\`, -1)
+	s = strings.Replace(s, `"`, `\"`, -1)
+	return `"` + s + `"`
+}
+
+func openvpnError(err error, output string) error {
+	spaces := regexp.MustCompile(`\s+`)
+	msg := strings.Replace(strings.TrimSpace(output), "\n", "; ", -1)
+	msg = spaces.ReplaceAllString(msg, " ")
+	if msg == "" {
+		return fmt.Errorf("openvpn: %v", err)
+	}
+	return fmt.Errorf("openvpn: %v: %s", err, msg)
+}
@@ -0,0 +1,132 @@
+// +build darwin linux
+
+package main
+
+import (
+	"bufio"
+	"fmt"
+	"io/ioutil"
+	"net"
+	"os"
+	"strings"
+	"testing"
+
+	"github.com/calmh/mole/conf"
+)
+
+func TestMain(m *testing.M) {
+	if os.Getenv("MOLE_OPENVPN_STUB") != "" {
+		os.Exit(openvpnStub(os.Args[1:]))
+	}
+	enableLogging()
+	os.Exit(m.Run())
+}
+
+// openvpnStub pretends to be openvpn, speaking just enough of the management
+// protocol to bring a connection up and down.
+func openvpnStub(args []string) int {
+	var sock, profile string
+	for i, arg := range args {
+		switch arg {
+		case "--management":
+			sock = args[i+1]
+		case "--config":
+			profile = args[i+1]
+		}
+	}
+
+	bs, err := ioutil.ReadFile(profile)
+	if err != nil || !strings.Contains(string(bs), "<ca>\nMIIB\n</ca>\n") {
+		fmt.Println("bad profile")
+		return 1
+	}
+
+	l, err := net.Listen("unix", sock)
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+	conn, err := l.Accept()
+	if err != nil {
+		fmt.Println(err)
+		return 1
+	}
+
+	fmt.Fprintln(conn, ">INFO:OpenVPN Management Interface Version 1 -- type 'help' for more info")
+	fmt.Fprintln(conn, ">HOLD:Waiting for hold release:0")
+
+	br := bufio.NewScanner(conn)
+	for br.Scan() {
+		line := br.Text()
+		switch {
+		case line == "state on":
+			fmt.Fprintln(conn, "SUCCESS: real-time state notification set to ON")
+		case line == "hold release":
+			fmt.Fprintln(conn, "SUCCESS: hold release succeeded")
+			fmt.Fprintln(conn, ">STATE:1472154474,CONNECTING,,,,,,")
+			fmt.Fprintln(conn, ">PASSWORD:Need 'Auth' username/password")
+		case strings.HasPrefix(line, "username "):
+			fmt.Fprintln(conn, "SUCCESS: 'Auth' username entered, but not yet verified")
+		case strings.HasPrefix(line, "password "):
+			fmt.Fprintln(conn, "SUCCESS: 'Auth' password entered, but not yet verified")
+			if line != `password "Auth" "s3cr\"t"` {
+				fmt.Fprintln(conn, ">PASSWORD:Verification Failed: 'Auth'")
+				continue
+			}
+			fmt.Fprintln(conn, ">STATE:1472154475,CONNECTED,SUCCESS,10.8.0.6,192.0.2.1,1194,,")
+		case line == "signal SIGTERM":
+			fmt.Fprintln(conn, "SUCCESS: signal SIGTERM thrown")
+			conn.Close()
+			return 0
+		}
+	}
+	return 1
+}
+
+func stubOpenVPNConfig(password string) *conf.Config {
+	return &conf.Config{
+		OpenVPN: map[string]string{
+			"remote":   "vpn.example.com 1194",
+			"client":   "yes",
+			"ca":       "MIIB",
+			"username": "jb",
+			"password": password,
+		},
+	}
+}
+
+func TestOpenVPNStub(t *testing.T) {
+	os.Setenv("MOLE_OPENVPN_STUB", "1")
+	defer os.Unsetenv("MOLE_OPENVPN_STUB")
+
+	p := OpenVPNProvider{os.Args[0]}
+	vpn, err := p.start(stubOpenVPNConfig(`s3cr"t`), "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	dir := vpn.(*OpenVPN).dir
+	vpn.Stop()
+	if _, err := os.Stat(dir); !os.IsNotExist(err) {
+		t.Errorf("temporary directory %s not removed", dir)
+	}
+}
+
+func TestOpenVPNStubAuthFailure(t *testing.T) {
+	os.Setenv("MOLE_OPENVPN_STUB", "1")
+	defer os.Unsetenv("MOLE_OPENVPN_STUB")
+
+	p := OpenVPNProvider{os.Args[0]}
+	_, err := p.start(stubOpenVPNConfig("wrong"), "")
+	if err == nil || !strings.Contains(err.Error(), "authentication failed") {
+		t.Errorf("unexpected error %v", err)
+	}
+}
+
+func TestOpenVPNProfile(t *testing.T) {
+	profile := openvpnProfile(stubOpenVPNConfig("secret").OpenVPN)
+	expected := "<ca>\nMIIB\n</ca>\nclient\nremote vpn.example.com 1194\nauth-user-pass\n"
+	if profile != expected {
+		t.Errorf("incorrect profile %q", profile)
+	}
+}
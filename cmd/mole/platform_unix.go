@@ -12,11 +12,22 @@ import (
 )
 
 func requireRoot(reason string) {
-	if syscall.Geteuid() != 0 {
+	if !hasRoot() {
 		fatalf(msgErrGainRoot, reason)
 	}
 }
 
+func hasRoot() bool {
+	return syscall.Geteuid() == 0
+}
+
+// processExists returns true if there is a process with the given PID,
+// whether or not it belongs to us.
+func processExists(pid int) bool {
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
+
 func getHomeDir() string {
 	home := os.Getenv("HOME")
 	if home == "" {
@@ -34,15 +45,16 @@ func setupHostsFile(tun string, cfg *conf.Config, qualify bool) {
 }
 
 func restoreHostsFile(tun string, qualify bool) {
-	var err error
+	tag := "mole"
 	if qualify {
-		err = hosts.ReplaceTagged("mole."+tun, nil)
-	} else {
-		err = hosts.ReplaceTagged("mole", nil)
+		tag = "mole." + tun
 	}
+	err := hosts.ReplaceTagged(hosts.DefaultPath, tag, nil)
 	if err != nil {
 		warnln(err)
+		return
 	}
+	journalHostsUntagged(tag)
 }
 
 func addToHostsFile(tag string, domain string, cfg *conf.Config) {
@@ -58,6 +70,15 @@ func addToHostsFile(tag string, domain string, cfg *conf.Config) {
 	}
 
 	requireRoot("update /etc/hosts")
-	err := hosts.ReplaceTagged(tag, entries)
+
+	// Clean up after any sessions that didn't get to do so themselves
+	n, err := hosts.RemoveStale(hosts.DefaultPath)
+	fatalErr(err)
+	if n > 0 {
+		debugf("removed %d stale hosts entries", n)
+	}
+
+	journalHostsTagged(tag)
+	err = hosts.ReplaceTagged(hosts.DefaultPath, tag, entries)
 	fatalErr(err)
 }
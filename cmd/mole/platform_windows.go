@@ -1,6 +1,7 @@
 package main
 
 import (
+	"os"
 	"os/user"
 
 	"github.com/calmh/mole/ansi"
@@ -13,6 +14,20 @@ func init() {
 
 func requireRoot(reason string) {}
 
+func hasRoot() bool {
+	return true
+}
+
+// processExists returns true if there is a process with the given PID.
+func processExists(pid int) bool {
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
+
 func getHomeDir() string {
 	user, err := user.Current()
 	fatalErr(err)
@@ -9,7 +9,7 @@ import (
 )
 
 func readpass(prompt string) string {
-	fmt.Printf(prompt)
+	fmt.Print(prompt)
 	bs, err := terminal.ReadPassword(int(os.Stdin.Fd()))
 	if err != nil {
 		return ""
@@ -8,7 +8,7 @@ import (
 
 func readpass(prompt string) string {
 	warnln(msgPasswordVisible)
-	fmt.Printf(prompt)
+	fmt.Print(prompt)
 	bf := bufio.NewReader(os.Stdin)
 	line, _, err := bf.ReadLine()
 	if err != nil {
@@ -11,11 +11,49 @@ import (
 )
 
 func sshOnConn(conn net.Conn, h conf.Host) (*ssh.Client, error) {
+	auths, err := sshAuthMethods(h, nil)
+	if err != nil {
+		return nil, err
+	}
+
+	config := &ssh.ClientConfig{
+		User: h.User,
+		Auth: auths,
+		// Tunnel definitions carry no host keys to verify against, and mole
+		// has always accepted any. The vendored x/crypto refuses to connect
+		// without a callback, so say so explicitly.
+		HostKeyCallback: ssh.InsecureIgnoreHostKey(),
+	}
+
+	debugln("handshake & authenticate")
+	cc, nc, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
+	if err != nil {
+		return nil, err
+	}
+	client := ssh.NewClient(cc, nc, reqs)
+	return client, nil
+}
+
+// sshAuthMethods returns the authentication methods to try for the host. If
+// tried is not nil it is called with the name of each method as the server
+// asks for it.
+func sshAuthMethods(h conf.Host, tried func(method string)) ([]ssh.AuthMethod, error) {
+	if tried == nil {
+		tried = func(string) {}
+	}
+
 	var auths []ssh.AuthMethod
 
 	if h.Pass != "" {
-		auths = append(auths, ssh.Password(h.Pass))
-		auths = append(auths, ssh.KeyboardInteractive(kbdInteractive(h.Pass)))
+		auths = append(auths, ssh.PasswordCallback(func() (string, error) {
+			tried("password")
+			return h.Pass, nil
+		}))
+		kbd := kbdInteractive(h.Pass)
+		auths = append(auths, ssh.KeyboardInteractive(func(user, instruction string, questions []string, echos []bool) ([]string, error) {
+			tried("keyboard-interactive")
+			return kbd(user, instruction, questions, echos)
+		}))
 	}
 
 	if h.Key != "" {
@@ -24,33 +62,29 @@ func sshOnConn(conn net.Conn, h conf.Host) (*ssh.Client, error) {
 		if err != nil {
 			return nil, err
 		}
+		var signers []ssh.Signer
 		for _, k := range k.keys {
 			s, _ := ssh.NewSignerFromKey(k)
-			auths = append(auths, ssh.PublicKeys(s))
+			signers = append(signers, s)
 		}
+		auths = append(auths, ssh.PublicKeysCallback(func() ([]ssh.Signer, error) {
+			tried("publickey")
+			return signers, nil
+		}))
 	}
 
-	config := &ssh.ClientConfig{
-		User: h.User,
-		Auth: auths,
-	}
-
-	debugln("handshake & authenticate")
-	cc, nc, reqs, err := ssh.NewClientConn(conn, conn.RemoteAddr().String(), config)
-	if err != nil {
-		return nil, err
-	}
-	client := ssh.NewClient(cc, nc, reqs)
-	return client, nil
+	return auths, nil
 }
 
-func sshHost(host string, cfg *conf.Config) (*ssh.Client, error) {
+// sshHost connects to the host, via any intermediate hosts. Connections to
+// the first host are made using the base dialer.
+func sshHost(host string, cfg *conf.Config, base Dialer) (*ssh.Client, error) {
 	h := cfg.Hosts[cfg.HostsMap[host]]
 	var conn net.Conn
 	var err error
 	if h.Via != "" {
 		debugln("via", h.Via)
-		dialer, err := sshHost(h.Via, cfg)
+		dialer, err := sshHost(h.Via, cfg, base)
 		if err != nil {
 			return nil, err
 		}
@@ -61,10 +95,10 @@ func sshHost(host string, cfg *conf.Config) (*ssh.Client, error) {
 			return nil, err
 		}
 	} else {
-		var dialer Dialer = proxy.Direct
+		var dialer Dialer = base
 		if h.SOCKS != "" {
 			debugln("socks via", h.SOCKS)
-			dialer, err = proxy.SOCKS5("tcp", h.SOCKS, nil, proxy.Direct)
+			dialer, err = proxy.SOCKS5("tcp", h.SOCKS, nil, base)
 			if err != nil {
 				return nil, err
 			}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"bytes"
+	"strings"
+
+	"github.com/calmh/mole/ansi"
+)
+
+// A diffLine is a line of a diff; removed ('-'), added ('+') or unchanged
+// (' ').
+type diffLine struct {
+	op   byte
+	text string
+}
+
+// diffLines returns the changes from a to b, by the longest common
+// subsequence of lines.
+func diffLines(a, b []string) []diffLine {
+	// lcs[i][j] is the length of the longest common subsequence of a[i:]
+	// and b[j:]
+	lcs := make([][]int, len(a)+1)
+	for i := range lcs {
+		lcs[i] = make([]int, len(b)+1)
+	}
+	for i := len(a) - 1; i >= 0; i-- {
+		for j := len(b) - 1; j >= 0; j-- {
+			if a[i] == b[j] {
+				lcs[i][j] = lcs[i+1][j+1] + 1
+			} else if lcs[i+1][j] >= lcs[i][j+1] {
+				lcs[i][j] = lcs[i+1][j]
+			} else {
+				lcs[i][j] = lcs[i][j+1]
+			}
+		}
+	}
+
+	var res []diffLine
+	i, j := 0, 0
+	for i < len(a) && j < len(b) {
+		switch {
+		case a[i] == b[j]:
+			res = append(res, diffLine{' ', a[i]})
+			i++
+			j++
+		case lcs[i+1][j] >= lcs[i][j+1]:
+			res = append(res, diffLine{'-', a[i]})
+			i++
+		default:
+			res = append(res, diffLine{'+', b[j]})
+			j++
+		}
+	}
+	for ; i < len(a); i++ {
+		res = append(res, diffLine{'-', a[i]})
+	}
+	for ; j < len(b); j++ {
+		res = append(res, diffLine{'+', b[j]})
+	}
+	return res
+}
+
+// fmtDiff formats the changes from a to b, with the given number of
+// unchanged lines around each change. It returns "" when there are none.
+func fmtDiff(a, b string, context int) string {
+	lines := diffLines(strings.Split(strings.TrimRight(a, "\n"), "\n"), strings.Split(strings.TrimRight(b, "\n"), "\n"))
+
+	// Unchanged lines are shown when within context of a change
+	show := make([]bool, len(lines))
+	for i, l := range lines {
+		if l.op == ' ' {
+			continue
+		}
+		for k := i - context; k <= i+context; k++ {
+			if k >= 0 && k < len(lines) {
+				show[k] = true
+			}
+		}
+	}
+
+	var buf bytes.Buffer
+	gap := false
+	for i, l := range lines {
+		if !show[i] {
+			gap = true
+			continue
+		}
+		if gap && buf.Len() > 0 {
+			buf.WriteString(ansi.Faint("...") + "\n")
+		}
+		gap = false
+		switch l.op {
+		case '-':
+			buf.WriteString(ansi.Red("-"+l.text) + "\n")
+		case '+':
+			buf.WriteString(ansi.Green("+"+l.text) + "\n")
+		default:
+			buf.WriteString(" " + l.text + "\n")
+		}
+	}
+	return buf.String()
+}
@@ -0,0 +1,22 @@
+package main
+
+import (
+	"testing"
+
+	"github.com/calmh/mole/ansi"
+)
+
+func TestFmtDiff(t *testing.T) {
+	ansi.Disable()
+
+	a := "[general]\ndescription = Test\nauthor = Test\nversion = 4.0\nmain = test\n\n[hosts.test]\naddr = 192.0.2.1\nuser = test\n"
+	b := "[general]\ndescription = Changed\nauthor = Test\nversion = 4.0\nmain = test\n\n[hosts.test]\naddr = 192.0.2.1\nuser = test\nport = 2222\n"
+
+	expected := " [general]\n-description = Test\n+description = Changed\n author = Test\n...\n user = test\n+port = 2222\n"
+	if d := fmtDiff(a, b, 1); d != expected {
+		t.Errorf("unexpected diff\n%s", d)
+	}
+	if d := fmtDiff(a, a, 3); d != "" {
+		t.Errorf("unexpected diff for equal texts\n%s", d)
+	}
+}
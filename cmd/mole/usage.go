@@ -82,6 +82,7 @@ func mainUsage(w io.Writer) {
 		{"  mole show foo", "# show the hosts and forwards in the tunnel \"foo\""},
 		{"  sudo mole dig foo", "# dig the tunnel \"foo\""},
 		{"  sudo mole -d d foo", "# dig the tunnel \"foo\", while showing debug output"},
+		{"  mole dig -u foo", "# dig the tunnel \"foo\" without root, using a userspace VPN"},
 		{"  mole push foo.ini", "# create or update the \"foo\" tunnel from a local file"},
 		{"  mole install", "# list packages available for installation"},
 		{"  mole ins vpnc", "# install a package named vpnc"},
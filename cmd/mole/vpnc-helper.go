@@ -0,0 +1,309 @@
+// +build darwin linux
+
+package main
+
+import (
+	"flag"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"strconv"
+	"strings"
+)
+
+func init() {
+	// Undocumented; called by vpnc, openconnect and openvpn via the script
+	// written by writeVpncScript.
+	addCommand(command{name: "vpnc-script-helper", fn: vpncScriptHelperCommand})
+}
+
+// A vpncSystem makes the changes to the network configuration that a vpnc
+// script is expected to do.
+type vpncSystem interface {
+	LinkUp(dev string, mtu int) error
+	AddAddress(dev string, addr *net.IPNet) error
+	AddRoute(dst *net.IPNet, gw net.IP, dev string) error
+	DelRoute(dst *net.IPNet, gw net.IP, dev string) error
+	RouteTo(ip net.IP) (gw net.IP, dev string, err error)
+	SetDNS(dev string, servers []net.IP, domains []string) error
+	RevertDNS(dev string, domains []string) error
+}
+
+// vpncConfig is the network configuration handed to the vpnc script by the
+// VPN client, combined with the routes from the tunnel configuration.
+type vpncConfig struct {
+	reason  string
+	dev     string
+	mtu     int
+	gateway net.IP
+	addrs   []*net.IPNet
+	routes  []*net.IPNet
+	dns     []net.IP
+	domains []string
+
+	// The interface has already been configured by the VPN client (as
+	// opposed to vpnc and openconnect that leave that to the script).
+	configured bool
+}
+
+type stringList []string
+
+func (l *stringList) String() string {
+	return strings.Join(*l, ",")
+}
+
+func (l *stringList) Set(s string) error {
+	*l = append(*l, s)
+	return nil
+}
+
+func vpncScriptHelperCommand(args []string) {
+	fs := flag.NewFlagSet("vpnc-script-helper", flag.ExitOnError)
+	var routes stringList
+	fs.Var(&routes, "route", "Route to set up through the VPN (repeatable)")
+	fs.Parse(args)
+	// Any further arguments are passed by openvpn and can be ignored.
+
+	env := make(map[string]string)
+	for _, kv := range os.Environ() {
+		if ps := strings.SplitN(kv, "=", 2); len(ps) == 2 {
+			env[ps[0]] = ps[1]
+		}
+	}
+
+	cfg, err := parseVpncEnv(env, routes)
+	fatalErr(err)
+	debugf("vpnc-script-helper: %s %+v", cfg.reason, cfg)
+
+	sys := newVpncSystem()
+	switch cfg.reason {
+	case "connect":
+		err = cfg.connect(sys)
+		fatalErr(err)
+		// The VPN providers wait for this to know we're ready
+		fmt.Println("mole-vpnc-script-next")
+	case "disconnect":
+		err = cfg.disconnect(sys)
+		fatalErr(err)
+	}
+}
+
+// parseVpncEnv interprets the environment set by vpnc, openconnect or
+// openvpn. The given routes replace any split routes pushed by the server.
+func parseVpncEnv(env map[string]string, routes []string) (vpncConfig, error) {
+	if env["script_type"] != "" {
+		env = translateOpenvpnEnv(env)
+	}
+
+	cfg := vpncConfig{
+		reason:     env["reason"],
+		dev:        env["TUNDEV"],
+		gateway:    net.ParseIP(env["VPNGATEWAY"]),
+		configured: env["MOLE_CONFIGURED"] == "yes",
+	}
+	cfg.mtu, _ = strconv.Atoi(env["INTERNAL_IP4_MTU"])
+
+	if ip := net.ParseIP(env["INTERNAL_IP4_ADDRESS"]); ip != nil {
+		bits, _ := strconv.Atoi(env["INTERNAL_IP4_NETMASKLEN"])
+		if mask := net.ParseIP(env["INTERNAL_IP4_NETMASK"]); bits == 0 && mask != nil {
+			bits, _ = net.IPMask(mask.To4()).Size()
+		}
+		if bits == 0 {
+			bits = 32
+		}
+		cfg.addrs = append(cfg.addrs, &net.IPNet{IP: ip.To4(), Mask: net.CIDRMask(bits, 32)})
+	}
+	if addr := env["INTERNAL_IP6_NETMASK"]; addr != "" {
+		ip, ipnet, err := net.ParseCIDR(addr)
+		if err != nil {
+			return cfg, err
+		}
+		cfg.addrs = append(cfg.addrs, &net.IPNet{IP: ip, Mask: ipnet.Mask})
+	} else if ip := net.ParseIP(env["INTERNAL_IP6_ADDRESS"]); ip != nil {
+		cfg.addrs = append(cfg.addrs, &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)})
+	}
+
+	if len(routes) > 0 {
+		for _, r := range routes {
+			_, ipnet, err := net.ParseCIDR(r)
+			if err != nil {
+				return cfg, err
+			}
+			cfg.routes = append(cfg.routes, ipnet)
+		}
+	} else {
+		for _, prefix := range []string{"CISCO_SPLIT_INC", "CISCO_IPV6_SPLIT_INC"} {
+			n, _ := strconv.Atoi(env[prefix])
+			for i := 0; i < n; i++ {
+				addr := env[fmt.Sprintf("%s_%d_ADDR", prefix, i)]
+				bits := env[fmt.Sprintf("%s_%d_MASKLEN", prefix, i)]
+				_, ipnet, err := net.ParseCIDR(addr + "/" + bits)
+				if err != nil {
+					return cfg, err
+				}
+				cfg.routes = append(cfg.routes, ipnet)
+			}
+		}
+	}
+
+	if len(cfg.routes) == 0 {
+		// No split routes; send everything through the VPN, without
+		// replacing the current default route.
+		for _, addr := range cfg.addrs {
+			if addr.IP.To4() != nil {
+				cfg.routes = append(cfg.routes, mustParseCIDR("0.0.0.0/1"), mustParseCIDR("128.0.0.0/1"))
+			} else {
+				cfg.routes = append(cfg.routes, mustParseCIDR("::/1"), mustParseCIDR("8000::/1"))
+			}
+		}
+	}
+
+	for _, s := range strings.Fields(env["INTERNAL_IP4_DNS"] + " " + env["INTERNAL_IP6_DNS"]) {
+		if ip := net.ParseIP(s); ip != nil {
+			cfg.dns = append(cfg.dns, ip)
+		}
+	}
+
+	// Domains from the tunnel configuration are handled by the split DNS
+	// stub, not here.
+	cfg.domains = strings.FieldsFunc(env["CISCO_SPLIT_DNS"], func(r rune) bool { return r == ',' || r == ' ' })
+	if def := env["CISCO_DEF_DOMAIN"]; def != "" {
+		cfg.domains = append(cfg.domains, def)
+	}
+
+	return cfg, nil
+}
+
+// translateOpenvpnEnv converts the environment openvpn gives its up and down
+// scripts into the vpnc equivalent.
+func translateOpenvpnEnv(env map[string]string) map[string]string {
+	res := map[string]string{
+		"TUNDEV":               env["dev"],
+		"INTERNAL_IP4_ADDRESS": env["ifconfig_local"],
+		"INTERNAL_IP4_NETMASK": env["ifconfig_netmask"],
+		"INTERNAL_IP4_MTU":     env["tun_mtu"],
+		"VPNGATEWAY":           env["trusted_ip"],
+		"MOLE_CONFIGURED":      "yes",
+	}
+	switch env["script_type"] {
+	case "up":
+		res["reason"] = "connect"
+	case "down":
+		res["reason"] = "disconnect"
+	}
+	if ip6 := env["ifconfig_ipv6_local"]; ip6 != "" {
+		res["INTERNAL_IP6_NETMASK"] = ip6 + "/" + env["ifconfig_ipv6_netbits"]
+	}
+
+	// foreign_option_1=dhcp-option DNS 10.0.0.1
+	var dns, domains []string
+	for i := 1; ; i++ {
+		opt, ok := env[fmt.Sprintf("foreign_option_%d", i)]
+		if !ok {
+			break
+		}
+		fields := strings.Fields(opt)
+		if len(fields) != 3 || fields[0] != "dhcp-option" {
+			continue
+		}
+		switch fields[1] {
+		case "DNS", "DNS6":
+			dns = append(dns, fields[2])
+		case "DOMAIN":
+			domains = append(domains, fields[2])
+		}
+	}
+	res["INTERNAL_IP4_DNS"] = strings.Join(dns, " ")
+	res["CISCO_SPLIT_DNS"] = strings.Join(domains, ",")
+
+	return res
+}
+
+func (c vpncConfig) connect(sys vpncSystem) error {
+	if !c.configured {
+		if err := sys.LinkUp(c.dev, c.mtu); err != nil {
+			return err
+		}
+		for _, addr := range c.addrs {
+			if err := sys.AddAddress(c.dev, addr); err != nil {
+				return err
+			}
+		}
+	}
+
+	if c.gateway != nil {
+		// Keep the VPN traffic itself off the tunnel, in case a route
+		// through it covers the gateway.
+		gw, dev, err := sys.RouteTo(c.gateway)
+		if err != nil {
+			return err
+		}
+		if err := sys.AddRoute(hostNet(c.gateway), gw, dev); err != nil {
+			return err
+		}
+	}
+
+	for _, route := range c.routes {
+		if err := sys.AddRoute(route, nil, c.dev); err != nil {
+			return fmt.Errorf("route %s: %v", route, err)
+		}
+	}
+
+	if len(c.dns) > 0 {
+		if err := sys.SetDNS(c.dev, c.dns, c.domains); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+// disconnect undoes the changes made by connect. It continues past failures,
+// since some of the changes may already have disappeared with the interface,
+// and returns the first error.
+func (c vpncConfig) disconnect(sys vpncSystem) error {
+	var firstErr error
+	check := func(err error) {
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+
+	if len(c.dns) > 0 {
+		check(sys.RevertDNS(c.dev, c.domains))
+	}
+	for _, route := range c.routes {
+		check(sys.DelRoute(route, nil, c.dev))
+	}
+	if c.gateway != nil {
+		check(sys.DelRoute(hostNet(c.gateway), nil, ""))
+	}
+
+	return firstErr
+}
+
+func hostNet(ip net.IP) *net.IPNet {
+	if ip4 := ip.To4(); ip4 != nil {
+		return &net.IPNet{IP: ip4, Mask: net.CIDRMask(32, 32)}
+	}
+	return &net.IPNet{IP: ip, Mask: net.CIDRMask(128, 128)}
+}
+
+func mustParseCIDR(s string) *net.IPNet {
+	_, ipnet, err := net.ParseCIDR(s)
+	if err != nil {
+		panic(err)
+	}
+	return ipnet
+}
+
+// runLogged runs the command, returning its output as part of any error.
+func runLogged(cmd string, args ...string) error {
+	debugln(cmd, strings.Join(args, " "))
+	out, err := exec.Command(cmd, args...).CombinedOutput()
+	if err != nil {
+		return fmt.Errorf("%s %s: %v: %s", cmd, strings.Join(args, " "), err, strings.TrimSpace(string(out)))
+	}
+	return nil
+}
@@ -0,0 +1,92 @@
+package main
+
+import (
+	"fmt"
+	"net"
+	"os/exec"
+	"regexp"
+	"strings"
+)
+
+// commandSystem configures interfaces and routes using ifconfig and route,
+// and DNS using per domain resolver files.
+type commandSystem struct{}
+
+func newVpncSystem() vpncSystem {
+	return commandSystem{}
+}
+
+func (commandSystem) LinkUp(dev string, mtu int) error {
+	if mtu > 0 {
+		return runLogged("ifconfig", dev, "mtu", fmt.Sprint(mtu), "up")
+	}
+	return runLogged("ifconfig", dev, "up")
+}
+
+func (commandSystem) AddAddress(dev string, addr *net.IPNet) error {
+	if addr.IP.To4() != nil {
+		// Point to point with ourselves, as the tunnel has no peer address
+		return runLogged("ifconfig", dev, "inet", addr.String(), addr.IP.String(), "alias")
+	}
+	return runLogged("ifconfig", dev, "inet6", addr.String(), "alias")
+}
+
+func (commandSystem) AddRoute(dst *net.IPNet, gw net.IP, dev string) error {
+	return runLogged("route", routeArgs("add", dst, gw, dev)...)
+}
+
+func (commandSystem) DelRoute(dst *net.IPNet, gw net.IP, dev string) error {
+	err := runLogged("route", routeArgs("delete", dst, gw, "")...)
+	if err != nil && dev != "" {
+		if _, ierr := net.InterfaceByName(dev); ierr != nil {
+			// The interface is gone, and its routes with it
+			return nil
+		}
+	}
+	return err
+}
+
+func routeArgs(cmd string, dst *net.IPNet, gw net.IP, dev string) []string {
+	args := []string{"-n", cmd}
+	if dst.IP.To4() == nil {
+		args = append(args, "-inet6")
+	}
+	args = append(args, "-net", dst.String())
+	if gw != nil {
+		args = append(args, gw.String())
+	} else if dev != "" {
+		args = append(args, "-interface", dev)
+	}
+	return args
+}
+
+var routeGetRe = regexp.MustCompile(`(?m)^\s*(gateway|interface):\s*(\S+)`)
+
+func (commandSystem) RouteTo(ip net.IP) (net.IP, string, error) {
+	out, err := exec.Command("route", "-n", "get", ip.String()).CombinedOutput()
+	if err != nil {
+		return nil, "", fmt.Errorf("route get %s: %s", ip, strings.TrimSpace(string(out)))
+	}
+	var gw net.IP
+	var dev string
+	for _, m := range routeGetRe.FindAllStringSubmatch(string(out), -1) {
+		if m[1] == "gateway" {
+			gw = net.ParseIP(m[2])
+		} else {
+			dev = m[2]
+		}
+	}
+	return gw, dev, nil
+}
+
+func (commandSystem) SetDNS(dev string, servers []net.IP, domains []string) error {
+	if len(domains) == 0 {
+		warnln(msgErrNoDNSDomains)
+		return nil
+	}
+	return writeResolverFiles("interface "+dev, servers, domains)
+}
+
+func (commandSystem) RevertDNS(dev string, domains []string) error {
+	return removeResolverFiles("interface "+dev, domains)
+}
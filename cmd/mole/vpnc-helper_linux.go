@@ -0,0 +1,111 @@
+package main
+
+import (
+	"net"
+	"os/exec"
+	"syscall"
+)
+
+// netlinkSystem configures interfaces and routes through netlink, and DNS
+// through systemd-resolved when available.
+type netlinkSystem struct{}
+
+func newVpncSystem() vpncSystem {
+	return netlinkSystem{}
+}
+
+func (netlinkSystem) LinkUp(dev string, mtu int) error {
+	intf, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	return netlinkLinkUp(intf.Index, mtu)
+}
+
+func (netlinkSystem) AddAddress(dev string, addr *net.IPNet) error {
+	intf, err := net.InterfaceByName(dev)
+	if err != nil {
+		return err
+	}
+	return netlinkAddrAdd(intf.Index, addr)
+}
+
+func (netlinkSystem) AddRoute(dst *net.IPNet, gw net.IP, dev string) error {
+	var ifindex int
+	if dev != "" {
+		intf, err := net.InterfaceByName(dev)
+		if err != nil {
+			return err
+		}
+		ifindex = intf.Index
+	}
+	return netlinkRouteAdd(dst, gw, ifindex)
+}
+
+func (netlinkSystem) DelRoute(dst *net.IPNet, gw net.IP, dev string) error {
+	var ifindex int
+	if dev != "" {
+		intf, err := net.InterfaceByName(dev)
+		if err != nil {
+			// The interface is gone, and its routes with it
+			return nil
+		}
+		ifindex = intf.Index
+	}
+	err := netlinkRouteDel(dst, gw, ifindex)
+	if err == syscall.ESRCH {
+		// Already gone
+		return nil
+	}
+	return err
+}
+
+func (netlinkSystem) RouteTo(ip net.IP) (net.IP, string, error) {
+	gw, ifindex, err := netlinkRouteGet(ip)
+	if err != nil {
+		return nil, "", err
+	}
+	intf, err := net.InterfaceByIndex(ifindex)
+	if err != nil {
+		return nil, "", err
+	}
+	return gw, intf.Name, nil
+}
+
+func (netlinkSystem) SetDNS(dev string, servers []net.IP, domains []string) error {
+	resolvectl, err := exec.LookPath("resolvectl")
+	if err != nil {
+		warnln(msgErrNoResolved)
+		return nil
+	}
+
+	args := []string{"dns", dev}
+	for _, ip := range servers {
+		args = append(args, ip.String())
+	}
+	if err := runLogged(resolvectl, args...); err != nil {
+		return err
+	}
+
+	if len(domains) > 0 {
+		// Routing-only domains; only names under them go to the VPN servers
+		args = []string{"domain", dev}
+		for _, d := range domains {
+			args = append(args, "~"+d)
+		}
+		return runLogged(resolvectl, args...)
+	}
+	return nil
+}
+
+func (netlinkSystem) RevertDNS(dev string, domains []string) error {
+	resolvectl, err := exec.LookPath("resolvectl")
+	if err != nil {
+		return nil
+	}
+	if _, err := net.InterfaceByName(dev); err != nil {
+		// The interface is gone, and its DNS settings with it
+		return nil
+	}
+	return runLogged(resolvectl, "revert", dev)
+}
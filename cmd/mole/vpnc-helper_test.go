@@ -0,0 +1,217 @@
+// +build darwin linux
+
+package main
+
+import (
+	"fmt"
+	"net"
+	"reflect"
+	"sort"
+	"testing"
+)
+
+// fakeSystem keeps a route table and DNS settings in memory.
+type fakeSystem struct {
+	up     map[string]int
+	addrs  map[string]bool
+	routes map[string]string
+	dns    map[string]string
+}
+
+func newFakeSystem() *fakeSystem {
+	return &fakeSystem{
+		up:    make(map[string]int),
+		addrs: make(map[string]bool),
+		routes: map[string]string{
+			"0.0.0.0/0": "192.168.1.1 eth0",
+		},
+		dns: make(map[string]string),
+	}
+}
+
+func (s *fakeSystem) LinkUp(dev string, mtu int) error {
+	s.up[dev] = mtu
+	return nil
+}
+
+func (s *fakeSystem) AddAddress(dev string, addr *net.IPNet) error {
+	s.addrs[dev+" "+addr.String()] = true
+	return nil
+}
+
+func (s *fakeSystem) AddRoute(dst *net.IPNet, gw net.IP, dev string) error {
+	if _, ok := s.routes[dst.String()]; ok {
+		return fmt.Errorf("route to %s exists", dst)
+	}
+	via := dev
+	if gw != nil {
+		via = gw.String() + " " + dev
+	}
+	s.routes[dst.String()] = via
+	return nil
+}
+
+func (s *fakeSystem) DelRoute(dst *net.IPNet, gw net.IP, dev string) error {
+	if _, ok := s.routes[dst.String()]; !ok {
+		return fmt.Errorf("no route to %s", dst)
+	}
+	delete(s.routes, dst.String())
+	return nil
+}
+
+func (s *fakeSystem) RouteTo(ip net.IP) (net.IP, string, error) {
+	return net.ParseIP("192.168.1.1"), "eth0", nil
+}
+
+func (s *fakeSystem) SetDNS(dev string, servers []net.IP, domains []string) error {
+	s.dns[dev] = fmt.Sprint(servers, domains)
+	return nil
+}
+
+func (s *fakeSystem) RevertDNS(dev string, domains []string) error {
+	delete(s.dns, dev)
+	return nil
+}
+
+func (s *fakeSystem) routeList() []string {
+	var l []string
+	for dst, via := range s.routes {
+		l = append(l, dst+" "+via)
+	}
+	sort.Strings(l)
+	return l
+}
+
+var vpncTestEnv = map[string]string{
+	"reason":                    "connect",
+	"TUNDEV":                    "tun0",
+	"VPNGATEWAY":                "198.51.100.1",
+	"INTERNAL_IP4_ADDRESS":      "10.8.0.6",
+	"INTERNAL_IP4_MTU":          "1400",
+	"INTERNAL_IP4_DNS":          "10.8.0.1",
+	"INTERNAL_IP6_NETMASK":      "fd00:8::6/64",
+	"CISCO_DEF_DOMAIN":          "example.com",
+	"CISCO_SPLIT_INC":           "1",
+	"CISCO_SPLIT_INC_0_ADDR":    "10.20.0.0",
+	"CISCO_SPLIT_INC_0_MASKLEN": "16",
+}
+
+func TestVpncConnectDisconnect(t *testing.T) {
+	cfg, err := parseVpncEnv(vpncTestEnv, []string{"10.22.0.0/24", "fd00:22::/64"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sys := newFakeSystem()
+	if err := cfg.connect(sys); err != nil {
+		t.Fatal(err)
+	}
+
+	if sys.up["tun0"] != 1400 {
+		t.Errorf("tun0 not up with correct mtu: %v", sys.up)
+	}
+	if !sys.addrs["tun0 10.8.0.6/32"] || !sys.addrs["tun0 fd00:8::6/64"] {
+		t.Errorf("incorrect addresses %v", sys.addrs)
+	}
+
+	// The configured routes replace the ones given by the server
+	expected := []string{
+		"0.0.0.0/0 192.168.1.1 eth0",
+		"10.22.0.0/24 tun0",
+		"198.51.100.1/32 192.168.1.1 eth0",
+		"fd00:22::/64 tun0",
+	}
+	if routes := sys.routeList(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("incorrect routes after connect:\n%v\n!=\n%v", routes, expected)
+	}
+	if dns := sys.dns["tun0"]; dns != "[10.8.0.1] [example.com]" {
+		t.Errorf("incorrect dns %q", dns)
+	}
+
+	cfg.reason = "disconnect"
+	if err := cfg.disconnect(sys); err != nil {
+		t.Fatal(err)
+	}
+
+	expected = []string{"0.0.0.0/0 192.168.1.1 eth0"}
+	if routes := sys.routeList(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("incorrect routes after disconnect: %v", routes)
+	}
+	if len(sys.dns) != 0 {
+		t.Errorf("dns not reverted: %v", sys.dns)
+	}
+}
+
+func TestVpncServerRoutes(t *testing.T) {
+	cfg, err := parseVpncEnv(vpncTestEnv, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sys := newFakeSystem()
+	if err := cfg.connect(sys); err != nil {
+		t.Fatal(err)
+	}
+
+	if via := sys.routes["10.20.0.0/16"]; via != "tun0" {
+		t.Errorf("missing split route from server; %v", sys.routeList())
+	}
+}
+
+func TestVpncNoSplitRoutes(t *testing.T) {
+	env := map[string]string{
+		"reason":               "connect",
+		"TUNDEV":               "tun0",
+		"INTERNAL_IP4_ADDRESS": "10.8.0.6",
+	}
+	cfg, err := parseVpncEnv(env, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	sys := newFakeSystem()
+	if err := cfg.connect(sys); err != nil {
+		t.Fatal(err)
+	}
+
+	// The default route is left in place but overridden
+	expected := []string{
+		"0.0.0.0/0 192.168.1.1 eth0",
+		"0.0.0.0/1 tun0",
+		"128.0.0.0/1 tun0",
+	}
+	if routes := sys.routeList(); !reflect.DeepEqual(routes, expected) {
+		t.Errorf("incorrect routes %v", routes)
+	}
+}
+
+func TestVpncOpenvpnEnv(t *testing.T) {
+	env := map[string]string{
+		"script_type":      "up",
+		"dev":              "tun1",
+		"ifconfig_local":   "10.9.0.2",
+		"tun_mtu":          "1500",
+		"trusted_ip":       "198.51.100.2",
+		"foreign_option_1": "dhcp-option DNS 10.9.0.1",
+		"foreign_option_2": "dhcp-option DOMAIN corp.example.com",
+	}
+	cfg, err := parseVpncEnv(env, []string{"10.9.0.0/16"})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if cfg.reason != "connect" || cfg.dev != "tun1" || !cfg.configured {
+		t.Errorf("incorrect translation %+v", cfg)
+	}
+
+	sys := newFakeSystem()
+	if err := cfg.connect(sys); err != nil {
+		t.Fatal(err)
+	}
+	if len(sys.up) != 0 || len(sys.addrs) != 0 {
+		t.Error("interface configured by openvpn should be left alone")
+	}
+	if dns := sys.dns["tun1"]; dns != "[10.9.0.1] [corp.example.com]" {
+		t.Errorf("incorrect dns %q", dns)
+	}
+}
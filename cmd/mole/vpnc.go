@@ -67,6 +67,7 @@ func (p VPNCProvider) Start(cfg *conf.Config) (VPN, error) {
 		return nil, err
 	}
 	debugf(msgVpncStart, cmd.Process.Pid)
+	journalProcessStarted(cmd)
 	debugln(msgVpncWait)
 
 	for k, v := range cfg.Vpnc {
@@ -111,10 +112,12 @@ func (v *Vpnc) Stop() {
 		err := os.Remove(v.script)
 		if err != nil {
 			warnln(err)
+		} else {
+			journalFileRemoved(v.script)
 		}
 	}()
 
-	debugln(msgVpncStopping, v.cmd.Process.Pid)
+	debugf(msgVpncStopping, v.cmd.Process.Pid)
 	err := v.cmd.Process.Signal(os.Interrupt)
 	if err != nil {
 		warnln(err)
@@ -123,5 +126,6 @@ func (v *Vpnc) Stop() {
 	if err != nil {
 		warnln(err)
 	}
+	journalProcessStopped(&v.cmd)
 	debugln(msgVpncStopped)
 }
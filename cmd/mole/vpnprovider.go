@@ -14,6 +14,21 @@ type VPNProvider interface {
 	Start(*conf.Config) (VPN, error)
 }
 
+// A UserspaceVPN is a VPN that doesn't use a tunnel device or touch the
+// system routing table. Connections through it must be made using the VPN as
+// a Dialer.
+type UserspaceVPN interface {
+	VPN
+	Dialer
+}
+
+// A UserspaceVPNProvider can bring up a VPN without root privileges. Only
+// openconnect can hand its traffic to another process instead of a tun
+// device; vpnc and openvpn cannot.
+type UserspaceVPNProvider interface {
+	StartUserspace(*conf.Config) (UserspaceVPN, error)
+}
+
 var vpnProviders = make(map[string]VPNProvider)
 
 func startVpn(provider string, cfg *conf.Config) (VPN, error) {
@@ -28,3 +43,15 @@ func supportsVpn(provider string) bool {
 	_, ok := vpnProviders[provider]
 	return ok
 }
+
+func startUserspaceVpn(provider string, cfg *conf.Config) (UserspaceVPN, error) {
+	prov, ok := vpnProviders[provider]
+	if !ok {
+		return nil, fmt.Errorf(msgErrNoVPN, provider)
+	}
+	uprov, ok := prov.(UserspaceVPNProvider)
+	if !ok {
+		return nil, fmt.Errorf(msgErrNoUserspaceVPN, provider)
+	}
+	return uprov.StartUserspace(cfg)
+}
@@ -0,0 +1,203 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/calmh/mole/conf"
+)
+
+// aclFile is the format of acl.json in the data directory. Rules for a
+// tunnel in acl.json take precedence over the [access] section of the
+// tunnel definition. The "*" entry applies to tunnels that have neither.
+// Tunnels with no rules at all are open to every authenticated user. The
+// ticket policy of users, groups and "*" may be set as well.
+//
+//	{
+//	    "admins": ["root"],
+//	    "groups": {"ops": ["alice", "bob"]},
+//	    "tunnels": {
+//	        "*": {"read": ["*"], "write": ["@ops"]},
+//	        "customer": {"read": ["carol", "@ops"], "write": ["@ops"]}
+//	    },
+//	    "tickets": {
+//	        "@ops": {"lifetime": "12h", "ipv4Prefix": 24}
+//	    }
+//	}
+type aclFile struct {
+	Admins  []string                `json:"admins"`
+	Groups  map[string][]string     `json:"groups"`
+	Tunnels map[string]conf.Access  `json:"tunnels"`
+	Tickets map[string]ticketPolicy `json:"tickets"`
+}
+
+const (
+	permRead = iota
+	permWrite
+)
+
+var (
+	acl        aclFile
+	aclModTime time.Time
+	aclLock    sync.Mutex
+)
+
+func aclPath() string {
+	return path.Join(storeDir, "data", "acl.json")
+}
+
+// loadACL reads acl.json, unless it is unchanged since the last load. A
+// missing file means no rules.
+func loadACL() error {
+	aclLock.Lock()
+	defer aclLock.Unlock()
+
+	fi, err := os.Stat(aclPath())
+	if os.IsNotExist(err) {
+		acl = aclFile{}
+		aclModTime = time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if fi.ModTime().Equal(aclModTime) {
+		return nil
+	}
+
+	fd, err := os.Open(aclPath())
+	if err != nil {
+		return err
+	}
+	defer fd.Close()
+
+	var a aclFile
+	err = json.NewDecoder(fd).Decode(&a)
+	if err != nil {
+		return fmt.Errorf("%s: %v", aclPath(), err)
+	}
+	for name, p := range a.Tickets {
+		if err := p.validate(); err != nil {
+			return fmt.Errorf("%s: tickets: %q: %v", aclPath(), name, err)
+		}
+	}
+
+	acl = a
+	aclModTime = fi.ModTime()
+	return nil
+}
+
+// currentACL returns the access rules in effect. Should acl.json have been
+// broken by an edit, the previous rules are kept until it is fixed.
+func currentACL() aclFile {
+	if err := loadACL(); err != nil {
+		log.Println("Warning:", err, "(keeping previous access rules)")
+	}
+	aclLock.Lock()
+	defer aclLock.Unlock()
+	return acl
+}
+
+// principals returns the names the user of the request is known by in
+// access rules; the user name itself, "@group" for each group the user is a
+// member of and "*" for any authenticated user. Groups are those in acl.json
+// and those reported by the authentication backend, as carried in the
+// ticket.
+func principals(req *http.Request, a aclFile) []string {
+	return principalsOf(req.Header.Get("X-Mole-Authenticated"), req.Header["X-Mole-Groups"], a)
+}
+
+func principalsOf(user string, groups []string, a aclFile) []string {
+	ps := []string{"*", user}
+	for group, members := range a.Groups {
+		if containsString(members, user) {
+			ps = append(ps, "@"+group)
+		}
+	}
+	for _, group := range groups {
+		ps = append(ps, "@"+group)
+	}
+	return ps
+}
+
+// unrestricted returns true if the request is not subject to access rules,
+// as authentication is disabled or the user is an administrator.
+func unrestricted(req *http.Request, a aclFile) bool {
+	if auth == "none" {
+		return true
+	}
+	return matchAny(principals(req, a), a.Admins)
+}
+
+// mayAccess returns true if the user of the request has the permission on
+// the tunnel, given the access section of the tunnel definition (if any).
+func mayAccess(req *http.Request, tunnel string, access *conf.Access, perm int) bool {
+	a := currentACL()
+	if unrestricted(req, a) {
+		return true
+	}
+
+	rules := access
+	if r, ok := a.Tunnels[tunnel]; ok {
+		rules = &r
+	} else if rules == nil {
+		if r, ok := a.Tunnels["*"]; ok {
+			rules = &r
+		}
+	}
+	if rules == nil {
+		return true
+	}
+
+	ps := principals(req, a)
+	if matchAny(ps, rules.Write) {
+		return true
+	}
+	return perm == permRead && matchAny(ps, rules.Read)
+}
+
+// tunnelAccess returns the access section of the stored tunnel definition,
+// or nil if there is none.
+func tunnelAccess(tunnel string) *conf.Access {
+	fd, err := os.Open(path.Join(storeDir, "data", tunnel+".ini"))
+	if err != nil {
+		return nil
+	}
+	defer fd.Close()
+
+	cfg, err := conf.Load(fd)
+	if err != nil {
+		return nil
+	}
+	return cfg.Access
+}
+
+func denyAccess(rw http.ResponseWriter, req *http.Request, what string) {
+	audit(req, "access denied to "+what)
+	rw.Header().Set("X-Mole-Access", "denied")
+	rw.WriteHeader(403)
+	rw.Write([]byte("access denied to " + what))
+}
+
+func matchAny(ps, names []string) bool {
+	for _, p := range ps {
+		if containsString(names, p) {
+			return true
+		}
+	}
+	return false
+}
+
+func containsString(l []string, s string) bool {
+	for _, e := range l {
+		if e == s {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,260 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/conf"
+)
+
+const testACL = `{
+    "admins": ["root"],
+    "groups": {"ops": ["alice"]},
+    "tunnels": {
+        "*": {"read": ["*"], "write": ["@ops"]},
+        "secret": {"read": ["bob"]}
+    }
+}`
+
+const testTunnel = `[general]
+description = Test
+author = Test
+version = 4.0
+main = test
+
+[hosts.test]
+addr = 192.0.2.1
+user = test
+password = $mole$%s
+
+[forwards.test]
+127.0.0.12:3306 = 10.0.0.1:3306
+`
+
+func withTestStore(t *testing.T) func() {
+	dir, err := ioutil.TempDir("", "molestore")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := os.MkdirAll(path.Join(dir, "data"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	oldStore, oldAuth, oldGit := storeDir, auth, disableGit
+	storeDir, auth, disableGit = dir, "test", true
+	iv = nil
+	secrets = &jsonSecrets{}
+	return func() {
+		storeDir, auth, disableGit = oldStore, oldAuth, oldGit
+		iv = nil
+		listCache = nil
+		acl, aclModTime = aclFile{}, time.Time{}
+		revoked, revokedModTime = revocations{}, time.Time{}
+		lockouts, lockoutsModTime = nil, time.Time{}
+		keys, masterKey, masterSalt, sealedKeys = nil, nil, nil, nil
+		secrets = nil
+		os.RemoveAll(dir)
+	}
+}
+
+func writeStoreFile(t *testing.T, name, data string) {
+	if err := ioutil.WriteFile(path.Join(storeDir, "data", name), []byte(data), 0644); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func testRequest(method, url, user string, body []byte) *http.Request {
+	req, _ := http.NewRequest(method, url, bytes.NewReader(body))
+	req.Header.Set("X-Mole-Authenticated", user)
+	return req
+}
+
+func TestMayAccess(t *testing.T) {
+	defer withTestStore(t)()
+	writeStoreFile(t, "acl.json", testACL)
+	if err := loadACL(); err != nil {
+		t.Fatal(err)
+	}
+
+	cases := []struct {
+		user   string
+		tunnel string
+		perm   int
+		ok     bool
+	}{
+		// The "*" entry applies
+		{"bob", "other", permRead, true},
+		{"bob", "other", permWrite, false},
+		{"alice", "other", permWrite, true},
+		// The tunnel entry applies
+		{"bob", "secret", permRead, true},
+		{"alice", "secret", permRead, false},
+		{"alice", "secret", permWrite, false},
+		// Administrators are not restricted
+		{"root", "secret", permWrite, true},
+	}
+	for _, tc := range cases {
+		req := testRequest("GET", "/", tc.user, nil)
+		if ok := mayAccess(req, tc.tunnel, nil, tc.perm); ok != tc.ok {
+			t.Errorf("%s %s %d: %v != %v", tc.user, tc.tunnel, tc.perm, ok, tc.ok)
+		}
+	}
+
+	// Groups from the ticket count as well
+	req := testRequest("GET", "/", "carol", nil)
+	req.Header["X-Mole-Groups"] = []string{"ops"}
+	if !mayAccess(req, "other", nil, permWrite) {
+		t.Error("ticket group not considered")
+	}
+
+	// The access section overrides the "*" entry, but write implies read
+	access := &conf.Access{Read: []string{"carol"}, Write: []string{"dave"}}
+	for user, ok := range map[string]bool{"carol": true, "dave": true, "bob": false} {
+		req := testRequest("GET", "/", user, nil)
+		if mayAccess(req, "other", access, permRead) != ok {
+			t.Errorf("%s: read access not %v", user, ok)
+		}
+	}
+}
+
+func TestAccessHandlers(t *testing.T) {
+	defer withTestStore(t)()
+	keys = map[string]string{"a1b2": "hunter2", "orphan": "unused"}
+	writeStoreFile(t, "acl.json", testACL)
+	writeStoreFile(t, "open.ini", fmt.Sprintf(testTunnel, "other"))
+	writeStoreFile(t, "secret.ini", fmt.Sprintf(testTunnel, "a1b2"))
+
+	// The list only contains readable tunnels
+	rec := httptest.NewRecorder()
+	storeList(rec, testRequest("GET", "/store", "alice", nil))
+	var items []listItem
+	if err := json.NewDecoder(rec.Body).Decode(&items); err != nil {
+		t.Fatal(err)
+	}
+	if len(items) != 1 || items[0].Name != "open" {
+		t.Errorf("unexpected list %v", items)
+	}
+
+	rec = httptest.NewRecorder()
+	getFile(rec, testRequest("GET", "/store/secret.ini", "alice", nil))
+	if rec.Code != 403 || rec.Header().Get("X-Mole-Access") != "denied" {
+		t.Errorf("unexpected get response %d", rec.Code)
+	}
+
+	// The store's own files are not served
+	rec = httptest.NewRecorder()
+	getFile(rec, testRequest("GET", "/store/acl.json", "root", nil))
+	if rec.Code != 404 {
+		t.Errorf("unexpected get response %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	putFile(rec, testRequest("PUT", "/store/secret.ini", "bob", []byte(fmt.Sprintf(testTunnel, "a1b2"))))
+	if rec.Code != 403 {
+		t.Errorf("unexpected put response %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	rmFile(rec, testRequest("DELETE", "/store/open.ini", "bob", nil))
+	if rec.Code != 403 {
+		t.Errorf("unexpected rm response %d", rec.Code)
+	}
+
+	// Keys are available only through a readable tunnel
+	for user, code := range map[string]int{"bob": 200, "alice": 403} {
+		rec = httptest.NewRecorder()
+		getKeys(rec, testRequest("POST", "/keys", user, []byte(`["a1b2"]`)))
+		if rec.Code != code {
+			t.Errorf("%s: unexpected keys response %d != %d", user, rec.Code, code)
+		}
+	}
+	rec = httptest.NewRecorder()
+	getKeys(rec, testRequest("POST", "/keys", "bob", []byte(`["orphan"]`)))
+	if rec.Code != 403 {
+		t.Errorf("unexpected keys response %d for unreferenced key", rec.Code)
+	}
+
+	// Keys cannot be made readable by referencing them from another tunnel
+	rec = httptest.NewRecorder()
+	putFile(rec, testRequest("PUT", "/store/steal.ini", "alice", []byte(fmt.Sprintf(testTunnel, "a1b2"))))
+	if rec.Code != 403 {
+		t.Errorf("unexpected put response %d for unreadable key", rec.Code)
+	}
+	rec = httptest.NewRecorder()
+	getKeys(rec, testRequest("POST", "/keys", "alice", []byte(`["a1b2"]`)))
+	if rec.Code != 403 {
+		t.Errorf("unexpected keys response %d after refused put", rec.Code)
+	}
+
+	// ... but those already referenced by the tunnel or readable are kept
+	puts := []struct{ user, tunnel, key string }{
+		{"alice", "open.ini", "other"},
+		{"root", "copy.ini", "a1b2"},
+	}
+	for _, p := range puts {
+		rec = httptest.NewRecorder()
+		putFile(rec, testRequest("PUT", "/store/"+p.tunnel, p.user, []byte(fmt.Sprintf(testTunnel, p.key))))
+		if rec.Code != 200 {
+			t.Errorf("%s: unexpected put response %d: %s", p.user, rec.Code, rec.Body)
+		}
+	}
+}
+
+func TestKeyAudit(t *testing.T) {
+	defer withTestStore(t)()
+	keys = map[string]string{}
+	writeStoreFile(t, "acl.json", testACL)
+
+	// Pushing a definition obfuscates and indexes the password
+	rec := httptest.NewRecorder()
+	putFile(rec, testRequest("PUT", "/store/new.ini", "alice", []byte(strings.Replace(fmt.Sprintf(testTunnel, "x"), "$mole$x", "hunter2", 1))))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected put response %d: %s", rec.Code, rec.Body)
+	}
+	listCacheLock.Lock()
+	loadListCache()
+	var key string
+	for k, refs := range keyIndex {
+		if len(refs) == 1 && refs[0] == (keyRef{"new", "hosts.test", "password"}) {
+			key = k
+		}
+	}
+	listCacheLock.Unlock()
+	if key == "" || keys[key] != "hunter2" {
+		t.Fatalf("password not indexed; %v", keyIndex)
+	}
+
+	rec = httptest.NewRecorder()
+	getKeys(rec, testRequest("POST", "/keys", "bob", []byte(`["`+key+`"]`)))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected keys response %d", rec.Code)
+	}
+	files, _ := filepath.Glob(path.Join(storeDir, auditFile+".*"))
+	var records []byte
+	for _, file := range files {
+		bs, _ := ioutil.ReadFile(file)
+		records = append(records, bs...)
+	}
+	if !bytes.Contains(records, []byte(`"user":"bob","comment":"released keys: `+key+` (new [hosts.test] password)"`)) {
+		t.Errorf("release not audited; %s", records)
+	}
+
+	// Removing the definition removes the references
+	rec = httptest.NewRecorder()
+	rmFile(rec, testRequest("DELETE", "/store/new.ini", "alice", nil))
+	rec = httptest.NewRecorder()
+	getKeys(rec, testRequest("POST", "/keys", "bob", []byte(`["`+key+`"]`)))
+	if rec.Code != 403 {
+		t.Errorf("unexpected keys response %d after rm", rec.Code)
+	}
+}
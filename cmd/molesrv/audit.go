@@ -3,6 +3,7 @@ package main
 import (
 	"encoding/json"
 	"net/http"
+	"os"
 	"path"
 	"time"
 )
@@ -20,10 +21,7 @@ type auditRecord struct {
 var iv *intervalWriter
 
 func audit(req *http.Request, comment string) {
-	if iv == nil {
-		iv = &intervalWriter{name: path.Join(storeDir, auditFile), interval: int(auditIntv.Seconds())}
-	}
-	rec := auditRecord{
+	writeAudit(auditRecord{
 		Time:      time.Now(),
 		Client:    req.RemoteAddr,
 		UserAgent: req.Header.Get("User-Agent"),
@@ -31,6 +29,31 @@ func audit(req *http.Request, comment string) {
 		Path:      req.URL.Path,
 		User:      req.Header.Get("X-Mole-Authenticated"),
 		Comment:   comment,
+	})
+}
+
+// auditCommand records an administrative command run on the server.
+func auditCommand(command, comment string) {
+	writeAudit(auditRecord{
+		Time:    time.Now(),
+		Client:  "local",
+		Method:  "COMMAND",
+		Path:    command,
+		User:    currentUser(),
+		Comment: comment,
+	})
+}
+
+func currentUser() string {
+	if u := os.Getenv("USER"); u != "" {
+		return u
+	}
+	return "server"
+}
+
+func writeAudit(rec auditRecord) {
+	if iv == nil {
+		iv = &intervalWriter{name: path.Join(storeDir, auditFile), interval: int(auditIntv.Seconds())}
 	}
 	bs, _ := json.Marshal(rec)
 	bs = append(bs, '\n')
@@ -0,0 +1,253 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+var htpasswdFile = "htpasswd"
+
+// An htpasswd file holds "user:hash" lines, with bcrypt hashes as created
+// by "htpasswd -B". A hash prefixed by "!" belongs to a disabled user. Other
+// lines are kept as they are. Last login times are kept alongside in a
+// separate file, as the password file should only change when edited.
+type htpasswd struct {
+	lines   []string
+	modTime time.Time
+	size    int64
+}
+
+var (
+	htpasswdCache *htpasswd
+	htpasswdLock  sync.Mutex
+	loginsLock    sync.Mutex
+)
+
+// Compared against for unknown users, so that they take as long to refuse
+// as incorrect passwords.
+var (
+	htpasswdDummyHash []byte
+	htpasswdDummyOnce sync.Once
+)
+
+func init() {
+	authBackends["htpasswd"] = backendAuthenticateHtpasswd
+	authLookups["htpasswd"] = lookupHtpasswd
+	authSetup["htpasswd"] = setupHtpasswd
+	globalFlags.StringVar(&htpasswdFile, "htpasswd-file", htpasswdFile, "(for -auth=htpasswd) Password file (relative to store directory)")
+}
+
+func htpasswdPath() string {
+	return path.Join(storeDir, htpasswdFile)
+}
+
+func loginsPath() string {
+	return htpasswdPath() + ".logins"
+}
+
+func setupHtpasswd() error {
+	_, err := loadHtpasswd()
+	if os.IsNotExist(err) {
+		return fmt.Errorf("%v; add users with -adduser", err)
+	}
+	return err
+}
+
+func backendAuthenticateHtpasswd(user, password string) ([]string, bool) {
+	h, err := loadHtpasswd()
+	if err != nil {
+		log.Println("htpasswd:", err)
+		return nil, false
+	}
+
+	hash, disabled, ok := h.get(user)
+	if !ok {
+		htpasswdDummyOnce.Do(func() {
+			htpasswdDummyHash, _ = bcrypt.GenerateFromPassword([]byte("dummy password"), bcrypt.DefaultCost)
+		})
+		bcrypt.CompareHashAndPassword(htpasswdDummyHash, []byte(password))
+		log.Printf("htpasswd: %q: no such user", user)
+		return nil, false
+	}
+
+	err = bcrypt.CompareHashAndPassword([]byte(hash), []byte(password))
+	if err != nil {
+		log.Printf("htpasswd: %q: %s", user, err)
+		return nil, false
+	}
+	if disabled {
+		log.Printf("htpasswd: %q: user is disabled", user)
+		return nil, false
+	}
+	return nil, true
+}
+
+func lookupHtpasswd(user string) ([]string, bool, error) {
+	h, err := loadHtpasswd()
+	if err != nil {
+		return nil, false, err
+	}
+	_, disabled, ok := h.get(user)
+	return nil, ok && !disabled, nil
+}
+
+// loadHtpasswd returns the current contents of the password file, reading
+// it again if it has changed since the last time.
+func loadHtpasswd() (*htpasswd, error) {
+	htpasswdLock.Lock()
+	defer htpasswdLock.Unlock()
+
+	fi, err := os.Stat(htpasswdPath())
+	if err != nil {
+		return nil, err
+	}
+	if htpasswdCache != nil && fi.ModTime().Equal(htpasswdCache.modTime) && fi.Size() == htpasswdCache.size {
+		return htpasswdCache, nil
+	}
+
+	h, err := readHtpasswd(htpasswdPath())
+	if err != nil {
+		return nil, err
+	}
+	h.modTime = fi.ModTime()
+	h.size = fi.Size()
+	htpasswdCache = h
+	return h, nil
+}
+
+func readHtpasswd(file string) (*htpasswd, error) {
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		return nil, err
+	}
+
+	var h htpasswd
+	if s := strings.TrimSuffix(string(bs), "\n"); s != "" {
+		h.lines = strings.Split(s, "\n")
+	}
+	return &h, nil
+}
+
+func (h *htpasswd) write(file string) error {
+	data := strings.Join(h.lines, "\n")
+	if len(h.lines) > 0 {
+		data += "\n"
+	}
+	return writeFileAtomic(file, []byte(data), 0600)
+}
+
+// index returns the line number of the user, or -1.
+func (h *htpasswd) index(user string) int {
+	for i, line := range h.lines {
+		if strings.HasPrefix(line, user+":") {
+			return i
+		}
+	}
+	return -1
+}
+
+// get returns the password hash of the user and whether the user is
+// disabled.
+func (h *htpasswd) get(user string) (hash string, disabled bool, ok bool) {
+	i := h.index(user)
+	if i < 0 {
+		return "", false, false
+	}
+	hash = h.lines[i][len(user)+1:]
+	// Anything after the hash is ignored, as by Apache
+	if j := strings.IndexByte(hash, ':'); j >= 0 {
+		hash = hash[:j]
+	}
+	if strings.HasPrefix(hash, "!") {
+		return hash[1:], true, true
+	}
+	return hash, false, true
+}
+
+func (h *htpasswd) set(user, hash string, disabled bool) {
+	if disabled {
+		hash = "!" + hash
+	}
+	line := user + ":" + hash
+	if i := h.index(user); i >= 0 {
+		h.lines[i] = line
+	} else {
+		h.lines = append(h.lines, line)
+	}
+}
+
+func (h *htpasswd) remove(user string) {
+	if i := h.index(user); i >= 0 {
+		h.lines = append(h.lines[:i], h.lines[i+1:]...)
+	}
+}
+
+// users returns the names of all users in the file.
+func (h *htpasswd) users() []string {
+	var users []string
+	for _, line := range h.lines {
+		if line == "" || strings.HasPrefix(line, "#") {
+			continue
+		}
+		if i := strings.IndexByte(line, ':'); i > 0 {
+			users = append(users, line[:i])
+		}
+	}
+	return users
+}
+
+func loadLogins() (map[string]time.Time, error) {
+	logins := make(map[string]time.Time)
+	bs, err := ioutil.ReadFile(loginsPath())
+	if os.IsNotExist(err) {
+		return logins, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(bs, &logins)
+	return logins, err
+}
+
+func saveLogins(logins map[string]time.Time) error {
+	bs, err := json.MarshalIndent(logins, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(loginsPath(), bs, 0600)
+}
+
+func recordLogin(user string, t time.Time) error {
+	loginsLock.Lock()
+	defer loginsLock.Unlock()
+
+	logins, err := loadLogins()
+	if err != nil {
+		return err
+	}
+	logins[user] = t
+	return saveLogins(logins)
+}
+
+func forgetLogin(user string) error {
+	loginsLock.Lock()
+	defer loginsLock.Unlock()
+
+	logins, err := loadLogins()
+	if err != nil {
+		return err
+	}
+	if _, ok := logins[user]; !ok {
+		return nil
+	}
+	delete(logins, user)
+	return saveLogins(logins)
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"golang.org/x/crypto/bcrypt"
+)
+
+func testHash(t *testing.T, password string) string {
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.MinCost)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(hash)
+}
+
+// withStdin makes the input available on os.Stdin.
+func withStdin(t *testing.T, input string) func() {
+	file := filepath.Join(storeDir, "stdin")
+	if err := ioutil.WriteFile(file, []byte(input), 0600); err != nil {
+		t.Fatal(err)
+	}
+	fd, err := os.Open(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	old := os.Stdin
+	os.Stdin = fd
+	return func() {
+		os.Stdin = old
+		fd.Close()
+	}
+}
+
+func TestHtpasswdAuthenticate(t *testing.T) {
+	defer withTestStore(t)()
+	htpasswdCache = nil
+
+	// As created by "htpasswd -B", with a comment and a disabled user
+	data := "# team members\nalice:" + strings.Replace(testHash(t, "secret"), "$2a$", "$2y$", 1) +
+		"\nbob:!" + testHash(t, "hunter2") + "\n"
+	if err := ioutil.WriteFile(htpasswdPath(), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupHtpasswd(); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, ok := backendAuthenticateHtpasswd("alice", "secret"); !ok {
+		t.Error("correct password refused")
+	}
+	if _, ok := backendAuthenticateHtpasswd("alice", "hunter2"); ok {
+		t.Error("incorrect password accepted")
+	}
+	if _, ok := backendAuthenticateHtpasswd("bob", "hunter2"); ok {
+		t.Error("disabled user accepted")
+	}
+	if _, ok := backendAuthenticateHtpasswd("carol", "secret"); ok {
+		t.Error("unknown user accepted")
+	}
+
+	// Changes to the file are picked up
+	data = "bob:" + testHash(t, "hunter2") + "\n"
+	if err := ioutil.WriteFile(htpasswdPath(), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backendAuthenticateHtpasswd("bob", "hunter2"); !ok {
+		t.Error("enabled user refused")
+	}
+	if _, ok := backendAuthenticateHtpasswd("alice", "secret"); ok {
+		t.Error("removed user accepted")
+	}
+}
+
+func TestHtpasswdManage(t *testing.T) {
+	defer withTestStore(t)()
+	htpasswdCache = nil
+
+	if err := setupHtpasswd(); err == nil {
+		t.Error("missing password file accepted")
+	}
+
+	restore := withStdin(t, "secret\n")
+	err := cmdAddUser("alice")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdAddUser("alice"); err == nil {
+		t.Error("existing user added again")
+	}
+	if err := cmdAddUser("a:b"); err == nil {
+		t.Error("invalid user name accepted")
+	}
+	if _, ok := backendAuthenticateHtpasswd("alice", "secret"); !ok {
+		t.Fatal("added user refused")
+	}
+
+	if err := cmdSetDisabled("alice", true); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backendAuthenticateHtpasswd("alice", "secret"); ok {
+		t.Error("disabled user accepted")
+	}
+
+	// A new password keeps the user disabled
+	restore = withStdin(t, "hunter2\n")
+	err = cmdPasswd("alice")
+	restore()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdSetDisabled("alice", false); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backendAuthenticateHtpasswd("alice", "hunter2"); !ok {
+		t.Error("new password refused")
+	}
+
+	if err := cmdDelUser("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backendAuthenticateHtpasswd("alice", "hunter2"); ok {
+		t.Error("deleted user accepted")
+	}
+	if logins, _ := loadLogins(); len(logins) != 0 {
+		t.Errorf("login of deleted user kept; %v", logins)
+	}
+	if err := cmdDelUser("alice"); err == nil {
+		t.Error("deleted user deleted again")
+	}
+}
@@ -1,39 +1,302 @@
 package main
 
 import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
 	"fmt"
+	"io/ioutil"
 	"log"
+	"net"
+	"strings"
+	"time"
 
+	"github.com/mavricknz/asn1-ber"
 	"github.com/mavricknz/ldap"
 )
 
 var (
-	ldapServer = "localhost"
-	ldapPort   = 389
-	ldapBind   = "uid=%s,cn=users"
+	ldapServer         = "localhost"
+	ldapPort           = 389
+	ldapBind           = "uid=%s,cn=users"
+	ldapTLS            = "none"
+	ldapCAFile         = ""
+	ldapSearchBase     = ""
+	ldapSearchFilter   = "(|(uid=%[1]s)(mail=%[1]s))"
+	ldapSearchDN       = ""
+	ldapSearchPassFile = ""
+	ldapGroupBase      = ""
+	ldapGroupFilter    = "(|(member=%[1]s)(uniqueMember=%[1]s)(memberUid=%[2]s))"
+	ldapGroupAttr      = "cn"
+
+	ldapTLSConfig  *tls.Config
+	ldapSearchPass string
 )
 
+const ldapTimeout = 10 * time.Second
+
 func init() {
 	authBackends["ldap"] = backendAuthenticateLDAP
+	authLookups["ldap"] = lookupLDAP
+	authSetup["ldap"] = setupLDAP
 	globalFlags.StringVar(&ldapServer, "ldap-host", ldapServer, "(for -auth=ldap) LDAP host")
 	globalFlags.IntVar(&ldapPort, "ldap-port", ldapPort, "(for -auth=ldap) LDAP port")
 	globalFlags.StringVar(&ldapBind, "ldap-bind", ldapBind, "(for -auth=ldap) LDAP bind template")
+	globalFlags.StringVar(&ldapTLS, "ldap-tls", ldapTLS, "(for -auth=ldap) LDAP connection security (none, starttls, ldaps)")
+	globalFlags.StringVar(&ldapCAFile, "ldap-ca-file", ldapCAFile, "(for -auth=ldap) CA certificates for the LDAP server. Leave blank to use the system roots.")
+	globalFlags.StringVar(&ldapSearchBase, "ldap-search-base", ldapSearchBase, "(for -auth=ldap) Search for the user under this DN instead of using the bind template")
+	globalFlags.StringVar(&ldapSearchFilter, "ldap-search-filter", ldapSearchFilter, "(for -auth=ldap) LDAP filter to find the user; %[1]s is the user name")
+	globalFlags.StringVar(&ldapSearchDN, "ldap-search-dn", ldapSearchDN, "(for -auth=ldap) Service account DN to bind as for searches. Leave blank to search anonymously.")
+	globalFlags.StringVar(&ldapSearchPassFile, "ldap-search-password-file", ldapSearchPassFile, "(for -auth=ldap) File containing the service account password")
+	globalFlags.StringVar(&ldapGroupBase, "ldap-group-base", ldapGroupBase, "(for -auth=ldap) Look up group membership under this DN")
+	globalFlags.StringVar(&ldapGroupFilter, "ldap-group-filter", ldapGroupFilter, "(for -auth=ldap) LDAP filter to find groups; %[1]s is the user DN, %[2]s the user name")
+	globalFlags.StringVar(&ldapGroupAttr, "ldap-group-attr", ldapGroupAttr, "(for -auth=ldap) Group name attribute")
 }
 
-func backendAuthenticateLDAP(user, password string) bool {
-	c := ldap.NewLDAPConnection(ldapServer, uint16(ldapPort))
-	err := c.Connect()
+func setupLDAP() error {
+	switch ldapTLS {
+	case "none", "starttls", "ldaps":
+	default:
+		return fmt.Errorf("unknown -ldap-tls mode %q", ldapTLS)
+	}
+
+	ldapTLSConfig = &tls.Config{ServerName: ldapServer}
+	if ldapCAFile != "" {
+		bs, err := ioutil.ReadFile(ldapCAFile)
+		if err != nil {
+			return err
+		}
+		ldapTLSConfig.RootCAs = x509.NewCertPool()
+		if !ldapTLSConfig.RootCAs.AppendCertsFromPEM(bs) {
+			return fmt.Errorf("%s: no certificates found", ldapCAFile)
+		}
+	}
+
+	if ldapSearchPassFile != "" {
+		bs, err := ioutil.ReadFile(ldapSearchPassFile)
+		if err != nil {
+			return err
+		}
+		ldapSearchPass = strings.TrimSpace(string(bs))
+	}
+	return nil
+}
+
+func backendAuthenticateLDAP(user, password string) ([]string, bool) {
+	if password == "" {
+		// Would be an unauthenticated bind, which always succeeds
+		return nil, false
+	}
+
+	c, err := ldapConnect()
 	if err != nil {
 		log.Println("ldap:", err)
-		return false
+		return nil, false
+	}
+	defer c.Close()
+
+	dn, err := ldapUserDN(c, user)
+	if err != nil {
+		log.Printf("ldap: %q: %s", user, err)
+		return nil, false
 	}
 
-	err = c.Bind(fmt.Sprintf(ldapBind, user), password)
+	err = c.Bind(dn, password)
 	if err != nil {
 		log.Printf("ldap: %q: %s", user, err)
-		return false
+		return nil, false
+	}
+
+	if ldapGroupBase == "" {
+		return nil, true
+	}
+
+	if ldapSearchDN != "" {
+		// Group lookups as the service account, which may see more than the
+		// user can.
+		err = c.Bind(ldapSearchDN, ldapSearchPass)
+		if err != nil {
+			log.Println("ldap: service account:", err)
+			return nil, false
+		}
+	}
+
+	groups, err := ldapGroups(c, user, dn)
+	if err != nil {
+		log.Printf("ldap: %q: groups: %s", user, err)
+		return nil, false
+	}
+	return groups, true
+}
+
+// lookupLDAP finds the user and their groups by searching the directory,
+// which requires -ldap-search-base; with a bind template, whether the user
+// still exists can only be known by binding as them.
+func lookupLDAP(user string) ([]string, bool, error) {
+	if ldapSearchBase == "" {
+		return nil, false, errors.New("looking up users requires -ldap-search-base")
+	}
+
+	c, err := ldapConnect()
+	if err != nil {
+		return nil, false, err
 	}
 	defer c.Close()
 
-	return true
+	dn, err := ldapUserDN(c, user)
+	if err == errLDAPNoUser {
+		return nil, false, nil
+	} else if err != nil {
+		return nil, false, err
+	}
+
+	if ldapGroupBase == "" {
+		return nil, true, nil
+	}
+	groups, err := ldapGroups(c, user, dn)
+	if err != nil {
+		return nil, false, err
+	}
+	return groups, true, nil
+}
+
+// ldapConnect returns a connection to the LDAP server, secured as
+// configured.
+func ldapConnect() (*ldap.LDAPConnection, error) {
+	var c *ldap.LDAPConnection
+	switch ldapTLS {
+	case "ldaps":
+		c = ldap.NewLDAPSSLConnection(ldapServer, uint16(ldapPort), ldapTLSConfig)
+	case "starttls":
+		// The library's own StartTLS races its reader for the handshake, so
+		// the connection is upgraded before it is handed over.
+		c = ldap.NewLDAPConnection(ldapServer, uint16(ldapPort))
+		c.Dialer = ldap.Dialer(dialStartTLS)
+	default:
+		c = ldap.NewLDAPConnection(ldapServer, uint16(ldapPort))
+	}
+	c.NetworkConnectTimeout = ldapTimeout
+	c.ReadTimeout = ldapTimeout
+
+	err := c.Connect()
+	if err != nil {
+		c.Close()
+		return nil, err
+	}
+	return c, nil
+}
+
+// dialStartTLS connects to the LDAP server and performs the StartTLS
+// extended operation, returning the TLS connection.
+func dialStartTLS(network, addr string) (net.Conn, error) {
+	conn, err := net.DialTimeout(network, addr, ldapTimeout)
+	if err != nil {
+		return nil, err
+	}
+	conn.SetDeadline(time.Now().Add(ldapTimeout))
+
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Request")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimative, ber.TagInteger, 1, "MessageID"))
+	req := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationExtendedRequest, nil, "Start TLS")
+	req.AppendChild(ber.NewString(ber.ClassContext, ber.TypePrimative, 0, "1.3.6.1.4.1.1466.20037", "TLS Extended Command"))
+	p.AppendChild(req)
+
+	_, err = conn.Write(p.Bytes())
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+
+	resp, err := ber.ReadPacket(conn)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if len(resp.Children) < 2 || len(resp.Children[1].Children) < 1 {
+		conn.Close()
+		return nil, errors.New("malformed StartTLS response")
+	}
+	if code, _ := resp.Children[1].Children[0].Value.(uint64); code != 0 {
+		conn.Close()
+		return nil, fmt.Errorf("StartTLS refused (result code %d)", code)
+	}
+
+	tlsConn := tls.Client(conn, ldapTLSConfig)
+	err = tlsConn.Handshake()
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	conn.SetDeadline(time.Time{})
+	return tlsConn, nil
+}
+
+var errLDAPNoUser = errors.New("no such user")
+
+// ldapUserDN returns the DN to bind as for the user, either from the bind
+// template or by searching the directory.
+func ldapUserDN(c *ldap.LDAPConnection, user string) (string, error) {
+	if ldapSearchBase == "" {
+		return fmt.Sprintf(ldapBind, escapeDN(user)), nil
+	}
+
+	if ldapSearchDN != "" {
+		err := c.Bind(ldapSearchDN, ldapSearchPass)
+		if err != nil {
+			return "", fmt.Errorf("service account: %v", err)
+		}
+	}
+
+	filter := fmt.Sprintf(ldapSearchFilter, ldap.EscapeFilterValue(user))
+	req := ldap.NewSimpleSearchRequest(ldapSearchBase, ldap.ScopeWholeSubtree, filter, []string{"1.1"})
+	res, err := c.Search(req)
+	if err != nil {
+		return "", err
+	}
+	switch len(res.Entries) {
+	case 0:
+		return "", errLDAPNoUser
+	case 1:
+		return res.Entries[0].DN, nil
+	default:
+		return "", fmt.Errorf("%d entries match", len(res.Entries))
+	}
+}
+
+// ldapGroups returns the names of the groups the user is a member of.
+func ldapGroups(c *ldap.LDAPConnection, user, dn string) ([]string, error) {
+	filter := fmt.Sprintf(ldapGroupFilter, ldap.EscapeFilterValue(dn), ldap.EscapeFilterValue(user))
+	req := ldap.NewSimpleSearchRequest(ldapGroupBase, ldap.ScopeWholeSubtree, filter, []string{ldapGroupAttr})
+	res, err := c.Search(req)
+	if err != nil {
+		return nil, err
+	}
+
+	var groups []string
+	for _, e := range res.Entries {
+		if name := e.GetAttributeValue(ldapGroupAttr); name != "" {
+			groups = append(groups, name)
+		}
+	}
+	return groups, nil
+}
+
+// escapeDN escapes the characters that are special in a DN attribute value
+// (RFC 4514).
+func escapeDN(s string) string {
+	var b strings.Builder
+	for i, r := range s {
+		switch {
+		case strings.ContainsRune(`,+"\<>;=`, r),
+			i == 0 && (r == ' ' || r == '#'),
+			i == len(s)-1 && r == ' ':
+			b.WriteByte('\\')
+			b.WriteRune(r)
+		case r == 0:
+			b.WriteString(`\00`)
+		default:
+			b.WriteRune(r)
+		}
+	}
+	return b.String()
 }
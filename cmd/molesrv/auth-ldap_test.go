@@ -0,0 +1,365 @@
+package main
+
+import (
+	"bytes"
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"io/ioutil"
+	"math/big"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/ticket"
+	"github.com/mavricknz/asn1-ber"
+	"github.com/mavricknz/ldap"
+)
+
+// ldapTestServer is an in-process stand-in for an LDAP server, knowing just
+// enough of the protocol for the backend.
+type ldapTestServer struct {
+	listener net.Listener
+	tls      *tls.Config
+	ldaps    bool
+}
+
+type ldapTestUser struct {
+	dn, uid, mail, password string
+}
+
+var ldapTestUsers = []ldapTestUser{
+	{"uid=alice,ou=people,dc=example", "alice", "alice@example.com", "secret"},
+	{"uid=bob,ou=people,dc=example", "bob", "bob@example.com", "hunter2"},
+	{"cn=service,dc=example", "", "", "servicepw"},
+}
+
+var ldapTestGroups = map[string][]string{
+	"ops":    {"uid=alice,ou=people,dc=example"},
+	"admins": {"uid=bob,ou=people,dc=example"},
+}
+
+func newLDAPTestServer(t *testing.T, ldaps bool) *ldapTestServer {
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	s := &ldapTestServer{listener: l, tls: testTLSConfig(t), ldaps: ldaps}
+	go s.serve()
+	return s
+}
+
+func (s *ldapTestServer) serve() {
+	for {
+		conn, err := s.listener.Accept()
+		if err != nil {
+			return
+		}
+		if s.ldaps {
+			conn = tls.Server(conn, s.tls)
+		}
+		go s.handle(conn)
+	}
+}
+
+func (s *ldapTestServer) handle(conn net.Conn) {
+	defer conn.Close()
+
+	bound := ""
+	for {
+		p, err := ber.ReadPacket(conn)
+		if err != nil {
+			return
+		}
+		id := p.Children[0].Value.(uint64)
+		op := p.Children[1]
+
+		switch op.Tag {
+		case ldap.ApplicationBindRequest:
+			dn := op.Children[1].ValueString()
+			password := op.Children[2].Data.String()
+			code := uint64(ldap.LDAPResultInvalidCredentials)
+			for _, u := range ldapTestUsers {
+				if u.dn == dn && u.password == password {
+					code = ldap.LDAPResultSuccess
+					bound = dn
+				}
+			}
+			conn.Write(ldapTestResult(id, ldap.ApplicationBindResponse, code).Bytes())
+
+		case ldap.ApplicationSearchRequest:
+			if bound == "" {
+				conn.Write(ldapTestResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultInsufficientAccessRights).Bytes())
+				continue
+			}
+			base := op.Children[0].ValueString()
+			filter, _ := ldap.DecompileFilter(op.Children[6])
+			for _, e := range ldapTestSearch(base, filter) {
+				conn.Write(ldapTestEntry(id, e[0], e[1:]...).Bytes())
+			}
+			conn.Write(ldapTestResult(id, ldap.ApplicationSearchResultDone, ldap.LDAPResultSuccess).Bytes())
+
+		case ldap.ApplicationExtendedRequest:
+			// StartTLS is the only extended operation we know
+			conn.Write(ldapTestResult(id, ldap.ApplicationExtendedResponse, ldap.LDAPResultSuccess).Bytes())
+			conn = tls.Server(conn, s.tls)
+
+		case ldap.ApplicationUnbindRequest:
+			return
+		}
+	}
+}
+
+// ldapTestSearch returns the DN and the group name, if any, of the entries
+// matching the filter.
+func ldapTestSearch(base, filter string) [][]string {
+	var res [][]string
+	switch base {
+	case "ou=people,dc=example":
+		for _, u := range ldapTestUsers {
+			if u.uid != "" && (strings.Contains(filter, "(uid="+u.uid+")") || strings.Contains(filter, "(mail="+u.mail+")")) {
+				res = append(res, []string{u.dn})
+			}
+		}
+	case "ou=groups,dc=example":
+		for name, members := range ldapTestGroups {
+			for _, m := range members {
+				if strings.Contains(filter, "(member="+m+")") {
+					res = append(res, []string{"cn=" + name + ",ou=groups,dc=example", name})
+				}
+			}
+		}
+	}
+	return res
+}
+
+func ldapTestResponse(id uint64, op *ber.Packet) *ber.Packet {
+	p := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "LDAP Response")
+	p.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimative, ber.TagInteger, id, "MessageID"))
+	p.AppendChild(op)
+	return p
+}
+
+func ldapTestResult(id uint64, tag uint8, code uint64) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, tag, nil, "Result")
+	op.AppendChild(ber.NewInteger(ber.ClassUniversal, ber.TypePrimative, ber.TagEnumerated, code, "Result Code"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimative, ber.TagOctetString, "", "Matched DN"))
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimative, ber.TagOctetString, "", "Diagnostic Message"))
+	return ldapTestResponse(id, op)
+}
+
+func ldapTestEntry(id uint64, dn string, cn ...string) *ber.Packet {
+	op := ber.Encode(ber.ClassApplication, ber.TypeConstructed, ldap.ApplicationSearchResultEntry, nil, "Entry")
+	op.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimative, ber.TagOctetString, dn, "DN"))
+	attrs := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attributes")
+	if len(cn) > 0 {
+		attr := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSequence, nil, "Attribute")
+		attr.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimative, ber.TagOctetString, "cn", "Name"))
+		vals := ber.Encode(ber.ClassUniversal, ber.TypeConstructed, ber.TagSet, nil, "Values")
+		vals.AppendChild(ber.NewString(ber.ClassUniversal, ber.TypePrimative, ber.TagOctetString, cn[0], "Value"))
+		attr.AppendChild(vals)
+		attrs.AppendChild(attr)
+	}
+	op.AppendChild(attrs)
+	return ldapTestResponse(id, op)
+}
+
+// testTLSConfig returns a server configuration with a self signed
+// certificate for 127.0.0.1, which is also written to the CA file setting.
+func testTLSConfig(t *testing.T) *tls.Config {
+	priv, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		t.Fatal(err)
+	}
+	template := x509.Certificate{
+		SerialNumber:          big.NewInt(1),
+		Subject:               pkix.Name{CommonName: "ldap test"},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().Add(time.Hour),
+		IPAddresses:           []net.IP{net.ParseIP("127.0.0.1")},
+		KeyUsage:              x509.KeyUsageDigitalSignature | x509.KeyUsageCertSign,
+		ExtKeyUsage:           []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, &template, &template, &priv.PublicKey, priv)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	ldapCAFile = filepath.Join(storeDir, "ca.pem")
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	if err := ioutil.WriteFile(ldapCAFile, certPEM, 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	return &tls.Config{Certificates: []tls.Certificate{{Certificate: [][]byte{der}, PrivateKey: priv}}}
+}
+
+// withLDAPTestServer points the LDAP backend at a new test server using the
+// given connection security.
+func withLDAPTestServer(t *testing.T, mode string) func() {
+	restoreStore := withTestStore(t)
+	oldVars := []string{ldapServer, ldapBind, ldapTLS, ldapCAFile, ldapSearchBase, ldapSearchDN, ldapSearchPassFile, ldapGroupBase}
+	oldPort, oldAuth := ldapPort, auth
+
+	s := newLDAPTestServer(t, mode == "ldaps")
+	ldapServer = "127.0.0.1"
+	ldapPort = s.listener.Addr().(*net.TCPAddr).Port
+	ldapBind = "uid=%s,ou=people,dc=example"
+	ldapTLS = mode
+	ldapGroupBase = "ou=groups,dc=example"
+	auth = "ldap"
+	if err := setupLDAP(); err != nil {
+		t.Fatal(err)
+	}
+
+	return func() {
+		s.listener.Close()
+		ldapServer, ldapBind, ldapTLS, ldapCAFile, ldapSearchBase, ldapSearchDN, ldapSearchPassFile, ldapGroupBase =
+			oldVars[0], oldVars[1], oldVars[2], oldVars[3], oldVars[4], oldVars[5], oldVars[6], oldVars[7]
+		ldapPort, auth = oldPort, oldAuth
+		ldapSearchPass = ""
+		restoreStore()
+	}
+}
+
+func TestLDAPBindTemplate(t *testing.T) {
+	defer withLDAPTestServer(t, "none")()
+
+	groups, ok := backendAuthenticateLDAP("alice", "secret")
+	if !ok {
+		t.Fatal("correct password refused")
+	}
+	// Group lookups as the user themselves
+	if len(groups) != 1 || groups[0] != "ops" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+
+	if _, ok := backendAuthenticateLDAP("alice", "hunter2"); ok {
+		t.Error("incorrect password accepted")
+	}
+	if _, ok := backendAuthenticateLDAP("alice", ""); ok {
+		t.Error("empty password accepted")
+	}
+	// The user name cannot add components to the DN
+	if _, ok := backendAuthenticateLDAP("bob,ou=people", "hunter2"); ok {
+		t.Error("DN injection accepted")
+	}
+}
+
+func TestLDAPSearchStartTLS(t *testing.T) {
+	defer withLDAPTestServer(t, "starttls")()
+
+	ldapSearchBase = "ou=people,dc=example"
+	ldapSearchDN = "cn=service,dc=example"
+	ldapSearchPassFile = filepath.Join(storeDir, "ldap-password")
+	if err := ioutil.WriteFile(ldapSearchPassFile, []byte("servicepw\n"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := setupLDAP(); err != nil {
+		t.Fatal(err)
+	}
+
+	// Found by mail address
+	groups, ok := backendAuthenticateLDAP("bob@example.com", "hunter2")
+	if !ok {
+		t.Fatal("correct password refused")
+	}
+	if len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("unexpected groups %v", groups)
+	}
+
+	if _, ok := backendAuthenticateLDAP("carol", "secret"); ok {
+		t.Error("unknown user accepted")
+	}
+
+	// Lookups for ticket renewal, as the service account
+	groups, ok, err := lookupLDAP("bob")
+	if err != nil || !ok || len(groups) != 1 || groups[0] != "admins" {
+		t.Errorf("unexpected lookup %v %v %v", groups, ok, err)
+	}
+	if _, ok, err := lookupLDAP("carol"); err != nil || ok {
+		t.Errorf("unknown user found; %v", err)
+	}
+
+	// Without a service account, anonymous searches are refused by the server
+	ldapSearchDN = ""
+	if _, ok := backendAuthenticateLDAP("bob", "hunter2"); ok {
+		t.Error("anonymous search succeeded")
+	}
+}
+
+func TestLDAPS(t *testing.T) {
+	defer withLDAPTestServer(t, "ldaps")()
+
+	if _, ok := backendAuthenticateLDAP("alice", "secret"); !ok {
+		t.Error("correct password refused")
+	}
+
+	// An untrusted server certificate is refused
+	os.Remove(ldapCAFile)
+	ldapCAFile = ""
+	if err := setupLDAP(); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := backendAuthenticateLDAP("alice", "secret"); ok {
+		t.Error("untrusted server accepted")
+	}
+}
+
+func TestLDAPTicketGroups(t *testing.T) {
+	defer withLDAPTestServer(t, "none")()
+
+	grant := func(user, password string) *httptest.ResponseRecorder {
+		req, _ := http.NewRequest("POST", "/ticket/"+user, bytes.NewBufferString(password))
+		req.RemoteAddr = "192.0.2.42:1234"
+		rec := httptest.NewRecorder()
+		grantTicket(rec, req)
+		return rec
+	}
+
+	rec := grant("alice", "secret")
+	if rec.Code != 200 {
+		t.Fatalf("unexpected response %d", rec.Code)
+	}
+	tic, err := ticket.VerifyTicket(rec.Body.String(), "192.0.2.42", time.Now().Unix())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(tic.Groups) != 1 || tic.Groups[0] != "ops" {
+		t.Errorf("unexpected ticket groups %v", tic.Groups)
+	}
+
+	defer func(old string) { requireGroup = old }(requireGroup)
+	requireGroup = "admins"
+	if rec := grant("alice", "secret"); rec.Code != 403 {
+		t.Errorf("ticket granted without required group; %d", rec.Code)
+	}
+	if rec := grant("bob", "hunter2"); rec.Code != 200 {
+		t.Errorf("ticket refused with required group; %d", rec.Code)
+	}
+}
+
+func TestEscapeDN(t *testing.T) {
+	cases := [][2]string{
+		{"alice", "alice"},
+		{"bob,ou=admins", `bob\,ou\=admins`},
+		{" #x ", `\ #x\ `},
+		{"a+b<c>", `a\+b\<c\>`},
+	}
+	for _, tc := range cases {
+		if e := escapeDN(tc[0]); e != tc[1] {
+			t.Errorf("escapeDN(%q) = %q, expected %q", tc[0], e, tc[1])
+		}
+	}
+}
@@ -1,6 +1,7 @@
 package main
 
 import (
+	"fmt"
 	"net"
 	"net/http"
 	"time"
@@ -8,21 +9,49 @@ import (
 	"github.com/calmh/mole/ticket"
 )
 
-var authBackends = map[string]func(string, string) bool{
+// An authentication backend verifies the password and returns the groups
+// the user is a member of.
+type authBackend func(user, password string) (groups []string, ok bool)
+
+var authBackends = map[string]authBackend{
 	"none": nil, // The nil backend always succeeds
 }
 
-func backendAuthenticate(user, password string) bool {
+// An account lookup returns the current groups of a user that exists and
+// may log in, without authenticating them, for renewing their tickets. An
+// error means the backend cannot tell.
+type authLookup func(user string) (groups []string, ok bool, err error)
+
+var authLookups = map[string]authLookup{
+	"none": nil, // The nil lookup always succeeds
+}
+
+// authSetup holds the functions that prepare backends for use, called on
+// startup for the selected backend.
+var authSetup = map[string]func() error{}
+
+func backendAuthenticate(user, password string) ([]string, bool) {
 	fn, ok := authBackends[auth]
 	if !ok {
-		return false
+		return nil, false
 	}
 	if fn == nil {
-		return true
+		return nil, true
 	}
 	return fn(user, password)
 }
 
+func backendLookup(user string) ([]string, bool, error) {
+	fn, ok := authLookups[auth]
+	if !ok {
+		return nil, false, fmt.Errorf("backend %q cannot look up users", auth)
+	}
+	if fn == nil {
+		return nil, true, nil
+	}
+	return fn(user)
+}
+
 func authenticate(rw http.ResponseWriter, req *http.Request) bool {
 	tic := req.Header.Get("X-Mole-Ticket")
 	if tic == "" {
@@ -40,12 +69,17 @@ func authenticate(rw http.ResponseWriter, req *http.Request) bool {
 		panic("bug: empty remote address")
 	}
 
-	user, err := ticket.Verify(tic, ip, time.Now().Unix())
+	dec, err := ticket.VerifyTicket(tic, ip, time.Now().Unix())
 	if err != nil {
 		return false
 	}
+	if ticketRevoked(dec) {
+		return false
+	}
 
-	rw.Header().Set("X-Mole-Authenticated", user)
-	req.Header.Set("X-Mole-Authenticated", user)
+	rw.Header().Set("X-Mole-Authenticated", dec.User)
+	req.Header.Set("X-Mole-Authenticated", dec.User)
+	// Replaces anything the client might have sent
+	req.Header["X-Mole-Groups"] = dec.Groups
 	return true
 }
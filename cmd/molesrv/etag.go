@@ -0,0 +1,56 @@
+package main
+
+import (
+	"crypto/sha256"
+	"fmt"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+)
+
+// storeWriteLock serializes changes to tunnel definitions, so that the
+// version a change is conditional on cannot change before it is made.
+var storeWriteLock sync.Mutex
+
+// contentETag returns the ETag of a tunnel definition with the contents.
+func contentETag(data []byte) string {
+	return fmt.Sprintf(`"%x"`, sha256.Sum256(data))
+}
+
+// tunnelETag returns the ETag of the stored tunnel definition, or "" if
+// there is none.
+func tunnelETag(tun string) (string, error) {
+	data, err := ioutil.ReadFile(path.Join(storeDir, "data", tun))
+	if os.IsNotExist(err) {
+		return "", nil
+	} else if err != nil {
+		return "", err
+	}
+	return contentETag(data), nil
+}
+
+// preconditionFailed returns true if the If-Match or If-None-Match header
+// of the request rules out the current version, with ETag "" when there is
+// none.
+func preconditionFailed(req *http.Request, current string) bool {
+	if m := req.Header.Get("If-Match"); m != "" {
+		return current == "" || !etagListMatches(m, current)
+	}
+	if m := req.Header.Get("If-None-Match"); m != "" {
+		return current != "" && etagListMatches(m, current)
+	}
+	return false
+}
+
+func etagListMatches(list, etag string) bool {
+	for _, e := range strings.Split(list, ",") {
+		e = strings.TrimSpace(e)
+		if e == "*" || strings.TrimPrefix(e, "W/") == etag {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"fmt"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestConditionalPut(t *testing.T) {
+	defer withTestStore(t)()
+	keys = map[string]string{"a1b2": "hunter2"}
+	writeStoreFile(t, "acl.json", testACL)
+	writeStoreFile(t, "open.ini", fmt.Sprintf(testTunnel, "a1b2"))
+	body := []byte(fmt.Sprintf(testTunnel, "a1b2"))
+
+	put := func(header, etag string, body []byte) *httptest.ResponseRecorder {
+		req := testRequest("PUT", "/store/new.ini", "alice", body)
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		rec := httptest.NewRecorder()
+		putFile(rec, req)
+		return rec
+	}
+
+	// Creating only if there is none
+	rec := put("If-None-Match", "*", body)
+	if rec.Code != 200 || rec.Header().Get("ETag") == "" {
+		t.Fatalf("unexpected put response %d: %s", rec.Code, rec.Body)
+	}
+	first := rec.Header().Get("ETag")
+	if rec := put("If-None-Match", "*", body); rec.Code != 412 || rec.Header().Get("ETag") != first {
+		t.Errorf("unexpected put response %d for existing tunnel", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	getFile(rec, testRequest("GET", "/store/new.ini", "alice", nil))
+	if rec.Header().Get("ETag") != first {
+		t.Errorf("get ETag %q != put ETag %q", rec.Header().Get("ETag"), first)
+	}
+
+	// A change to the fetched version is accepted once
+	changed := []byte(strings.Replace(string(body), "Test", "Changed", 1))
+	rec = put("If-Match", first, changed)
+	if rec.Code != 200 || rec.Header().Get("ETag") == first {
+		t.Fatalf("unexpected put response %d: %s", rec.Code, rec.Body)
+	}
+	if rec := put("If-Match", first, body); rec.Code != 412 {
+		t.Errorf("unexpected put response %d for stale version", rec.Code)
+	}
+
+	// Unconditional pushes overwrite as before
+	if rec := put("", "", body); rec.Code != 200 {
+		t.Errorf("unexpected put response %d without precondition", rec.Code)
+	}
+}
+
+func TestConditionalDelete(t *testing.T) {
+	defer withTestStore(t)()
+	keys = map[string]string{"a1b2": "hunter2"}
+	writeStoreFile(t, "acl.json", testACL)
+	writeStoreFile(t, "open.ini", fmt.Sprintf(testTunnel, "a1b2"))
+
+	rm := func(header, etag, tun string) *httptest.ResponseRecorder {
+		req := testRequest("DELETE", "/store/"+tun, "alice", nil)
+		if header != "" {
+			req.Header.Set(header, etag)
+		}
+		rec := httptest.NewRecorder()
+		rmFile(rec, req)
+		return rec
+	}
+
+	rec := httptest.NewRecorder()
+	getFile(rec, testRequest("GET", "/store/open.ini", "alice", nil))
+	current := rec.Header().Get("ETag")
+
+	// A stale version is not deleted
+	if rec := rm("If-Match", `"0123"`, "open.ini"); rec.Code != 412 || rec.Header().Get("ETag") != current {
+		t.Errorf("unexpected delete response %d for stale version", rec.Code)
+	}
+	if rec := rm("If-Match", current, "open.ini"); rec.Code != 200 {
+		t.Errorf("unexpected delete response %d: %s", rec.Code, rec.Body)
+	}
+
+	// Nor is a tunnel that does not exist
+	if rec := rm("", "", "open.ini"); rec.Code != 404 {
+		t.Errorf("unexpected delete response %d for deleted tunnel", rec.Code)
+	}
+	if rec := rm("If-Match", current, "open.ini"); rec.Code != 412 {
+		t.Errorf("unexpected delete response %d for deleted tunnel", rec.Code)
+	}
+}
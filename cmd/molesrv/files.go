@@ -0,0 +1,24 @@
+package main
+
+import "os"
+
+// writeFileAtomic replaces the file with one containing data, so that
+// readers see either the old or the new contents in full.
+func writeFileAtomic(file string, data []byte, mode os.FileMode) error {
+	fd, err := os.OpenFile(file+".part", os.O_WRONLY|os.O_CREATE|os.O_TRUNC, mode)
+	if err != nil {
+		return err
+	}
+	_, err = fd.Write(data)
+	if err == nil {
+		err = fd.Sync()
+	}
+	if cerr := fd.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(file + ".part")
+		return err
+	}
+	return os.Rename(file+".part", file)
+}
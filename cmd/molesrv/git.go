@@ -1,9 +1,11 @@
 package main
 
 import (
+	"bytes"
 	"fmt"
 	"log"
 	"os/exec"
+	"strings"
 )
 
 func gitCommit(dir, comment, user string) {
@@ -17,6 +19,17 @@ func gitCommit(dir, comment, user string) {
 		return
 	}
 
+	if !keysEncrypted() {
+		// Secrets are only committed when encrypted
+		cmd = exec.Command("git", "reset", "-q", "--", "keys.json")
+		cmd.Dir = dir
+		_, err = cmd.CombinedOutput()
+		if err != nil {
+			log.Println("git:", err)
+			return
+		}
+	}
+
 	author := fmt.Sprintf("%s <%s@mole>", user, user)
 	cmd = exec.Command("git", "commit", "--author", author, "-m", comment)
 	cmd.Dir = dir
@@ -38,3 +51,19 @@ func gitInit(dir string) {
 		return
 	}
 }
+
+// gitOutput runs git in the directory and returns what it prints.
+func gitOutput(dir string, args ...string) ([]byte, error) {
+	cmd := exec.Command("git", args...)
+	cmd.Dir = dir
+	var stderr bytes.Buffer
+	cmd.Stderr = &stderr
+	out, err := cmd.Output()
+	if err != nil {
+		if msg := strings.TrimSpace(stderr.String()); msg != "" {
+			return nil, fmt.Errorf("git %s: %s", args[0], msg)
+		}
+		return nil, fmt.Errorf("git %s: %v", args[0], err)
+	}
+	return out, nil
+}
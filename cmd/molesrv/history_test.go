@@ -0,0 +1,96 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"net/http/httptest"
+	"os"
+	"os/exec"
+	"path"
+	"strings"
+	"testing"
+)
+
+func TestTunnelHistory(t *testing.T) {
+	if _, err := exec.LookPath("git"); err != nil {
+		t.Skip("git not available")
+	}
+	defer withTestStore(t)()
+	for _, v := range []string{"GIT_AUTHOR_NAME", "GIT_AUTHOR_EMAIL", "GIT_COMMITTER_NAME", "GIT_COMMITTER_EMAIL"} {
+		old, ok := os.LookupEnv(v)
+		os.Setenv(v, "test")
+		if ok {
+			defer os.Setenv(v, old)
+		} else {
+			defer os.Unsetenv(v)
+		}
+	}
+	keys = map[string]string{"a1b2": "hunter2", "c3d4": "s3cr3t"}
+	writeStoreFile(t, "acl.json", testACL)
+	disableGit = false
+	dir := path.Join(storeDir, "data")
+	gitInit(dir)
+	gitCommit(dir, "Initial", "server")
+
+	writeStoreFile(t, "open.ini", fmt.Sprintf(testTunnel, "a1b2"))
+	gitCommit(dir, "push open.ini", "alice")
+	writeStoreFile(t, "open.ini", strings.Replace(fmt.Sprintf(testTunnel, "c3d4"), "Test", "Changed", 1))
+	gitCommit(dir, "push open.ini", "carol")
+
+	rec := httptest.NewRecorder()
+	tunnelHistory(rec, testRequest("GET", "/history/open", "alice", nil))
+	var revs []revision
+	if err := json.NewDecoder(rec.Body).Decode(&revs); err != nil {
+		t.Fatal(err)
+	}
+	if len(revs) != 2 || revs[0].Author != "carol" || revs[1].Author != "alice" || revs[0].Comment != "push open.ini" {
+		t.Fatalf("unexpected history %+v", revs)
+	}
+
+	// The latest change, with secrets as references
+	rec = httptest.NewRecorder()
+	tunnelDiff(rec, testRequest("GET", "/diff/open", "alice", nil))
+	diff := rec.Body.String()
+	if !strings.Contains(diff, "-password = $mole$a1b2") || !strings.Contains(diff, "+password = $mole$c3d4") || strings.Contains(diff, "hunter2") {
+		t.Errorf("unexpected diff\n%s", diff)
+	}
+
+	rec = httptest.NewRecorder()
+	tunnelDiff(rec, testRequest("GET", "/diff/open?rev=--output=x", "alice", nil))
+	if rec.Code != 400 {
+		t.Errorf("unexpected diff response %d for bad revision", rec.Code)
+	}
+
+	// Only writers may revert
+	rec = httptest.NewRecorder()
+	revertTunnel(rec, testRequest("POST", "/revert/open?rev="+revs[1].Rev[:8], "bob", nil))
+	if rec.Code != 403 {
+		t.Errorf("unexpected revert response %d", rec.Code)
+	}
+
+	rec = httptest.NewRecorder()
+	revertTunnel(rec, testRequest("POST", "/revert/open?rev="+revs[1].Rev[:8], "alice", nil))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected revert response %d: %s", rec.Code, rec.Body)
+	}
+	bs, _ := ioutil.ReadFile(path.Join(dir, "open.ini"))
+	if string(bs) != fmt.Sprintf(testTunnel, "a1b2") {
+		t.Errorf("not reverted:\n%s", bs)
+	}
+	rec = httptest.NewRecorder()
+	tunnelHistory(rec, testRequest("GET", "/history/open", "alice", nil))
+	revs = nil
+	json.NewDecoder(rec.Body).Decode(&revs)
+	if len(revs) != 3 || revs[0].Author != "alice" || !strings.HasPrefix(revs[0].Comment, "revert open.ini to ") {
+		t.Errorf("revert not committed; %+v", revs)
+	}
+
+	// A revision referencing removed keys is not restored
+	delete(keys, "a1b2")
+	rec = httptest.NewRecorder()
+	revertTunnel(rec, testRequest("POST", "/revert/open?rev="+revs[2].Rev, "alice", nil))
+	if rec.Code != 409 {
+		t.Errorf("unexpected revert response %d with missing key", rec.Code)
+	}
+}
@@ -17,7 +17,19 @@ func init() {
 
 // DEPRECATE
 func getKey(rw http.ResponseWriter, req *http.Request) {
-	if key, ok := keys[req.URL.Path[5:]]; ok {
+	refs, ok := readableKeyRefs(req, req.URL.Path[5:])
+	if !ok {
+		denyAccess(rw, req, "key "+req.URL.Path[5:])
+		return
+	}
+	key, ok, err := secrets.Get(req.URL.Path[5:])
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if ok {
+		audit(req, keyAuditComment(map[string][]keyRef{req.URL.Path[5:]: refs}))
 		bs, _ := json.Marshal(struct {
 			Key string `json:"key"`
 		}{key})
@@ -26,15 +26,29 @@ func getKeys(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	released := make(map[string][]keyRef)
 	for _, key := range keylist {
-		if secret, ok := keys[key]; ok {
+		refs, ok := readableKeyRefs(req, key)
+		if !ok {
+			denyAccess(rw, req, "key "+key)
+			return
+		}
+		secret, ok, err := secrets.Get(key)
+		if err != nil {
+			rw.WriteHeader(500)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if ok {
 			keymap[key] = secret
+			released[key] = refs
 		} else {
 			rw.WriteHeader(404)
 			rw.Write([]byte(key))
 			return
 		}
 	}
+	audit(req, keyAuditComment(released))
 
 	rw.Header().Set("Content-Type", "application/json")
 	json.NewEncoder(rw).Encode(keymap)
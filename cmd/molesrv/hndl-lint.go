@@ -0,0 +1,87 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+
+	"github.com/calmh/mole/conf"
+)
+
+func init() {
+	addHandler(handler{
+		pattern: "/lint/",
+		method:  "POST",
+		fn:      lintTunnel,
+		auth:    true,
+		ro:      true,
+	})
+}
+
+// lintTunnel returns the warnings for the posted definition, were it pushed
+// as the named tunnel.
+func lintTunnel(rw http.ResponseWriter, req *http.Request) {
+	name := req.URL.Path[6:]
+	if !filenamePattern.MatchString(name + ".ini") {
+		rw.WriteHeader(404)
+		return
+	}
+
+	data, err := ioutil.ReadAll(req.Body)
+	req.Body.Close()
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	cfg, err := conf.Load(bytes.NewReader(data))
+	if err != nil {
+		rw.WriteHeader(400)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	ws := cfg.Lint(otherConfigs(req, name))
+	if ws == nil {
+		ws = []conf.Warning{}
+	}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(ws)
+}
+
+// otherConfigs returns the tunnels other than the named one that the user
+// of the request may read, to check for conflicts with.
+func otherConfigs(req *http.Request, name string) map[string]*conf.Config {
+	files, _ := filepath.Glob(path.Join(storeDir, "data", "*.ini"))
+	others := make(map[string]*conf.Config)
+	for _, file := range files {
+		other := path.Base(file[:len(file)-4])
+		if other == name {
+			continue
+		}
+		fd, err := os.Open(file)
+		if err != nil {
+			continue
+		}
+		cfg, err := conf.Load(fd)
+		fd.Close()
+		if err != nil {
+			continue
+		}
+		if mayAccess(req, other, cfg.Access, permRead) {
+			others[other] = cfg
+		}
+	}
+	return others
+}
+
+// addWarnings adds the warnings to the response, one header each.
+func addWarnings(rw http.ResponseWriter, ws []conf.Warning) {
+	for _, w := range ws {
+		rw.Header().Add("X-Mole-Warning", w.String())
+	}
+}
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"log"
+	"net/http"
+
+	"github.com/calmh/mole/ticket"
+)
+
+func init() {
+	addHandler(handler{
+		pattern: "/logout",
+		method:  "POST",
+		fn:      logout,
+		auth:    true,
+		ro:      true,
+	})
+	addHandler(handler{
+		pattern: "/revoke/",
+		method:  "POST",
+		fn:      revokeUserTickets,
+		auth:    true,
+		ro:      true,
+	})
+}
+
+// logout revokes the ticket the request is made with.
+func logout(rw http.ResponseWriter, req *http.Request) {
+	tic, err := ticket.Load(req.Header.Get("X-Mole-Ticket"))
+	if err != nil {
+		rw.WriteHeader(403)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if len(tic.ID) == 0 {
+		// Granted before tickets had IDs
+		rw.WriteHeader(400)
+		rw.Write([]byte("ticket cannot be revoked individually"))
+		return
+	}
+
+	if err := revokeTicket(tic); err != nil {
+		log.Println("revocations:", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("Ticket %x for %q revoked by logout", tic.ID, tic.User)
+}
+
+// revokeUserTickets handles /revoke/<user>, revoking all tickets granted to
+// the user so far. Only admins may revoke the tickets of others.
+func revokeUserTickets(rw http.ResponseWriter, req *http.Request) {
+	user := req.URL.Path[8:]
+	if user == "" {
+		rw.WriteHeader(404)
+		return
+	}
+	if user != req.Header.Get("X-Mole-Authenticated") && !unrestricted(req, currentACL()) {
+		denyAccess(rw, req, "revoke tickets of "+user)
+		return
+	}
+
+	if err := revokeUser(user); err != nil {
+		log.Println("revocations:", err)
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	log.Printf("All tickets for %q revoked by %q", user, req.Header.Get("X-Mole-Authenticated"))
+}
@@ -16,6 +16,23 @@ func init() {
 }
 
 func getFile(rw http.ResponseWriter, req *http.Request) {
-	iniFile := path.Join(storeDir, "data", req.URL.Path[7:])
+	tun := req.URL.Path[7:]
+	if !filenamePattern.MatchString(tun) {
+		rw.WriteHeader(404)
+		return
+	}
+
+	name := tun[:len(tun)-4]
+	if !mayAccess(req, name, tunnelAccess(name), permRead) {
+		denyAccess(rw, req, name)
+		return
+	}
+
+	// Sent back in If-Match to push changes to this version
+	if etag, err := tunnelETag(tun); err == nil && etag != "" {
+		rw.Header().Set("ETag", etag)
+	}
+
+	iniFile := path.Join(storeDir, "data", tun)
 	http.ServeFile(rw, req, iniFile)
 }
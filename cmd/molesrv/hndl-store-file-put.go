@@ -4,7 +4,6 @@ import (
 	"bytes"
 	"io/ioutil"
 	"net/http"
-	"os"
 	"path"
 	"regexp"
 
@@ -22,22 +21,9 @@ func init() {
 	})
 }
 
-var obfuscateKeys = []string{
-	"key",
-	"password",
-	"IPSec_secret",
-	"Xauth_password",
-}
-
 var filenamePattern = regexp.MustCompile(`^[a-z0-9_-]+\.ini$`)
 
 func putFile(rw http.ResponseWriter, req *http.Request) {
-	defer func() {
-		defer listCacheLock.Unlock()
-		listCacheLock.Lock()
-		listCache = nil
-	}()
-
 	tun := req.URL.Path[7:]
 	if !filenamePattern.MatchString(tun) {
 		rw.WriteHeader(403)
@@ -45,6 +31,19 @@ func putFile(rw http.ResponseWriter, req *http.Request) {
 		return
 	}
 
+	// The rules of the stored definition apply, or the defaults for a new one
+	name := tun[:len(tun)-4]
+	if !mayAccess(req, name, tunnelAccess(name), permWrite) {
+		denyAccess(rw, req, name)
+		return
+	}
+
+	defer func() {
+		defer listCacheLock.Unlock()
+		listCacheLock.Lock()
+		updateListCache(name)
+	}()
+
 	iniFile := path.Join(storeDir, "data", tun)
 	// Read pushed data
 	data, err := ioutil.ReadAll(req.Body)
@@ -56,45 +55,68 @@ func putFile(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	// Verify the configuration
-	_, err = conf.Load(bytes.NewBuffer(data))
+	cfg, err := conf.Load(bytes.NewBuffer(data))
 	if err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
 
+	// Only change the version the client expects
+	storeWriteLock.Lock()
+	defer storeWriteLock.Unlock()
+	current, err := tunnelETag(tun)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if preconditionFailed(req, current) {
+		if current != "" {
+			rw.Header().Set("ETag", current)
+		}
+		rw.WriteHeader(412)
+		rw.Write([]byte("the tunnel has been changed on the server"))
+		return
+	}
+
 	// Get the raw INI
 	inf := ini.Parse(bytes.NewBuffer(data))
 
+	// Obfuscated values are kept as they are, so they must not give access
+	// to keys the user cannot otherwise read
+	if key, ok := foreignKey(req, iniFile, inf); !ok {
+		rw.WriteHeader(403)
+		rw.Write([]byte("reference to key " + key + " not allowed"))
+		return
+	}
+
 	// Obfuscate
-	shouldSaveKeys := false
 	for _, section := range inf.Sections() {
 		for _, option := range inf.Options(section) {
-			for i := range obfuscateKeys {
-				if option == obfuscateKeys[i] {
-					val := inf.Get(section, option)
-					if oval := obfuscate(val); oval != val {
-						inf.Set(section, option, oval)
-						shouldSaveKeys = true
-					}
-					break
+			if conf.IsSecretField(section, option) {
+				val := inf.Get(section, option)
+				oval, err := obfuscate(val)
+				if err != nil {
+					rw.WriteHeader(500)
+					rw.Write([]byte(err.Error()))
+					return
 				}
+				inf.Set(section, option, oval)
 			}
 		}
 	}
-	if shouldSaveKeys {
-		saveKeys()
-	}
 
 	// Save
-	outf, err := os.Create(iniFile)
-	if err != nil {
+	var buf bytes.Buffer
+	inf.Write(&buf)
+	if err := writeFileAtomic(iniFile, buf.Bytes(), 0644); err != nil {
 		rw.WriteHeader(500)
 		rw.Write([]byte(err.Error()))
 		return
 	}
-	inf.Write(outf)
-	outf.Close()
+	rw.Header().Set("ETag", contentETag(buf.Bytes()))
+	addWarnings(rw, cfg.Lint(otherConfigs(req, name)))
 
 	if !disableGit {
 		// Commit
@@ -103,3 +125,39 @@ func putFile(rw http.ResponseWriter, req *http.Request) {
 		gitCommit(dir, "push "+tun, user)
 	}
 }
+
+// foreignKey returns a key referenced by the definition that is neither
+// referenced by the stored version of it, nor readable by the user of the
+// request, and false. It returns true if there is no such key.
+func foreignKey(req *http.Request, iniFile string, inf ini.Config) (string, bool) {
+	stored := make(map[string]bool)
+	if bs, err := ioutil.ReadFile(iniFile); err == nil {
+		cur := ini.Parse(bytes.NewReader(bs))
+		for _, key := range obfuscatedKeys(cur) {
+			stored[key] = true
+		}
+	}
+
+	for _, key := range obfuscatedKeys(inf) {
+		if stored[key] {
+			continue
+		}
+		if _, ok := readableKeyRefs(req, key); !ok {
+			return key, false
+		}
+	}
+	return "", true
+}
+
+// obfuscatedKeys returns the obfuscation keys referenced by the definition.
+func obfuscatedKeys(inf ini.Config) []string {
+	var keys []string
+	for _, section := range inf.Sections() {
+		for _, val := range inf.OptionMap(section) {
+			for _, m := range obfuscatedRe.FindAllStringSubmatch(val, -1) {
+				keys = append(keys, m[1])
+			}
+		}
+	}
+	return keys
+}
@@ -17,16 +17,46 @@ func init() {
 }
 
 func rmFile(rw http.ResponseWriter, req *http.Request) {
+	tun := req.URL.Path[7:]
+	if !filenamePattern.MatchString(tun) {
+		rw.WriteHeader(404)
+		return
+	}
+
+	name := tun[:len(tun)-4]
+	if !mayAccess(req, name, tunnelAccess(name), permWrite) {
+		denyAccess(rw, req, name)
+		return
+	}
+
 	defer func() {
 		defer listCacheLock.Unlock()
 		listCacheLock.Lock()
-		listCache = nil
+		updateListCache(name)
 	}()
 
-	tun := req.URL.Path[7:]
+	// Only delete the version the client expects
+	storeWriteLock.Lock()
+	defer storeWriteLock.Unlock()
+	current, err := tunnelETag(tun)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if preconditionFailed(req, current) {
+		if current != "" {
+			rw.Header().Set("ETag", current)
+		}
+		rw.WriteHeader(412)
+		rw.Write([]byte("the tunnel has been changed on the server"))
+		return
+	}
+
 	iniFile := path.Join(storeDir, "data", tun)
 	if err := os.Rename(iniFile, iniFile+".deleted"); err != nil {
 		rw.WriteHeader(404)
+		return
 	}
 
 	if !disableGit {
@@ -0,0 +1,210 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"path"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"github.com/calmh/mole/conf"
+)
+
+func init() {
+	addHandler(handler{
+		pattern: "/history/",
+		method:  "GET",
+		fn:      tunnelHistory,
+		auth:    true,
+		ro:      true,
+	})
+	addHandler(handler{
+		pattern: "/diff/",
+		method:  "GET",
+		fn:      tunnelDiff,
+		auth:    true,
+		ro:      true,
+	})
+	addHandler(handler{
+		pattern: "/revert/",
+		method:  "POST",
+		fn:      revertTunnel,
+		auth:    true,
+		ro:      false,
+	})
+}
+
+// A revision is a commit changing a tunnel definition.
+type revision struct {
+	Rev     string
+	Author  string
+	Date    int64
+	Comment string
+}
+
+var revPattern = regexp.MustCompile(`^[0-9a-f]{4,40}$`)
+
+// historyTunnel returns the tunnel named by the request after the prefix,
+// if it may be accessed, or writes an error response.
+func historyTunnel(rw http.ResponseWriter, req *http.Request, prefix string, perm int) (string, bool) {
+	name := strings.TrimPrefix(req.URL.Path, prefix)
+	if !filenamePattern.MatchString(name + ".ini") {
+		rw.WriteHeader(404)
+		return "", false
+	}
+	if disableGit {
+		rw.WriteHeader(404)
+		rw.Write([]byte("the store has no history"))
+		return "", false
+	}
+	if !mayAccess(req, name, tunnelAccess(name), perm) {
+		denyAccess(rw, req, name)
+		return "", false
+	}
+	return name, true
+}
+
+// resolveRev returns the full commit ID of the revision in the request.
+func resolveRev(rw http.ResponseWriter, req *http.Request) (string, bool) {
+	rev := req.URL.Query().Get("rev")
+	if !revPattern.MatchString(rev) {
+		rw.WriteHeader(400)
+		rw.Write([]byte("bad revision"))
+		return "", false
+	}
+	out, err := gitOutput(path.Join(storeDir, "data"), "rev-parse", "--verify", "-q", rev+"^{commit}")
+	if err != nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte("no such revision " + rev))
+		return "", false
+	}
+	return strings.TrimSpace(string(out)), true
+}
+
+func tunnelHistory(rw http.ResponseWriter, req *http.Request) {
+	name, ok := historyTunnel(rw, req, "/history/", permRead)
+	if !ok {
+		return
+	}
+
+	out, err := gitOutput(path.Join(storeDir, "data"), "log", "--format=%H%x1f%an%x1f%at%x1f%s", "--", name+".ini")
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	revs := []revision{}
+	for _, line := range strings.Split(strings.TrimSpace(string(out)), "\n") {
+		fields := strings.SplitN(line, "\x1f", 4)
+		if len(fields) != 4 {
+			continue
+		}
+		date, _ := strconv.ParseInt(fields[2], 10, 64)
+		revs = append(revs, revision{Rev: fields[0], Author: fields[1], Date: date, Comment: fields[3]})
+	}
+	if len(revs) == 0 {
+		rw.WriteHeader(404)
+		return
+	}
+
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(revs)
+}
+
+// tunnelDiff returns the changes to the tunnel since the revision, or the
+// latest change when no revision is given. Secrets are stored obfuscated
+// and so appear as references.
+func tunnelDiff(rw http.ResponseWriter, req *http.Request) {
+	name, ok := historyTunnel(rw, req, "/diff/", permRead)
+	if !ok {
+		return
+	}
+
+	args := []string{"log", "-1", "-p", "--format=", "--no-color", "--no-ext-diff", "--", name + ".ini"}
+	if req.URL.Query().Get("rev") != "" {
+		rev, ok := resolveRev(rw, req)
+		if !ok {
+			return
+		}
+		args = []string{"diff", "--no-color", "--no-ext-diff", rev, "--", name + ".ini"}
+	}
+
+	out, err := gitOutput(path.Join(storeDir, "data"), args...)
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("Content-Type", "text/plain; charset=utf-8")
+	rw.Write(out)
+}
+
+// revertTunnel restores the tunnel as it was in the revision, as a new
+// commit.
+func revertTunnel(rw http.ResponseWriter, req *http.Request) {
+	name, ok := historyTunnel(rw, req, "/revert/", permWrite)
+	if !ok {
+		return
+	}
+	rev, ok := resolveRev(rw, req)
+	if !ok {
+		return
+	}
+
+	defer func() {
+		defer listCacheLock.Unlock()
+		listCacheLock.Lock()
+		updateListCache(name)
+	}()
+
+	storeWriteLock.Lock()
+	defer storeWriteLock.Unlock()
+
+	dir := path.Join(storeDir, "data")
+	tun := name + ".ini"
+	data, err := gitOutput(dir, "show", rev+":"+tun)
+	if err != nil {
+		rw.WriteHeader(404)
+		rw.Write([]byte(fmt.Sprintf("%s does not exist in revision %s", tun, rev)))
+		return
+	}
+	if _, err := conf.Load(bytes.NewReader(data)); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	// The keys may have been removed since
+	var missing []string
+	for _, m := range obfuscatedRe.FindAllSubmatch(data, -1) {
+		_, ok, err := secrets.Get(string(m[1]))
+		if err != nil {
+			rw.WriteHeader(500)
+			rw.Write([]byte(err.Error()))
+			return
+		}
+		if !ok {
+			missing = append(missing, string(m[1]))
+		}
+	}
+	if len(missing) > 0 {
+		rw.WriteHeader(409)
+		rw.Write([]byte("revision references keys no longer in the key store: " + strings.Join(missing, ", ")))
+		return
+	}
+
+	if err := writeFileAtomic(path.Join(dir, tun), data, 0644); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	rw.Header().Set("ETag", contentETag(data))
+	audit(req, "reverted "+tun+" to "+rev)
+
+	user := req.Header.Get("X-Mole-Authenticated")
+	gitCommit(dir, fmt.Sprintf("revert %s to %.8s", tun, rev), user)
+}
@@ -1,15 +1,21 @@
 package main
 
 import (
+	"bytes"
 	"encoding/json"
+	"io/ioutil"
 	"log"
 	"net/http"
 	"os"
 	"path"
 	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
 	"sync"
 
 	"github.com/calmh/mole/conf"
+	"github.com/calmh/mole/ini"
 )
 
 func init() {
@@ -25,63 +31,203 @@ func init() {
 var listCache []listItem
 var listCacheLock sync.Mutex
 
+// keyIndex maps obfuscation keys to where they are referenced. It is built
+// along with listCache and kept up to date by putFile and rmFile.
+var keyIndex map[string][]keyRef
+
+// A keyRef is a reference to an obfuscation key from an option of a tunnel
+// definition.
+type keyRef struct {
+	Tunnel  string
+	Section string
+	Option  string
+}
+
+func (r keyRef) String() string {
+	return r.Tunnel + " [" + r.Section + "] " + r.Option
+}
+
+var obfuscatedRe = regexp.MustCompile(`\$mole\$([0-9a-zA-Z+/-]+)`)
+
 type listItem struct {
 	Name        string
 	Description string
 	Hosts       []string
 	Version     float64
 	Features    uint32
+
+	access *conf.Access
 }
 
 func storeList(rw http.ResponseWriter, req *http.Request) {
 	defer listCacheLock.Unlock()
 	listCacheLock.Lock()
 
-	if listCache == nil {
-		files, err := filepath.Glob(storeDir + "/data/*.ini")
-		if err != nil {
-			rw.WriteHeader(500)
-			rw.Write([]byte(err.Error()))
-			return
+	if err := loadListCache(); err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	items := []listItem{}
+	for _, item := range listCache {
+		if mayAccess(req, item.Name, item.access, permRead) {
+			items = append(items, item)
 		}
+	}
 
-		for _, file := range files {
-			item := listItem{
-				Name: path.Base(file[:len(file)-4]),
-			}
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(items)
+}
 
-			f, err := os.Open(file)
-			if err != nil {
-				log.Printf("Warning: %q: %s", file, err)
-				item.Features = conf.FeatureError
-				item.Description = "- unreadable -"
-				listCache = append(listCache, item)
-				continue
-			}
+// loadListCache builds listCache and keyIndex, unless already done. The
+// caller must hold listCacheLock.
+func loadListCache() error {
+	if listCache != nil {
+		return nil
+	}
+
+	files, err := filepath.Glob(storeDir + "/data/*.ini")
+	if err != nil {
+		return err
+	}
+
+	listCache = []listItem{}
+	keyIndex = make(map[string][]keyRef)
+	for _, file := range files {
+		addListItem(file)
+	}
+	return nil
+}
+
+// updateListCache reads the definition of the tunnel again, or removes it
+// if it no longer exists. The caller must hold listCacheLock.
+func updateListCache(name string) {
+	if listCache == nil {
+		// Built in full when needed
+		return
+	}
 
-			cfg, err := conf.Load(f)
-			f.Close()
-			if err != nil {
-				log.Printf("Warning: %q: %s", file, err)
-				item.Features = conf.FeatureError
-				item.Description = "- parse error -"
-				listCache = append(listCache, item)
-				continue
+	for i, item := range listCache {
+		if item.Name == name {
+			listCache = append(listCache[:i], listCache[i+1:]...)
+			break
+		}
+	}
+	for key, refs := range keyIndex {
+		var keep []keyRef
+		for _, ref := range refs {
+			if ref.Tunnel != name {
+				keep = append(keep, ref)
 			}
+		}
+		if len(keep) == 0 {
+			delete(keyIndex, key)
+		} else {
+			keyIndex[key] = keep
+		}
+	}
 
-			var hosts []string
-			for _, h := range cfg.Hosts {
-				hosts = append(hosts, h.Name)
+	file := path.Join(storeDir, "data", name+".ini")
+	if _, err := os.Stat(file); err == nil {
+		addListItem(file)
+	}
+}
+
+// addListItem reads the definition into listCache and keyIndex. The caller
+// must hold listCacheLock.
+func addListItem(file string) {
+	item := listItem{
+		Name: path.Base(file[:len(file)-4]),
+	}
+
+	bs, err := ioutil.ReadFile(file)
+	if err != nil {
+		log.Printf("Warning: %q: %s", file, err)
+		item.Features = conf.FeatureError
+		item.Description = "- unreadable -"
+		listCache = append(listCache, item)
+		return
+	}
+
+	inf := ini.Parse(bytes.NewReader(bs))
+	for _, section := range inf.Sections() {
+		for option, val := range inf.OptionMap(section) {
+			for _, m := range obfuscatedRe.FindAllStringSubmatch(val, -1) {
+				keyIndex[m[1]] = append(keyIndex[m[1]], keyRef{item.Name, section, option})
 			}
+		}
+	}
+
+	cfg, err := conf.Load(bytes.NewReader(bs))
+	if err != nil {
+		log.Printf("Warning: %q: %s", file, err)
+		item.Features = conf.FeatureError
+		item.Description = "- parse error -"
+		listCache = append(listCache, item)
+		return
+	}
+
+	var hosts []string
+	for _, h := range cfg.Hosts {
+		hosts = append(hosts, h.Name)
+	}
+
+	item.Features = cfg.FeatureFlags()
+	item.Description = cfg.General.Description
+	item.Hosts = hosts
+	item.Version = float64(cfg.General.Version) / 100
+	item.access = cfg.Access
+	listCache = append(listCache, item)
+}
 
-			item.Features = cfg.FeatureFlags()
-			item.Description = cfg.General.Description
-			item.Hosts = hosts
-			item.Version = float64(cfg.General.Version) / 100
-			listCache = append(listCache, item)
+// readableKeyRefs returns the references to the key from tunnels the user
+// of the request may read, and whether the user may read the key. Only
+// unrestricted users may read keys referenced by no such tunnel, and get all
+// references.
+func readableKeyRefs(req *http.Request, key string) ([]keyRef, bool) {
+	defer listCacheLock.Unlock()
+	listCacheLock.Lock()
+
+	if err := loadListCache(); err != nil {
+		log.Println("Warning:", err)
+		return nil, false
+	}
+
+	var refs []keyRef
+	for _, ref := range keyIndex[key] {
+		for _, item := range listCache {
+			if item.Name == ref.Tunnel && mayAccess(req, item.Name, item.access, permRead) {
+				refs = append(refs, ref)
+				break
+			}
 		}
 	}
+	if len(refs) > 0 {
+		return refs, true
+	}
+	return keyIndex[key], unrestricted(req, currentACL())
+}
 
-	rw.Header().Set("Content-Type", "application/json")
-	json.NewEncoder(rw).Encode(listCache)
+// keyAuditComment describes the released keys and where they are referenced
+// for the audit log.
+func keyAuditComment(released map[string][]keyRef) string {
+	names := make([]string, 0, len(released))
+	for key := range released {
+		names = append(names, key)
+	}
+	sort.Strings(names)
+
+	var descs []string
+	for _, key := range names {
+		var where []string
+		for _, ref := range released[key] {
+			where = append(where, ref.String())
+		}
+		if len(where) == 0 {
+			where = []string{"unreferenced"}
+		}
+		descs = append(descs, key+" ("+strings.Join(where, ", ")+")")
+	}
+	return "released keys: " + strings.Join(descs, "; ")
 }
@@ -34,6 +34,7 @@ func parseTicket(rw http.ResponseWriter, req *http.Request) {
 		"user":     tic.User,
 		"ips":      tic.IP,
 		"validity": tic.Validity,
+		"groups":   tic.Groups,
 	}
 	json.NewEncoder(rw).Encode(exposedFields)
 	return
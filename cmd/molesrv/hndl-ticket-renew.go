@@ -0,0 +1,75 @@
+package main
+
+import (
+	"log"
+	"net/http"
+	"time"
+
+	"github.com/calmh/mole/ticket"
+)
+
+func init() {
+	addHandler(handler{
+		pattern: "/renew",
+		method:  "POST",
+		fn:      renewTicket,
+		auth:    true,
+		ro:      true,
+	})
+}
+
+// renewTicket extends the validity of the still valid ticket the request is
+// made with, by the lifetime of the user's tickets. Tickets are renewable
+// until the renewal limit after they were granted, as long as the
+// authentication backend still knows the user, whose groups are updated.
+func renewTicket(rw http.ResponseWriter, req *http.Request) {
+	tic, err := ticket.Load(req.Header.Get("X-Mole-Ticket"))
+	if err != nil {
+		rw.WriteHeader(403)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	if ticketRenewLimit <= 0 || tic.Issued == 0 {
+		// Disabled, or granted before tickets recorded when
+		rw.WriteHeader(403)
+		rw.Write([]byte("ticket is not renewable"))
+		return
+	}
+
+	groups, ok, err := backendLookup(tic.User)
+	if err != nil {
+		// Tickets can't outlive their lifetime unless the user is checked
+		log.Printf("Renewal refused for %q: %s", tic.User, err)
+		rw.WriteHeader(403)
+		rw.Write([]byte("ticket is not renewable"))
+		return
+	}
+	if !ok {
+		log.Printf("Renewal refused for %q; disabled or removed", tic.User)
+		rw.WriteHeader(403)
+		rw.Write([]byte("user is disabled or removed"))
+		return
+	}
+	if requireGroup != "" && !containsString(groups, requireGroup) {
+		log.Printf("Renewal refused for %q; not a member of %q", tic.User, requireGroup)
+		rw.WriteHeader(403)
+		rw.Write([]byte("not a member of the group required for access"))
+		return
+	}
+	tic.Groups = groups
+
+	policy := ticketPolicyFor(tic.User, tic.Groups, currentACL())
+	validTo := time.Now().Add(time.Duration(policy.Lifetime)).Unix()
+	if limit := tic.Issued + int64(ticketRenewLimit/time.Second); validTo > limit {
+		validTo = limit
+	}
+	if validTo <= tic.Validity {
+		rw.WriteHeader(403)
+		rw.Write([]byte("ticket renewal limit reached"))
+		return
+	}
+
+	tic.Validity = validTo
+	log.Printf("Renewed ticket %x %q %v %d", tic.ID, tic.User, tic.Groups, tic.Validity)
+	rw.Write([]byte(tic.String()))
+}
@@ -10,11 +10,6 @@ import (
 	"github.com/calmh/mole/ticket"
 )
 
-const (
-	validityPeriod = 86400 * 7 // seconds
-	maxValidIPs    = 4
-)
-
 func init() {
 	addHandler(handler{
 		pattern: "/ticket/",
@@ -32,23 +27,8 @@ func grantTicket(rw http.ResponseWriter, req *http.Request) {
 	}
 
 	user := req.URL.Path[8:]
-	if user == "" {
-		// Empty username is not permitted
-		rw.WriteHeader(401)
-		return
-	}
-
-	bs, err := ioutil.ReadAll(req.Body)
-	if err != nil {
-		// Should have existed a body with a password in it
-		rw.WriteHeader(500)
-		return
-	}
-
-	password := string(bs)
-	if password == "" {
-		// Empty password is not permitted
-		rw.WriteHeader(401)
+	groups, ok := passwordAuth(rw, req, user)
+	if !ok {
 		return
 	}
 
@@ -63,24 +43,81 @@ func grantTicket(rw http.ResponseWriter, req *http.Request) {
 		panic("bug: empty remote address")
 	}
 
-	if !backendAuthenticate(user, password) {
-		// Authentication failed
-		rw.WriteHeader(401)
+	if requireGroup != "" && !containsString(groups, requireGroup) {
+		log.Printf("Ticket refused for %q; not a member of %q", user, requireGroup)
+		rw.WriteHeader(403)
+		rw.Write([]byte("not a member of the group required for access"))
+		return
+	}
+
+	if !checkOTP(rw, req, user, groups) {
 		return
 	}
 
-	validTo := time.Now().Unix() + validityPeriod
+	// Only the failures of the user are cleared; clearing those of the
+	// address would let a valid login reset the limit for guessing others
+	clearFailures(lockoutKeys(req, user)[:1])
+
+	policy := ticketPolicyFor(user, groups, currentACL())
+	now := time.Now()
 
 	tic := getTicket(req)
 	tic.User = user
-	tic.Validity = validTo
-	tic.IP = newIPList(tic.IP, ip, maxValidIPs)
+	tic.Groups = groups
+	tic.Validity = now.Add(time.Duration(policy.Lifetime)).Unix()
+	tic.IP = newIPList(tic.IP, policy.bindAddress(ip), policy.MaxIPs)
+	tic.ID = ticket.NewID()
+	tic.Issued = now.Unix()
 
-	log.Printf("New ticket %q %v %d", tic.User, tic.IP, tic.Validity)
+	log.Printf("New ticket %x %q %v %v %d", tic.ID, tic.User, tic.Groups, tic.IP, tic.Validity)
 	rw.Write([]byte(tic.String()))
+
+	if auth == "htpasswd" {
+		if err := recordLogin(user, now); err != nil {
+			log.Println("htpasswd:", err)
+		}
+	}
 	return
 }
 
+// passwordAuth authenticates the user with the password in the request body
+// and returns the user's groups. On failure an error response is written
+// and false is returned.
+func passwordAuth(rw http.ResponseWriter, req *http.Request, user string) ([]string, bool) {
+	if user == "" {
+		// Empty username is not permitted
+		rw.WriteHeader(401)
+		return nil, false
+	}
+
+	if refuseLockedOut(rw, req, user) {
+		return nil, false
+	}
+
+	bs, err := ioutil.ReadAll(req.Body)
+	if err != nil {
+		// Should have existed a body with a password in it
+		rw.WriteHeader(500)
+		return nil, false
+	}
+
+	password := string(bs)
+	if password == "" {
+		// Empty password is not permitted
+		rw.WriteHeader(401)
+		return nil, false
+	}
+
+	groups, ok := backendAuthenticate(user, password)
+	if !ok {
+		// Authentication failed
+		authFailed(req, user, "incorrect password")
+		rw.WriteHeader(401)
+		return nil, false
+	}
+	return groups, true
+}
+
 func getTicket(req *http.Request) ticket.Ticket {
 	ticStr := req.Header.Get("X-Mole-Ticket")
 	if ticStr != "" {
@@ -0,0 +1,85 @@
+package main
+
+import (
+	"encoding/json"
+	"log"
+	"net/http"
+	"strings"
+
+	"github.com/calmh/mole/totp"
+)
+
+func init() {
+	addHandler(handler{
+		pattern: "/totp/",
+		method:  "POST",
+		fn:      enrollTOTP,
+		auth:    false,
+		ro:      true,
+	})
+}
+
+// enrollTOTP handles /totp/enroll/<user>, which creates a new pending
+// secret, and /totp/confirm/<user>, which activates it given a correct
+// code. Both require the user's password, and replacing an active
+// enrollment requires a code from it.
+func enrollTOTP(rw http.ResponseWriter, req *http.Request) {
+	parts := strings.SplitN(req.URL.Path[6:], "/", 2)
+	if len(parts) != 2 || (parts[0] != "enroll" && parts[0] != "confirm") {
+		rw.WriteHeader(404)
+		return
+	}
+	op, user := parts[0], parts[1]
+
+	groups, ok := passwordAuth(rw, req, user)
+	if !ok {
+		return
+	}
+
+	if op == "confirm" {
+		if !totpVerify(user, req.Header.Get("X-Mole-OTP"), true) {
+			authFailed(req, user, "incorrect one-time code for enrollment")
+			rw.Header().Set("X-Mole-OTP", "invalid")
+			rw.WriteHeader(401)
+			return
+		}
+		log.Printf("TOTP enrollment confirmed for %q", user)
+		return
+	}
+
+	if totpEnrolled(user) && !checkOTP(rw, req, user, groups) {
+		return
+	}
+
+	secret, err := totp.NewSecret()
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+	err = updateTOTP(func(users map[string]*totpUser) error {
+		u, ok := users[user]
+		if !ok {
+			u = &totpUser{}
+			users[user] = u
+		}
+		u.Pending = secret
+		return nil
+	})
+	if err != nil {
+		rw.WriteHeader(500)
+		rw.Write([]byte(err.Error()))
+		return
+	}
+
+	account := user
+	if canonicalHostname != "" {
+		account += "@" + canonicalHostname
+	}
+	log.Printf("TOTP enrollment started for %q", user)
+	rw.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(rw).Encode(map[string]string{
+		"secret": secret,
+		"uri":    totp.URI("mole", account, secret),
+	})
+}
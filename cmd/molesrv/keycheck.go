@@ -0,0 +1,146 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+var (
+	checkKeys = false
+	gcKeys    = false
+	dryRun    = false
+)
+
+func init() {
+	globalFlags.BoolVar(&checkKeys, "check-keys", checkKeys, "Report references to missing keys and unreferenced keys in the key store and exit")
+	globalFlags.BoolVar(&gcKeys, "gc-keys", gcKeys, "Remove unreferenced keys from the key store and exit. The server must not be running.")
+	globalFlags.BoolVar(&dryRun, "dry-run", dryRun, "(for -gc-keys) Only report what would be removed")
+}
+
+// scanKeyReferences returns the tunnels referencing each key. Unlike the
+// list cache, an unreadable definition is an error, as its keys would
+// otherwise look unreferenced.
+func scanKeyReferences() (map[string][]string, error) {
+	files, err := filepath.Glob(path.Join(storeDir, "data", "*.ini"))
+	if err != nil {
+		return nil, err
+	}
+
+	refs := make(map[string][]string)
+	for _, file := range files {
+		bs, err := ioutil.ReadFile(file)
+		if err != nil {
+			return nil, err
+		}
+		name := path.Base(file[:len(file)-4])
+		for _, m := range obfuscatedRe.FindAllSubmatch(bs, -1) {
+			key := string(m[1])
+			refs[key] = append(refs[key], name)
+		}
+	}
+	return refs, nil
+}
+
+// unreferencedKeys returns the keys in the secret store not referenced by
+// any tunnel, sorted.
+func unreferencedKeys(stored []string, refs map[string][]string) []string {
+	var unused []string
+	for _, key := range stored {
+		if _, ok := refs[key]; !ok {
+			unused = append(unused, key)
+		}
+	}
+	sort.Strings(unused)
+	return unused
+}
+
+func cmdCheckKeys() error {
+	if err := openSecrets(); err != nil {
+		return err
+	}
+	stored, err := secrets.List()
+	if err != nil {
+		return err
+	}
+	refs, err := scanKeyReferences()
+	if err != nil {
+		return err
+	}
+
+	exists := make(map[string]bool, len(stored))
+	for _, key := range stored {
+		exists[key] = true
+	}
+	var missing [][]string
+	for key, tunnels := range refs {
+		if !exists[key] {
+			for _, tunnel := range tunnels {
+				missing = append(missing, []string{tunnel, key})
+			}
+		}
+	}
+	if len(missing) > 0 {
+		sort.Slice(missing, func(a, b int) bool {
+			return missing[a][0]+" "+missing[a][1] < missing[b][0]+" "+missing[b][1]
+		})
+		optionTable(os.Stdout, append([][]string{{"TUNNEL", "MISSING KEY"}}, missing...))
+		fmt.Println()
+	}
+
+	unused := unreferencedKeys(stored, refs)
+	for _, key := range unused {
+		fmt.Println("Unreferenced key:", key)
+	}
+
+	log.Printf("%d keys, %d referenced by tunnels, %d unreferenced", len(stored), len(stored)-len(unused), len(unused))
+	if len(missing) > 0 {
+		return fmt.Errorf("%d references to missing keys", len(missing))
+	}
+	log.Println("OK: All references resolve")
+	return nil
+}
+
+func cmdGCKeys() error {
+	if err := openSecrets(); err != nil {
+		return err
+	}
+	stored, err := secrets.List()
+	if err != nil {
+		return err
+	}
+	refs, err := scanKeyReferences()
+	if err != nil {
+		return err
+	}
+
+	unused := unreferencedKeys(stored, refs)
+	if len(unused) == 0 {
+		log.Println("OK: No unreferenced keys")
+		return nil
+	}
+	if dryRun {
+		for _, key := range unused {
+			fmt.Println("Would remove key:", key)
+		}
+		log.Printf("OK: Would remove %d unreferenced keys (dry run)", len(unused))
+		return nil
+	}
+
+	for _, key := range unused {
+		if err := secrets.Delete(key); err != nil {
+			return err
+		}
+	}
+	auditCommand("gc-keys", fmt.Sprintf("removed %d unreferenced keys: %s", len(unused), strings.Join(unused, " ")))
+	if !disableGit && secretBackend == "json" {
+		gitCommit(path.Join(storeDir, "data"), fmt.Sprintf("gc-keys: removed %d unreferenced keys", len(unused)), "server")
+	}
+	log.Printf("OK: Removed %d unreferenced keys", len(unused))
+	return nil
+}
@@ -0,0 +1,46 @@
+package main
+
+import (
+	"fmt"
+	"testing"
+)
+
+func TestGCKeys(t *testing.T) {
+	defer withTestStore(t)()
+	oldDryRun := dryRun
+	defer func() { dryRun = oldDryRun }()
+
+	writeStoreFile(t, "keys.json", `{"aaaa": "one", "bbbb": "two", "cccc": "three"}`)
+	writeStoreFile(t, "first.ini", fmt.Sprintf(testTunnel, "aaaa"))
+	writeStoreFile(t, "second.ini", fmt.Sprintf(testTunnel, "dddd"))
+	// Removed tunnels don't count
+	writeStoreFile(t, "third.ini.deleted", fmt.Sprintf(testTunnel, "bbbb"))
+
+	if err := cmdCheckKeys(); err == nil {
+		t.Error("missing key not reported")
+	}
+
+	refs, err := scanKeyReferences()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if unused := unreferencedKeys([]string{"cccc", "bbbb", "aaaa"}, refs); fmt.Sprint(unused) != "[bbbb cccc]" {
+		t.Errorf("unexpected unreferenced keys %v", unused)
+	}
+
+	dryRun = true
+	if err := cmdGCKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadKeys(); err != nil || len(keys) != 3 {
+		t.Fatalf("keys removed by dry run; %v %v", keys, err)
+	}
+
+	dryRun = false
+	if err := cmdGCKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if err := reloadKeys(); err != nil || len(keys) != 1 || keys["aaaa"] != "one" {
+		t.Errorf("unexpected keys after gc %v %v", keys, err)
+	}
+}
@@ -1,78 +1,295 @@
 package main
 
 import (
-	"bytes"
+	"crypto/aes"
+	"crypto/cipher"
 	"crypto/rand"
 	"encoding/base64"
 	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
 	"os"
 	"path"
 	"strings"
+
+	"golang.org/x/crypto/scrypt"
+	"golang.org/x/crypto/ssh/terminal"
 )
 
 var keys map[string]string
 
-func loadKeys() error {
-	file := path.Join(storeDir, "data", "keys.json")
+var (
+	masterKeySource    = ""
+	newMasterKeySource = ""
+	rekey              = false
+
+	// The master key and salt it was derived with, when the key store is
+	// encrypted
+	masterKey  []byte
+	masterSalt []byte
+
+	// The encrypted values as stored, so that only new ones are encrypted
+	// on save
+	sealedKeys map[string]string
+)
+
+const (
+	keyStoreVersion = 2
+	keyStoreCheck   = "mole key store"
+	saltSize        = 16
+)
+
+// keyStoreFile is the format of an encrypted keys.json. Every value is
+// encrypted by itself with AES-GCM, authenticating the key it belongs to.
+// The check value tells an incorrect master key from a corrupt file.
+type keyStoreFile struct {
+	Version int               `json:"version"`
+	Salt    []byte            `json:"salt"`
+	Check   string            `json:"check"`
+	Keys    map[string]string `json:"keys"`
+}
+
+func init() {
+	globalFlags.StringVar(&masterKeySource, "master-key", masterKeySource, "Key store master key; file:<path>, env:<variable> or prompt. Leave blank for an unencrypted key store.")
+	globalFlags.BoolVar(&rekey, "rekey", rekey, "Encrypt the key store with the master key given by -new-master-key and exit")
+	globalFlags.StringVar(&newMasterKeySource, "new-master-key", newMasterKeySource, "(for -rekey) New key store master key; file:<path>, env:<variable> or prompt")
+}
+
+func keysPath() string {
+	return path.Join(storeDir, "data", "keys.json")
+}
+
+// readMasterSecret returns the master key secret from the source.
+func readMasterSecret(source string) (string, error) {
+	var secret string
+	switch {
+	case strings.HasPrefix(source, "file:"):
+		bs, err := ioutil.ReadFile(source[5:])
+		if err != nil {
+			return "", err
+		}
+		secret = strings.TrimSpace(string(bs))
+	case strings.HasPrefix(source, "env:"):
+		secret = os.Getenv(source[4:])
+	case source == "prompt":
+		fd := int(os.Stdin.Fd())
+		if !terminal.IsTerminal(fd) {
+			return "", errors.New("cannot prompt for the master key; not a terminal")
+		}
+		fmt.Fprint(os.Stderr, "Master key: ")
+		bs, err := terminal.ReadPassword(fd)
+		fmt.Fprintln(os.Stderr)
+		if err != nil {
+			return "", err
+		}
+		secret = string(bs)
+	default:
+		return "", fmt.Errorf("unknown master key source %q", source)
+	}
+	if secret == "" {
+		return "", fmt.Errorf("master key from %q is empty", source)
+	}
+	return secret, nil
+}
+
+func deriveMasterKey(secret string, salt []byte) ([]byte, error) {
+	return scrypt.Key([]byte(secret), salt, 1<<15, 8, 1, 32)
+}
 
-	fd, err := os.Open(file)
+// setMasterKey makes the key store encrypted by the secret from now on.
+// Every value is encrypted again on the next save.
+func setMasterKey(source string) error {
+	secret, err := readMasterSecret(source)
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
+	salt := make([]byte, saltSize)
+	if _, err := io.ReadFull(rand.Reader, salt); err != nil {
+		return err
+	}
+	key, err := deriveMasterKey(secret, salt)
+	if err != nil {
+		return err
+	}
+	masterKey, masterSalt, sealedKeys = key, salt, nil
+	return nil
+}
 
-	d := json.NewDecoder(fd)
-	return d.Decode(&keys)
+func masterAEAD() cipher.AEAD {
+	c, err := aes.NewCipher(masterKey)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		panic(err)
+	}
+	return aead
 }
 
-func saveKeys() error {
-	file := path.Join(storeDir, "data", "keys.json")
+func sealValue(name, val string) string {
+	aead := masterAEAD()
+	nonce := make([]byte, aead.NonceSize())
+	if _, err := io.ReadFull(rand.Reader, nonce); err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(aead.Seal(nonce, nonce, []byte(val), []byte(name)))
+}
 
-	bs, err := json.Marshal(keys)
+func openValue(name, sealed string) (string, error) {
+	bs, err := base64.StdEncoding.DecodeString(sealed)
 	if err != nil {
-		return err
+		return "", err
+	}
+	aead := masterAEAD()
+	if len(bs) < aead.NonceSize() {
+		return "", errors.New("value too short")
 	}
-	var ibs bytes.Buffer
-	json.Indent(&ibs, bs, "", "  ")
+	val, err := aead.Open(nil, bs[:aead.NonceSize()], bs[aead.NonceSize():], []byte(name))
+	return string(val), err
+}
+
+// keysEncrypted returns true if the key store is saved encrypted.
+func keysEncrypted() bool {
+	return masterKey != nil
+}
 
-	fd, err := os.Create(file + ".part")
+// loadKeys reads the key store, encrypted or not. An unencrypted store is
+// encrypted when a master key is given.
+func loadKeys() error {
+	bs, err := ioutil.ReadFile(keysPath())
 	if err != nil {
 		return err
 	}
-	defer fd.Close()
 
-	_, err = ibs.WriteTo(fd)
+	var probe map[string]interface{}
+	if err := json.Unmarshal(bs, &probe); err != nil {
+		return err
+	}
+	if _, ok := probe["version"]; !ok {
+		return loadPlainKeys(bs)
+	}
+
+	var f keyStoreFile
+	if err := json.Unmarshal(bs, &f); err != nil {
+		return err
+	}
+	if f.Version != keyStoreVersion {
+		return fmt.Errorf("unsupported key store version %d", f.Version)
+	}
+	if masterKeySource == "" {
+		return errors.New("the key store is encrypted; a master key is required (-master-key)")
+	}
+	secret, err := readMasterSecret(masterKeySource)
 	if err != nil {
 		return err
 	}
-	err = fd.Sync()
+	masterKey, err = deriveMasterKey(secret, f.Salt)
 	if err != nil {
 		return err
 	}
+	masterSalt = f.Salt
+
+	if check, err := openValue("check", f.Check); err != nil || check != keyStoreCheck {
+		masterKey = nil
+		return errors.New("incorrect master key")
+	}
 
-	return os.Rename(file+".part", file)
+	keys = make(map[string]string, len(f.Keys))
+	for name, sealed := range f.Keys {
+		val, err := openValue(name, sealed)
+		if err != nil {
+			return fmt.Errorf("key %q: %v", name, err)
+		}
+		keys[name] = val
+	}
+	sealedKeys = f.Keys
+	return nil
 }
 
-func randomKey() string {
-	keybs := make([]byte, 15)
-	_, err := rand.Read(keybs)
-	if err != nil {
-		panic(err)
+func loadPlainKeys(bs []byte) error {
+	var plain map[string]string
+	if err := json.Unmarshal(bs, &plain); err != nil {
+		return err
+	}
+	keys = plain
+	if masterKeySource == "" {
+		log.Println("Warning: the key store is not encrypted; see -master-key")
+		return nil
+	}
+
+	if err := setMasterKey(masterKeySource); err != nil {
+		return err
+	}
+	if err := saveKeys(); err != nil {
+		return err
+	}
+	log.Println("OK: Encrypted the key store")
+	if !disableGit {
+		log.Println("Warning: earlier versions of keys.json may be readable in the git history")
 	}
-	return base64.StdEncoding.EncodeToString(keybs)
+	return nil
 }
 
-func obfuscate(val string) string {
-	if strings.HasPrefix(val, "$mole$") {
-		return val
-	} else {
-		key := randomKey()
-		if _, ok := keys[key]; ok {
-			panic("randomly generated key already exists")
+// saveKeys writes the key store, encrypting the values not already
+// encrypted when there is a master key.
+func saveKeys() error {
+	if !keysEncrypted() {
+		bs, err := json.MarshalIndent(keys, "", "  ")
+		if err != nil {
+			return err
 		}
+		return writeFileAtomic(keysPath(), bs, 0600)
+	}
 
-		keys[key] = val
+	sealed := make(map[string]string, len(keys))
+	for name, val := range keys {
+		if s, ok := sealedKeys[name]; ok {
+			sealed[name] = s
+		} else {
+			sealed[name] = sealValue(name, val)
+		}
+	}
 
-		return "$mole$" + key
+	bs, err := json.MarshalIndent(keyStoreFile{
+		Version: keyStoreVersion,
+		Salt:    masterSalt,
+		Check:   sealValue("check", keyStoreCheck),
+		Keys:    sealed,
+	}, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(keysPath(), bs, 0600); err != nil {
+		return err
+	}
+	sealedKeys = sealed
+	return nil
+}
+
+// cmdRekey encrypts the key store with a new master key.
+func cmdRekey() error {
+	if secretBackend != "json" {
+		return fmt.Errorf("-rekey applies to the json secret store, not %q", secretBackend)
+	}
+	if newMasterKeySource == "" {
+		return errors.New("-rekey requires -new-master-key")
+	}
+	if err := loadKeys(); err != nil {
+		return err
+	}
+	if err := setMasterKey(newMasterKeySource); err != nil {
+		return err
+	}
+	if err := saveKeys(); err != nil {
+		return err
+	}
+	if !disableGit {
+		gitCommit(path.Join(storeDir, "data"), "rekey", "server")
 	}
+	log.Printf("OK: Encrypted %d keys with the new master key", len(keys))
+	return nil
 }
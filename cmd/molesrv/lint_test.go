@@ -0,0 +1,61 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http/httptest"
+	"reflect"
+	"testing"
+
+	"github.com/calmh/mole/conf"
+)
+
+func TestLintWarnings(t *testing.T) {
+	defer withTestStore(t)()
+	keys = map[string]string{"a1b2": "hunter2"}
+	writeStoreFile(t, "acl.json", testACL)
+	writeStoreFile(t, "open.ini", fmt.Sprintf(testTunnel, "a1b2"))
+	writeStoreFile(t, "secret.ini", fmt.Sprintf(testTunnel, "a1b2"))
+	body := []byte(fmt.Sprintf(testTunnel, "a1b2"))
+
+	// Tunnels the user cannot read are not compared against
+	expected := []conf.Warning{
+		{Section: "forwards.test", Message: "forward has no comment describing it"},
+		{Section: "forwards.test", Key: "127.0.0.12:3306", Message: `source 127.0.0.12:3306 is also used by tunnel "open"`},
+	}
+
+	rec := httptest.NewRecorder()
+	lintTunnel(rec, testRequest("POST", "/lint/new", "alice", body))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected lint response %d: %s", rec.Code, rec.Body)
+	}
+	var ws []conf.Warning
+	if err := json.NewDecoder(rec.Body).Decode(&ws); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(ws, expected) {
+		t.Errorf("unexpected warnings %v", ws)
+	}
+
+	rec = httptest.NewRecorder()
+	lintTunnel(rec, testRequest("POST", "/lint/new", "alice", []byte("[general]\nfoo")))
+	if rec.Code != 400 {
+		t.Errorf("unexpected lint response %d for invalid tunnel", rec.Code)
+	}
+
+	// The same warnings are returned on push, which is not refused
+	rec = httptest.NewRecorder()
+	putFile(rec, testRequest("PUT", "/store/new.ini", "alice", body))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected put response %d: %s", rec.Code, rec.Body)
+	}
+	hdrs := rec.Header()["X-Mole-Warning"]
+	if len(hdrs) != len(expected) {
+		t.Fatalf("unexpected warning headers %q", hdrs)
+	}
+	for i := range expected {
+		if hdrs[i] != expected[i].String() {
+			t.Errorf("warning header %q != %q", hdrs[i], expected[i].String())
+		}
+	}
+}
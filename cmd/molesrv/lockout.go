@@ -0,0 +1,293 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"net"
+	"net/http"
+	"os"
+	"path"
+	"sort"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+var (
+	lockoutFile      = "lockouts.json"
+	lockoutThreshold = 5
+	lockoutBase      = time.Minute
+	lockoutMax       = time.Hour
+)
+
+// Failures are forgotten when there has been none for this long.
+const lockoutForget = 24 * time.Hour
+
+// A lockout tracks failed authentications for a user ("user:name") or a
+// source address ("ip:addr"). Beyond the threshold every failure locks it
+// out, for twice as long as the previous one up to the maximum.
+type lockout struct {
+	Failures int       `json:"failures"`
+	Last     time.Time `json:"last"`
+	Until    time.Time `json:"until,omitempty"`
+}
+
+var (
+	lockouts        map[string]*lockout
+	lockoutsModTime time.Time
+	lockoutsLock    sync.Mutex
+)
+
+var (
+	listLockouts = false
+	clearLockout = ""
+)
+
+func init() {
+	globalFlags.StringVar(&lockoutFile, "lockout-file", lockoutFile, "Authentication lockout state file (relative to store directory)")
+	globalFlags.IntVar(&lockoutThreshold, "lockout-threshold", lockoutThreshold, "Failed authentications per user or address before lockout (zero to disable)")
+	globalFlags.DurationVar(&lockoutBase, "lockout-base", lockoutBase, "Duration of the first lockout; each following doubles it")
+	globalFlags.DurationVar(&lockoutMax, "lockout-max", lockoutMax, "Maximum lockout duration")
+	globalFlags.BoolVar(&listLockouts, "list-lockouts", listLockouts, "List failed authentications and lockouts and exit")
+	globalFlags.StringVar(&clearLockout, "clear-lockout", clearLockout, "Clear the failures of a user or address (or \"all\") and exit")
+}
+
+func lockoutPath() string {
+	return path.Join(storeDir, lockoutFile)
+}
+
+func lockoutKeys(req *http.Request, user string) []string {
+	ip, _, err := net.SplitHostPort(req.RemoteAddr)
+	if err != nil {
+		ip = req.RemoteAddr
+	}
+	return []string{"user:" + user, "ip:" + ip}
+}
+
+// loadLockouts reads the lockout state, unless it is unchanged since the
+// last time. The caller holds lockoutsLock.
+func loadLockouts() error {
+	fi, err := os.Stat(lockoutPath())
+	if os.IsNotExist(err) {
+		lockouts, lockoutsModTime = make(map[string]*lockout), time.Time{}
+		return nil
+	} else if err != nil {
+		return err
+	}
+	if lockouts != nil && fi.ModTime().Equal(lockoutsModTime) {
+		return nil
+	}
+
+	bs, err := ioutil.ReadFile(lockoutPath())
+	if err != nil {
+		return err
+	}
+	l := make(map[string]*lockout)
+	if err := json.Unmarshal(bs, &l); err != nil {
+		return fmt.Errorf("%s: %v", lockoutPath(), err)
+	}
+	lockouts, lockoutsModTime = l, fi.ModTime()
+	return nil
+}
+
+// saveLockouts writes the lockout state, dropping forgotten failures. The
+// caller holds lockoutsLock.
+func saveLockouts(now time.Time) error {
+	for key, l := range lockouts {
+		if now.Sub(l.Last) > lockoutForget && now.After(l.Until) {
+			delete(lockouts, key)
+		}
+	}
+	bs, err := json.MarshalIndent(lockouts, "", "  ")
+	if err != nil {
+		return err
+	}
+	if err := writeFileAtomic(lockoutPath(), bs, 0600); err != nil {
+		return err
+	}
+	if fi, err := os.Stat(lockoutPath()); err == nil {
+		lockoutsModTime = fi.ModTime()
+	}
+	return nil
+}
+
+// lockedOut returns the first of the keys that is locked out, and until
+// when.
+func lockedOut(keys []string, now time.Time) (string, time.Time, bool) {
+	if lockoutThreshold <= 0 {
+		return "", time.Time{}, false
+	}
+
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+
+	if err := loadLockouts(); err != nil {
+		log.Println("lockout:", err)
+		// Fail closed; the state cannot be checked
+		return "", now.Add(lockoutBase), true
+	}
+	for _, key := range keys {
+		if l, ok := lockouts[key]; ok && now.Before(l.Until) {
+			return key, l.Until, true
+		}
+	}
+	return "", time.Time{}, false
+}
+
+// recordFailure counts a failed authentication for the keys and returns
+// those that became locked out by it.
+func recordFailure(keys []string, now time.Time) []string {
+	if lockoutThreshold <= 0 {
+		return nil
+	}
+
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+
+	if err := loadLockouts(); err != nil {
+		log.Println("lockout:", err)
+		return nil
+	}
+
+	var locked []string
+	for _, key := range keys {
+		l, ok := lockouts[key]
+		if !ok || now.Sub(l.Last) > lockoutForget {
+			l = &lockout{}
+			lockouts[key] = l
+		}
+		l.Failures++
+		l.Last = now
+		if l.Failures >= lockoutThreshold {
+			l.Until = now.Add(lockoutDuration(l.Failures - lockoutThreshold))
+			locked = append(locked, key)
+		}
+	}
+
+	if err := saveLockouts(now); err != nil {
+		log.Println("lockout:", err)
+	}
+	return locked
+}
+
+// clearFailures forgets the failures of the keys, after a successful
+// authentication.
+func clearFailures(keys []string) {
+	if lockoutThreshold <= 0 {
+		return
+	}
+
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+
+	if err := loadLockouts(); err != nil {
+		log.Println("lockout:", err)
+		return
+	}
+	changed := false
+	for _, key := range keys {
+		if _, ok := lockouts[key]; ok {
+			delete(lockouts, key)
+			changed = true
+		}
+	}
+	if changed {
+		if err := saveLockouts(time.Now()); err != nil {
+			log.Println("lockout:", err)
+		}
+	}
+}
+
+// lockoutDuration returns the duration of the n:th lockout, counting from
+// zero.
+func lockoutDuration(n int) time.Duration {
+	d := lockoutBase
+	for i := 0; i < n && d < lockoutMax; i++ {
+		d *= 2
+	}
+	if d > lockoutMax {
+		d = lockoutMax
+	}
+	return d
+}
+
+// authFailed records a failed authentication with the reason in the audit
+// log, locking out the user and address as required.
+func authFailed(req *http.Request, user, reason string) {
+	audit(req, fmt.Sprintf("authentication failed for %q: %s", user, reason))
+	for _, key := range recordFailure(lockoutKeys(req, user), time.Now()) {
+		log.Printf("Locked out %s after failed authentication", key)
+		audit(req, "locked out "+key)
+	}
+}
+
+// refuseLockedOut writes a refusal and returns true if the user or the
+// address of the request is locked out.
+func refuseLockedOut(rw http.ResponseWriter, req *http.Request, user string) bool {
+	now := time.Now()
+	key, until, locked := lockedOut(lockoutKeys(req, user), now)
+	if !locked {
+		return false
+	}
+	audit(req, fmt.Sprintf("authentication refused for %q: %s locked out until %s", user, key, until.Format(time.RFC3339)))
+	rw.Header().Set("Retry-After", strconv.Itoa(int(until.Sub(now).Seconds())+1))
+	rw.WriteHeader(429)
+	rw.Write([]byte("too many failed authentications; try again later"))
+	return true
+}
+
+func cmdListLockouts() error {
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+
+	if err := loadLockouts(); err != nil {
+		return err
+	}
+	keys := make([]string, 0, len(lockouts))
+	for key := range lockouts {
+		keys = append(keys, key)
+	}
+	sort.Strings(keys)
+
+	now := time.Now()
+	rows := [][]string{{"KEY", "FAILURES", "LAST FAILURE", "LOCKED UNTIL"}}
+	for _, key := range keys {
+		l := lockouts[key]
+		until := "-"
+		if now.Before(l.Until) {
+			until = l.Until.Format(time.RFC3339)
+		}
+		rows = append(rows, []string{key, strconv.Itoa(l.Failures), l.Last.Format(time.RFC3339), until})
+	}
+	optionTable(os.Stdout, rows)
+	return nil
+}
+
+// cmdClearLockout clears the failures of the key, given with or without
+// the "user:" or "ip:" prefix, or of all keys.
+func cmdClearLockout(name string) error {
+	lockoutsLock.Lock()
+	defer lockoutsLock.Unlock()
+
+	if err := loadLockouts(); err != nil {
+		return err
+	}
+	n := 0
+	for key := range lockouts {
+		if name == "all" || key == name || key[strings.IndexByte(key, ':')+1:] == name {
+			delete(lockouts, key)
+			n++
+		}
+	}
+	if n == 0 {
+		return fmt.Errorf("no failures recorded for %q", name)
+	}
+	if err := saveLockouts(time.Now()); err != nil {
+		return err
+	}
+	log.Printf("OK: Cleared %d lockout(s)", n)
+	return nil
+}
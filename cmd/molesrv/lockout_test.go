@@ -0,0 +1,83 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+)
+
+func TestLockoutDuration(t *testing.T) {
+	cases := []struct {
+		n int
+		d time.Duration
+	}{
+		{0, lockoutBase},
+		{1, 2 * lockoutBase},
+		{3, 8 * lockoutBase},
+		{1000, lockoutMax},
+	}
+	for _, tc := range cases {
+		if d := lockoutDuration(tc.n); d != tc.d {
+			t.Errorf("lockout %d: %v != %v", tc.n, d, tc.d)
+		}
+	}
+}
+
+func TestLockout(t *testing.T) {
+	defer withTestStore(t)()
+	htpasswdCache = nil
+	auth = "htpasswd"
+	oldThreshold := lockoutThreshold
+	lockoutThreshold = 3
+	defer func() { lockoutThreshold = oldThreshold }()
+
+	data := "alice:" + testHash(t, "secret") + "\n"
+	if err := ioutil.WriteFile(htpasswdPath(), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	for i := 0; i < lockoutThreshold; i++ {
+		rw := httptest.NewRecorder()
+		grantTicket(rw, otpRequest("/ticket/alice", "wrong", ""))
+		if rw.Code != 401 {
+			t.Fatalf("attempt %d: unexpected response %d", i, rw.Code)
+		}
+	}
+
+	// Locked out even with the correct password
+	rw := httptest.NewRecorder()
+	grantTicket(rw, otpRequest("/ticket/alice", "secret", ""))
+	if rw.Code != 429 || rw.Header().Get("Retry-After") == "" {
+		t.Fatalf("unexpected response %d", rw.Code)
+	}
+
+	// The lockout survives a restart
+	lockouts = nil
+	if _, _, locked := lockedOut([]string{"user:alice"}, time.Now()); !locked {
+		t.Error("lockout not persisted")
+	}
+	if _, _, locked := lockedOut([]string{"user:alice"}, time.Now().Add(lockoutBase+time.Second)); locked {
+		t.Error("lockout did not expire")
+	}
+
+	// Other users from the same address are locked out as well
+	if _, _, locked := lockedOut(lockoutKeys(otpRequest("/ticket/bob", "", ""), "bob"), time.Now()); !locked {
+		t.Error("address not locked out")
+	}
+
+	if err := cmdClearLockout("carol"); err == nil {
+		t.Error("clearing unknown lockout succeeded")
+	}
+	if err := cmdClearLockout("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if err := cmdClearLockout("192.0.2.42"); err != nil {
+		t.Fatal(err)
+	}
+	rw = httptest.NewRecorder()
+	grantTicket(rw, otpRequest("/ticket/alice", "secret", ""))
+	if rw.Code != 200 {
+		t.Errorf("refused after clearing lockout; %d", rw.Code)
+	}
+}
@@ -15,8 +15,6 @@ import (
 	"path"
 	"strings"
 	"time"
-
-	"github.com/calmh/mole/ticket"
 )
 
 type handler struct {
@@ -42,6 +40,7 @@ var (
 	keyFile           = "key.pem"
 	listenAddr        = ":9443"
 	readOnly          = false
+	requireGroup      = ""
 	storeDir          = "~/mole-store"
 	ticketKeyFile     = ""
 )
@@ -62,8 +61,9 @@ func init() {
 	globalFlags.StringVar(&listenAddr, "listen", listenAddr, "HTTPS listen address")
 	globalFlags.BoolVar(&disableGit, "no-git", disableGit, "Do not treat the store as a git repository")
 	globalFlags.BoolVar(&readOnly, "no-write", readOnly, "Disallow writable client operations (push, rm, etc)")
+	globalFlags.StringVar(&requireGroup, "require-group", requireGroup, "Group membership required to be granted a ticket")
 	globalFlags.StringVar(&storeDir, "store-dir", storeDir, "Mole store directory")
-	globalFlags.StringVar(&ticketKeyFile, "ticket-file", ticketKeyFile, "Ticket key file. Leave blank to autogenerate key on startup.")
+	globalFlags.StringVar(&ticketKeyFile, "ticket-file", ticketKeyFile, "Legacy ticket key file, for accepting tickets granted before the keyring was created")
 	globalFlags.StringVar(&buildVersion, "version", buildVersion, "Version string to advertise")
 }
 
@@ -82,6 +82,13 @@ func main() {
 		storeDir = strings.Replace(storeDir, "~", home, 1)
 	}
 
+	if fn := adminCommand(); fn != nil {
+		if err := fn(); err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+
 	if initStore {
 		dataDir := path.Join(storeDir, "data")
 		err := os.MkdirAll(dataDir, 0700)
@@ -89,14 +96,37 @@ func main() {
 			log.Fatal(err)
 		}
 
-		keys = make(map[string]string)
-		err = saveKeys()
-		if err != nil {
-			log.Fatal(err)
+		if secretBackend == "json" {
+			keys = make(map[string]string)
+			if masterKeySource != "" {
+				err = setMasterKey(masterKeySource)
+				if err != nil {
+					log.Fatal(err)
+				}
+			}
+			err = saveKeys()
+			if err != nil {
+				log.Fatal(err)
+			}
 		}
 
 		newCertificate()
 
+		err = ioutil.WriteFile(path.Join(dataDir, "acl.json.example"), []byte(`{
+    "admins": ["root"],
+    "groups": {"ops": ["alice", "bob"]},
+    "tunnels": {
+        "*": {"read": ["*"], "write": ["@ops"]},
+        "customer": {"read": ["carol", "@ops"], "write": ["@ops"]}
+    },
+    "tickets": {
+        "@ops": {"lifetime": "12h", "ipv4Prefix": 24}
+    }
+}`), 0644)
+		if err != nil {
+			log.Fatal(err)
+		}
+
 		if !disableGit {
 			gitInit(dataDir)
 			gitCommit(dataDir, "Initial", "server")
@@ -136,6 +166,11 @@ func main() {
 	if _, ok := authBackends[auth]; !ok {
 		log.Fatalf("Unknown auth backend %q", auth)
 	}
+	if fn, ok := authSetup[auth]; ok {
+		if err := fn(); err != nil {
+			log.Fatalf("Auth backend %q: %v", auth, err)
+		}
+	}
 
 	if buildVersion == "" {
 		buildVersion = "4.0-dev-unknown"
@@ -143,22 +178,21 @@ func main() {
 
 	log.Println("mole server", buildVersion)
 
-	err := loadKeys()
+	err := openSecrets()
 	if err != nil {
-		log.Println("Warning:", err)
+		log.Fatalf("Secret store %q: %v", secretBackend, err)
 	}
-	if keys == nil {
-		keys = make(map[string]string)
-		log.Println("Initialized new key store")
+
+	err = loadACL()
+	if err != nil {
+		log.Fatal(err)
 	}
 
-	if ticketKeyFile != "" {
-		f, err := os.Open(ticketKeyFile)
-		if err != nil {
-			log.Fatal(err)
-		}
-		ticket.LoadKey(f)
+	err = setupTicketKeys()
+	if err != nil {
+		log.Fatal(err)
 	}
+	go ticketKeyRotator()
 
 	for pattern, handlerList := range handlers {
 		setupHandler(pattern, handlerList)
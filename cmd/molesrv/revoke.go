@@ -0,0 +1,150 @@
+package main
+
+import (
+	"encoding/hex"
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"os"
+	"path"
+	"sync"
+	"time"
+
+	"github.com/calmh/mole/ticket"
+)
+
+var revocationFile = "revoked.json"
+
+// revocations are the tickets that are no longer accepted although still
+// valid. Entries are kept only as long as the tickets they revoke could be
+// valid.
+type revocations struct {
+	// Ticket ID (hex) to the time the ticket is valid to at most
+	Tickets map[string]int64 `json:"tickets"`
+	// User to the time before which all tickets of the user are revoked
+	Users map[string]int64 `json:"users"`
+}
+
+var (
+	revoked        revocations
+	revokedModTime time.Time
+	revokedLock    sync.Mutex
+)
+
+func init() {
+	globalFlags.StringVar(&revocationFile, "revocation-file", revocationFile, "Ticket revocation file (relative to store directory)")
+}
+
+func revocationPath() string {
+	return path.Join(storeDir, revocationFile)
+}
+
+func readRevocations() (revocations, error) {
+	r := revocations{Tickets: make(map[string]int64), Users: make(map[string]int64)}
+	bs, err := ioutil.ReadFile(revocationPath())
+	if os.IsNotExist(err) {
+		return r, nil
+	} else if err != nil {
+		return r, err
+	}
+	err = json.Unmarshal(bs, &r)
+	if r.Tickets == nil {
+		r.Tickets = make(map[string]int64)
+	}
+	if r.Users == nil {
+		r.Users = make(map[string]int64)
+	}
+	return r, err
+}
+
+// currentRevocations returns the revocations, reading the file again if it
+// has changed since the last time.
+func currentRevocations() (revocations, error) {
+	revokedLock.Lock()
+	defer revokedLock.Unlock()
+
+	fi, err := os.Stat(revocationPath())
+	if os.IsNotExist(err) {
+		revoked, revokedModTime = revocations{}, time.Time{}
+		return revoked, nil
+	} else if err != nil {
+		return revocations{}, err
+	}
+	if fi.ModTime().Equal(revokedModTime) {
+		return revoked, nil
+	}
+
+	r, err := readRevocations()
+	if err != nil {
+		return revocations{}, err
+	}
+	revoked, revokedModTime = r, fi.ModTime()
+	return r, nil
+}
+
+// updateRevocations applies the change to the revocations and saves them,
+// dropping entries that no longer matter.
+func updateRevocations(fn func(r revocations)) error {
+	revokedLock.Lock()
+	defer revokedLock.Unlock()
+
+	r, err := readRevocations()
+	if err != nil {
+		return err
+	}
+	fn(r)
+
+	now := time.Now().Unix()
+	for id, validity := range r.Tickets {
+		if validity < now {
+			delete(r.Tickets, id)
+		}
+	}
+	maxAge := int64(longestTicketAge() / time.Second)
+	for user, before := range r.Users {
+		if before+maxAge < now {
+			delete(r.Users, user)
+		}
+	}
+
+	bs, err := json.MarshalIndent(r, "", "  ")
+	if err != nil {
+		return err
+	}
+	// Picked up by the next currentRevocations
+	revokedModTime = time.Time{}
+	return writeFileAtomic(revocationPath(), bs, 0600)
+}
+
+// ticketRevoked returns true if the ticket has been revoked, or the
+// revocations cannot be checked.
+func ticketRevoked(tic *ticket.Ticket) bool {
+	r, err := currentRevocations()
+	if err != nil {
+		log.Println("revocations:", err)
+		return true
+	}
+	if before, ok := r.Users[tic.User]; ok && tic.Issued <= before {
+		return true
+	}
+	_, ok := r.Tickets[hex.EncodeToString(tic.ID)]
+	return ok && len(tic.ID) > 0
+}
+
+// revokeTicket revokes the single ticket, including renewed copies of it.
+func revokeTicket(tic *ticket.Ticket) error {
+	validity := tic.Validity
+	if renewable := tic.Issued + int64(ticketRenewLimit/time.Second); renewable > validity {
+		validity = renewable
+	}
+	return updateRevocations(func(r revocations) {
+		r.Tickets[hex.EncodeToString(tic.ID)] = validity
+	})
+}
+
+// revokeUser revokes all tickets of the user granted up to now.
+func revokeUser(user string) error {
+	return updateRevocations(func(r revocations) {
+		r.Users[user] = time.Now().Unix()
+	})
+}
@@ -0,0 +1,76 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/ticket"
+)
+
+func ticketRequest(url, tic string) *http.Request {
+	req, _ := http.NewRequest("POST", url, nil)
+	req.RemoteAddr = "192.0.2.42:12345"
+	req.Header.Set("X-Mole-Ticket", tic)
+	return req
+}
+
+func TestRevocation(t *testing.T) {
+	defer withTestStore(t)()
+	writeStoreFile(t, "acl.json", testACL)
+
+	validity := time.Now().Add(time.Hour).Unix()
+	tic1 := ticket.Grant("alice", "192.0.2.42", validity)
+	tic2 := ticket.Grant("alice", "192.0.2.42", validity)
+	other := ticket.Grant("bob", "192.0.2.42", validity)
+	admin := ticket.Grant("root", "192.0.2.42", validity)
+
+	if !authenticate(httptest.NewRecorder(), ticketRequest("/store", tic1)) {
+		t.Fatal("valid ticket refused")
+	}
+
+	// Logging out revokes only the ticket used
+	req := ticketRequest("/logout", tic1)
+	authenticate(httptest.NewRecorder(), req)
+	rw := httptest.NewRecorder()
+	logout(rw, req)
+	if rw.Code != 200 {
+		t.Fatalf("logout failed; %d", rw.Code)
+	}
+	if authenticate(httptest.NewRecorder(), ticketRequest("/store", tic1)) {
+		t.Error("revoked ticket accepted")
+	}
+	if !authenticate(httptest.NewRecorder(), ticketRequest("/store", tic2)) {
+		t.Error("other ticket of user refused")
+	}
+
+	// Only admins revoke the tickets of others
+	req = ticketRequest("/revoke/alice", other)
+	authenticate(httptest.NewRecorder(), req)
+	rw = httptest.NewRecorder()
+	revokeUserTickets(rw, req)
+	if rw.Code != 403 {
+		t.Errorf("revocation by non-admin; %d", rw.Code)
+	}
+
+	req = ticketRequest("/revoke/alice", admin)
+	authenticate(httptest.NewRecorder(), req)
+	rw = httptest.NewRecorder()
+	revokeUserTickets(rw, req)
+	if rw.Code != 200 {
+		t.Fatalf("revocation by admin failed; %d", rw.Code)
+	}
+	if authenticate(httptest.NewRecorder(), ticketRequest("/store", tic2)) {
+		t.Error("ticket of revoked user accepted")
+	}
+	if !authenticate(httptest.NewRecorder(), ticketRequest("/store", other)) {
+		t.Error("ticket of other user refused")
+	}
+
+	// Tickets granted afterwards are accepted
+	tic := ticket.Ticket{User: "alice", IP: []string{"192.0.2.42"}, Validity: validity, ID: ticket.NewID(), Issued: time.Now().Unix() + 1}
+	if !authenticate(httptest.NewRecorder(), ticketRequest("/store", tic.String())) {
+		t.Error("new ticket refused")
+	}
+}
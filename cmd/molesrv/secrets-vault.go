@@ -0,0 +1,171 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"io/ioutil"
+	"net/http"
+	"os"
+	"sort"
+	"strings"
+	"time"
+)
+
+var (
+	vaultAddr      = os.Getenv("VAULT_ADDR")
+	vaultTokenFile = ""
+	vaultMount     = "secret"
+	vaultPath      = "mole"
+)
+
+func init() {
+	globalFlags.StringVar(&vaultAddr, "vault-addr", vaultAddr, "(for -secret-store vault) Vault server address")
+	globalFlags.StringVar(&vaultTokenFile, "vault-token-file", vaultTokenFile, "(for -secret-store vault) File containing the Vault token; $VAULT_TOKEN when blank")
+	globalFlags.StringVar(&vaultMount, "vault-mount", vaultMount, "(for -secret-store vault) Mount point of the KV version 2 secrets engine")
+	globalFlags.StringVar(&vaultPath, "vault-path", vaultPath, "(for -secret-store vault) Path under the mount to keep secrets at")
+	secretBackends["vault"] = openVaultSecrets
+}
+
+// vaultSecrets keeps every secret as a separate entry in a Vault KV
+// version 2 secrets engine, with the value in the "value" field.
+type vaultSecrets struct {
+	addr   string
+	token  string
+	client *http.Client
+}
+
+func openVaultSecrets() (secretStore, error) {
+	if vaultAddr == "" {
+		return nil, errors.New("-vault-addr is required")
+	}
+	token := os.Getenv("VAULT_TOKEN")
+	if vaultTokenFile != "" {
+		bs, err := ioutil.ReadFile(vaultTokenFile)
+		if err != nil {
+			return nil, err
+		}
+		token = strings.TrimSpace(string(bs))
+	}
+	if token == "" {
+		return nil, errors.New("no Vault token; see -vault-token-file")
+	}
+
+	s := &vaultSecrets{
+		addr:   strings.TrimRight(vaultAddr, "/"),
+		token:  token,
+		client: &http.Client{Timeout: 30 * time.Second},
+	}
+	// Fail on startup rather than on the first push if Vault is unusable
+	if _, err := s.List(); err != nil {
+		return nil, err
+	}
+	return s, nil
+}
+
+// References are base64, of which '/' and '+' don't belong in Vault paths.
+var vaultRefReplacer = strings.NewReplacer("/", "_", "+", "-")
+var vaultNameReplacer = strings.NewReplacer("_", "/", "-", "+")
+
+func (s *vaultSecrets) url(kind, ref string) string {
+	u := s.addr + "/v1/" + strings.Trim(vaultMount, "/") + "/" + kind
+	if p := strings.Trim(vaultPath, "/"); p != "" {
+		u += "/" + p
+	}
+	if ref != "" {
+		u += "/" + vaultRefReplacer.Replace(ref)
+	}
+	return u
+}
+
+// do performs the request and decodes the response into res, if any. It
+// returns false when Vault responds 404.
+func (s *vaultSecrets) do(method, url string, body, res interface{}) (bool, error) {
+	var r io.Reader
+	if body != nil {
+		bs, err := json.Marshal(body)
+		if err != nil {
+			return false, err
+		}
+		r = bytes.NewReader(bs)
+	}
+	req, err := http.NewRequest(method, url, r)
+	if err != nil {
+		return false, err
+	}
+	req.Header.Set("X-Vault-Token", s.token)
+	if body != nil {
+		req.Header.Set("Content-Type", "application/json")
+	}
+
+	resp, err := s.client.Do(req)
+	if err != nil {
+		return false, err
+	}
+	defer resp.Body.Close()
+
+	if resp.StatusCode == 404 {
+		return false, nil
+	}
+	if resp.StatusCode < 200 || resp.StatusCode > 299 {
+		bs, _ := ioutil.ReadAll(io.LimitReader(resp.Body, 1024))
+		return false, fmt.Errorf("vault: %s %s: %s: %s", method, url, resp.Status, strings.TrimSpace(string(bs)))
+	}
+	if res != nil {
+		if err := json.NewDecoder(resp.Body).Decode(res); err != nil {
+			return false, fmt.Errorf("vault: %s %s: %v", method, url, err)
+		}
+	}
+	return true, nil
+}
+
+func (s *vaultSecrets) Put(ref, value string) error {
+	body := map[string]interface{}{
+		"data": map[string]string{"value": value},
+	}
+	_, err := s.do("POST", s.url("data", ref), body, nil)
+	return err
+}
+
+func (s *vaultSecrets) Get(ref string) (string, bool, error) {
+	var res struct {
+		Data struct {
+			Data map[string]string `json:"data"`
+		} `json:"data"`
+	}
+	ok, err := s.do("GET", s.url("data", ref), nil, &res)
+	if err != nil || !ok {
+		return "", false, err
+	}
+	// A deleted version reads as data null
+	value, ok := res.Data.Data["value"]
+	return value, ok, nil
+}
+
+// Delete removes the secret with all its versions.
+func (s *vaultSecrets) Delete(ref string) error {
+	_, err := s.do("DELETE", s.url("metadata", ref), nil, nil)
+	return err
+}
+
+func (s *vaultSecrets) List() ([]string, error) {
+	var res struct {
+		Data struct {
+			Keys []string `json:"keys"`
+		} `json:"data"`
+	}
+	if _, err := s.do("LIST", s.url("metadata", ""), nil, &res); err != nil {
+		return nil, err
+	}
+	var refs []string
+	for _, name := range res.Data.Keys {
+		// Subdirectories are not ours
+		if !strings.HasSuffix(name, "/") {
+			refs = append(refs, vaultNameReplacer.Replace(name))
+		}
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
@@ -0,0 +1,148 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"sync"
+	"testing"
+)
+
+// fakeVault serves the parts of the KV version 2 API the vault secret store
+// uses, for secrets under secret/mole.
+func fakeVault(t *testing.T) (*httptest.Server, map[string]string) {
+	var mut sync.Mutex
+	data := make(map[string]string)
+
+	srv := httptest.NewServer(http.HandlerFunc(func(rw http.ResponseWriter, req *http.Request) {
+		mut.Lock()
+		defer mut.Unlock()
+
+		if req.Header.Get("X-Vault-Token") != "test-token" {
+			rw.WriteHeader(403)
+			return
+		}
+		switch {
+		case req.Method == "LIST" && req.URL.Path == "/v1/secret/metadata/mole":
+			var names []string
+			for name := range data {
+				names = append(names, name)
+			}
+			if len(names) == 0 {
+				rw.WriteHeader(404)
+				return
+			}
+			json.NewEncoder(rw).Encode(map[string]interface{}{"data": map[string]interface{}{"keys": names}})
+
+		case strings.HasPrefix(req.URL.Path, "/v1/secret/data/mole/"):
+			name := req.URL.Path[len("/v1/secret/data/mole/"):]
+			switch req.Method {
+			case "POST":
+				var body struct {
+					Data map[string]string `json:"data"`
+				}
+				if err := json.NewDecoder(req.Body).Decode(&body); err != nil {
+					rw.WriteHeader(400)
+					return
+				}
+				data[name] = body.Data["value"]
+			case "GET":
+				val, ok := data[name]
+				if !ok {
+					rw.WriteHeader(404)
+					return
+				}
+				fmt.Fprintf(rw, `{"data": {"data": {"value": %q}, "metadata": {"version": 1}}}`, val)
+			default:
+				rw.WriteHeader(405)
+			}
+
+		case req.Method == "DELETE" && strings.HasPrefix(req.URL.Path, "/v1/secret/metadata/mole/"):
+			delete(data, req.URL.Path[len("/v1/secret/metadata/mole/"):])
+			rw.WriteHeader(204)
+
+		default:
+			t.Errorf("unexpected request %s %s", req.Method, req.URL.Path)
+			rw.WriteHeader(404)
+		}
+	}))
+	return srv, data
+}
+
+func TestVaultSecrets(t *testing.T) {
+	defer withTestStore(t)()
+	srv, data := fakeVault(t)
+	defer srv.Close()
+
+	oldBackend, oldAddr, oldMount, oldPath := secretBackend, vaultAddr, vaultMount, vaultPath
+	defer func() { secretBackend, vaultAddr, vaultMount, vaultPath = oldBackend, oldAddr, oldMount, oldPath }()
+	secretBackend, vaultAddr, vaultMount, vaultPath = "vault", srv.URL, "secret", "mole"
+
+	oldToken := os.Getenv("VAULT_TOKEN")
+	defer os.Setenv("VAULT_TOKEN", oldToken)
+	os.Setenv("VAULT_TOKEN", "wrong")
+	if err := openSecrets(); err == nil {
+		t.Fatal("incorrect token accepted")
+	}
+	os.Setenv("VAULT_TOKEN", "test-token")
+	if err := openSecrets(); err != nil {
+		t.Fatal(err)
+	}
+
+	// References containing '/' are stored under a single name
+	if err := secrets.Put("ab/c+d=", "hunter2"); err != nil {
+		t.Fatal(err)
+	}
+	if data["ab_c-d="] != "hunter2" {
+		t.Errorf("unexpected stored data %v", data)
+	}
+	if val, ok, err := secrets.Get("ab/c+d="); err != nil || !ok || val != "hunter2" {
+		t.Errorf("unexpected get %q %v %v", val, ok, err)
+	}
+	if _, ok, err := secrets.Get("missing"); err != nil || ok {
+		t.Errorf("missing secret found; %v %v", ok, err)
+	}
+	if refs, err := secrets.List(); err != nil || fmt.Sprint(refs) != "[ab/c+d=]" {
+		t.Errorf("unexpected list %v %v", refs, err)
+	}
+
+	// Pushing a definition puts the password in Vault, where getKeys
+	// finds it
+	writeStoreFile(t, "acl.json", testACL)
+	rec := httptest.NewRecorder()
+	putFile(rec, testRequest("PUT", "/store/new.ini", "alice", []byte(strings.Replace(fmt.Sprintf(testTunnel, "x"), "$mole$x", "s3cr3t", 1))))
+	if rec.Code != 200 {
+		t.Fatalf("unexpected put response %d: %s", rec.Code, rec.Body)
+	}
+	if len(keys) != 0 {
+		t.Errorf("password stored in the json key store; %v", keys)
+	}
+	refs, err := secrets.List()
+	if err != nil || len(refs) != 2 {
+		t.Fatalf("unexpected list %v %v", refs, err)
+	}
+	key := refs[0]
+	if key == "ab/c+d=" {
+		key = refs[1]
+	}
+
+	rec = httptest.NewRecorder()
+	getKeys(rec, testRequest("POST", "/keys", "bob", []byte(`["`+key+`"]`)))
+	var keymap map[string]string
+	if err := json.NewDecoder(rec.Body).Decode(&keymap); err != nil || rec.Code != 200 {
+		t.Fatalf("unexpected keys response %d %v", rec.Code, err)
+	}
+	if keymap[key] != "s3cr3t" {
+		t.Errorf("unexpected keys %v", keymap)
+	}
+
+	if err := secrets.Delete("ab/c+d="); err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := data["ab_c-d="]; ok {
+		t.Error("secret not deleted")
+	}
+}
@@ -0,0 +1,133 @@
+package main
+
+import (
+	"crypto/rand"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"os"
+	"sort"
+	"strings"
+	"sync"
+)
+
+// A secretStore holds the secrets that tunnel definitions reference as
+// $mole$<ref>. Get returns false for a reference that doesn't exist.
+type secretStore interface {
+	Put(ref, value string) error
+	Get(ref string) (string, bool, error)
+	Delete(ref string) error
+	List() ([]string, error)
+}
+
+var secretBackend = "json"
+
+// secretBackends holds the functions that open each kind of secret store.
+var secretBackends = map[string]func() (secretStore, error){
+	"json": openJSONSecrets,
+}
+
+var secrets secretStore
+
+func init() {
+	globalFlags.StringVar(&secretBackend, "secret-store", secretBackend, "Secret store backend for tunnel credentials")
+}
+
+func openSecrets() error {
+	open, ok := secretBackends[secretBackend]
+	if !ok {
+		return fmt.Errorf("unknown secret store %q", secretBackend)
+	}
+	s, err := open()
+	if err != nil {
+		return err
+	}
+	secrets = s
+	return nil
+}
+
+// jsonSecrets is the key store in keys.json, held in memory and saved on
+// every change.
+type jsonSecrets struct {
+	mut sync.Mutex
+}
+
+// openJSONSecrets loads keys.json, starting an empty store if there is
+// none.
+func openJSONSecrets() (secretStore, error) {
+	err := loadKeys()
+	if os.IsNotExist(err) {
+		log.Println("Warning:", err)
+	} else if err != nil {
+		// Continuing would overwrite the key store on the next push
+		return nil, err
+	}
+	if keys == nil {
+		keys = make(map[string]string)
+		log.Println("Initialized new key store")
+	}
+	return &jsonSecrets{}, nil
+}
+
+func (s *jsonSecrets) Put(ref, value string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	keys[ref] = value
+	return saveKeys()
+}
+
+func (s *jsonSecrets) Get(ref string) (string, bool, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	value, ok := keys[ref]
+	return value, ok, nil
+}
+
+func (s *jsonSecrets) Delete(ref string) error {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	if _, ok := keys[ref]; !ok {
+		return nil
+	}
+	delete(keys, ref)
+	return saveKeys()
+}
+
+func (s *jsonSecrets) List() ([]string, error) {
+	s.mut.Lock()
+	defer s.mut.Unlock()
+	refs := make([]string, 0, len(keys))
+	for ref := range keys {
+		refs = append(refs, ref)
+	}
+	sort.Strings(refs)
+	return refs, nil
+}
+
+func randomKey() string {
+	keybs := make([]byte, 15)
+	_, err := rand.Read(keybs)
+	if err != nil {
+		panic(err)
+	}
+	return base64.StdEncoding.EncodeToString(keybs)
+}
+
+// obfuscate puts the value in the secret store and returns the reference
+// to it, unless it already is one.
+func obfuscate(val string) (string, error) {
+	if strings.HasPrefix(val, "$mole$") {
+		return val, nil
+	}
+
+	key := randomKey()
+	if _, ok, err := secrets.Get(key); err != nil {
+		return "", err
+	} else if ok {
+		panic("randomly generated key already exists")
+	}
+	if err := secrets.Put(key, val); err != nil {
+		return "", err
+	}
+	return "$mole$" + key, nil
+}
@@ -0,0 +1,119 @@
+package main
+
+import (
+	"bytes"
+	"log"
+	"os"
+	"path"
+	"time"
+
+	"github.com/calmh/mole/ticket"
+)
+
+var (
+	ticketKeyring  = "ticket-keys.json"
+	ticketRotation = 30 * 24 * time.Hour
+)
+
+const ticketRotationCheck = time.Hour
+
+func init() {
+	globalFlags.StringVar(&ticketKeyring, "ticket-keyring", ticketKeyring, "Ticket keyring file (relative to store directory)")
+	globalFlags.DurationVar(&ticketRotation, "ticket-key-rotation", ticketRotation, "Interval between ticket key rotations (zero to disable)")
+}
+
+func ticketKeyringPath() string {
+	return path.Join(storeDir, ticketKeyring)
+}
+
+// setupTicketKeys loads the ticket keyring, creating it on first start, and
+// the legacy ticket key if one is given.
+func setupTicketKeys() error {
+	k, err := loadTicketKeyring()
+	if os.IsNotExist(err) {
+		k, err = ticket.NewKeyring()
+		if err != nil {
+			return err
+		}
+		if err := saveTicketKeyring(k); err != nil {
+			return err
+		}
+		log.Println("Initialized new ticket keyring")
+	} else if err != nil {
+		return err
+	}
+	ticket.SetKeyring(k)
+
+	if ticketKeyFile != "" {
+		fd, err := os.Open(ticketKeyFile)
+		if err != nil {
+			return err
+		}
+		ticket.LoadKey(fd)
+		fd.Close()
+
+		// Tickets granted before the keyring existed have all expired by the
+		// time the first key is as old as a ticket may be.
+		until := k.Keys[0].Created.Add(legacyTicketLifetime)
+		ticket.AcceptLegacyUntil(until)
+		if time.Now().Before(until) {
+			log.Println("Accepting legacy tickets until", until.Format(time.RFC3339))
+		}
+	}
+
+	_, err = rotateTicketKeys(time.Now())
+	return err
+}
+
+func loadTicketKeyring() (*ticket.Keyring, error) {
+	fd, err := os.Open(ticketKeyringPath())
+	if err != nil {
+		return nil, err
+	}
+	defer fd.Close()
+	return ticket.ReadKeyring(fd)
+}
+
+func saveTicketKeyring(k *ticket.Keyring) error {
+	var buf bytes.Buffer
+	if _, err := k.WriteTo(&buf); err != nil {
+		return err
+	}
+	return writeFileAtomic(ticketKeyringPath(), buf.Bytes(), 0600)
+}
+
+// rotateTicketKeys adds a new ticket key when the current one is older than
+// the rotation interval, and removes those that can only have granted
+// expired tickets. The keyring is read from disk so that servers sharing
+// the store agree on it.
+func rotateTicketKeys(now time.Time) (bool, error) {
+	k, err := loadTicketKeyring()
+	if err != nil {
+		return false, err
+	}
+
+	if ticketRotation <= 0 || now.Sub(k.Current().Created) < ticketRotation {
+		// Another server may have rotated it
+		ticket.SetKeyring(k)
+		return false, nil
+	}
+
+	if err := k.Rotate(now); err != nil {
+		return false, err
+	}
+	k.Prune(now.Add(-longestTicketAge()))
+	if err := saveTicketKeyring(k); err != nil {
+		return false, err
+	}
+	ticket.SetKeyring(k)
+	log.Printf("Rotated ticket keys; current key %d, %d keys in use", k.Current().ID, len(k.Keys))
+	return true, nil
+}
+
+func ticketKeyRotator() {
+	for range time.NewTicker(ticketRotationCheck).C {
+		if _, err := rotateTicketKeys(time.Now()); err != nil {
+			log.Println("Warning: ticket key rotation:", err)
+		}
+	}
+}
@@ -0,0 +1,166 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"strings"
+	"time"
+)
+
+var (
+	ticketLifetime   = 7 * 24 * time.Hour
+	ticketRenewLimit = 30 * 24 * time.Hour
+	ticketMaxIPs     = 4
+	ticketIPv4Prefix = 32
+	ticketIPv6Prefix = 128
+)
+
+// Tickets granted before the lifetime was configurable were valid for this
+// long.
+const legacyTicketLifetime = 7 * 24 * time.Hour
+
+// A ticketPolicy decides how long tickets are valid and where from. Zero
+// fields are unset. The prefix lengths bind tickets to the network of the
+// client instead of its exact address, for clients that roam within it.
+type ticketPolicy struct {
+	Lifetime   duration `json:"lifetime,omitempty"`
+	MaxIPs     int      `json:"maxIPs,omitempty"`
+	IPv4Prefix int      `json:"ipv4Prefix,omitempty"`
+	IPv6Prefix int      `json:"ipv6Prefix,omitempty"`
+}
+
+// A duration is a time.Duration given as a string, such as "12h", in JSON.
+type duration time.Duration
+
+func (d *duration) UnmarshalJSON(bs []byte) error {
+	var s string
+	if err := json.Unmarshal(bs, &s); err != nil {
+		return err
+	}
+	v, err := time.ParseDuration(s)
+	if err != nil {
+		return err
+	}
+	*d = duration(v)
+	return nil
+}
+
+func (d duration) MarshalJSON() ([]byte, error) {
+	return json.Marshal(time.Duration(d).String())
+}
+
+func init() {
+	globalFlags.DurationVar(&ticketLifetime, "ticket-lifetime", ticketLifetime, "Ticket validity, unless set for the user in acl.json")
+	globalFlags.DurationVar(&ticketRenewLimit, "ticket-renew-limit", ticketRenewLimit, "Time after login during which tickets may be renewed (zero to disable renewal)")
+	globalFlags.IntVar(&ticketMaxIPs, "ticket-max-ips", ticketMaxIPs, "Number of addresses a ticket is valid from, unless set for the user in acl.json")
+	globalFlags.IntVar(&ticketIPv4Prefix, "ticket-ipv4-prefix", ticketIPv4Prefix, "Bind tickets to IPv4 networks of this prefix length, unless set for the user in acl.json")
+	globalFlags.IntVar(&ticketIPv6Prefix, "ticket-ipv6-prefix", ticketIPv6Prefix, "Bind tickets to IPv6 networks of this prefix length, unless set for the user in acl.json")
+}
+
+func (p ticketPolicy) validate() error {
+	if p.Lifetime < 0 || p.MaxIPs < 0 {
+		return fmt.Errorf("negative lifetime or maxIPs")
+	}
+	if p.IPv4Prefix < 0 || p.IPv4Prefix > 32 || p.IPv6Prefix < 0 || p.IPv6Prefix > 128 {
+		return fmt.Errorf("prefix length out of range")
+	}
+	return nil
+}
+
+// override returns the policy with the fields set in o replaced.
+func (p ticketPolicy) override(o ticketPolicy) ticketPolicy {
+	if o.Lifetime != 0 {
+		p.Lifetime = o.Lifetime
+	}
+	if o.MaxIPs != 0 {
+		p.MaxIPs = o.MaxIPs
+	}
+	if o.IPv4Prefix != 0 {
+		p.IPv4Prefix = o.IPv4Prefix
+	}
+	if o.IPv6Prefix != 0 {
+		p.IPv6Prefix = o.IPv6Prefix
+	}
+	return p
+}
+
+// restrict returns the policy with the fields that are more restrictive in
+// o replaced.
+func (p ticketPolicy) restrict(o ticketPolicy) ticketPolicy {
+	if o.Lifetime != 0 && (p.Lifetime == 0 || o.Lifetime < p.Lifetime) {
+		p.Lifetime = o.Lifetime
+	}
+	if o.MaxIPs != 0 && (p.MaxIPs == 0 || o.MaxIPs < p.MaxIPs) {
+		p.MaxIPs = o.MaxIPs
+	}
+	if o.IPv4Prefix > p.IPv4Prefix {
+		p.IPv4Prefix = o.IPv4Prefix
+	}
+	if o.IPv6Prefix > p.IPv6Prefix {
+		p.IPv6Prefix = o.IPv6Prefix
+	}
+	return p
+}
+
+// ticketPolicyFor returns the ticket policy of the user. An entry in
+// acl.json for the user takes precedence over entries for its groups, which
+// take precedence over the "*" entry and then the command line options.
+// When several groups have entries, the most restrictive setting applies.
+func ticketPolicyFor(user string, groups []string, a aclFile) ticketPolicy {
+	p := ticketPolicy{
+		Lifetime:   duration(ticketLifetime),
+		MaxIPs:     ticketMaxIPs,
+		IPv4Prefix: ticketIPv4Prefix,
+		IPv6Prefix: ticketIPv6Prefix,
+	}
+	if o, ok := a.Tickets["*"]; ok {
+		p = p.override(o)
+	}
+
+	var gp ticketPolicy
+	for _, pr := range principalsOf(user, groups, a) {
+		if o, ok := a.Tickets[pr]; ok && strings.HasPrefix(pr, "@") {
+			gp = gp.restrict(o)
+		}
+	}
+	p = p.override(gp)
+
+	if o, ok := a.Tickets[user]; ok {
+		p = p.override(o)
+	}
+	return p
+}
+
+// bindAddress returns what a ticket for the policy is bound to when used
+// from the IP; the address itself or its network.
+func (p ticketPolicy) bindAddress(ip string) string {
+	addr := net.ParseIP(ip)
+	if addr == nil {
+		return ip
+	}
+	bits, prefix := 128, p.IPv6Prefix
+	if v4 := addr.To4(); v4 != nil {
+		addr, bits, prefix = v4, 32, p.IPv4Prefix
+	}
+	if prefix <= 0 || prefix >= bits {
+		return ip
+	}
+	ipnet := net.IPNet{IP: addr.Mask(net.CIDRMask(prefix, bits)), Mask: net.CIDRMask(prefix, bits)}
+	return ipnet.String()
+}
+
+// longestTicketAge returns the longest time a ticket may be valid after it
+// was granted, renewals included.
+func longestTicketAge() time.Duration {
+	age := ticketLifetime
+	if ticketRenewLimit > age {
+		age = ticketRenewLimit
+	}
+	for _, p := range currentACL().Tickets {
+		if d := time.Duration(p.Lifetime); d > age {
+			age = d
+		}
+	}
+	return age
+}
@@ -0,0 +1,139 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http/httptest"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/ticket"
+)
+
+const testTicketACL = `{
+    "groups": {"ops": ["alice"]},
+    "tickets": {
+        "*": {"maxIPs": 2},
+        "@ops": {"lifetime": "12h", "ipv4Prefix": 24},
+        "@contractors": {"lifetime": "1h", "ipv4Prefix": 16},
+        "carol": {"lifetime": "48h"}
+    }
+}`
+
+func TestTicketPolicy(t *testing.T) {
+	defer withTestStore(t)()
+	writeStoreFile(t, "acl.json", testTicketACL)
+	a := currentACL()
+
+	cases := []struct {
+		user   string
+		groups []string
+		policy ticketPolicy
+	}{
+		{"bob", nil, ticketPolicy{duration(ticketLifetime), 2, 32, 128}},
+		{"alice", nil, ticketPolicy{duration(12 * time.Hour), 2, 24, 128}},
+		// The most restrictive group setting applies
+		{"alice", []string{"contractors"}, ticketPolicy{duration(time.Hour), 2, 24, 128}},
+		{"carol", []string{"ops"}, ticketPolicy{duration(48 * time.Hour), 2, 24, 128}},
+	}
+	for _, tc := range cases {
+		if p := ticketPolicyFor(tc.user, tc.groups, a); p != tc.policy {
+			t.Errorf("%s %v: unexpected policy %+v != %+v", tc.user, tc.groups, p, tc.policy)
+		}
+	}
+
+	writeStoreFile(t, "acl.json", `{"tickets": {"*": {"ipv4Prefix": 33}}}`)
+	if err := loadACL(); err == nil {
+		t.Error("invalid prefix length accepted")
+	}
+}
+
+func TestBindAddress(t *testing.T) {
+	p := ticketPolicy{IPv4Prefix: 24, IPv6Prefix: 64}
+	cases := [][2]string{
+		{"192.0.2.42", "192.0.2.0/24"},
+		{"2001:db8::1:42", "2001:db8::/64"},
+		{"::ffff:192.0.2.42", "192.0.2.0/24"},
+	}
+	for _, tc := range cases {
+		if b := p.bindAddress(tc[0]); b != tc[1] {
+			t.Errorf("%s bound to %s, not %s", tc[0], b, tc[1])
+		}
+	}
+
+	p = ticketPolicy{IPv4Prefix: 32, IPv6Prefix: 128}
+	if b := p.bindAddress("192.0.2.42"); b != "192.0.2.42" {
+		t.Errorf("unexpected binding %s", b)
+	}
+}
+
+func TestRenewTicket(t *testing.T) {
+	defer withTestStore(t)()
+	auth = "none"
+
+	now := time.Now()
+	tic := ticket.Ticket{User: "alice", IP: []string{"192.0.2.42"}, Validity: now.Add(time.Hour).Unix(), ID: ticket.NewID(), Issued: now.Unix()}
+	rw := httptest.NewRecorder()
+	renewTicket(rw, ticketRequest("/renew", tic.String()))
+	if rw.Code != 200 {
+		t.Fatalf("renewal refused; %d", rw.Code)
+	}
+	renewed, err := ticket.Load(rw.Body.String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if renewed.Validity < now.Add(ticketLifetime).Unix() || string(renewed.ID) != string(tic.ID) {
+		t.Errorf("unexpected renewed ticket %+v", renewed)
+	}
+
+	// Not beyond the renewal limit
+	tic.Issued = now.Add(-ticketRenewLimit).Unix()
+	rw = httptest.NewRecorder()
+	renewTicket(rw, ticketRequest("/renew", tic.String()))
+	if rw.Code != 403 {
+		t.Errorf("renewal beyond limit; %d", rw.Code)
+	}
+}
+
+func TestRenewTicketAccount(t *testing.T) {
+	defer withTestStore(t)()
+	htpasswdCache = nil
+	auth = "htpasswd"
+
+	data := "alice:" + testHash(t, "secret") + "\nbob:!" + testHash(t, "hunter2") + "\n"
+	if err := ioutil.WriteFile(htpasswdPath(), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	now := time.Now()
+	renew := func(user string) int {
+		tic := ticket.Ticket{User: user, IP: []string{"192.0.2.42"}, Validity: now.Add(time.Hour).Unix(), ID: ticket.NewID(), Issued: now.Unix()}
+		rw := httptest.NewRecorder()
+		renewTicket(rw, ticketRequest("/renew", tic.String()))
+		return rw.Code
+	}
+
+	if code := renew("alice"); code != 200 {
+		t.Errorf("renewal for enabled user refused; %d", code)
+	}
+	if code := renew("bob"); code != 403 {
+		t.Errorf("renewal for disabled user; %d", code)
+	}
+	if code := renew("carol"); code != 403 {
+		t.Errorf("renewal for removed user; %d", code)
+	}
+
+	// Group membership is checked again
+	defer func(old string) { requireGroup = old }(requireGroup)
+	requireGroup = "ops"
+	if code := renew("alice"); code != 403 {
+		t.Errorf("renewal without the required group; %d", code)
+	}
+	requireGroup = ""
+
+	// Backends that cannot look up users don't renew
+	auth = "ldap"
+	ldapSearchBase = ""
+	if code := renew("alice"); code != 403 {
+		t.Errorf("renewal without lookup; %d", code)
+	}
+}
@@ -2,6 +2,9 @@ package main
 
 import (
 	"testing"
+	"time"
+
+	"github.com/calmh/mole/ticket"
 )
 
 var testcases = []struct {
@@ -47,3 +50,42 @@ func TestNewIPList(t *testing.T) {
 		}
 	}
 }
+
+func TestTicketKeyring(t *testing.T) {
+	defer withTestStore(t)()
+	defer ticket.Init()
+
+	if err := setupTicketKeys(); err != nil {
+		t.Fatal(err)
+	}
+	tic := ticket.Grant("jb", "10.2.3.4", 1234567890)
+
+	// Tickets survive a restart
+	ticket.Init()
+	if err := setupTicketKeys(); err != nil {
+		t.Fatal(err)
+	}
+	if _, err := ticket.Verify(tic, "10.2.3.4", 1234567890); err != nil {
+		t.Errorf("ticket refused after restart; %s", err)
+	}
+
+	now := time.Now()
+	if rotated, err := rotateTicketKeys(now); err != nil || rotated {
+		t.Errorf("unexpected rotation %v %v", rotated, err)
+	}
+	if rotated, err := rotateTicketKeys(now.Add(ticketRotation)); err != nil || !rotated {
+		t.Fatalf("missing rotation %v %v", rotated, err)
+	}
+	if _, err := ticket.Verify(tic, "10.2.3.4", 1234567890); err != nil {
+		t.Errorf("ticket refused after rotation; %s", err)
+	}
+
+	// The first key is dropped once its tickets have expired
+	later := now.Add(ticketRotation + longestTicketAge() + time.Second)
+	if rotated, err := rotateTicketKeys(later); err != nil || !rotated {
+		t.Fatalf("missing rotation %v %v", rotated, err)
+	}
+	if _, err := ticket.Verify(tic, "10.2.3.4", 1234567890); err != ticket.ErrUnknownKey {
+		t.Errorf("unexpected err %v", err)
+	}
+}
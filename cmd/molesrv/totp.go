@@ -0,0 +1,184 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"log"
+	"net/http"
+	"os"
+	"path"
+	"strings"
+	"sync"
+	"time"
+
+	"github.com/calmh/mole/totp"
+)
+
+var (
+	totpFile     = "totp.json"
+	totpBackends = ""
+	totpGroups   = ""
+)
+
+// A totpUser is the TOTP enrollment of a user. A new secret is pending
+// until confirmed by a correct code, so that a mistyped enrollment doesn't
+// lock the user out.
+type totpUser struct {
+	Secret   string    `json:",omitempty"`
+	Pending  string    `json:",omitempty"`
+	LastStep int64     `json:",omitempty"`
+	Enrolled time.Time `json:",omitempty"`
+}
+
+var totpLock sync.Mutex
+
+func init() {
+	globalFlags.StringVar(&totpFile, "totp-file", totpFile, "TOTP enrollment file (relative to store directory)")
+	globalFlags.StringVar(&totpBackends, "totp-backends", totpBackends, "Auth backends requiring TOTP for all users (comma separated)")
+	globalFlags.StringVar(&totpGroups, "totp-groups", totpGroups, "Groups whose members require TOTP (comma separated)")
+}
+
+func totpPath() string {
+	return path.Join(storeDir, totpFile)
+}
+
+func loadTOTP() (map[string]*totpUser, error) {
+	users := make(map[string]*totpUser)
+	bs, err := ioutil.ReadFile(totpPath())
+	if os.IsNotExist(err) {
+		return users, nil
+	} else if err != nil {
+		return nil, err
+	}
+	err = json.Unmarshal(bs, &users)
+	return users, err
+}
+
+// updateTOTP applies the change to the enrollments and saves them.
+func updateTOTP(fn func(users map[string]*totpUser) error) error {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+
+	users, err := loadTOTP()
+	if err != nil {
+		return err
+	}
+	if err := fn(users); err != nil {
+		return err
+	}
+	bs, err := json.MarshalIndent(users, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(totpPath(), bs, 0600)
+}
+
+func totpEnrolled(user string) bool {
+	totpLock.Lock()
+	defer totpLock.Unlock()
+
+	users, err := loadTOTP()
+	if err != nil {
+		log.Println("totp:", err)
+		// Fail closed; the user cannot be checked
+		return true
+	}
+	u, ok := users[user]
+	return ok && u.Secret != ""
+}
+
+// totpRequired returns true if the user must use TOTP, by the backend or
+// group settings.
+func totpRequired(user string, groups []string) bool {
+	if containsString(splitFlag(totpBackends), auth) {
+		return true
+	}
+	required := splitFlag(totpGroups)
+	if matchAny(groups, required) {
+		return true
+	}
+	// Groups defined in acl.json count as well
+	a := currentACL()
+	for _, group := range required {
+		if containsString(a.Groups[group], user) {
+			return true
+		}
+	}
+	return false
+}
+
+// totpVerify checks the code against the user's secret, or the pending one
+// if pending is set.
+func totpVerify(user, code string, pending bool) bool {
+	ok := false
+	err := updateTOTP(func(users map[string]*totpUser) error {
+		u, exists := users[user]
+		if !exists {
+			return nil
+		}
+		secret := u.Secret
+		if pending {
+			secret = u.Pending
+		}
+		if secret == "" {
+			return nil
+		}
+		var step int64
+		step, ok = totp.Verify(secret, code, time.Now(), u.LastStep)
+		if ok {
+			u.LastStep = step
+			if pending {
+				u.Secret = u.Pending
+				u.Pending = ""
+				u.Enrolled = time.Now()
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		log.Println("totp:", err)
+		return false
+	}
+	return ok
+}
+
+// checkOTP verifies the one-time code of the request, when the user is
+// enrolled or required to be. On failure an error response is written and
+// false is returned.
+func checkOTP(rw http.ResponseWriter, req *http.Request, user string, groups []string) bool {
+	if !totpEnrolled(user) {
+		if !totpRequired(user, groups) {
+			return true
+		}
+		log.Printf("Ticket refused for %q; TOTP enrollment required", user)
+		rw.Header().Set("X-Mole-OTP", "enroll")
+		rw.WriteHeader(403)
+		rw.Write([]byte("TOTP enrollment required"))
+		return false
+	}
+
+	code := req.Header.Get("X-Mole-OTP")
+	if code == "" {
+		rw.Header().Set("X-Mole-OTP", "required")
+		rw.WriteHeader(401)
+		return false
+	}
+	if !totpVerify(user, code, false) {
+		log.Printf("Ticket refused for %q; incorrect one-time code", user)
+		authFailed(req, user, "incorrect one-time code")
+		rw.Header().Set("X-Mole-OTP", "invalid")
+		rw.WriteHeader(401)
+		return false
+	}
+	return true
+}
+
+func splitFlag(s string) []string {
+	var res []string
+	for _, f := range strings.Split(s, ",") {
+		if f = strings.TrimSpace(f); f != "" {
+			res = append(res, f)
+		}
+	}
+	return res
+}
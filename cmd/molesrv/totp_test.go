@@ -0,0 +1,121 @@
+package main
+
+import (
+	"encoding/json"
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/calmh/mole/totp"
+)
+
+func otpRequest(url, password, code string) *http.Request {
+	req, _ := http.NewRequest("POST", url, strings.NewReader(password))
+	req.RemoteAddr = "192.0.2.42:12345"
+	if code != "" {
+		req.Header.Set("X-Mole-OTP", code)
+	}
+	return req
+}
+
+func testCode(t *testing.T, secret string, at time.Time) string {
+	code, err := totp.Code(secret, at)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return code
+}
+
+func TestTOTPTicket(t *testing.T) {
+	defer withTestStore(t)()
+	htpasswdCache = nil
+	auth = "htpasswd"
+	oldBackends := totpBackends
+	totpBackends = "htpasswd"
+	defer func() { totpBackends = oldBackends }()
+
+	data := "alice:" + testHash(t, "secret") + "\n"
+	if err := ioutil.WriteFile(htpasswdPath(), []byte(data), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	// Enrollment is required before a ticket is granted
+	rw := httptest.NewRecorder()
+	grantTicket(rw, otpRequest("/ticket/alice", "secret", ""))
+	if rw.Code != 403 || rw.Header().Get("X-Mole-OTP") != "enroll" {
+		t.Fatalf("unexpected response %d %q", rw.Code, rw.Header().Get("X-Mole-OTP"))
+	}
+
+	rw = httptest.NewRecorder()
+	enrollTOTP(rw, otpRequest("/totp/enroll/alice", "wrong", ""))
+	if rw.Code != 401 {
+		t.Errorf("enrollment with incorrect password; %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	enrollTOTP(rw, otpRequest("/totp/enroll/alice", "secret", ""))
+	if rw.Code != 200 {
+		t.Fatalf("enrollment refused; %d", rw.Code)
+	}
+	var enr map[string]string
+	if err := json.Unmarshal(rw.Body.Bytes(), &enr); err != nil {
+		t.Fatal(err)
+	}
+	secret := enr["secret"]
+
+	// Still pending until confirmed
+	if totpEnrolled("alice") {
+		t.Error("unconfirmed enrollment active")
+	}
+	now := time.Now()
+	wrong := "000000"
+	if testCode(t, secret, now) == wrong {
+		wrong = "111111"
+	}
+	rw = httptest.NewRecorder()
+	enrollTOTP(rw, otpRequest("/totp/confirm/alice", "secret", wrong))
+	if rw.Code != 401 {
+		t.Error("incorrect confirmation code accepted")
+	}
+	rw = httptest.NewRecorder()
+	enrollTOTP(rw, otpRequest("/totp/confirm/alice", "secret", testCode(t, secret, now)))
+	if rw.Code != 200 || !totpEnrolled("alice") {
+		t.Fatalf("confirmation refused; %d", rw.Code)
+	}
+
+	rw = httptest.NewRecorder()
+	grantTicket(rw, otpRequest("/ticket/alice", "secret", ""))
+	if rw.Code != 401 || rw.Header().Get("X-Mole-OTP") != "required" {
+		t.Errorf("unexpected response without code %d %q", rw.Code, rw.Header().Get("X-Mole-OTP"))
+	}
+
+	// The code used for confirmation can't be used again
+	rw = httptest.NewRecorder()
+	grantTicket(rw, otpRequest("/ticket/alice", "secret", testCode(t, secret, now)))
+	if rw.Code != 401 || rw.Header().Get("X-Mole-OTP") != "invalid" {
+		t.Errorf("replayed code accepted; %d", rw.Code)
+	}
+
+	// Only an issued ticket counts as a login
+	if logins, _ := loadLogins(); len(logins) != 0 {
+		t.Errorf("login recorded without ticket; %v", logins)
+	}
+	rw = httptest.NewRecorder()
+	grantTicket(rw, otpRequest("/ticket/alice", "secret", testCode(t, secret, now.Add(totp.Step))))
+	if rw.Code != 200 {
+		t.Errorf("correct code refused; %d", rw.Code)
+	}
+	if logins, _ := loadLogins(); logins["alice"].IsZero() {
+		t.Errorf("login not recorded; %v", logins)
+	}
+
+	if err := cmdResetTOTP("alice"); err != nil {
+		t.Fatal(err)
+	}
+	if totpEnrolled("alice") {
+		t.Error("reset enrollment still active")
+	}
+}
@@ -0,0 +1,245 @@
+package main
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"log"
+	"os"
+	"strings"
+	"time"
+
+	"golang.org/x/crypto/bcrypt"
+	"golang.org/x/crypto/ssh/terminal"
+)
+
+var (
+	addUser     = ""
+	passwdUser  = ""
+	delUser     = ""
+	disableUser = ""
+	enableUser  = ""
+	listUsers   = false
+	resetTOTP   = ""
+)
+
+func init() {
+	globalFlags.StringVar(&addUser, "adduser", addUser, "Add a user to the htpasswd file and exit")
+	globalFlags.StringVar(&passwdUser, "passwd", passwdUser, "Change the password of a user in the htpasswd file and exit")
+	globalFlags.StringVar(&delUser, "deluser", delUser, "Remove a user from the htpasswd file and exit")
+	globalFlags.StringVar(&disableUser, "disable-user", disableUser, "Disable a user in the htpasswd file and exit")
+	globalFlags.StringVar(&enableUser, "enable-user", enableUser, "Enable a disabled user in the htpasswd file and exit")
+	globalFlags.BoolVar(&listUsers, "list-users", listUsers, "List the users in the htpasswd file and exit")
+	globalFlags.StringVar(&resetTOTP, "totp-reset", resetTOTP, "Remove the TOTP enrollment of a user and exit")
+}
+
+// adminCommand returns the administrative operation (user, key or lockout
+// management) requested on the command line, if any.
+func adminCommand() func() error {
+	switch {
+	case addUser != "":
+		return func() error { return cmdAddUser(addUser) }
+	case passwdUser != "":
+		return func() error { return cmdPasswd(passwdUser) }
+	case delUser != "":
+		return func() error { return cmdDelUser(delUser) }
+	case disableUser != "":
+		return func() error { return cmdSetDisabled(disableUser, true) }
+	case enableUser != "":
+		return func() error { return cmdSetDisabled(enableUser, false) }
+	case listUsers:
+		return cmdListUsers
+	case resetTOTP != "":
+		return func() error { return cmdResetTOTP(resetTOTP) }
+	case rekey:
+		return cmdRekey
+	case checkKeys:
+		return cmdCheckKeys
+	case gcKeys:
+		return cmdGCKeys
+	case listLockouts:
+		return cmdListLockouts
+	case clearLockout != "":
+		return func() error { return cmdClearLockout(clearLockout) }
+	}
+	return nil
+}
+
+// updateHtpasswd applies the change to the password file, which is created
+// if it doesn't exist.
+func updateHtpasswd(fn func(h *htpasswd) error) error {
+	h, err := readHtpasswd(htpasswdPath())
+	if os.IsNotExist(err) {
+		h = &htpasswd{}
+	} else if err != nil {
+		return err
+	}
+	if err := fn(h); err != nil {
+		return err
+	}
+	return h.write(htpasswdPath())
+}
+
+func cmdAddUser(user string) error {
+	if user == "" || strings.ContainsAny(user, ":\n") || strings.HasPrefix(user, "#") {
+		return fmt.Errorf("invalid user name %q", user)
+	}
+	err := updateHtpasswd(func(h *htpasswd) error {
+		if _, _, ok := h.get(user); ok {
+			return fmt.Errorf("user %q already exists", user)
+		}
+		hash, err := newPasswordHash(user)
+		if err != nil {
+			return err
+		}
+		h.set(user, hash, false)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("OK: Added user %q", user)
+	return nil
+}
+
+func cmdPasswd(user string) error {
+	err := updateHtpasswd(func(h *htpasswd) error {
+		_, disabled, ok := h.get(user)
+		if !ok {
+			return fmt.Errorf("no such user %q", user)
+		}
+		hash, err := newPasswordHash(user)
+		if err != nil {
+			return err
+		}
+		h.set(user, hash, disabled)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("OK: Changed password for %q", user)
+	return nil
+}
+
+func cmdDelUser(user string) error {
+	err := updateHtpasswd(func(h *htpasswd) error {
+		if _, _, ok := h.get(user); !ok {
+			return fmt.Errorf("no such user %q", user)
+		}
+		h.remove(user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("OK: Removed user %q", user)
+	return forgetLogin(user)
+}
+
+func cmdSetDisabled(user string, disabled bool) error {
+	err := updateHtpasswd(func(h *htpasswd) error {
+		hash, _, ok := h.get(user)
+		if !ok {
+			return fmt.Errorf("no such user %q", user)
+		}
+		h.set(user, hash, disabled)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	if disabled {
+		log.Printf("OK: Disabled user %q", user)
+	} else {
+		log.Printf("OK: Enabled user %q", user)
+	}
+	return nil
+}
+
+func cmdListUsers() error {
+	h, err := readHtpasswd(htpasswdPath())
+	if err != nil {
+		return err
+	}
+	logins, err := loadLogins()
+	if err != nil {
+		return err
+	}
+	enrollments, err := loadTOTP()
+	if err != nil {
+		return err
+	}
+
+	rows := [][]string{{"USER", "STATUS", "TOTP", "LAST LOGIN"}}
+	for _, user := range h.users() {
+		_, disabled, _ := h.get(user)
+		status := "enabled"
+		if disabled {
+			status = "disabled"
+		}
+		last := "never"
+		if t, ok := logins[user]; ok {
+			last = t.Format(time.RFC3339)
+		}
+		otp := "-"
+		if u, ok := enrollments[user]; ok && u.Secret != "" {
+			otp = "enrolled"
+		}
+		rows = append(rows, []string{user, status, otp, last})
+	}
+	optionTable(os.Stdout, rows)
+	return nil
+}
+
+func cmdResetTOTP(user string) error {
+	err := updateTOTP(func(users map[string]*totpUser) error {
+		if _, ok := users[user]; !ok {
+			return fmt.Errorf("no TOTP enrollment for %q", user)
+		}
+		delete(users, user)
+		return nil
+	})
+	if err != nil {
+		return err
+	}
+	log.Printf("OK: Removed TOTP enrollment for %q", user)
+	return nil
+}
+
+// newPasswordHash asks for a new password for the user, twice if on a
+// terminal, and returns the hash of it.
+func newPasswordHash(user string) (string, error) {
+	var password string
+	if fd := int(os.Stdin.Fd()); terminal.IsTerminal(fd) {
+		fmt.Printf("New password for %s: ", user)
+		bs, err := terminal.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		fmt.Printf("Repeat password: ")
+		again, err := terminal.ReadPassword(fd)
+		fmt.Println()
+		if err != nil {
+			return "", err
+		}
+		if string(bs) != string(again) {
+			return "", errors.New("passwords do not match")
+		}
+		password = string(bs)
+	} else {
+		// Not interactive; read the password from the first line of input
+		line, err := bufio.NewReader(os.Stdin).ReadString('\n')
+		if err != nil && line == "" {
+			return "", err
+		}
+		password = strings.TrimRight(line, "\r\n")
+	}
+
+	if password == "" {
+		return "", errors.New("empty password")
+	}
+	hash, err := bcrypt.GenerateFromPassword([]byte(password), bcrypt.DefaultCost)
+	return string(hash), err
+}
@@ -22,6 +22,7 @@ const (
 	FeatureOpenConnect
 	FeatureLocalOnly
 	FeatureSocks
+	FeatureOpenVPN
 )
 
 // Config is a complete tunnel configuration
@@ -41,8 +42,25 @@ type Config struct {
 	Forwards    []Forward
 	HostsMap    map[string]int
 	OpenConnect map[string]string
+	OpenVPN     map[string]string
 	Vpnc        map[string]string
 	VpnRoutes   []string
+	DNS         *DNS
+	Access      *Access
+}
+
+// Access lists the users and groups (as "@group") that may read and write
+// the tunnel definition on the server. Write access implies read access.
+type Access struct {
+	Read  []string
+	Write []string
+}
+
+// DNS is a split DNS configuration; names within the domains are resolved by
+// the servers, reached through the tunnel.
+type DNS struct {
+	Domains []string
+	Servers []string
 }
 
 // Host is an SSH host to bounce via
@@ -180,6 +198,9 @@ func (c *Config) FeatureFlags() uint32 {
 	if c.OpenConnect != nil {
 		flags |= FeatureOpenConnect
 	}
+	if c.OpenVPN != nil {
+		flags |= FeatureOpenVPN
+	}
 	if c.General.Main != "" && c.Hosts[c.HostsMap[c.General.Main]].SOCKS != "" {
 		flags |= FeatureSocks
 	}
@@ -41,6 +41,11 @@ var validationCases = []TestCase{
 	{"inv-nohostpasskey.ini", `required field "password" or "key"`},
 	{"inv-badfwd*.ini", `malformed forward`},
 	{"inv-socksvia.ini", `"socks" and "via"`},
+	{"inv-openvpnremote.ini", `required field "remote" in openvpn`},
+	{"inv-openvpnemptyremote.ini", `required field "remote" in openvpn`},
+	{"inv-dnsnoservers.ini", `required field "servers" in dns`},
+	{"inv-access.ini", `unrecognized field "delete" in access`},
+	{"inv-dnsserver.ini", `malformed dns server address "ns1.corp.example.com"`},
 }
 
 func TestValidations(t *testing.T) {
@@ -256,6 +261,48 @@ func TestOpenConnect(t *testing.T) {
 	}
 }
 
+func TestOpenVPN(t *testing.T) {
+	cfg, _ := loadFile("test/valid-openvpn.ini")
+
+	if cfg.OpenVPN["remote"] != "vpn.example.com 1194" {
+		t.Error("incorrectly parsed openvpn remote")
+	}
+	if cfg.OpenVPN["ca"] != "-----BEGIN CERTIFICATE-----\nMIIB\n-----END CERTIFICATE-----" {
+		t.Errorf("incorrectly parsed openvpn ca %q", cfg.OpenVPN["ca"])
+	}
+	if cfg.FeatureFlags()&conf.FeatureOpenVPN == 0 {
+		t.Error("missing openvpn feature flag")
+	}
+}
+
+func TestDNS(t *testing.T) {
+	cfg, _ := loadFile("test/valid-dns.ini")
+
+	if cfg.DNS == nil {
+		t.Fatal("missing dns section")
+	}
+	if d := cfg.DNS.Domains; len(d) != 2 || d[0] != "corp.example.com" || d[1] != "lab.example.org" {
+		t.Errorf("incorrectly parsed dns domains %q", d)
+	}
+	if s := cfg.DNS.Servers; len(s) != 2 || s[0] != "10.22.0.53:53" || s[1] != "[fd00:22::53]:5353" {
+		t.Errorf("incorrectly parsed dns servers %q", s)
+	}
+}
+
+func TestAccess(t *testing.T) {
+	cfg, _ := loadFile("test/valid-access.ini")
+
+	if cfg.Access == nil {
+		t.Fatal("missing access section")
+	}
+	if r := cfg.Access.Read; len(r) != 2 || r[0] != "alice" || r[1] != "@ops" {
+		t.Errorf("incorrectly parsed read access %q", r)
+	}
+	if w := cfg.Access.Write; len(w) != 1 || w[0] != "@admins" {
+		t.Errorf("incorrectly parsed write access %q", w)
+	}
+}
+
 func TestComments(t *testing.T) {
 	cfg, _ := loadFile("test/valid-comments.ini")
 
@@ -0,0 +1,187 @@
+package conf
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+)
+
+// SecretFields are the fields holding secrets, which are stored obfuscated
+// on the server.
+var SecretFields = []string{
+	"key",
+	"password",
+	"IPSec_secret",
+	"Xauth_password",
+	"secret",
+	"tls-auth",
+	"tls-crypt",
+}
+
+// OpenVPNSecretFields are the inline certificates of the openvpn section,
+// also stored obfuscated. The names are too generic to obfuscate elsewhere.
+var OpenVPNSecretFields = []string{
+	"ca",
+	"cert",
+	"extra-certs",
+}
+
+// IsSecretField returns true if the field holds a secret in the section.
+func IsSecretField(section, field string) bool {
+	for _, f := range SecretFields {
+		if field == f {
+			return true
+		}
+	}
+	if section == "openvpn" {
+		for _, f := range OpenVPNSecretFields {
+			if field == f {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Warning is a questionable but valid part of a tunnel configuration. Key is
+// empty when it concerns the section as a whole.
+type Warning struct {
+	Section string
+	Key     string
+	Message string
+}
+
+func (w Warning) String() string {
+	if w.Key == "" {
+		return fmt.Sprintf("[%s]: %s", w.Section, w.Message)
+	}
+	return fmt.Sprintf("[%s] %s: %s", w.Section, w.Key, w.Message)
+}
+
+// Lint returns warnings for bad practice in the configuration. Forward
+// sources are checked against those of the other configurations, by tunnel
+// name, if given.
+func (c *Config) Lint(others map[string]*Config) []Warning {
+	var ws []Warning
+
+	// Hosts are used when on the path to main
+	used := make(map[string]bool)
+	for h := c.General.Main; h != "" && !used[h]; h = c.Hosts[c.HostsMap[h]].Via {
+		used[h] = true
+	}
+	if c.General.Main == "" && len(c.Hosts) > 0 && len(c.Forwards) > 0 {
+		ws = append(ws, Warning{"general", "main", "not set; the forwards are not reached through any host"})
+	}
+
+	for _, h := range c.Hosts {
+		section := "hosts." + h.Name
+		if !used[h.Name] {
+			ws = append(ws, Warning{section, "", "host is not used by main or any host it is reached via"})
+		}
+		if h.Key != "" && h.Pass != "" {
+			ws = append(ws, Warning{section, "password", `set along with "key"; both are tried, the password first`})
+		}
+	}
+
+	dsts := make(map[string]string)
+	for _, fwd := range c.Forwards {
+		section := "forwards." + fwd.Name
+		if len(fwd.Comments) == 0 {
+			ws = append(ws, Warning{section, "", "forward has no comment describing it"})
+		}
+		for _, line := range fwd.Lines {
+			for i := range line.Dst.Ports {
+				dst := line.DstString(i)
+				if prev, ok := dsts[dst]; ok {
+					ws = append(ws, Warning{section, srcKey(line), fmt.Sprintf("destination %s is also forwarded to in [%s]", dst, prev)})
+					break
+				}
+				dsts[dst] = section
+			}
+		}
+	}
+
+	names := make([]string, 0, len(others))
+	for name := range others {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	for _, fwd := range c.Forwards {
+		for _, line := range fwd.Lines {
+			for _, name := range names {
+				if src, ok := overlappingSource(line, others[name]); ok {
+					ws = append(ws, Warning{"forwards." + fwd.Name, srcKey(line), fmt.Sprintf("source %s is also used by tunnel %q", src, name)})
+				}
+			}
+		}
+	}
+
+	sort.SliceStable(ws, func(a, b int) bool {
+		if ws[a].Section != ws[b].Section {
+			return ws[a].Section < ws[b].Section
+		}
+		return ws[a].Key < ws[b].Key
+	})
+	return ws
+}
+
+// ClearSecrets returns warnings for secrets that are not obfuscated, such as
+// in a tunnel definition kept in a local file.
+func (c *Config) ClearSecrets() []Warning {
+	var ws []Warning
+	clear := func(section, key, value string) {
+		if value != "" && !strings.HasPrefix(value, "$mole$") {
+			ws = append(ws, Warning{section, key, "secret is not obfuscated; push the file and remove the local copy"})
+		}
+	}
+
+	for _, h := range c.Hosts {
+		clear("hosts."+h.Name, "key", h.Key)
+		clear("hosts."+h.Name, "password", h.Pass)
+	}
+	for section, options := range map[string]map[string]string{"vpnc": c.Vpnc, "openconnect": c.OpenConnect, "openvpn": c.OpenVPN} {
+		for field, value := range options {
+			if IsSecretField(section, field) {
+				clear(section, field, value)
+			}
+		}
+	}
+
+	sort.SliceStable(ws, func(a, b int) bool {
+		if ws[a].Section != ws[b].Section {
+			return ws[a].Section < ws[b].Section
+		}
+		return ws[a].Key < ws[b].Key
+	})
+	return ws
+}
+
+// overlappingSource returns the first source of the line that is also a
+// forward source in the other configuration.
+func overlappingSource(line ForwardLine, other *Config) (string, bool) {
+	if other == nil {
+		return "", false
+	}
+	for i := range line.Src.Ports {
+		src := line.SrcString(i)
+		for _, ofwd := range other.Forwards {
+			for _, oline := range ofwd.Lines {
+				for j := range oline.Src.Ports {
+					if oline.SrcString(j) == src {
+						return src, true
+					}
+				}
+			}
+		}
+	}
+	return "", false
+}
+
+// srcKey returns the source of the line as written in the configuration.
+func srcKey(line ForwardLine) string {
+	s := line.SrcString(0)
+	if n := len(line.Src.Ports); n > 1 {
+		s += fmt.Sprintf("-%d", line.Src.Ports[n-1])
+	}
+	return s
+}
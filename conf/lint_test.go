@@ -0,0 +1,56 @@
+package conf_test
+
+import (
+	"bytes"
+	"fmt"
+	"strings"
+	"testing"
+
+	"github.com/calmh/mole/conf"
+)
+
+func TestLint(t *testing.T) {
+	cfg, err := loadFile("test/lint-warnings.ini")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	other, err := conf.Load(bytes.NewBufferString(`[general]
+description = Other
+author = Test
+version = 4.0
+
+[forwards.db]
+127.0.0.1:3307 = 10.0.1.2:3306
+`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{
+		`[forwards.db]: forward has no comment describing it`,
+		`[forwards.db] 127.0.0.1:3306-3307: source 127.0.0.1:3307 is also used by tunnel "other"`,
+		`[forwards.web] 127.0.0.1:8081: destination 10.0.0.1:80 is also forwarded to in [forwards.web]`,
+		`[hosts.tac1] password: set along with "key"; both are tried, the password first`,
+		`[hosts.unused]: host is not used by main or any host it is reached via`,
+	}
+	if ws := cfg.Lint(map[string]*conf.Config{"other": other}); fmt.Sprint(strs(ws)) != fmt.Sprint(expected) {
+		t.Errorf("unexpected warnings\n%s", strings.Join(strs(ws), "\n"))
+	}
+
+	expected = []string{
+		`[hosts.tac1] password: secret is not obfuscated; push the file and remove the local copy`,
+		`[vpnc] IPSec_secret: secret is not obfuscated; push the file and remove the local copy`,
+	}
+	if ws := cfg.ClearSecrets(); fmt.Sprint(strs(ws)) != fmt.Sprint(expected) {
+		t.Errorf("unexpected secret warnings\n%s", strings.Join(strs(ws), "\n"))
+	}
+}
+
+func strs(ws []conf.Warning) []string {
+	var res []string
+	for _, w := range ws {
+		res = append(res, w.String())
+	}
+	return res
+}
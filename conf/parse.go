@@ -49,6 +49,8 @@ func parse(ic ini.Config) (cp *Config, err error) {
 			c.Forwards = append(c.Forwards, forw)
 		} else if section == "openconnect" {
 			c.OpenConnect = options
+		} else if section == "openvpn" {
+			c.OpenVPN = options
 		} else if section == "vpnc" {
 			c.Vpnc = options
 		} else if section == "vpn routes" {
@@ -56,6 +58,18 @@ func parse(ic ini.Config) (cp *Config, err error) {
 				c.VpnRoutes = append(c.VpnRoutes, net+"/"+mask)
 			}
 			sort.Strings(c.VpnRoutes)
+		} else if section == "dns" {
+			dns, err := parseDNS(options)
+			if err != nil {
+				return nil, err
+			}
+			c.DNS = dns
+		} else if section == "access" {
+			access, err := parseAccess(options)
+			if err != nil {
+				return nil, err
+			}
+			c.Access = access
 		}
 	}
 
@@ -73,6 +87,14 @@ func parse(ic ini.Config) (cp *Config, err error) {
 		}
 	}
 
+	// Check for an openvpn section without a server to connect to
+	if c.OpenVPN != nil {
+		if strings.TrimSpace(c.OpenVPN["remote"]) == "" {
+			err = fmt.Errorf(`missing required field "remote" in openvpn section`)
+			return
+		}
+	}
+
 	for _, host := range c.Hosts {
 		// Check for errors in "via" links
 		if host.Via != "" {
@@ -144,6 +166,56 @@ func parseGeneral(c *Config, options map[string]string) (err error) {
 	return
 }
 
+func parseDNS(options map[string]string) (*DNS, error) {
+	for _, field := range []string{"domains", "servers"} {
+		if _, ok := options[field]; !ok {
+			return nil, fmt.Errorf("missing required field %q in dns section", field)
+		}
+	}
+
+	dns := &DNS{}
+	for _, d := range splitList(options["domains"]) {
+		dns.Domains = append(dns.Domains, strings.ToLower(strings.Trim(d, ".")))
+	}
+	for _, s := range splitList(options["servers"]) {
+		host, port, err := net.SplitHostPort(s)
+		if err != nil {
+			host, port = strings.Trim(s, "[]"), "53"
+		}
+		if net.ParseIP(host) == nil {
+			return nil, fmt.Errorf("malformed dns server address %q", s)
+		}
+		dns.Servers = append(dns.Servers, net.JoinHostPort(host, port))
+	}
+
+	if len(dns.Domains) == 0 || len(dns.Servers) == 0 {
+		return nil, fmt.Errorf(`fields "domains" and "servers" in dns section must not be empty`)
+	}
+	return dns, nil
+}
+
+func parseAccess(options map[string]string) (*Access, error) {
+	access := &Access{}
+	for k, v := range options {
+		switch k {
+		case "read":
+			access.Read = splitList(v)
+		case "write":
+			access.Write = splitList(v)
+		default:
+			return nil, fmt.Errorf("unrecognized field %q in access section", k)
+		}
+	}
+	return access, nil
+}
+
+// splitList splits a comma and/or whitespace separated list.
+func splitList(s string) []string {
+	return strings.FieldsFunc(s, func(r rune) bool {
+		return r == ',' || r == ' ' || r == '\t'
+	})
+}
+
 func parseHost(ic ini.Config, section string) (host Host, err error) {
 	name := section[6:]
 	options := ic.OptionMap(section)
@@ -2,12 +2,19 @@
 package hosts
 
 import (
-	"bufio"
-	"io"
+	"fmt"
+	"io/ioutil"
 	"os"
+	"path/filepath"
+	"strconv"
 	"strings"
 )
 
+// DefaultPath is the location of the system hosts file.
+const DefaultPath = "/etc/hosts"
+
+const tagMarker = " #tag:"
+
 // An Entry represents a line in /etc/hosts
 type Entry struct {
 	IP    string
@@ -15,53 +22,157 @@ type Entry struct {
 	Tag   string
 }
 
-// ReplaceTagged removes all lines in /etc/hosts marked with the specified tag
-// and insert the given slice of entries instead. The slice may be nil or zero
-// length to remove all tagged entries.
-func ReplaceTagged(tag string, entries []Entry) error {
-	hostf, err := os.Open("/etc/hosts")
+// ReplaceTagged removes all lines in the hosts file at path marked with the
+// specified tag and owned by the current process, and inserts the given
+// slice of entries instead. The slice may be nil or zero length to remove all
+// tagged entries. Lines with the tag that predate owner tracking are removed
+// as well.
+func ReplaceTagged(path, tag string, entries []Entry) error {
+	pid := os.Getpid()
+	return update(path, func(lines []string) []string {
+		var res []string
+		for _, line := range lines {
+			if t, owner, ok := parseTag(line); ok && t == tag && (owner == pid || owner == 0) {
+				continue
+			}
+			res = append(res, line)
+		}
+		for _, e := range entries {
+			res = append(res, fmt.Sprintf("%s\t%s%s%s:%d", e.IP, strings.Join(e.Names, " "), tagMarker, tag, pid))
+		}
+		return res
+	})
+}
+
+// RemoveStale removes all tagged lines in the hosts file at path whose owning
+// process no longer exists, returning the number of lines removed.
+func RemoveStale(path string) (int, error) {
+	removed := 0
+	err := update(path, func(lines []string) []string {
+		var res []string
+		for _, line := range lines {
+			if _, owner, ok := parseTag(line); ok && owner > 0 && !processExists(owner) {
+				removed++
+				continue
+			}
+			res = append(res, line)
+		}
+		return res
+	})
+	return removed, err
+}
+
+// parseTag returns the tag and owning PID of a tagged line. The PID is zero
+// for lines written before owners were recorded.
+func parseTag(line string) (tag string, pid int, ok bool) {
+	idx := strings.LastIndex(line, tagMarker)
+	if idx < 0 {
+		return "", 0, false
+	}
+	tag = line[idx+len(tagMarker):]
+	if i := strings.LastIndex(tag, ":"); i >= 0 {
+		if p, err := strconv.Atoi(tag[i+1:]); err == nil {
+			return tag[:i], p, true
+		}
+	}
+	return tag, 0, true
+}
+
+// update rewrites the hosts file at path with the lines returned by fn, while
+// holding a lock against concurrent updates. The file is replaced atomically,
+// keeping its permissions and ownership.
+func update(path string, fn func(lines []string) []string) error {
+	f, err := openLocked(path)
 	if err != nil {
 		return err
 	}
+	// Closing the file releases the lock, which must be held until the new
+	// file has been renamed into place.
+	defer f.Close()
 
+	fi, err := f.Stat()
+	if err != nil {
+		return err
+	}
+	bs, err := ioutil.ReadAll(f)
+	if err != nil {
+		return err
+	}
+
+	text := string(bs)
 	var lines []string
-	br := bufio.NewReader(hostf)
-	for {
-		bs, _, err := br.ReadLine()
-		if err == io.EOF {
-			break
+	if text != "" {
+		lines = strings.Split(strings.TrimSuffix(text, "\n"), "\n")
+	}
+
+	lines = fn(lines)
+
+	text = strings.Join(lines, "\n")
+	if l := len(lines); l > 0 {
+		// Keep a missing final newline, unless we added the last line
+		_, _, tagged := parseTag(lines[l-1])
+		if strings.HasSuffix(string(bs), "\n") || tagged {
+			text += "\n"
 		}
+	}
+
+	return replaceFile(path, []byte(text), fi)
+}
+
+// openLocked opens the file at path and takes an exclusive lock on it. As the
+// file is replaced on update, the lock might be granted on a file that has
+// just been replaced, in which case we try again with the new one.
+func openLocked(path string) (*os.File, error) {
+	for {
+		f, err := os.Open(path)
 		if err != nil {
-			return err
+			return nil, err
 		}
-
-		line := string(bs)
-		if !strings.HasSuffix(line, "#tag:"+tag) {
-			lines = append(lines, line)
+		if err := lockFile(f); err != nil {
+			f.Close()
+			return nil, err
 		}
-	}
-	_ = hostf.Close()
 
-	for _, e := range entries {
-		lines = append(lines, e.IP+"\t"+strings.Join(e.Names, " ")+" #tag:"+tag)
+		locked, err := f.Stat()
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		current, err := os.Stat(path)
+		if err != nil {
+			f.Close()
+			return nil, err
+		}
+		if os.SameFile(locked, current) {
+			return f, nil
+		}
+		f.Close()
 	}
+}
 
-	outf, err := os.Create("/etc/hosts.new")
+func replaceFile(path string, data []byte, fi os.FileInfo) error {
+	tmp, err := ioutil.TempFile(filepath.Dir(path), "."+filepath.Base(path)+".")
 	if err != nil {
 		return err
 	}
+	defer os.Remove(tmp.Name()) // fails harmlessly after the rename
 
-	for _, line := range lines {
-		_, err = outf.WriteString(line + "\n")
-		if err != nil {
-			return err
-		}
+	_, err = tmp.Write(data)
+	if err == nil {
+		err = tmp.Chmod(fi.Mode().Perm())
+	}
+	if err == nil {
+		err = chownLike(tmp, fi)
+	}
+	if err == nil {
+		err = tmp.Sync()
+	}
+	if cerr := tmp.Close(); err == nil {
+		err = cerr
 	}
-
-	err = outf.Close()
 	if err != nil {
 		return err
 	}
 
-	return os.Rename("/etc/hosts.new", "/etc/hosts")
+	return os.Rename(tmp.Name(), path)
 }
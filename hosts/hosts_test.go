@@ -0,0 +1,162 @@
+package hosts
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+)
+
+const testHosts = `127.0.0.1	localhost
+# The following lines are desirable for IPv6 capable hosts
+::1     ip6-localhost ip6-loopback
+10.0.0.1	old #tag:mole
+`
+
+func writeTestHosts(t *testing.T, data string) (string, func()) {
+	dir, err := ioutil.TempDir("", "hosts")
+	if err != nil {
+		t.Fatal(err)
+	}
+	path := filepath.Join(dir, "hosts")
+	if err := ioutil.WriteFile(path, []byte(data), 0640); err != nil {
+		t.Fatal(err)
+	}
+	return path, func() { os.RemoveAll(dir) }
+}
+
+func readTestHosts(t *testing.T, path string) string {
+	bs, err := ioutil.ReadFile(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(bs)
+}
+
+func TestReplaceTagged(t *testing.T) {
+	path, cleanup := writeTestHosts(t, testHosts)
+	defer cleanup()
+
+	entries := []Entry{
+		{IP: "127.0.0.12", Names: []string{"foo"}},
+		{IP: "127.0.0.13", Names: []string{"bar", "baz"}},
+	}
+	if err := ReplaceTagged(path, "mole", entries); err != nil {
+		t.Fatal(err)
+	}
+
+	pid := os.Getpid()
+	expected := strings.Replace(testHosts, "10.0.0.1	old #tag:mole\n", "", 1) +
+		fmt.Sprintf("127.0.0.12\tfoo #tag:mole:%d\n127.0.0.13\tbar baz #tag:mole:%d\n", pid, pid)
+	if s := readTestHosts(t, path); s != expected {
+		t.Errorf("incorrect hosts file after replace:\n%s", s)
+	}
+
+	fi, err := os.Stat(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fi.Mode().Perm() != 0640 {
+		t.Errorf("mode not kept; %v", fi.Mode())
+	}
+
+	if err := ReplaceTagged(path, "mole", nil); err != nil {
+		t.Fatal(err)
+	}
+	expected = strings.Replace(testHosts, "10.0.0.1	old #tag:mole\n", "", 1)
+	if s := readTestHosts(t, path); s != expected {
+		t.Errorf("incorrect hosts file after removal:\n%s", s)
+	}
+}
+
+func TestReplaceTaggedOtherOwner(t *testing.T) {
+	// Lines with the same tag from another process are left alone
+	other := "10.0.0.2\tother #tag:mole:1\n"
+	path, cleanup := writeTestHosts(t, testHosts+other)
+	defer cleanup()
+
+	if err := ReplaceTagged(path, "mole", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := readTestHosts(t, path); !strings.HasSuffix(s, other) {
+		t.Errorf("other owner's line removed:\n%s", s)
+	}
+}
+
+func TestNoFinalNewline(t *testing.T) {
+	data := "127.0.0.1\tlocalhost\n10.0.0.1\tsomething # no newline"
+	path, cleanup := writeTestHosts(t, data)
+	defer cleanup()
+
+	// Nothing to change
+	if err := ReplaceTagged(path, "mole", nil); err != nil {
+		t.Fatal(err)
+	}
+	if s := readTestHosts(t, path); s != data {
+		t.Errorf("content not kept:\n%q", s)
+	}
+
+	if err := ReplaceTagged(path, "mole", []Entry{{IP: "127.0.0.12", Names: []string{"foo"}}}); err != nil {
+		t.Fatal(err)
+	}
+	expected := fmt.Sprintf("%s\n127.0.0.12\tfoo #tag:mole:%d\n", data, os.Getpid())
+	if s := readTestHosts(t, path); s != expected {
+		t.Errorf("content not kept:\n%q", s)
+	}
+}
+
+func TestRemoveStale(t *testing.T) {
+	// A process that has exited, to get the PID of a nonexistent process
+	cmd := exec.Command("true")
+	if err := cmd.Run(); err != nil {
+		t.Skip(err)
+	}
+	dead := cmd.ProcessState.Pid()
+
+	live := fmt.Sprintf("10.0.0.3\tlive #tag:mole:%d\n", os.Getpid())
+	stale := fmt.Sprintf("10.0.0.4\tstale #tag:mole.foo:%d\n", dead)
+	path, cleanup := writeTestHosts(t, testHosts+stale+live)
+	defer cleanup()
+
+	n, err := RemoveStale(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("removed %d lines, not 1", n)
+	}
+	// Lines without an owner are not considered stale
+	if s := readTestHosts(t, path); s != testHosts+live {
+		t.Errorf("incorrect hosts file after removing stale entries:\n%s", s)
+	}
+}
+
+func TestConcurrentReplace(t *testing.T) {
+	path, cleanup := writeTestHosts(t, testHosts)
+	defer cleanup()
+
+	var wg sync.WaitGroup
+	for i := 0; i < 20; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			tag := fmt.Sprintf("mole.t%d", i)
+			entries := []Entry{{IP: fmt.Sprintf("127.0.1.%d", i), Names: []string{tag}}}
+			if err := ReplaceTagged(path, tag, entries); err != nil {
+				t.Error(err)
+			}
+		}(i)
+	}
+	wg.Wait()
+
+	s := readTestHosts(t, path)
+	for i := 0; i < 20; i++ {
+		if !strings.Contains(s, fmt.Sprintf("127.0.1.%d\t", i)) {
+			t.Errorf("lost entry %d:\n%s", i, s)
+		}
+	}
+}
@@ -0,0 +1,26 @@
+//+build !windows
+
+package hosts
+
+import (
+	"os"
+	"syscall"
+)
+
+func lockFile(f *os.File) error {
+	return syscall.Flock(int(f.Fd()), syscall.LOCK_EX)
+}
+
+func chownLike(f *os.File, fi os.FileInfo) error {
+	if st, ok := fi.Sys().(*syscall.Stat_t); ok {
+		return f.Chown(int(st.Uid), int(st.Gid))
+	}
+	return nil
+}
+
+func processExists(pid int) bool {
+	// Signal zero checks for existence; EPERM means it exists but belongs to
+	// someone else.
+	err := syscall.Kill(pid, 0)
+	return err == nil || err == syscall.EPERM
+}
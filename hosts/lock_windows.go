@@ -0,0 +1,22 @@
+package hosts
+
+import "os"
+
+// The hosts file isn't managed on Windows, so there is no need for locking.
+func lockFile(f *os.File) error {
+	return nil
+}
+
+func chownLike(f *os.File, fi os.FileInfo) error {
+	return nil
+}
+
+func processExists(pid int) bool {
+	// FindProcess opens the process on Windows, failing if it is gone.
+	p, err := os.FindProcess(pid)
+	if err != nil {
+		return false
+	}
+	p.Release()
+	return true
+}
@@ -2,9 +2,11 @@ package ticket
 
 import (
 	"bytes"
+	"crypto/aes"
 	"crypto/cipher"
 	"crypto/rand"
 	"crypto/sha1"
+	"encoding/binary"
 	"errors"
 	"io"
 
@@ -15,6 +17,10 @@ const (
 	keySize  = 32
 	ivSize   = 16
 	hashSize = 20
+
+	// Tickets start with the format version and the ID of the key used.
+	formatVersion = 2
+	headerSize    = 5
 )
 
 var (
@@ -24,6 +30,15 @@ var (
 
 func init() {
 	initKeyAndIV(rand.Reader)
+	initKeyring()
+}
+
+func initKeyring() {
+	k, err := NewKeyring()
+	if err != nil {
+		panic(err)
+	}
+	SetKeyring(k)
 }
 
 func initKeyAndIV(r io.Reader) {
@@ -125,3 +140,50 @@ func decryptAndHash(blob []byte) ([]byte, error) {
 
 	return msg, nil
 }
+
+func newAEAD(secret []byte) cipher.AEAD {
+	c, err := aes.NewCipher(secret)
+	if err != nil {
+		panic(err)
+	}
+	aead, err := cipher.NewGCM(c)
+	if err != nil {
+		panic(err)
+	}
+	return aead
+}
+
+// seal encrypts and authenticates the message with the current key. The
+// header is authenticated as well.
+func seal(msg []byte) []byte {
+	key := currentKeyring().Current()
+	aead := newAEAD(key.Secret)
+
+	blob := make([]byte, headerSize+aead.NonceSize(), headerSize+aead.NonceSize()+len(msg)+aead.Overhead())
+	blob[0] = formatVersion
+	binary.BigEndian.PutUint32(blob[1:headerSize], key.ID)
+	_, err := io.ReadFull(rand.Reader, blob[headerSize:])
+	if err != nil {
+		panic(err)
+	}
+
+	return aead.Seal(blob, blob[headerSize:], msg, blob[:headerSize])
+}
+
+func open(blob []byte) ([]byte, error) {
+	if len(blob) < headerSize || blob[0] != formatVersion {
+		return nil, errors.New("corrupt packet")
+	}
+
+	key, ok := currentKeyring().find(binary.BigEndian.Uint32(blob[1:headerSize]))
+	if !ok {
+		return nil, ErrUnknownKey
+	}
+	aead := newAEAD(key.Secret)
+
+	if len(blob) < headerSize+aead.NonceSize()+aead.Overhead() {
+		return nil, errors.New("corrupt packet")
+	}
+	nonce := blob[headerSize : headerSize+aead.NonceSize()]
+	return aead.Open(nil, nonce, blob[headerSize+aead.NonceSize():], blob[:headerSize])
+}
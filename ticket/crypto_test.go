@@ -2,9 +2,12 @@ package ticket
 
 import (
 	"bytes"
+	"encoding/asn1"
+	"encoding/base64"
 	"math/rand"
 	"testing"
 	"testing/quick"
+	"time"
 )
 
 func TestEncryptDecryptOK(t *testing.T) {
@@ -45,3 +48,26 @@ func TestEncryptDecryptFail(t *testing.T) {
 		t.Error(err)
 	}
 }
+
+func TestLegacyTicket(t *testing.T) {
+	defer AcceptLegacyUntil(time.Time{})
+
+	bs, err := asn1.Marshal(Ticket{Nonce: []byte("01234567"), User: "jb", IP: []string{"10.2.3.4"}, Validity: 1234567890})
+	if err != nil {
+		t.Fatal(err)
+	}
+	tic := base64.StdEncoding.EncodeToString(hashAndEncrypt(bs))
+
+	if _, err := Load(tic); err == nil {
+		t.Error("legacy ticket accepted outside migration")
+	}
+
+	AcceptLegacyUntil(time.Now().Add(time.Hour))
+	dec, err := Load(tic)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.User != "jb" {
+		t.Errorf("unexpected ticket %v", dec)
+	}
+}
@@ -0,0 +1,143 @@
+package ticket
+
+import (
+	"crypto/rand"
+	"encoding/json"
+	"errors"
+	"io"
+	"sync"
+	"time"
+)
+
+// A Key is a ticket encryption key. Only the newest key in a keyring
+// encrypts new tickets; retired keys are kept to verify the tickets they
+// encrypted until those have expired.
+type Key struct {
+	ID      uint32
+	Secret  []byte
+	Created time.Time
+	Retired time.Time `json:",omitempty"`
+}
+
+// A Keyring is the set of ticket keys, oldest first.
+type Keyring struct {
+	Keys []Key
+}
+
+var (
+	ErrUnknownKey = errors.New("unknown ticket key")
+
+	keyring     *Keyring
+	legacyUntil time.Time
+	keyringLock sync.RWMutex
+)
+
+// NewKeyring returns a keyring with a single new key.
+func NewKeyring() (*Keyring, error) {
+	var k Keyring
+	if err := k.Rotate(time.Now()); err != nil {
+		return nil, err
+	}
+	return &k, nil
+}
+
+// ReadKeyring reads a keyring as written by WriteTo.
+func ReadKeyring(r io.Reader) (*Keyring, error) {
+	var k Keyring
+	if err := json.NewDecoder(r).Decode(&k); err != nil {
+		return nil, err
+	}
+	if len(k.Keys) == 0 {
+		return nil, errors.New("keyring is empty")
+	}
+	for _, key := range k.Keys {
+		if len(key.Secret) != keySize {
+			return nil, errors.New("keyring contains a key of incorrect length")
+		}
+	}
+	return &k, nil
+}
+
+// WriteTo writes the keyring, secrets included, as JSON.
+func (k *Keyring) WriteTo(w io.Writer) (int64, error) {
+	bs, err := json.MarshalIndent(k, "", "  ")
+	if err != nil {
+		return 0, err
+	}
+	n, err := w.Write(append(bs, '\n'))
+	return int64(n), err
+}
+
+// Current returns the key used to encrypt new tickets.
+func (k *Keyring) Current() Key {
+	return k.Keys[len(k.Keys)-1]
+}
+
+// Rotate retires the current key and adds a new one.
+func (k *Keyring) Rotate(now time.Time) error {
+	key := Key{
+		ID:      1,
+		Secret:  make([]byte, keySize),
+		Created: now,
+	}
+	if _, err := io.ReadFull(rand.Reader, key.Secret); err != nil {
+		return err
+	}
+	if len(k.Keys) > 0 {
+		key.ID = k.Current().ID + 1
+		k.Keys[len(k.Keys)-1].Retired = now
+	}
+	k.Keys = append(k.Keys, key)
+	return nil
+}
+
+// Prune removes the keys retired before the given time, i.e. those that can
+// only have encrypted tickets that are expired by now.
+func (k *Keyring) Prune(before time.Time) {
+	var keep []Key
+	for _, key := range k.Keys {
+		if key.Retired.IsZero() || !key.Retired.Before(before) {
+			keep = append(keep, key)
+		}
+	}
+	k.Keys = keep
+}
+
+func (k *Keyring) find(id uint32) (Key, bool) {
+	for _, key := range k.Keys {
+		if key.ID == id {
+			return key, true
+		}
+	}
+	return Key{}, false
+}
+
+// SetKeyring makes the keyring the one used to grant and verify tickets.
+// Changes made to the keyring afterwards have no effect until it is set
+// again.
+func SetKeyring(k *Keyring) {
+	c := &Keyring{Keys: append([]Key(nil), k.Keys...)}
+	keyringLock.Lock()
+	keyring = c
+	keyringLock.Unlock()
+}
+
+// AcceptLegacyUntil makes tickets in the format used before keyrings
+// readable, using the key given to LoadKey, until the given time.
+func AcceptLegacyUntil(t time.Time) {
+	keyringLock.Lock()
+	legacyUntil = t
+	keyringLock.Unlock()
+}
+
+func currentKeyring() *Keyring {
+	keyringLock.RLock()
+	defer keyringLock.RUnlock()
+	return keyring
+}
+
+func legacyAccepted() bool {
+	keyringLock.RLock()
+	defer keyringLock.RUnlock()
+	return time.Now().Before(legacyUntil)
+}
@@ -7,17 +7,26 @@ import (
 	"encoding/base64"
 	"errors"
 	"io"
+	"net"
+	"strings"
+	"time"
 )
 
+// A Ticket is bound to a list of IP addresses, or networks in CIDR
+// notation, that it may be used from.
 type Ticket struct {
 	Nonce    []byte
 	User     string
 	IP       []string
 	Validity int64
+	Groups   []string `asn1:"optional,omitempty"`
+	ID       []byte   `asn1:"optional,omitempty"`
+	Issued   int64    `asn1:"optional,omitempty"`
 }
 
 const (
 	nonceSize = 8
+	idSize    = 16
 )
 
 var (
@@ -25,49 +34,87 @@ var (
 	ErrInvalidIP = errors.New("invalid IP")
 )
 
-// Init (re)initializes the session that tickets are based on. Init is called
-// automatically on package initialization but may be called manually to
-// invalidate all currently granted tickets.
+// Init (re)initializes the session that tickets are based on with a new
+// keyring. Init is called automatically on package initialization but may be
+// called manually to invalidate all currently granted tickets.
 func Init() {
 	initKeyAndIV(rand.Reader)
+	initKeyring()
 }
 
-// LoadKey initializes the session key that tickets are based on from the
-// Reader.
+// LoadKey loads the key of tickets in the format used before keyrings from
+// the Reader. Such tickets are readable as set by AcceptLegacyUntil.
 func LoadKey(r io.Reader) {
 	initKeyAndIV(r)
 }
 
 // Grant generates a ticket for the given user, IP and validity stamp.
 func Grant(user, ip string, validity int64) string {
-	t := Ticket{User: user, IP: []string{ip}, Validity: validity}
+	t := Ticket{User: user, IP: []string{ip}, Validity: validity, ID: NewID(), Issued: time.Now().Unix()}
 	return t.String()
 }
 
+// NewID returns a random ticket ID, identifying the ticket for revocation.
+func NewID() []byte {
+	id := make([]byte, idSize)
+	_, err := io.ReadFull(rand.Reader, id)
+	if err != nil {
+		panic(err)
+	}
+	return id
+}
+
 // Verify checks that a ticket is valid for the given IP and validity time,
 // and returns the authenticated user name or an error.
 func Verify(tic, ip string, validity int64) (string, error) {
-	dec, err := Load(tic)
+	dec, err := VerifyTicket(tic, ip, validity)
 	if err != nil {
 		return "", err
 	}
+	return dec.User, nil
+}
+
+// VerifyTicket checks that a ticket is valid for the given IP and validity
+// time, and returns the decoded ticket or an error.
+func VerifyTicket(tic, ip string, validity int64) (*Ticket, error) {
+	dec, err := Load(tic)
+	if err != nil {
+		return nil, err
+	}
 
 	foundIp := false
 	for _, dip := range dec.IP {
-		if dip == ip {
+		if ipMatches(dip, ip) {
 			foundIp = true
 			break
 		}
 	}
 	if !foundIp {
-		return "", ErrInvalidIP
+		return nil, ErrInvalidIP
 	}
 
 	if dec.Validity < validity {
-		return "", ErrExpired
+		return nil, ErrExpired
 	}
 
-	return dec.User, nil
+	return dec, nil
+}
+
+// ipMatches returns true if the IP is the one bound to, or within the
+// network if that is given in CIDR notation.
+func ipMatches(bound, ip string) bool {
+	if bound == ip {
+		return true
+	}
+	if !strings.Contains(bound, "/") {
+		return false
+	}
+	_, ipnet, err := net.ParseCIDR(bound)
+	if err != nil {
+		return false
+	}
+	addr := net.ParseIP(ip)
+	return addr != nil && ipnet.Contains(addr)
 }
 
 func (t Ticket) String() string {
@@ -82,17 +129,24 @@ func (t Ticket) String() string {
 		panic(err)
 	}
 
-	enc := hashAndEncrypt(bs)
+	enc := seal(bs)
 	return base64.StdEncoding.EncodeToString(enc)
 }
 
+// Load decodes the ticket, which must have been encrypted by a key in the
+// current keyring or, during a migration, be in the legacy format.
 func Load(tic string) (*Ticket, error) {
 	bs, err := base64.StdEncoding.DecodeString(tic)
 	if err != nil {
 		return nil, err
 	}
 
-	msg, err := decryptAndHash(bs)
+	msg, err := open(bs)
+	if err != nil && legacyAccepted() {
+		if lmsg, lerr := decryptAndHash(bs); lerr == nil {
+			msg, err = lmsg, nil
+		}
+	}
 	if err != nil {
 		return nil, err
 	}
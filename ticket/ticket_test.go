@@ -1,7 +1,9 @@
 package ticket_test
 
 import (
+	"bytes"
 	"testing"
+	"time"
 
 	"github.com/calmh/mole/ticket"
 )
@@ -107,3 +109,91 @@ func TestTicketExtendValidity(t *testing.T) {
 		t.Errorf("unexpected err %s", err)
 	}
 }
+
+func TestGroups(t *testing.T) {
+	tic := ticket.Ticket{User: "jb", IP: []string{"10.2.3.4"}, Validity: 1234567890, Groups: []string{"ops", "dev_team"}}
+
+	dec, err := ticket.VerifyTicket(tic.String(), "10.2.3.4", 1234567890)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(dec.Groups) != 2 || dec.Groups[0] != "ops" || dec.Groups[1] != "dev_team" {
+		t.Errorf("unexpected groups %v", dec.Groups)
+	}
+
+	// Tickets without groups are readable, as are those granted before
+	// groups were recorded.
+	tic = ticket.Ticket{User: "jb", IP: []string{"10.2.3.4"}, Validity: 1234567890}
+	dec, err = ticket.VerifyTicket(tic.String(), "10.2.3.4", 1234567890)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if dec.User != "jb" || len(dec.Groups) != 0 {
+		t.Errorf("unexpected ticket %v", dec)
+	}
+}
+
+func TestKeyRotation(t *testing.T) {
+	defer ticket.Init()
+
+	k, err := ticket.NewKeyring()
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket.SetKeyring(k)
+	tic := ticket.Grant("jb", "10.2.3.4", 1234567890)
+
+	// Tickets from the retired key are still accepted
+	now := time.Now()
+	if err := k.Rotate(now); err != nil {
+		t.Fatal(err)
+	}
+	ticket.SetKeyring(k)
+	if _, err := ticket.Verify(tic, "10.2.3.4", 1234567890); err != nil {
+		t.Errorf("ticket from retired key refused; %s", err)
+	}
+	if k.Current().ID != k.Keys[0].ID+1 || k.Keys[0].Retired != now {
+		t.Errorf("unexpected keyring %+v", k)
+	}
+
+	// The keyring survives a round trip and a restart
+	var buf bytes.Buffer
+	if _, err := k.WriteTo(&buf); err != nil {
+		t.Fatal(err)
+	}
+	ticket.Init()
+	k, err = ticket.ReadKeyring(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	ticket.SetKeyring(k)
+	if _, err := ticket.Verify(tic, "10.2.3.4", 1234567890); err != nil {
+		t.Errorf("ticket refused after reload; %s", err)
+	}
+
+	// ... until the retired key is pruned
+	k.Prune(now.Add(time.Second))
+	ticket.SetKeyring(k)
+	if len(k.Keys) != 1 {
+		t.Errorf("unexpected keys after prune %+v", k.Keys)
+	}
+	if _, err := ticket.Verify(tic, "10.2.3.4", 1234567890); err != ticket.ErrUnknownKey {
+		t.Errorf("unexpected err %v", err)
+	}
+}
+
+func TestNetworkBinding(t *testing.T) {
+	tic := ticket.Ticket{User: "jb", IP: []string{"10.2.3.0/24", "2001:db8::/64"}, Validity: 1234567890}
+	s := tic.String()
+
+	for _, ip := range []string{"10.2.3.4", "10.2.3.254", "2001:db8::42"} {
+		if _, err := ticket.Verify(s, ip, 1234567890); err != nil {
+			t.Errorf("%s refused; %s", ip, err)
+		}
+	}
+	for _, ip := range []string{"10.2.4.4", "2001:db8:0:1::42"} {
+		if _, err := ticket.Verify(s, ip, 1234567890); err != ticket.ErrInvalidIP {
+			t.Errorf("%s accepted", ip)
+		}
+	}
+}
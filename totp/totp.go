@@ -0,0 +1,105 @@
+// Package totp implements time based one-time passwords (RFC 6238), as used
+// by authenticator apps.
+package totp
+
+import (
+	"crypto/hmac"
+	"crypto/rand"
+	"crypto/sha1"
+	"encoding/base32"
+	"encoding/binary"
+	"fmt"
+	"net/url"
+	"strings"
+	"time"
+)
+
+const (
+	// Step is the time period each code is valid for.
+	Step   = 30 * time.Second
+	digits = 6
+	// Codes from this many steps before or after the current one are
+	// accepted, to allow for clock skew and slow typing.
+	skew = 1
+)
+
+var encoding = base32.StdEncoding.WithPadding(base32.NoPadding)
+
+// NewSecret returns a new random secret, base32 encoded.
+func NewSecret() (string, error) {
+	bs := make([]byte, 20)
+	_, err := rand.Read(bs)
+	if err != nil {
+		return "", err
+	}
+	return encoding.EncodeToString(bs), nil
+}
+
+// Code returns the code for the secret at the given time.
+func Code(secret string, t time.Time) (string, error) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return "", err
+	}
+	return hotp(key, uint64(StepAt(t)), digits), nil
+}
+
+// StepAt returns the step number for the given time.
+func StepAt(t time.Time) int64 {
+	return t.Unix() / int64(Step/time.Second)
+}
+
+// Verify checks the code against the secret at the given time. Codes for
+// steps up to and including lastStep are refused, so that a code cannot be
+// used twice. The step of the accepted code is returned, to be passed as
+// lastStep next time.
+func Verify(secret, code string, t time.Time, lastStep int64) (int64, bool) {
+	key, err := decodeSecret(secret)
+	if err != nil {
+		return 0, false
+	}
+	code = strings.Replace(code, " ", "", -1)
+	cur := StepAt(t)
+	for step := cur - skew; step <= cur+skew; step++ {
+		if step <= lastStep {
+			continue
+		}
+		if hmac.Equal([]byte(hotp(key, uint64(step), digits)), []byte(code)) {
+			return step, true
+		}
+	}
+	return 0, false
+}
+
+// URI returns the provisioning URI for the secret, to be entered in or
+// scanned by an authenticator app.
+func URI(issuer, account, secret string) string {
+	v := url.Values{}
+	v.Set("secret", secret)
+	v.Set("issuer", issuer)
+	label := url.PathEscape(issuer + ":" + account)
+	return "otpauth://totp/" + label + "?" + v.Encode()
+}
+
+func decodeSecret(secret string) ([]byte, error) {
+	secret = strings.ToUpper(strings.Replace(secret, " ", "", -1))
+	return encoding.DecodeString(strings.TrimRight(secret, "="))
+}
+
+// hotp is the HMAC based one-time password of RFC 4226.
+func hotp(key []byte, counter uint64, digits int) string {
+	var msg [8]byte
+	binary.BigEndian.PutUint64(msg[:], counter)
+	h := hmac.New(sha1.New, key)
+	h.Write(msg[:])
+	sum := h.Sum(nil)
+
+	offset := sum[len(sum)-1] & 0xf
+	bin := binary.BigEndian.Uint32(sum[offset:]) & 0x7fffffff
+
+	mod := uint32(1)
+	for i := 0; i < digits; i++ {
+		mod *= 10
+	}
+	return fmt.Sprintf("%0*d", digits, bin%mod)
+}
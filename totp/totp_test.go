@@ -0,0 +1,86 @@
+package totp
+
+import (
+	"encoding/base32"
+	"testing"
+	"time"
+)
+
+// The test secret of RFC 4226 and RFC 6238
+var rfcKey = []byte("12345678901234567890")
+
+func TestHOTP(t *testing.T) {
+	expected := []string{"755224", "287082", "359152", "969429", "338314", "254676", "287922", "162583", "399871", "520489"}
+	for i, e := range expected {
+		if c := hotp(rfcKey, uint64(i), 6); c != e {
+			t.Errorf("counter %d: %s != %s", i, c, e)
+		}
+	}
+}
+
+func TestTOTP(t *testing.T) {
+	cases := []struct {
+		unix int64
+		code string
+	}{
+		{59, "94287082"},
+		{1111111109, "07081804"},
+		{1111111111, "14050471"},
+		{1234567890, "89005924"},
+		{2000000000, "69279037"},
+	}
+	for _, tc := range cases {
+		if c := hotp(rfcKey, uint64(StepAt(time.Unix(tc.unix, 0))), 8); c != tc.code {
+			t.Errorf("%d: %s != %s", tc.unix, c, tc.code)
+		}
+	}
+}
+
+func TestVerify(t *testing.T) {
+	secret := base32.StdEncoding.EncodeToString(rfcKey)
+	now := time.Unix(1234567890, 0)
+
+	code, err := Code(secret, now)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if code != "005924" {
+		t.Errorf("unexpected code %s", code)
+	}
+
+	step, ok := Verify(secret, code, now, 0)
+	if !ok || step != StepAt(now) {
+		t.Fatal("correct code refused")
+	}
+	// Reuse is refused
+	if _, ok := Verify(secret, code, now, step); ok {
+		t.Error("code accepted twice")
+	}
+	// Slight clock skew is allowed, more is not
+	if _, ok := Verify(secret, code, now.Add(Step), 0); !ok {
+		t.Error("code refused one step later")
+	}
+	if _, ok := Verify(secret, code, now.Add(3*Step), 0); ok {
+		t.Error("code accepted three steps later")
+	}
+	if _, ok := Verify(secret, "000000", now, 0); ok {
+		t.Error("incorrect code accepted")
+	}
+}
+
+func TestNewSecret(t *testing.T) {
+	secret, err := NewSecret()
+	if err != nil {
+		t.Fatal(err)
+	}
+	code, err := Code(secret, time.Now())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, ok := Verify(secret, code, time.Now(), 0); !ok {
+		t.Error("code for new secret refused")
+	}
+	if u := URI("mole", "jb", secret); u != "otpauth://totp/mole:jb?issuer=mole&secret="+secret {
+		t.Errorf("unexpected URI %s", u)
+	}
+}